@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// adscReportExpiry is how long the time of an aircraft's latest ADS-C or
+// satellite report is remembered. ADS-C contracts over the oceans commonly
+// report every 10 to 30 minutes, so it is well beyond that.
+const adscReportExpiry = 2 * time.Hour
+
+// adscFeedName is the receiver ADS-C and satellite reports are tagged with,
+// which receiver_trust can weigh against terrestrial receivers.
+const adscFeedName = "adsc"
+
+// adscReport is a position report of an ADS-C or satellite ADS-B feed, as
+// served by adsc_url with the time it was fetched added. It is what an
+// ADS-C feed's lines hold. Altitudes are in feet, speeds in knots and
+// vertical rates in feet per minute, as in events. link_type is 'adsc' for
+// ADS-C contract reports relayed over ACARS and 'satellite' for ADS-B
+// received from orbit; reports without one are taken to be ADS-C.
+type adscReport struct {
+	Received     int64     `json:"received,omitempty"` // Unix milliseconds
+	Icao24       string    `json:"icao24"`
+	Callsign     string    `json:"callsign,omitempty"`
+	Lat          *float64  `json:"lat,omitempty"`
+	Lon          *float64  `json:"lon,omitempty"`
+	Altitude     *int32    `json:"altitude,omitempty"`
+	GroundSpeed  *float64  `json:"ground_speed,omitempty"`
+	Track        *float64  `json:"track,omitempty"`
+	VerticalRate *int32    `json:"vertical_rate,omitempty"`
+	Squawk       string    `json:"squawk,omitempty"`
+	OnGround     bool      `json:"on_ground,omitempty"`
+	Timestamp    time.Time `json:"timestamp"`
+	LinkType     string    `json:"link_type,omitempty"`
+}
+
+// adscPoller fetches the reports of an ADS-C or satellite feed and turns
+// each response into a line per new report. Providers list each aircraft's
+// latest report until the next one arrives, so a report is only passed on
+// once.
+type adscPoller struct {
+	url    string
+	apiKey string
+	client *http.Client
+	// latest is the time of each aircraft's latest report.
+	latest map[string]time.Time
+}
+
+// openADSC polls the reports at url every interval, with apiKey as bearer
+// token if set, and returns the new ones as JSON lines, as openPolled does.
+func openADSC(url, apiKey string, interval, wait time.Duration, stop <-chan struct{}) (io.ReadCloser, error) {
+	p := &adscPoller{url: url, apiKey: apiKey, client: &http.Client{Timeout: 30 * time.Second}, latest: map[string]time.Time{}}
+	return openPolled(url, interval, wait, stop, p.poll)
+}
+
+// poll fetches the reports once. The response is a JSON array of reports,
+// or an object listing them under reports.
+func (p *adscPoller) poll() ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, p.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgent())
+	req.Header.Set("Accept", "application/json")
+	if p.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+p.apiKey)
+	}
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden {
+		return nil, newError(errAuth, fmt.Errorf("%s returned %s, check adsc_api_key", p.url, res.Status))
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", p.url, res.Status)
+	}
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	var reports []adscReport
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		var list struct {
+			Reports []adscReport `json:"reports"`
+		}
+		err = json.Unmarshal(trimmed, &list)
+		reports = list.Reports
+	} else {
+		err = json.Unmarshal(trimmed, &reports)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("decoding %s: %w", p.url, err)
+	}
+
+	now := time.Now()
+	var lines bytes.Buffer
+	for _, r := range reports {
+		icao := strings.ToUpper(r.Icao24)
+		if icao == "" || r.Timestamp.IsZero() {
+			continue
+		}
+		if latest, ok := p.latest[icao]; ok && !r.Timestamp.After(latest) {
+			continue
+		}
+		p.latest[icao] = r.Timestamp
+		r.Received = now.UnixMilli()
+		data, err := json.Marshal(r)
+		if err != nil {
+			return nil, err
+		}
+		lines.Write(data)
+		lines.WriteByte('\n')
+	}
+	for icao, latest := range p.latest {
+		if now.Sub(latest) > adscReportExpiry {
+			delete(p.latest, icao)
+		}
+	}
+	return lines.Bytes(), nil
+}
+
+// parseADSCLine converts a line of an ADS-C feed to a message tagged with
+// the report's link type. It is generated at the report's time and logged
+// when it was fetched.
+func parseADSCLine(line string) (SBS1Message, bool) {
+	var r adscReport
+	if err := json.Unmarshal([]byte(line), &r); err != nil || r.Icao24 == "" || r.Timestamp.IsZero() {
+		metricParseErrors.Inc("adsc")
+		return SBS1Message{}, false
+	}
+	if r.LinkType == "" {
+		r.LinkType = "adsc"
+	}
+	if r.LinkType != "adsc" && r.LinkType != "satellite" {
+		metricParseErrors.Inc("adsc")
+		return SBS1Message{}, false
+	}
+	msg := NewSBS1Message()
+	msg.MessageType = "MSG"
+	msg.Icao24 = strings.ToUpper(r.Icao24)
+	msg.Callsign = strings.TrimSpace(r.Callsign)
+	msg.LinkType = r.LinkType
+
+	generated := r.Timestamp.UTC()
+	logged := generated
+	if r.Received != 0 {
+		logged = time.UnixMilli(r.Received).UTC()
+	}
+	msg.GeneratedDate, msg.LoggedDate = &generated, &logged
+	if observeRecordedTime(msg.GeneratedDate, msg.LoggedDate) {
+		msg.Timestamp = formatTimestamp(clock.Now())
+	}
+
+	if r.Altitude != nil {
+		msg.Altitude = *r.Altitude
+	}
+	if r.GroundSpeed != nil {
+		msg.GroundSpeed = float32(*r.GroundSpeed)
+	}
+	if r.Track != nil {
+		msg.Track = float32(*r.Track)
+	}
+	if r.Lat != nil && r.Lon != nil {
+		msg.Lat, msg.Lon = float32(*r.Lat), float32(*r.Lon)
+	}
+	if r.VerticalRate != nil {
+		msg.VerticalRate = *r.VerticalRate
+	}
+	msg.Squawk = parseInt(r.Squawk)
+	msg.Emergency = msg.Squawk == 7500 || msg.Squawk == 7600 || msg.Squawk == 7700
+	msg.OnGround = r.OnGround
+
+	switch {
+	case r.Lat != nil && r.Lon != nil:
+		msg.TransmissionType = 3
+	case msg.GroundSpeed != 0:
+		msg.TransmissionType = 4
+	case msg.Callsign != "":
+		msg.TransmissionType = 1
+	case r.Squawk != "":
+		msg.TransmissionType = 6
+	default:
+		msg.TransmissionType = 5
+	}
+	return msg, true
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// maxAggregatorRadius is the largest radius, in nautical miles, that the
+// ADS-B Exchange v2 API and its clones serve.
+const maxAggregatorRadius = 250
+
+// aggregatorURL returns the v2 API query for the aircraft within radius
+// nautical miles of lat, lon. The API serves the same records as
+// aircraft.json, under "ac".
+func aggregatorURL(base string, lat, lon float64, radius int) string {
+	f := func(v float64) string { return strconv.FormatFloat(v, 'f', -1, 64) }
+	return fmt.Sprintf("%s/lat/%s/lon/%s/dist/%d", strings.TrimSuffix(base, "/"), f(lat), f(lon), radius)
+}
+
+// aggregatorHeaders authenticates requests with key, both the way ADS-B
+// Exchange's own API expects it and the way RapidAPI, which resells it, does.
+func aggregatorHeaders(base, key string) http.Header {
+	headers := http.Header{}
+	if key == "" {
+		return headers
+	}
+	headers.Set("api-auth", key)
+	headers.Set("X-RapidAPI-Key", key)
+	if u, err := url.Parse(base); err == nil && strings.HasSuffix(u.Hostname(), ".rapidapi.com") {
+		headers.Set("X-RapidAPI-Host", u.Hostname())
+	}
+	return headers
+}
+
+// aggregatorName names the aggregator at base as a receiver, by its host.
+func aggregatorName(base string) string {
+	if u, err := url.Parse(base); err == nil && u.Hostname() != "" {
+		return u.Hostname()
+	}
+	return "aggregator"
+}
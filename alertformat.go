@@ -0,0 +1,286 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// alertRichLimit is the most alerts a Slack or Discord notification shows;
+// Discord takes at most ten embeds per message. The rest of a digest is
+// summarised in a line.
+const alertRichLimit = 10
+
+// Embed colors of Discord alerts.
+const (
+	alertColorRule      = 0x3498db
+	alertColorEmergency = 0xe74c3c
+	alertColorCoverage  = 0xf39c12
+)
+
+// alertFormat is the alert webhook format configured on the command line.
+var alertFormat *alertFormatter
+
+// alertFormatter turns notifications into the body POSTed to the alert
+// webhook: the notification itself as JSON, or a Slack or Discord message
+// with a map thumbnail, photo and reference data of each aircraft. text,
+// mapURL and photoURL are optional templates executed on an alertView.
+type alertFormatter struct {
+	format                 string
+	text, mapURL, photoURL *template.Template
+}
+
+// alertView is what alert templates see: the alert flattened, so that
+// templates need not check for missing parts.
+type alertView struct {
+	Rule, Text                  string
+	Time                        time.Time
+	Icao24, Callsign, Squawk    string
+	Altitude                    int32
+	Lat, Lon                    float32
+	HasPosition, Emergency      bool
+	Registration, AircraftType  string
+	Operator, Route             string
+	Origin, Destination         string
+	OriginName, DestinationName string
+	MapImage                    string
+}
+
+// newAlertFormatter checks format and parses the templates; textPath is a
+// file, mapURL and photoURL are the templates themselves.
+func newAlertFormatter(format, textPath, mapURL, photoURL string) (*alertFormatter, error) {
+	if format != "json" && format != "slack" && format != "discord" {
+		return nil, fmt.Errorf("unknown alert_webhook_format %q, expected 'json', 'slack' or 'discord'", format)
+	}
+	f := &alertFormatter{format: format}
+	var err error
+	if textPath != "" {
+		data, err := os.ReadFile(textPath)
+		if err != nil {
+			return nil, err
+		}
+		if f.text, err = template.New("alert_template").Parse(string(data)); err != nil {
+			return nil, err
+		}
+	}
+	if mapURL != "" {
+		if f.mapURL, err = template.New("alert_map_url").Parse(mapURL); err != nil {
+			return nil, err
+		}
+	}
+	if photoURL != "" {
+		if f.photoURL, err = template.New("alert_photo_url").Parse(photoURL); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// view flattens an alert for the templates.
+func (f *alertFormatter) view(alert Alert) alertView {
+	v := alertView{Rule: alert.Rule, Time: alert.Time, Text: alert.String(), MapImage: alert.MapImage}
+	if a := alert.Aircraft; a != nil {
+		v.Icao24, v.Callsign, v.Altitude = a.Icao24, a.Callsign, a.Altitude
+		v.Lat, v.Lon, v.HasPosition, v.Emergency = a.Lat, a.Lon, a.HasPosition(), a.Emergency
+		if a.Squawk != 0 {
+			v.Squawk = fmt.Sprintf("%04d", a.Squawk)
+		}
+	}
+	if en := alert.Enrichment; en != nil {
+		v.Registration, v.AircraftType, v.Operator = en.Registration, en.AircraftType, en.Operator
+		v.Origin, v.Destination, v.OriginName, v.DestinationName = en.Origin, en.Destination, en.OriginName, en.DestinationName
+		if en.Origin != "" || en.Destination != "" {
+			v.Route = en.Origin + " → " + en.Destination
+		}
+	}
+	return v
+}
+
+// execute runs t on v. A template that fails yields fallback, so a broken
+// template degrades the notification instead of losing it.
+func (f *alertFormatter) execute(t *template.Template, v alertView, fallback string) string {
+	if t == nil {
+		return fallback
+	}
+	var out strings.Builder
+	if err := t.Execute(&out, v); err != nil {
+		metricParseErrors.Inc("alert_template")
+		return fallback
+	}
+	return strings.TrimSpace(out.String())
+}
+
+// details renders an alert's text, map and photo URLs. The map needs a
+// position and the photo a registration; without a mapURL template, the
+// rendered map is shown.
+func (f *alertFormatter) details(alert Alert) (v alertView, text, mapURL, photoURL string) {
+	v = f.view(alert)
+	text = f.execute(f.text, v, v.Text)
+	if v.HasPosition {
+		mapURL = f.execute(f.mapURL, v, v.MapImage)
+	}
+	if v.Registration != "" {
+		photoURL = f.execute(f.photoURL, v, "")
+	}
+	return v, text, mapURL, photoURL
+}
+
+// Payload returns what to POST for n.
+func (f *alertFormatter) Payload(n Notification) interface{} {
+	switch f.format {
+	case "slack":
+		return f.slack(n)
+	case "discord":
+		return f.discord(n)
+	}
+	return n
+}
+
+// alertFields are the reference data shown with an alert, by label.
+func alertFields(v alertView) [][2]string {
+	var fields [][2]string
+	add := func(name, value string) {
+		if value != "" {
+			fields = append(fields, [2]string{name, value})
+		}
+	}
+	add("Callsign", v.Callsign)
+	if v.Altitude != 0 {
+		add("Altitude", fmt.Sprintf("%d ft", v.Altitude))
+	}
+	add("Squawk", v.Squawk)
+	add("Registration", v.Registration)
+	add("Type", v.AircraftType)
+	add("Operator", v.Operator)
+	add("Route", v.Route)
+	return fields
+}
+
+// footer notes the alerts a notification leaves out: those beyond
+// alertRichLimit and those suppressed by throttling.
+func alertFooter(n Notification) string {
+	var notes []string
+	if more := len(n.Alerts) - alertRichLimit; more > 0 {
+		notes = append(notes, fmt.Sprintf("%d more alert(s) not shown", more))
+	}
+	if n.Suppressed > 0 {
+		notes = append(notes, fmt.Sprintf("%d alert(s) suppressed by throttling", n.Suppressed))
+	}
+	return strings.Join(notes, ", ")
+}
+
+type slackMessage struct {
+	Text   string       `json:"text"`
+	Blocks []slackBlock `json:"blocks"`
+}
+
+type slackBlock struct {
+	Type      string      `json:"type"`
+	Text      *slackText  `json:"text,omitempty"`
+	Fields    []slackText `json:"fields,omitempty"`
+	Accessory *slackBlock `json:"accessory,omitempty"`
+	Elements  []slackText `json:"elements,omitempty"`
+	ImageURL  string      `json:"image_url,omitempty"`
+	AltText   string      `json:"alt_text,omitempty"`
+}
+
+type slackText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// slack builds a Block Kit message: per alert a section with the map as
+// its accessory, the reference data and the photo.
+func (f *alertFormatter) slack(n Notification) slackMessage {
+	var msg slackMessage
+	var texts []string
+	for i, alert := range n.Alerts {
+		v, text, mapURL, photoURL := f.details(alert)
+		texts = append(texts, text)
+		if i >= alertRichLimit {
+			continue
+		}
+		if i > 0 {
+			msg.Blocks = append(msg.Blocks, slackBlock{Type: "divider"})
+		}
+		section := slackBlock{Type: "section", Text: &slackText{"mrkdwn", text}}
+		if mapURL != "" {
+			section.Accessory = &slackBlock{Type: "image", ImageURL: mapURL, AltText: "map"}
+		}
+		msg.Blocks = append(msg.Blocks, section)
+		if fields := alertFields(v); len(fields) > 0 {
+			block := slackBlock{Type: "section"}
+			for _, field := range fields {
+				block.Fields = append(block.Fields, slackText{"mrkdwn", "*" + field[0] + "*\n" + field[1]})
+			}
+			msg.Blocks = append(msg.Blocks, block)
+		}
+		if photoURL != "" {
+			msg.Blocks = append(msg.Blocks, slackBlock{Type: "image", ImageURL: photoURL, AltText: v.Registration})
+		}
+	}
+	if footer := alertFooter(n); footer != "" {
+		msg.Blocks = append(msg.Blocks, slackBlock{Type: "context", Elements: []slackText{{"mrkdwn", footer}}})
+		texts = append(texts, footer)
+	}
+	// The text is the plain fallback shown in notifications.
+	msg.Text = strings.Join(texts, "\n")
+	return msg
+}
+
+type discordMessage struct {
+	Content string         `json:"content,omitempty"`
+	Embeds  []discordEmbed `json:"embeds"`
+}
+
+type discordEmbed struct {
+	Title       string         `json:"title"`
+	Description string         `json:"description"`
+	Color       int            `json:"color"`
+	Timestamp   string         `json:"timestamp"`
+	Fields      []discordField `json:"fields,omitempty"`
+	Thumbnail   *discordImage  `json:"thumbnail,omitempty"`
+	Image       *discordImage  `json:"image,omitempty"`
+}
+
+type discordField struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Inline bool   `json:"inline"`
+}
+
+type discordImage struct {
+	URL string `json:"url"`
+}
+
+// discord builds a message with an embed per alert, the map as its
+// thumbnail and the photo as its image.
+func (f *alertFormatter) discord(n Notification) discordMessage {
+	msg := discordMessage{Content: alertFooter(n)}
+	for i, alert := range n.Alerts {
+		if i >= alertRichLimit {
+			break
+		}
+		v, text, mapURL, photoURL := f.details(alert)
+		embed := discordEmbed{Title: alert.Rule, Description: text, Color: alertColorRule, Timestamp: alert.Time.UTC().Format(time.RFC3339)}
+		switch {
+		case alert.Coverage != nil:
+			embed.Color = alertColorCoverage
+		case v.Emergency:
+			embed.Color = alertColorEmergency
+		}
+		for _, field := range alertFields(v) {
+			embed.Fields = append(embed.Fields, discordField{Name: field[0], Value: field[1], Inline: true})
+		}
+		if mapURL != "" {
+			embed.Thumbnail = &discordImage{mapURL}
+		}
+		if photoURL != "" {
+			embed.Image = &discordImage{photoURL}
+		}
+		msg.Embeds = append(msg.Embeds, embed)
+	}
+	return msg
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/jpeg" // tile providers serving JPEG
+	"image/png"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// alertMapSize is the width and height of rendered alert maps in pixels.
+	alertMapSize = 320
+	// alertMapMaxZoom is the closest zoom level maps are rendered at, for an
+	// aircraft without a track yet.
+	alertMapMaxZoom = 11
+	// alertMapKeep is how many rendered maps are served; older ones are
+	// dropped first.
+	alertMapKeep = 500
+	// alertTrailLength is how many positions of an aircraft are kept to
+	// draw its track.
+	alertTrailLength = 64
+	// alertTileCacheSize is how many map tiles are kept between renders.
+	alertTileCacheSize = 256
+)
+
+var (
+	alertMapLand   = color.RGBA{0xf2, 0xef, 0xe9, 0xff}
+	alertMapGrid   = color.RGBA{0xcc, 0xc8, 0xbf, 0xff}
+	alertMapTrack  = color.RGBA{0x1f, 0x6f, 0xd1, 0xff}
+	alertMapPlane  = color.RGBA{0xe7, 0x4c, 0x3c, 0xff}
+	alertMapWhite  = color.RGBA{0xff, 0xff, 0xff, 0xff}
+	alertMapHome   = color.RGBA{0x33, 0x33, 0x33, 0xff}
+	alertGridSteps = []float64{0.01, 0.02, 0.05, 0.1, 0.2, 0.5, 1, 2, 5, 10, 20, 45}
+)
+
+// alertMaps renders the alert maps configured on the command line, if any.
+var alertMaps *alertMapRenderer
+
+// alertMapRenderer draws a small map of an alerting aircraft's position and
+// recent track, and serves the images under baseURL/alert_maps/ for chat
+// services to fetch. The background comes from a tile server when tiles is
+// a URL template with {z}, {x} and {y}; otherwise the map is drawn without
+// tiles on a grid of latitude and longitude, with the receiver marked.
+type alertMapRenderer struct {
+	baseURL, tiles string
+	client         *http.Client
+
+	mu     sync.Mutex
+	trails map[string][]trailPoint
+	images map[string][]byte
+	order  []string
+	cache  map[string]image.Image
+}
+
+// trailPoint is a position an aircraft reported.
+type trailPoint struct {
+	lat, lon float64
+	at       time.Time
+}
+
+func newAlertMapRenderer(baseURL, tiles string) *alertMapRenderer {
+	return &alertMapRenderer{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		tiles:   tiles,
+		client:  newHTTPClient(),
+		trails:  map[string][]trailPoint{},
+		images:  map[string][]byte{},
+		cache:   map[string]image.Image{},
+	}
+}
+
+// Record adds the position of a, if it has a new one, to its trail.
+func (m *alertMapRenderer) Record(a *Aircraft) {
+	if !a.HasPosition() {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	trail := m.trails[a.Icao24]
+	if n := len(trail); n > 0 && trail[n-1].at.Equal(*a.LastPosition) {
+		return
+	}
+	if len(trail) == alertTrailLength {
+		trail = append(trail[:0], trail[1:]...)
+	}
+	m.trails[a.Icao24] = append(trail, trailPoint{float64(a.Lat), float64(a.Lon), *a.LastPosition})
+}
+
+// Trail returns a copy of the trail of icao24.
+func (m *alertMapRenderer) Trail(icao24 string) []trailPoint {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]trailPoint(nil), m.trails[icao24]...)
+}
+
+// Sweep forgets the trails of aircraft without a position since expiry.
+func (m *alertMapRenderer) Sweep(now time.Time, expiry time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for icao24, trail := range m.trails {
+		if now.Sub(trail[len(trail)-1].at) > expiry {
+			delete(m.trails, icao24)
+		}
+	}
+}
+
+// Render draws the map of an alert and returns the URL it is served at, or
+// "" when the alert has no position.
+func (m *alertMapRenderer) Render(alert Alert) string {
+	a := alert.Aircraft
+	if a == nil || !a.HasPosition() {
+		return ""
+	}
+	trail := alert.trail
+	if len(trail) == 0 {
+		trail = []trailPoint{{lat: float64(a.Lat), lon: float64(a.Lon)}}
+	}
+
+	// The zoom is the closest that fits the trail, with a margin.
+	minX, minY, maxX, maxY := math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)
+	for _, p := range trail {
+		x, y := mercator(p.lat, p.lon, 0)
+		minX, minY = math.Min(minX, x), math.Min(minY, y)
+		maxX, maxY = math.Max(maxX, x), math.Max(maxY, y)
+	}
+	zoom := alertMapMaxZoom
+	for ; zoom > 1; zoom-- {
+		scale := math.Exp2(float64(zoom))
+		if (maxX-minX)*scale <= alertMapSize*0.7 && (maxY-minY)*scale <= alertMapSize*0.7 {
+			break
+		}
+	}
+	scale := math.Exp2(float64(zoom))
+	left := (minX+maxX)/2*scale - alertMapSize/2
+	top := (minY+maxY)/2*scale - alertMapSize/2
+	project := func(lat, lon float64) (float64, float64) {
+		x, y := mercator(lat, lon, zoom)
+		return x - left, y - top
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, alertMapSize, alertMapSize))
+	if m.tiles == "" || !m.drawTiles(img, zoom, left, top) {
+		m.drawPlain(img, zoom, left, top, project)
+	}
+	for i := 1; i < len(trail); i++ {
+		x0, y0 := project(trail[i-1].lat, trail[i-1].lon)
+		x1, y1 := project(trail[i].lat, trail[i].lon)
+		drawLine(img, x0, y0, x1, y1, 1.5, alertMapTrack)
+	}
+	x, y := project(float64(a.Lat), float64(a.Lon))
+	if a.GroundSpeed > 0 {
+		track := float64(a.Track) * math.Pi / 180
+		drawLine(img, x, y, x+14*math.Sin(track), y-14*math.Cos(track), 1.5, alertMapPlane)
+	}
+	fillCircle(img, x, y, 6, alertMapWhite)
+	fillCircle(img, x, y, 4.5, alertMapPlane)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		log.Println("Error encoding alert map:", err)
+		return ""
+	}
+	id := uuid.NewString()
+	m.mu.Lock()
+	m.images[id] = buf.Bytes()
+	m.order = append(m.order, id)
+	if len(m.order) > alertMapKeep {
+		delete(m.images, m.order[0])
+		m.order = m.order[1:]
+	}
+	m.mu.Unlock()
+	return m.baseURL + "/alert_maps/" + id + ".png"
+}
+
+// drawPlain draws the background without tiles: a grid of latitude and
+// longitude at least 60 pixels apart, and the receiver when its position
+// is configured.
+func (m *alertMapRenderer) drawPlain(img *image.RGBA, zoom int, left, top float64, project func(lat, lon float64) (float64, float64)) {
+	draw.Draw(img, img.Bounds(), image.NewUniform(alertMapLand), image.Point{}, draw.Src)
+	perDegree := 256 * math.Exp2(float64(zoom)) / 360
+	step := alertGridSteps[len(alertGridSteps)-1]
+	for _, s := range alertGridSteps {
+		if s*perDegree >= 60 {
+			step = s
+			break
+		}
+	}
+	lat0, lon0 := unmercator(left, top+alertMapSize, zoom)
+	lat1, lon1 := unmercator(left+alertMapSize, top, zoom)
+	for lon := math.Ceil(lon0/step) * step; lon <= lon1; lon += step {
+		x, _ := project(0, lon)
+		drawLine(img, x, 0, x, alertMapSize, 0.5, alertMapGrid)
+	}
+	for lat := math.Ceil(lat0/step) * step; lat <= lat1; lat += step {
+		_, y := project(lat, 0)
+		drawLine(img, 0, y, alertMapSize, y, 0.5, alertMapGrid)
+	}
+	if RECEIVER_LAT != 0 || RECEIVER_LON != 0 {
+		x, y := project(RECEIVER_LAT, RECEIVER_LON)
+		draw.Draw(img, image.Rect(int(x)-3, int(y)-3, int(x)+4, int(y)+4), image.NewUniform(alertMapHome), image.Point{}, draw.Src)
+	}
+}
+
+// drawTiles draws the tiles covering the map. It reports false, leaving the
+// map to be drawn without tiles, when one cannot be fetched.
+func (m *alertMapRenderer) drawTiles(img *image.RGBA, zoom int, left, top float64) bool {
+	n := 1 << zoom
+	for ty := int(math.Floor(top / 256)); ty*256 < int(top)+alertMapSize; ty++ {
+		for tx := int(math.Floor(left / 256)); tx*256 < int(left)+alertMapSize; tx++ {
+			at := image.Pt(tx*256-int(math.Floor(left)), ty*256-int(math.Floor(top)))
+			if ty < 0 || ty >= n {
+				draw.Draw(img, image.Rect(at.X, at.Y, at.X+256, at.Y+256), image.NewUniform(alertMapLand), image.Point{}, draw.Src)
+				continue
+			}
+			tile, err := m.tile(zoom, (tx%n+n)%n, ty)
+			if err != nil {
+				metricSinkErrors.Inc("alert_map_tiles")
+				log.Println("Error fetching alert map tile:", err)
+				return false
+			}
+			draw.Draw(img, image.Rect(at.X, at.Y, at.X+256, at.Y+256), tile, tile.Bounds().Min, draw.Src)
+		}
+	}
+	return true
+}
+
+// tile fetches a map tile, or takes it from the cache.
+func (m *alertMapRenderer) tile(z, x, y int) (image.Image, error) {
+	url := strings.NewReplacer("{z}", strconv.Itoa(z), "{x}", strconv.Itoa(x), "{y}", strconv.Itoa(y)).Replace(m.tiles)
+	m.mu.Lock()
+	tile, ok := m.cache[url]
+	m.mu.Unlock()
+	if ok {
+		return tile, nil
+	}
+	res, err := m.client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("tile server returned %s for %s", res.Status, url)
+	}
+	tile, _, err = image.Decode(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("decoding %s: %w", url, err)
+	}
+	m.mu.Lock()
+	if len(m.cache) >= alertTileCacheSize {
+		m.cache = map[string]image.Image{}
+	}
+	m.cache[url] = tile
+	m.mu.Unlock()
+	return tile, nil
+}
+
+// ServeHTTP serves the rendered maps.
+func (m *alertMapRenderer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/alert_maps/"), ".png")
+	m.mu.Lock()
+	data, ok := m.images[id]
+	m.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "public, max-age=86400, immutable")
+	w.Write(data)
+}
+
+// mercator projects a position to Web Mercator pixels at zoom, the scheme
+// of map tiles.
+func mercator(lat, lon float64, zoom int) (float64, float64) {
+	lat = math.Max(-85.05, math.Min(85.05, lat))
+	scale := 256 * math.Exp2(float64(zoom))
+	phi := lat * math.Pi / 180
+	x := (lon + 180) / 360 * scale
+	y := (1 - math.Log(math.Tan(phi)+1/math.Cos(phi))/math.Pi) / 2 * scale
+	return x, y
+}
+
+// unmercator is the inverse of mercator.
+func unmercator(x, y float64, zoom int) (float64, float64) {
+	scale := 256 * math.Exp2(float64(zoom))
+	lon := x/scale*360 - 180
+	lat := math.Atan(math.Sinh(math.Pi*(1-2*y/scale))) * 180 / math.Pi
+	return lat, lon
+}
+
+// drawLine draws a line of the given half width.
+func drawLine(img *image.RGBA, x0, y0, x1, y1, width float64, c color.RGBA) {
+	steps := int(math.Max(math.Abs(x1-x0), math.Abs(y1-y0))) + 1
+	for i := 0; i <= steps; i++ {
+		t := float64(i) / float64(steps)
+		fillCircle(img, x0+(x1-x0)*t, y0+(y1-y0)*t, width, c)
+	}
+}
+
+// fillCircle draws a filled circle. Below a radius of one pixel, the pixel
+// under the center is set.
+func fillCircle(img *image.RGBA, cx, cy, r float64, c color.RGBA) {
+	if r < 1 {
+		img.SetRGBA(int(math.Floor(cx)), int(math.Floor(cy)), c)
+		return
+	}
+	for y := int(math.Floor(cy - r)); y <= int(math.Ceil(cy+r)); y++ {
+		for x := int(math.Floor(cx - r)); x <= int(math.Ceil(cx+r)); x++ {
+			dx, dy := float64(x)+0.5-cx, float64(y)+0.5-cy
+			if dx*dx+dy*dy <= r*r {
+				img.SetRGBA(x, y, c)
+			}
+		}
+	}
+}
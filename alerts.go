@@ -0,0 +1,540 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AlertRule describes aircraft worth a notification. All conditions that
+// are set must hold for the rule to match.
+type AlertRule struct {
+	Name           string          `json:"name"`
+	Icao24         []string        `json:"icao24,omitempty"`
+	CallsignPrefix []string        `json:"callsign_prefix,omitempty"`
+	Squawk         []string        `json:"squawk,omitempty"`
+	Emergency      bool            `json:"emergency,omitempty"`
+	MinAltitude    *int32          `json:"min_altitude,omitempty"`
+	MaxAltitude    *int32          `json:"max_altitude,omitempty"`
+	Within         *Geofence       `json:"within,omitempty"`
+	Throttle       *ThrottleConfig `json:"throttle,omitempty"`
+	// Expires removes a rule added through the rules webhook.
+	Expires *time.Time `json:"expires,omitempty"`
+	// Runtime marks a rule added through the rules webhook rather than
+	// loaded from alert_rules.
+	Runtime bool `json:"runtime,omitempty"`
+
+	bucket *tokenBucket
+}
+
+// Geofence is a circle around a point.
+type Geofence struct {
+	Lat      float64 `json:"lat"`
+	Lon      float64 `json:"lon"`
+	RadiusNM float64 `json:"radius_nm"`
+}
+
+// ThrottleConfig limits how often a single rule may notify.
+type ThrottleConfig struct {
+	RatePerMinute float64 `json:"rate_per_minute"`
+	Burst         int     `json:"burst"`
+}
+
+// loadAlertRules reads a JSON array of rules from path.
+func loadAlertRules(path string) ([]*AlertRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []*AlertRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("parsing alert rules %s: %w", path, err)
+	}
+
+	seen := map[string]bool{}
+	for i, r := range rules {
+		if r.Name == "" {
+			return nil, fmt.Errorf("alert rule %d has no name", i+1)
+		}
+		if seen[r.Name] {
+			return nil, fmt.Errorf("alert rule %q is defined twice", r.Name)
+		}
+		seen[r.Name] = true
+		r.Expires, r.Runtime = nil, false
+		if err := r.prepare(); err != nil {
+			return nil, err
+		}
+	}
+	return rules, nil
+}
+
+// prepare checks a named rule and sets up its throttle.
+func (r *AlertRule) prepare() error {
+	if !r.hasConditions() {
+		return fmt.Errorf("alert rule %q has no conditions and would match every aircraft", r.Name)
+	}
+	if r.Throttle != nil {
+		r.bucket = newTokenBucket(r.Throttle.RatePerMinute, r.Throttle.Burst)
+	}
+	return nil
+}
+
+func (r *AlertRule) hasConditions() bool {
+	return len(r.Icao24) > 0 || len(r.CallsignPrefix) > 0 || len(r.Squawk) > 0 || r.Emergency ||
+		r.MinAltitude != nil || r.MaxAltitude != nil || r.Within != nil
+}
+
+// Matches reports whether a satisfies every condition of the rule.
+func (r *AlertRule) Matches(a *Aircraft) bool {
+	if len(r.Icao24) > 0 && !containsFold(r.Icao24, a.Icao24) {
+		return false
+	}
+	if len(r.CallsignPrefix) > 0 && !hasAnyPrefix(a.Callsign, r.CallsignPrefix) {
+		return false
+	}
+	if len(r.Squawk) > 0 && (a.Squawk == 0 || !containsFold(r.Squawk, fmt.Sprintf("%04d", a.Squawk))) {
+		return false
+	}
+	if r.Emergency && !a.Emergency {
+		return false
+	}
+	if r.MinAltitude != nil && a.Altitude < *r.MinAltitude {
+		return false
+	}
+	if r.MaxAltitude != nil && a.Altitude > *r.MaxAltitude {
+		return false
+	}
+	if r.Within != nil && (!a.HasPosition() ||
+		distanceNM(float64(a.Lat), float64(a.Lon), r.Within.Lat, r.Within.Lon) > r.Within.RadiusNM) {
+		return false
+	}
+	return true
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if p != "" && strings.HasPrefix(strings.ToUpper(s), strings.ToUpper(p)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Alert is raised when an aircraft starts matching a rule, or when a
+// receiver misses a coverage SLA.
+type Alert struct {
+	Rule       string          `json:"rule"`
+	Time       time.Time       `json:"time"`
+	Aircraft   *Aircraft       `json:"aircraft,omitempty"`
+	Enrichment *Enrichment     `json:"enrichment,omitempty"`
+	Coverage   *CoverageReport `json:"coverage,omitempty"`
+	MapImage   string          `json:"map_image,omitempty"`
+
+	// trail is the aircraft's recent track, for the map.
+	trail []trailPoint
+}
+
+func (a Alert) String() string {
+	if a.Coverage != nil {
+		return fmt.Sprintf("%s: coverage below SLA for %d interval(s): %s", a.Rule, a.Coverage.Misses, strings.Join(a.Coverage.Reasons, "; "))
+	}
+	s := fmt.Sprintf("%s: %s", a.Rule, a.Aircraft.Icao24)
+	if a.Aircraft.Callsign != "" {
+		s += " " + a.Aircraft.Callsign
+	}
+	if a.Aircraft.Altitude != 0 {
+		s += fmt.Sprintf(" %dft", a.Aircraft.Altitude)
+	}
+	if a.Aircraft.Squawk != 0 {
+		s += fmt.Sprintf(" squawk %04d", a.Aircraft.Squawk)
+	}
+	return s
+}
+
+// errStaticRule is returned when a rule from alert_rules would be changed
+// at runtime.
+var errStaticRule = errors.New("the rule is defined in alert_rules and cannot be changed at runtime")
+
+// Notification is one message delivered to the alert destinations. Outside
+// digest mode it carries a single alert. Suppressed counts alerts dropped by
+// throttling since the previous notification.
+type Notification struct {
+	Alerts     []Alert `json:"alerts"`
+	Suppressed int     `json:"suppressed,omitempty"`
+}
+
+// Alerter evaluates rules against tracker updates and delivers throttled
+// notifications. An alert fires once when an aircraft starts matching a
+// rule and re-arms after the aircraft stops matching.
+type Alerter struct {
+	rules          []*AlertRule
+	global         *tokenBucket
+	digestSize     int
+	digestInterval time.Duration
+	webhookURL     string
+	format         *alertFormatter
+	maps           *alertMapRenderer
+	mail           *mailer
+	client         *http.Client
+	// raised, if set, is told of every alert a rule raises, before
+	// throttling.
+	raised func(Alert)
+
+	mu           sync.Mutex
+	active       map[string]time.Time
+	pending      []Alert
+	pendingSince time.Time
+	suppressed   int
+	lastSweep    time.Time
+	closed       bool
+	// muted drops alerts instead of notifying until mutedUntil, or until
+	// unmuted if that is zero.
+	muted      bool
+	mutedUntil time.Time
+
+	out  chan Notification
+	done chan struct{}
+}
+
+// newAlerter creates an alerter and starts its delivery goroutine.
+func newAlerter(rules []*AlertRule) *Alerter {
+	a := &Alerter{
+		rules:          rules,
+		global:         newTokenBucket(ALERT_RATE, ALERT_BURST),
+		digestSize:     ALERT_DIGEST_SIZE,
+		digestInterval: ALERT_DIGEST_INTERVAL,
+		webhookURL:     ALERT_WEBHOOK_URL,
+		format:         alertFormat,
+		maps:           alertMaps,
+		client:         withChaos("alert_webhook", newHTTPClient()),
+		active:         map[string]time.Time{},
+		out:            make(chan Notification, 64),
+		done:           make(chan struct{}),
+	}
+	if SMTP_ALERTS {
+		a.mail = smtpMail
+	}
+	safeGo("alerts", false, a.deliver)
+	safeGo("alerts-tick", true, func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				a.Tick(clock.Now())
+			case <-a.done:
+				return
+			}
+		}
+	})
+	return a
+}
+
+// Evaluate checks the updated state of an aircraft against every rule. en
+// is what the enrichment databases know about it, if anything.
+func (a *Alerter) Evaluate(ac Aircraft, en *Enrichment) {
+	now := clock.Now()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.tickLocked(now)
+	if a.maps != nil {
+		a.maps.Record(&ac)
+	}
+	for _, rule := range a.rules {
+		key := rule.Name + "/" + ac.Icao24
+		if !rule.Matches(&ac) {
+			delete(a.active, key)
+			continue
+		}
+		_, firing := a.active[key]
+		a.active[key] = now
+		if firing {
+			continue
+		}
+
+		metricAlerts.Inc(rule.Name)
+		alert := Alert{Rule: rule.Name, Time: now, Aircraft: &ac, Enrichment: en}
+		if a.raised != nil {
+			a.raised(alert)
+		}
+		if rule.bucket != nil && !rule.bucket.Allow(now) {
+			a.suppressLocked(1)
+			continue
+		}
+		if a.maps != nil {
+			alert.trail = a.maps.Trail(ac.Icao24)
+		}
+		a.enqueueLocked(alert, now)
+	}
+}
+
+// Rules returns the current rules.
+func (a *Alerter) Rules() []*AlertRule {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]*AlertRule(nil), a.rules...)
+}
+
+// SetRule adds a runtime rule, or replaces the runtime rule of the same
+// name, which then alerts afresh. It reports whether a rule was replaced.
+// Rules from alert_rules cannot be replaced.
+func (a *Alerter) SetRule(rule *AlertRule) (bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i, r := range a.rules {
+		if r.Name != rule.Name {
+			continue
+		}
+		if !r.Runtime {
+			return false, errStaticRule
+		}
+		a.rules[i] = rule
+		a.resetLocked(rule.Name)
+		return true, nil
+	}
+	a.rules = append(a.rules, rule)
+	return false, nil
+}
+
+// RemoveRule removes the runtime rule called name. It reports false when
+// there is none.
+func (a *Alerter) RemoveRule(name string) (bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i, r := range a.rules {
+		if r.Name != name {
+			continue
+		}
+		if !r.Runtime {
+			return false, errStaticRule
+		}
+		a.rules = append(a.rules[:i:i], a.rules[i+1:]...)
+		a.resetLocked(name)
+		return true, nil
+	}
+	return false, nil
+}
+
+// ExpireRules removes the runtime rules that expired by now and returns
+// them.
+func (a *Alerter) ExpireRules(now time.Time) []*AlertRule {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var expired []*AlertRule
+	kept := a.rules[:0:0]
+	for _, r := range a.rules {
+		if r.Expires != nil && !now.Before(*r.Expires) {
+			expired = append(expired, r)
+			a.resetLocked(r.Name)
+			continue
+		}
+		kept = append(kept, r)
+	}
+	if len(expired) > 0 {
+		a.rules = kept
+	}
+	return expired
+}
+
+// resetLocked forgets which aircraft match the rule called name.
+func (a *Alerter) resetLocked(name string) {
+	for key := range a.active {
+		if strings.HasPrefix(key, name+"/") {
+			delete(a.active, key)
+		}
+	}
+}
+
+// Raise sends an alert that does not come from a rule, subject to the
+// global throttle and digest settings.
+func (a *Alerter) Raise(alert Alert) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	metricAlerts.Inc(alert.Rule)
+	a.enqueueLocked(alert, clock.Now())
+}
+
+// Tick flushes a digest whose interval has elapsed.
+func (a *Alerter) Tick(now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.tickLocked(now)
+}
+
+func (a *Alerter) tickLocked(now time.Time) {
+	if a.muted && !a.mutedUntil.IsZero() && !now.Before(a.mutedUntil) {
+		a.muted = false
+		log.Println("Alerts are no longer muted")
+	}
+	if len(a.pending) > 0 && now.Sub(a.pendingSince) >= a.digestInterval {
+		a.flushLocked(now)
+	}
+	if now.Sub(a.lastSweep) >= time.Minute {
+		for key, seen := range a.active {
+			if now.Sub(seen) > TRACKER_EXPIRY {
+				delete(a.active, key)
+			}
+		}
+		if a.maps != nil {
+			a.maps.Sweep(now, TRACKER_EXPIRY)
+		}
+		a.lastSweep = now
+	}
+}
+
+func (a *Alerter) enqueueLocked(alert Alert, now time.Time) {
+	if a.muted {
+		metricAlertsMuted.Inc(alert.Rule)
+		return
+	}
+	if len(a.pending) == 0 {
+		a.pendingSince = now
+	}
+	a.pending = append(a.pending, alert)
+	if a.digestSize <= 1 || len(a.pending) >= a.digestSize {
+		a.flushLocked(now)
+	}
+}
+
+// flushLocked turns the pending alerts into a notification if the global
+// bucket allows it; otherwise they are dropped and counted as suppressed.
+func (a *Alerter) flushLocked(now time.Time) {
+	if a.closed {
+		return
+	}
+	alerts := a.pending
+	a.pending = nil
+	if !a.global.Allow(now) {
+		a.suppressLocked(len(alerts))
+		return
+	}
+
+	n := Notification{Alerts: alerts, Suppressed: a.suppressed}
+	select {
+	case a.out <- n:
+		a.suppressed = 0
+	default:
+		a.suppressLocked(len(alerts))
+	}
+}
+
+// Mute drops alerts instead of notifying until until, or until Unmute if
+// until is zero. Rules are still evaluated, so an aircraft that matched
+// while alerts were muted does not alert once they are unmuted. It returns
+// the end of the mute it replaces, and whether there was one.
+func (a *Alerter) Mute(until time.Time) (time.Time, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	previous, was := a.mutedUntil, a.muted
+	a.muted, a.mutedUntil = true, until
+	return previous, was
+}
+
+// Unmute resumes notifying and reports whether alerts were muted.
+func (a *Alerter) Unmute() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	was := a.muted
+	a.muted, a.mutedUntil = false, time.Time{}
+	return was
+}
+
+// Muted reports whether alerts are muted, and until when.
+func (a *Alerter) Muted() (bool, time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.muted, a.mutedUntil
+}
+
+func (a *Alerter) suppressLocked(n int) {
+	a.suppressed += n
+	metricAlertsSuppressed.Add("", float64(n))
+}
+
+// Close sends any pending digest and waits for queued notifications to be
+// delivered.
+func (a *Alerter) Close() {
+	a.mu.Lock()
+	if len(a.pending) > 0 {
+		a.flushLocked(clock.Now())
+	}
+	a.closed = true
+	close(a.out)
+	a.mu.Unlock()
+	<-a.done
+}
+
+// deliver logs every notification, posts it to the webhook and mails it,
+// if configured, with the alert maps rendered.
+func (a *Alerter) deliver() {
+	defer close(a.done)
+	for n := range a.out {
+		for _, alert := range n.Alerts {
+			log.Printf("ALERT %s", alert)
+		}
+		if n.Suppressed > 0 {
+			log.Printf("ALERT %d alert(s) suppressed by throttling", n.Suppressed)
+		}
+		if a.webhookURL == "" && a.mail == nil {
+			continue
+		}
+		if a.maps != nil {
+			for i := range n.Alerts {
+				n.Alerts[i].MapImage = a.maps.Render(n.Alerts[i])
+			}
+		}
+		if a.webhookURL != "" {
+			if err := a.post(n); err != nil {
+				metricSinkErrors.Inc("alert_webhook")
+				log.Println("Error sending alert notification:", err)
+			}
+		}
+		if a.mail != nil {
+			if err := a.mail.SendAlerts(n, a.format); err != nil {
+				log.Println("Error mailing alert notification:", err)
+			}
+		}
+	}
+}
+
+func (a *Alerter) post(n Notification) error {
+	data, err := json.Marshal(a.format.Payload(n))
+	if err != nil {
+		return err
+	}
+	res, err := a.client.Post(a.webhookURL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", res.Status)
+	}
+	return nil
+}
+
+var (
+	metricAlerts           = newCounter("adsb_alerts_total", "Alerts raised, by rule.", "rule")
+	metricAlertsSuppressed = newCounter("adsb_alerts_suppressed_total", "Alerts dropped by throttling.", "")
+	metricAlertsMuted      = newCounter("adsb_alerts_muted_total", "Alerts dropped while alerts were muted through the control API, by rule.", "rule")
+)
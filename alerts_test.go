@@ -0,0 +1,199 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useRecordedClock runs the test on a recorded clock set to start.
+func useRecordedClock(t *testing.T, start time.Time) *recordedClock {
+	t.Helper()
+	saved := clock
+	t.Cleanup(func() { clock = saved })
+	rc := &recordedClock{}
+	rc.Observe(start)
+	clock = rc
+	return rc
+}
+
+func TestLoadAlertRules(t *testing.T) {
+	tests := []struct {
+		name, rules, err string
+	}{
+		{"valid", `[{"name":"emergency","emergency":true,"throttle":{"rate_per_minute":1,"burst":2}},{"name":"low","max_altitude":1000}]`, ""},
+		{"not JSON", `{"name":`, "parsing alert rules"},
+		{"no name", `[{"emergency":true}]`, "alert rule 1 has no name"},
+		{"defined twice", `[{"name":"a","emergency":true},{"name":"a","squawk":["7700"]}]`, `alert rule "a" is defined twice`},
+		{"no conditions", `[{"name":"all"}]`, `alert rule "all" has no conditions`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "rules.json")
+			if err := os.WriteFile(path, []byte(tt.rules), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			rules, err := loadAlertRules(path)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rules) != 2 || rules[0].bucket == nil || rules[1].bucket != nil {
+				t.Errorf("rules %+v, want two with a throttle on the first", rules)
+			}
+		})
+	}
+}
+
+func TestAlertRuleMatches(t *testing.T) {
+	alt := func(ft int32) *int32 { return &ft }
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	// Dublin airport, and an aircraft 5 NM east of it.
+	dublin := &Geofence{Lat: 53.4213, Lon: -6.2701, RadiusNM: 10}
+	ac := Aircraft{Icao24: "4CA2D6", Callsign: "EIN123", Altitude: 3000, Squawk: 7700, Emergency: true,
+		Lat: 53.4213, Lon: -6.1303, LastPosition: &now}
+
+	tests := []struct {
+		name string
+		rule AlertRule
+		ac   Aircraft
+		want bool
+	}{
+		{"address in any case", AlertRule{Icao24: []string{"4ca2d6"}}, ac, true},
+		{"other address", AlertRule{Icao24: []string{"A1B2C3"}}, ac, false},
+		{"callsign prefix in any case", AlertRule{CallsignPrefix: []string{"RYR", "ein"}}, ac, true},
+		{"empty callsign prefix", AlertRule{CallsignPrefix: []string{""}}, ac, false},
+		{"squawk", AlertRule{Squawk: []string{"7500", "7700"}}, ac, true},
+		{"squawk with leading zeros", AlertRule{Squawk: []string{"0020"}}, Aircraft{Squawk: 20}, true},
+		{"no squawk", AlertRule{Squawk: []string{"0000"}}, Aircraft{}, false},
+		{"emergency", AlertRule{Emergency: true}, ac, true},
+		{"no emergency", AlertRule{Emergency: true}, Aircraft{Squawk: 7700}, false},
+		{"above the minimum", AlertRule{MinAltitude: alt(3000)}, ac, true},
+		{"below the minimum", AlertRule{MinAltitude: alt(3001)}, ac, false},
+		{"above the maximum", AlertRule{MaxAltitude: alt(2999)}, ac, false},
+		{"within", AlertRule{Within: dublin}, ac, true},
+		{"outside", AlertRule{Within: &Geofence{Lat: 53.4213, Lon: -6.2701, RadiusNM: 4}}, ac, false},
+		{"within without a position", AlertRule{Within: dublin}, Aircraft{Icao24: "4CA2D6"}, false},
+		{"every condition", AlertRule{CallsignPrefix: []string{"EIN"}, Emergency: true, MaxAltitude: alt(5000), Within: dublin}, ac, true},
+		{"one condition failing", AlertRule{CallsignPrefix: []string{"EIN"}, Emergency: true, MaxAltitude: alt(2000)}, ac, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.rule.Matches(&tt.ac); got != tt.want {
+				t.Errorf("Matches = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// testAlerter is an alerter whose notifications are read from its queue
+// rather than delivered.
+func testAlerter(rules []*AlertRule, perMinute float64, burst, digestSize int, digestInterval time.Duration) *Alerter {
+	return &Alerter{
+		rules:          rules,
+		global:         newTokenBucket(perMinute, burst),
+		digestSize:     digestSize,
+		digestInterval: digestInterval,
+		active:         map[string]time.Time{},
+		out:            make(chan Notification, 64),
+	}
+}
+
+// notified returns the notifications queued so far, as the addresses of
+// their alerts and the suppressed counts.
+func notified(a *Alerter) (alerts [][]string, suppressed []int) {
+	for {
+		select {
+		case n := <-a.out:
+			var icaos []string
+			for _, alert := range n.Alerts {
+				icaos = append(icaos, alert.Rule+"/"+alert.Aircraft.Icao24)
+			}
+			alerts, suppressed = append(alerts, icaos), append(suppressed, n.Suppressed)
+		default:
+			return alerts, suppressed
+		}
+	}
+}
+
+func TestAlerterFiresOnce(t *testing.T) {
+	rc := useRecordedClock(t, time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC))
+	a := testAlerter([]*AlertRule{{Name: "hijack", Squawk: []string{"7500"}}}, 60, 10, 0, time.Minute)
+
+	for i, squawk := range []int32{7500, 7500, 1200, 7500} {
+		rc.Observe(clock.Now().Add(time.Second))
+		a.Evaluate(Aircraft{Icao24: "4CA2D6", Squawk: squawk}, nil)
+		alerts, _ := notified(a)
+		want := 0
+		if i == 0 || i == 3 {
+			want = 1
+		}
+		if len(alerts) != want {
+			t.Errorf("update %d, squawk %04d: %d notification(s), want %d", i, squawk, len(alerts), want)
+		}
+	}
+}
+
+func TestAlerterThrottle(t *testing.T) {
+	rc := useRecordedClock(t, time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC))
+	rule := &AlertRule{Name: "emergency", Emergency: true, bucket: newTokenBucket(1, 1)}
+	a := testAlerter([]*AlertRule{rule}, 60, 10, 0, time.Minute)
+
+	// The rule allows one alert a minute: the second aircraft is
+	// suppressed and counted with the next notification.
+	a.Evaluate(Aircraft{Icao24: "000001", Emergency: true}, nil)
+	a.Evaluate(Aircraft{Icao24: "000002", Emergency: true}, nil)
+	rc.Observe(clock.Now().Add(time.Minute))
+	a.Evaluate(Aircraft{Icao24: "000003", Emergency: true}, nil)
+	alerts, suppressed := notified(a)
+	if want := [][]string{{"emergency/000001"}, {"emergency/000003"}}; !reflect.DeepEqual(alerts, want) {
+		t.Errorf("notified %v, want %v", alerts, want)
+	}
+	if want := []int{0, 1}; !reflect.DeepEqual(suppressed, want) {
+		t.Errorf("suppressed %v, want %v", suppressed, want)
+	}
+
+	// The global throttle applies across rules.
+	a = testAlerter([]*AlertRule{{Name: "emergency", Emergency: true}}, 0, 2, 0, time.Minute)
+	for _, icao := range []string{"000001", "000002", "000003", "000004"} {
+		a.Evaluate(Aircraft{Icao24: icao, Emergency: true}, nil)
+	}
+	if alerts, _ := notified(a); len(alerts) != 2 || a.suppressed != 2 {
+		t.Errorf("%d notification(s) with %d suppressed, want 2 and 2", len(alerts), a.suppressed)
+	}
+}
+
+func TestAlerterDigest(t *testing.T) {
+	rc := useRecordedClock(t, time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC))
+	a := testAlerter([]*AlertRule{{Name: "emergency", Emergency: true}}, 60, 10, 3, time.Minute)
+
+	// A digest goes out when full...
+	for _, icao := range []string{"000001", "000002", "000003", "000004"} {
+		a.Evaluate(Aircraft{Icao24: icao, Emergency: true}, nil)
+	}
+	alerts, _ := notified(a)
+	if want := [][]string{{"emergency/000001", "emergency/000002", "emergency/000003"}}; !reflect.DeepEqual(alerts, want) {
+		t.Errorf("notified %v, want %v", alerts, want)
+	}
+
+	// ...or when its first alert has waited the digest interval.
+	rc.Observe(clock.Now().Add(59 * time.Second))
+	a.Tick(clock.Now())
+	if alerts, _ := notified(a); len(alerts) != 0 {
+		t.Errorf("notified %v before the interval", alerts)
+	}
+	rc.Observe(clock.Now().Add(time.Second))
+	a.Tick(clock.Now())
+	alerts, _ = notified(a)
+	if want := [][]string{{"emergency/000004"}}; !reflect.DeepEqual(alerts, want) {
+		t.Errorf("notified %v, want %v", alerts, want)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// archive keeps a copy of every raw line read from the feed. A new file is
+// started at each UTC midnight and whenever Rotate is called.
+type archive struct {
+	dir string
+
+	mu        sync.Mutex
+	file      *os.File
+	w         *bufio.Writer
+	name      string
+	day       string
+	lastFlush time.Time
+}
+
+// newArchive creates the archive directory and opens the first file.
+func newArchive(dir string) (*archive, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating archive directory: %w", err)
+	}
+	a := &archive{dir: dir}
+	if err := a.openLocked(clock.Now().UTC()); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Write appends a raw line.
+func (a *archive) Write(line string) error {
+	now := clock.Now().UTC()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if now.Format("20060102") != a.day {
+		if err := a.rotateLocked(now); err != nil {
+			return err
+		}
+	}
+	if _, err := a.w.WriteString(line + "\n"); err != nil {
+		return err
+	}
+	if now.Sub(a.lastFlush) >= time.Second {
+		a.lastFlush = now
+		return a.w.Flush()
+	}
+	return nil
+}
+
+// Rotate closes the current file and starts a new one, returning the name
+// of the file that was closed.
+func (a *archive) Rotate() (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	closed := a.name
+	return closed, a.rotateLocked(clock.Now().UTC())
+}
+
+// Current returns the name of the file being written.
+func (a *archive) Current() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.name
+}
+
+// Close flushes and closes the current file.
+func (a *archive) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.closeLocked()
+}
+
+func (a *archive) rotateLocked(now time.Time) error {
+	if err := a.closeLocked(); err != nil {
+		return err
+	}
+	return a.openLocked(now)
+}
+
+func (a *archive) openLocked(now time.Time) error {
+	stamp := now.Format("20060102T150405Z")
+	name := fmt.Sprintf("sbs-%s.sbs", stamp)
+	f, err := os.OpenFile(filepath.Join(a.dir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	for i := 1; os.IsExist(err); i++ {
+		name = fmt.Sprintf("sbs-%s-%d.sbs", stamp, i)
+		f, err = os.OpenFile(filepath.Join(a.dir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	}
+	if err != nil {
+		return err
+	}
+	a.file, a.w, a.name, a.day = f, bufio.NewWriter(f), name, now.Format("20060102")
+	return nil
+}
+
+func (a *archive) closeLocked() error {
+	if a.file == nil {
+		return nil
+	}
+	if err := a.w.Flush(); err != nil {
+		a.file.Close()
+		return err
+	}
+	err := a.file.Close()
+	a.file, a.w = nil, nil
+	return err
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/hex"
+	"strings"
+)
+
+// parseAVRLine decodes an AVR line as served on dump1090's port 30002:
+// "*" and the message in hex, or "@" and a 6-byte MLAT timestamp before it,
+// ended by ";". Mode A/C replies carry no address and are skipped.
+func parseAVRLine(line string) (SBS1Message, bool) {
+	line = strings.TrimSuffix(strings.TrimSpace(line), ";")
+	var timestamp string
+	switch {
+	case strings.HasPrefix(line, "*"):
+		line = line[1:]
+	case strings.HasPrefix(line, "@") && len(line) > 13:
+		timestamp, line = line[1:13], line[13:]
+	default:
+		metricParseErrors.Inc("avr_frame")
+		return SBS1Message{}, false
+	}
+	frame, err := hex.DecodeString(line)
+	if err != nil || (len(frame) != 2 && len(frame) != 7 && len(frame) != 14) {
+		metricParseErrors.Inc("avr_frame")
+		return SBS1Message{}, false
+	}
+	if len(frame) == 2 {
+		return SBS1Message{}, false
+	}
+	msg, ok := decodeModeS(frame, false)
+	if !ok {
+		return msg, false
+	}
+	if timestamp != "" {
+		ts, err := hex.DecodeString(timestamp)
+		if err != nil {
+			metricParseErrors.Inc("avr_frame")
+			return SBS1Message{}, false
+		}
+		for _, b := range ts {
+			msg.MLATTimestamp = msg.MLATTimestamp<<8 | uint64(b)
+		}
+	}
+	return msg, true
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	// backfillWindow is the span of time whose uploaded event IDs are
+	// fetched at once when deduplicating.
+	backfillWindow = time.Hour
+	// backfillSlack widens each window, since live uploads are stamped with
+	// the collector's clock rather than the recorded time.
+	backfillSlack = 5 * time.Minute
+)
+
+// backfillCommand uploads archived captures and spooled batches.
+func backfillCommand() *cli.Command {
+	return &cli.Command{
+		Name:      "backfill",
+		Usage:     "Upload raw SBS-1 archives (.sbs), packet captures of them (pcap or pcapng), CSV logs (.csv) or spooled batches (.ndjson) to DataSet, e.g. after an outage.",
+		ArgsUsage: "FILE...",
+		Flags: append(filterFlags(),
+			&cli.BoolFlag{
+				Name:  "dedup",
+				Usage: "Query DataSet for events this receiver already uploaded in each hour of the files and skip them. Requires dataset_api_read_token.",
+			},
+			&cli.IntFlag{
+				Name:  "parallel",
+				Value: 4,
+				Usage: "Number of files uploaded at the same time.",
+			},
+			&cli.StringFlag{
+				Name:  "checkpoint",
+				Usage: "Record the progress of every file here after each batch, and resume from it when backfill is run again.",
+			},
+		),
+		Action: func(c *cli.Context) error {
+			if DATASET_API_WRITE_TOKEN == "" {
+				return configErrorf("dataset_api_write_token is not set. Please provide it as a command-line argument or set the ADSB_DATASET_API_WRITE_TOKEN environment variable")
+			}
+			if c.NArg() == 0 {
+				return configErrorf("no files given to backfill")
+			}
+			if c.Int("parallel") < 1 {
+				return configErrorf("--parallel must be at least 1")
+			}
+			name, _, err := splitHosts()
+			if err != nil {
+				return configErrorf("%v", err)
+			}
+			if RECEIVER_NAME == "" {
+				RECEIVER_NAME = name
+			}
+			filter, err := newMessageFilter(c)
+			if err != nil {
+				return err
+			}
+			if surface, err = newSurfaceFilter(VEHICLE_ICAO_RANGES.Value(), OBSTACLE_ICAO_RANGES.Value(), VEHICLES, OBSTACLES); err != nil {
+				return err
+			}
+			if transmissionTypes, err = parseTransmissionTypes(TRANSMISSION_TYPES.Value()); err != nil {
+				return configErrorf("%v", err)
+			}
+			if cells, err = newCellIndexer(GEOHASH_PRECISION, H3_RESOLUTION); err != nil {
+				return configErrorf("%v", err)
+			}
+			if derived, err = loadDerivedFields(DERIVED_FIELDS); err != nil {
+				return configErrorf("derived_fields: %v", err)
+			}
+			if ids, err = newIDScheme(ID_FORMAT); err != nil {
+				return configErrorf("%v", err)
+			}
+			if eventParsers, err = parseEventClassValues("dataset_parser", DATASET_PARSER.Value()); err != nil {
+				return configErrorf("%v", err)
+			}
+			if eventSeverities, err = parseEventSeverities(DATASET_SEVERITY.Value()); err != nil {
+				return configErrorf("%v", err)
+			}
+			if SOURCE == "" {
+				// Archives hold SBS-1 lines.
+				SOURCE = "sbs"
+			}
+			if httpHeaders, err = parseHeaders(HTTP_HEADERS.Value()); err != nil {
+				return err
+			}
+			if httpTLSConfig, err = newTLSConfig(HTTP_CLIENT_CERT, HTTP_CLIENT_KEY, HTTP_CA_CERT); err != nil {
+				return err
+			}
+
+			b := &backfill{dataset: newDatasetClient(DATASET_API_WRITE_TOKEN), filter: filter}
+			if c.Bool("dedup") {
+				if DATASET_API_READ_TOKEN == "" {
+					return configErrorf("--dedup needs dataset_api_read_token to query DataSet")
+				}
+				if RECEIVER_NAME == "" {
+					return configErrorf("--dedup needs the receiver_name (or dump1090_host) the events were uploaded with")
+				}
+				b.dedup = true
+			}
+			if path := c.String("checkpoint"); path != "" {
+				if b.checkpoint, err = loadCheckpoint(path); err != nil {
+					return err
+				}
+			}
+
+			// Archived lines are timestamped with the time they were
+			// received; each file keeps its own recorded clock so files can
+			// be processed side by side.
+			clock = &recordedClock{}
+			err = b.Run(c.Args().Slice(), c.Int("parallel"))
+			log.Printf("Backfill done: %d events sent, %d already present", b.sent, b.skipped)
+			return err
+		},
+	}
+}
+
+// backfill uploads files in batches, optionally skipping events DataSet
+// already has.
+type backfill struct {
+	dataset    *datasetClient
+	filter     *messageFilter
+	dedup      bool
+	checkpoint *checkpoint
+
+	mu            sync.Mutex
+	sent, skipped int
+}
+
+// Run uploads files using up to parallel workers. A failing file does not
+// stop the others; all failures are returned together.
+func (b *backfill) Run(paths []string, parallel int) error {
+	queue := make(chan int)
+	errs := make([]error, len(paths))
+	var wg sync.WaitGroup
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				if err := b.File(paths[i]); err != nil {
+					log.Printf("Error backfilling %s: %v", paths[i], err)
+					errs[i] = fmt.Errorf("%s: %w", paths[i], err)
+				}
+			}
+		}()
+	}
+	for i := range paths {
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// File uploads one archive or spool file, starting from its checkpointed
+// offset.
+func (b *backfill) File(path string) error {
+	progress := b.checkpoint.Get(path)
+	if progress.Done {
+		log.Printf("Skipping %s, already backfilled", path)
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	capture, err := isPcapFile(f)
+	if err != nil {
+		return err
+	}
+	// A CSV log's header is read first, and skipped unless a previous run
+	// got further.
+	start := progress.Offset
+	var schema *csvSchema
+	var r io.Reader = f
+	if capture {
+		// The offset of a packet capture is into the SBS-1 stream
+		// extracted from it, which is read up to there again.
+		if INPUT_FORMAT != "sbs" {
+			return configErrorf("packet captures can only be backfilled with input_format sbs, whose lines carry the time they were received")
+		}
+		port, err := capturePort()
+		if err != nil {
+			return err
+		}
+		pr := extractCapture(f, port, false, path)
+		defer pr.Close()
+		if _, err := io.CopyN(io.Discard, pr, start); err != nil {
+			return fmt.Errorf("%s: skipping to byte %d: %w", path, start, err)
+		}
+		r = pr
+	} else if strings.HasSuffix(path, ".csv") {
+		header, err := readFirstLine(f)
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(header, "MSG,") {
+			if schema, err = sniffCSV(header); err != nil {
+				return configErrorf("%s: %v", path, err)
+			}
+			if start == 0 {
+				start = int64(len(header))
+			}
+		}
+	}
+	if !capture {
+		if _, err := f.Seek(start, io.SeekStart); err != nil {
+			return err
+		}
+	}
+	if progress.Offset > 0 {
+		log.Printf("Resuming %s at byte %d", path, progress.Offset)
+	} else {
+		log.Printf("Backfilling %s", path)
+	}
+
+	up := &fileUpload{backfill: b, path: path, offset: start}
+	switch {
+	case strings.HasSuffix(path, ".ndjson"):
+		err = up.ndjson(r)
+	case schema != nil:
+		err = up.csv(r, schema)
+	default:
+		err = up.sbs(r)
+	}
+	if err != nil {
+		return err
+	}
+	return b.checkpoint.Set(path, checkpointEntry{Offset: up.offset, Done: true})
+}
+
+// fileUpload is the state of one file being backfilled.
+type fileUpload struct {
+	*backfill
+	path   string
+	offset int64
+	batch  []SBS1Message
+
+	uploaded    map[string]bool
+	windowStart time.Time
+	windowEnd   time.Time
+}
+
+// sbs reads raw archive lines through a tracker of their own.
+func (u *fileUpload) sbs(r io.Reader) error {
+	fileClock := &recordedClock{}
+	tracker := newTracker()
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if line == "" {
+			break
+		}
+		u.add(line, fileClock, tracker)
+		if err := u.advance(int64(len(line)), false); err != nil {
+			return err
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	return u.advance(0, true)
+}
+
+// csv reads a CSV log after its header, converting each record to an
+// SBS-1 line as schema maps it.
+func (u *fileUpload) csv(r io.Reader, schema *csvSchema) error {
+	fileClock := &recordedClock{}
+	tracker := newTracker()
+	cr := csv.NewReader(r)
+	cr.Comma = schema.comma
+	cr.FieldsPerRecord = -1
+	cr.LazyQuotes = true
+	var read int64
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", u.path, err)
+		}
+		if line, ok := schema.Line(record); ok {
+			u.add(line, fileClock, tracker)
+		}
+		if err := u.advance(cr.InputOffset()-read, false); err != nil {
+			return err
+		}
+		read = cr.InputOffset()
+	}
+	return u.advance(0, true)
+}
+
+// add parses an archived line and batches it if it passes the filters,
+// timestamped with the time it was received.
+func (u *fileUpload) add(line string, fileClock *recordedClock, tracker *Tracker) {
+	if parsed, ok := parseLine(line); ok && transmissionTypes.Keep(parsed) && surface.Apply(&parsed) {
+		fileClock.ObserveMessage(parsed.GeneratedDate, parsed.LoggedDate)
+		parsed.Timestamp = formatTimestamp(fileClock.Now())
+		if u.filter.Match(parsed, tracker.annotate(&parsed)) {
+			cells.Apply(&parsed)
+			derived.Apply(&parsed)
+			u.batch = append(u.batch, parsed)
+		}
+	}
+}
+
+// ndjson reads spooled messages, which are uploaded as they were spooled.
+// The tracker is only used to select messages by callsign.
+func (u *fileUpload) ndjson(r io.Reader) error {
+	tracker := newTracker()
+	dec := json.NewDecoder(r)
+	var read int64
+	for dec.More() {
+		var msg SBS1Message
+		if err := dec.Decode(&msg); err != nil {
+			return err
+		}
+		if u.filter.Match(msg, tracker.Update(msg)) {
+			u.batch = append(u.batch, msg)
+		}
+		if err := u.advance(dec.InputOffset()-read, false); err != nil {
+			return err
+		}
+		read = dec.InputOffset()
+	}
+	return u.advance(0, true)
+}
+
+// advance moves the offset past n bytes, uploading the batch when it is
+// full or final. The checkpoint only moves once a batch is delivered, so a
+// resumed run re-reads at most one batch.
+func (u *fileUpload) advance(n int64, final bool) error {
+	u.offset += n
+	if len(u.batch) < offlineBatchSize() && !final {
+		return nil
+	}
+	if err := u.send(u.batch); err != nil {
+		return err
+	}
+	u.batch = u.batch[:0]
+	return u.checkpoint.Set(u.path, checkpointEntry{Offset: u.offset})
+}
+
+// send uploads a batch, leaving out events that are already present.
+func (u *fileUpload) send(messages []SBS1Message) error {
+	skipped := 0
+	if u.dedup {
+		fresh := make([]SBS1Message, 0, len(messages))
+		for _, msg := range messages {
+			present, err := u.uploadedBefore(msg)
+			if err != nil {
+				return err
+			}
+			if present {
+				skipped++
+				continue
+			}
+			fresh = append(fresh, msg)
+		}
+		messages = fresh
+	}
+	if len(messages) > 0 {
+		if err := u.dataset.Send(messages); err != nil {
+			return err
+		}
+	}
+
+	u.mu.Lock()
+	u.sent += len(messages)
+	u.skipped += skipped
+	u.mu.Unlock()
+	return nil
+}
+
+// uploadedBefore reports whether DataSet already holds msg, fetching the
+// uploaded event IDs for the hour around it when msg falls outside the
+// current window.
+func (u *fileUpload) uploadedBefore(msg SBS1Message) (bool, error) {
+	ts, err := parseTimestamp(msg.Timestamp)
+	if err != nil {
+		return false, err
+	}
+	if u.uploaded == nil || ts.Before(u.windowStart) || !ts.Before(u.windowEnd) {
+		u.windowStart = ts.Truncate(backfillWindow)
+		u.windowEnd = u.windowStart.Add(backfillWindow)
+		u.uploaded, err = u.dataset.EventIDs(DATASET_API_READ_TOKEN, RECEIVER_NAME, u.windowStart.Add(-backfillSlack), u.windowEnd.Add(backfillSlack))
+		if err != nil {
+			return false, fmt.Errorf("querying uploaded events: %w", err)
+		}
+		log.Printf("Found %d events already uploaded between %s and %s", len(u.uploaded), u.windowStart.Format(time.RFC3339), u.windowEnd.Format(time.RFC3339))
+	}
+	return u.uploaded[eventID(msg)], nil
+}
+
+// checkpointEntry is the progress of one file: the byte offset up to which
+// its events have been delivered, and whether it is finished.
+type checkpointEntry struct {
+	Offset int64 `json:"offset"`
+	Done   bool  `json:"done,omitempty"`
+}
+
+// checkpoint records backfill progress in a JSON file. A nil checkpoint
+// records nothing.
+type checkpoint struct {
+	path string
+
+	mu    sync.Mutex
+	files map[string]checkpointEntry
+}
+
+// loadCheckpoint reads the checkpoint at path; a missing file is empty.
+func loadCheckpoint(path string) (*checkpoint, error) {
+	c := &checkpoint{path: path, files: map[string]checkpointEntry{}}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &c.files); err != nil {
+		return nil, fmt.Errorf("reading checkpoint %s: %w", path, err)
+	}
+	return c, nil
+}
+
+// Get returns the recorded progress of a file.
+func (c *checkpoint) Get(file string) checkpointEntry {
+	if c == nil {
+		return checkpointEntry{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.files[file]
+}
+
+// Set records the progress of a file and saves the checkpoint.
+func (c *checkpoint) Set(file string, entry checkpointEntry) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.files[file] = entry
+
+	data, err := json.MarshalIndent(c.files, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(c.path+".tmp", data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(c.path+".tmp", c.path)
+}
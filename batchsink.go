@@ -0,0 +1,148 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// batchSink is the queue of a sink that writes batches of messages every
+// interval. Messages wait in a queue of up to max, beyond which the newest
+// are dropped; what a write does not take is put back in front of the
+// messages queued since, dropping the oldest beyond max, so each
+// aircraft's messages go out in order. Drops are counted as errors of the
+// sink and logged with the next flush.
+type batchSink struct {
+	// name labels the sink's metrics and background flushes, title names
+	// it and target its destination in log lines.
+	name, title, target string
+	max                 int
+	// linger is how long Close keeps flushing while write leaves messages
+	// unsent without an error, as when the destination throttles.
+	linger time.Duration
+	// write sends msgs and returns those it did not, to be sent with the
+	// next flush. An error stops the flush; without one, unsent messages
+	// were throttled or rejected in part.
+	write func(msgs []SBS1Message) ([]SBS1Message, error)
+
+	mu      sync.Mutex
+	pending []SBS1Message
+	dropped int
+
+	// flushMu serializes writes.
+	flushMu sync.Mutex
+	failing bool
+	closed  bool
+	// ticker drives the background flushes until stop is closed.
+	ticker   *time.Ticker
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// newBatchSink starts flushing with write every interval until Close.
+func newBatchSink(name, title, target string, max int, interval time.Duration, write func([]SBS1Message) ([]SBS1Message, error)) *batchSink {
+	s := &batchSink{
+		name: name, title: title, target: target, max: max, write: write,
+		ticker: time.NewTicker(interval), stop: make(chan struct{}),
+	}
+	safeGo(name, true, func() {
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-s.ticker.C:
+				s.Flush()
+			}
+		}
+	})
+	return s
+}
+
+// Add queues a message to be written.
+func (s *batchSink) Add(msg SBS1Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.pending) >= s.max {
+		s.dropped++
+		return
+	}
+	s.pending = append(s.pending, msg)
+}
+
+// Flush writes the queued messages. Failures are logged once until a flush
+// succeeds again.
+func (s *batchSink) Flush() error {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+	s.mu.Lock()
+	pending, dropped := s.pending, s.dropped
+	s.pending, s.dropped = nil, 0
+	s.mu.Unlock()
+	if dropped > 0 {
+		metricSinkErrors.Add(s.name, float64(dropped))
+		log.Printf("Dropped %d message(s) for %s, which fell behind", dropped, s.title)
+	}
+	if len(pending) == 0 || s.closed {
+		return nil
+	}
+
+	unsent, err := s.write(pending)
+	switch {
+	case err != nil && !s.failing:
+		log.Printf("Error writing messages to %s: %v", s.target, err)
+	case err == nil && len(unsent) > 0 && !s.failing:
+		log.Printf("%s did not take %d message(s), sending them with the next flush", s.target, len(unsent))
+	case err == nil && len(unsent) == 0 && s.failing:
+		log.Printf("Writing messages to %s again", s.target)
+	}
+	s.failing = err != nil || len(unsent) > 0
+	if s.failing {
+		metricSinkErrors.Inc(s.name)
+	}
+	if len(unsent) > 0 {
+		s.requeue(unsent)
+	}
+	return err
+}
+
+// requeue puts unsent messages back in front of those queued since,
+// dropping the oldest beyond max.
+func (s *batchSink) requeue(msgs []SBS1Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pending := append(msgs, s.pending...)
+	if over := len(pending) - s.max; over > 0 {
+		pending = pending[over:]
+		s.dropped += over
+	}
+	s.pending = pending
+}
+
+// queued returns the number of messages waiting to be written.
+func (s *batchSink) queued() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.pending)
+}
+
+// Close stops the background flushes and writes what is queued, flushing
+// again every second for up to linger while messages are left unsent.
+// Later flushes write nothing.
+func (s *batchSink) Close() error {
+	s.stopOnce.Do(func() {
+		s.ticker.Stop()
+		close(s.stop)
+	})
+	err := s.Flush()
+	for deadline := time.Now().Add(s.linger); err == nil && s.queued() > 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Second)
+		err = s.Flush()
+	}
+	if n := s.queued(); n > 0 {
+		log.Printf("Exiting with %d message(s) not written to %s", n, s.title)
+	}
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+	s.closed = true
+	return err
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// icaos lists the ICAO addresses of msgs.
+func icaos(msgs []SBS1Message) []string {
+	var out []string
+	for _, msg := range msgs {
+		out = append(out, msg.Icao24)
+	}
+	return out
+}
+
+func TestBatchSinkRequeue(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		written [][]string
+		fail    = true
+	)
+	s := newBatchSink("test", "Test", "test target", 3, time.Hour, func(msgs []SBS1Message) ([]SBS1Message, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if fail {
+			// Take the first message, leave the rest.
+			written = append(written, icaos(msgs[:1]))
+			return msgs[1:], errors.New("unreachable")
+		}
+		written = append(written, icaos(msgs))
+		return nil, nil
+	})
+	defer s.Close()
+
+	for _, icao := range []string{"A", "B", "C", "D"} {
+		s.Add(SBS1Message{Icao24: icao})
+	}
+	if s.dropped != 1 {
+		t.Fatalf("dropped %d beyond the queue, want 1", s.dropped)
+	}
+	if err := s.Flush(); err == nil {
+		t.Fatal("Flush succeeded, want the write's error")
+	}
+	if !s.failing {
+		t.Error("not failing after an error")
+	}
+
+	// Unsent messages go back in front of those queued since, and the
+	// oldest are dropped beyond the queue.
+	s.Add(SBS1Message{Icao24: "E"})
+	s.Add(SBS1Message{Icao24: "F"})
+	if got := icaos(s.pending); !reflect.DeepEqual(got, []string{"B", "C", "E"}) {
+		t.Errorf("queued %v, want [B C E]", got)
+	}
+	if s.dropped != 1 {
+		t.Errorf("dropped %d, want 1", s.dropped)
+	}
+
+	fail = false
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if s.failing || s.queued() != 0 || s.dropped != 0 {
+		t.Errorf("after a good flush: failing %v, queued %d, dropped %d", s.failing, s.queued(), s.dropped)
+	}
+	want := [][]string{{"A"}, {"B", "C", "E"}}
+	if !reflect.DeepEqual(written, want) {
+		t.Errorf("wrote %v, want %v", written, want)
+	}
+}
+
+func TestBatchSinkThrottled(t *testing.T) {
+	s := newBatchSink("test", "Test", "test target", 10, time.Hour, func(msgs []SBS1Message) ([]SBS1Message, error) {
+		return msgs[len(msgs)-1:], nil
+	})
+	defer s.Close()
+	s.Add(SBS1Message{Icao24: "A"})
+	s.Add(SBS1Message{Icao24: "B"})
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if !s.failing {
+		t.Error("not failing with messages left unsent")
+	}
+	if got := icaos(s.pending); !reflect.DeepEqual(got, []string{"B"}) {
+		t.Errorf("queued %v, want [B]", got)
+	}
+}
+
+func TestBatchSinkClose(t *testing.T) {
+	var mu sync.Mutex
+	flushes := 0
+	s := newBatchSink("test", "Test", "test target", 10, 10*time.Millisecond, func(msgs []SBS1Message) ([]SBS1Message, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		flushes++
+		return nil, nil
+	})
+	s.Add(SBS1Message{Icao24: "A"})
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	if flushes != 1 {
+		t.Errorf("%d background flushes of one message, want 1", flushes)
+	}
+	mu.Unlock()
+
+	s.Add(SBS1Message{Icao24: "B"})
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("second Close: %v", err)
+	}
+	// Messages added after Close are never written.
+	s.Add(SBS1Message{Icao24: "C"})
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if flushes != 2 {
+		t.Errorf("%d flushes, want 2: one in the background and one on Close", flushes)
+	}
+	select {
+	case <-s.stop:
+	default:
+		t.Error("background flushes not stopped")
+	}
+}
+
+func TestBatchSinkLinger(t *testing.T) {
+	calls := 0
+	s := newBatchSink("test", "Test", "test target", 10, time.Hour, func(msgs []SBS1Message) ([]SBS1Message, error) {
+		calls++
+		if calls == 1 {
+			return msgs, nil
+		}
+		return nil, nil
+	})
+	s.linger = 5 * time.Second
+	s.Add(SBS1Message{Icao24: "A"})
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 || s.queued() != 0 {
+		t.Errorf("%d writes, %d left queued; want 2 and none", calls, s.queued())
+	}
+}
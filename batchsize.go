@@ -0,0 +1,104 @@
+package main
+
+import "time"
+
+// batchRateWindow is how long messages are counted before the rate
+// estimate is updated, and batchRateWeight how much the newest window
+// counts in it.
+const (
+	batchRateWindow = time.Second
+	batchRateWeight = 0.3
+)
+
+// batchSizer picks the size a DataSet batch is sent at from the message
+// rate, aiming for a batch every latency: a quiet feed sends small batches
+// soon instead of holding messages for minutes, and a busy one sends large
+// batches instead of many small requests. The size stays between min and
+// max; with min equal to max it is fixed. Whatever the size, a batch is
+// due once its oldest message has waited latency.
+type batchSizer struct {
+	min, max int
+	latency  time.Duration
+	// oldest is when the first message of the batch was added, zero while
+	// it is empty.
+	oldest time.Time
+
+	rate        float64 // messages per second, smoothed
+	count       int
+	windowStart time.Time
+}
+
+// newBatchSizer returns a sizer using the configured sizes: --batch_size
+// when set, and otherwise scaling between --batch_size_min and
+// --batch_size_max.
+func newBatchSizer() *batchSizer {
+	if BATCH_SIZE > 0 {
+		return &batchSizer{min: BATCH_SIZE, max: BATCH_SIZE, latency: BATCH_LATENCY}
+	}
+	return &batchSizer{min: BATCH_SIZE_MIN, max: BATCH_SIZE_MAX, latency: BATCH_LATENCY}
+}
+
+// offlineBatchSize is the batch size of uploads that do not wait on a
+// feed, such as backfills: --batch_size when set, and otherwise
+// --batch_size_max.
+func offlineBatchSize() int {
+	if BATCH_SIZE > 0 {
+		return BATCH_SIZE
+	}
+	return BATCH_SIZE_MAX
+}
+
+// batchDeadlineTick is how often batches are checked for being due.
+const batchDeadlineTick = 250 * time.Millisecond
+
+// Observe counts n messages added at now.
+func (b *batchSizer) Observe(n int, now time.Time) {
+	if b.oldest.IsZero() && n > 0 {
+		b.oldest = now
+	}
+	if b.windowStart.IsZero() {
+		b.windowStart = now
+	}
+	b.count += n
+	elapsed := now.Sub(b.windowStart)
+	if elapsed < batchRateWindow {
+		return
+	}
+	// A long silence is one window, so the rate drops at once.
+	current := float64(b.count) / elapsed.Seconds()
+	if b.rate == 0 {
+		b.rate = current
+	} else {
+		b.rate = batchRateWeight*current + (1-batchRateWeight)*b.rate
+	}
+	b.count = 0
+	b.windowStart = now
+}
+
+// Size returns the number of messages a batch is sent at.
+func (b *batchSizer) Size() int {
+	size := int(b.rate * b.latency.Seconds())
+	if size < b.min {
+		return b.min
+	}
+	if size > b.max {
+		return b.max
+	}
+	return size
+}
+
+// Full reports whether a batch of n messages should be sent.
+func (b *batchSizer) Full(n int) bool {
+	return n >= b.Size()
+}
+
+// Due reports whether the batch has waited latency since its oldest
+// message was added, and should be sent even though it is not full.
+func (b *batchSizer) Due(now time.Time) bool {
+	return b.latency > 0 && !b.oldest.IsZero() && now.Sub(b.oldest) >= b.latency
+}
+
+// Sent starts a new batch.
+func (b *batchSizer) Sent() {
+	b.oldest = time.Time{}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"io"
+	"math"
+)
+
+// beastEscape starts every Beast frame. Inside a frame it is doubled.
+const beastEscape = 0x1a
+
+// beastMessageLengths are the message sizes of the Beast frame types: Mode
+// A/C, Mode S short and Mode S long.
+var beastMessageLengths = map[byte]int{'1': 2, '2': 7, '3': 14}
+
+// beastMLATMagic is the timestamp of the frames mlat-client and dump1090
+// send multilaterated positions in: 0xFF, 0x00 and "MLAT".
+const beastMLATMagic = 0xFF004D4C4154
+
+// readBeast reads Beast frames from r and passes each unescaped frame to
+// emit: the type byte, the 6-byte MLAT timestamp, the signal level and the
+// message. Frames cut short by the start of another are dropped.
+func readBeast(r io.Reader, emit func(frame []byte)) error {
+	br := bufio.NewReader(r)
+	// synced is set when the escape starting the next frame was already
+	// consumed.
+	synced := false
+	for {
+		if !synced {
+			b, err := br.ReadByte()
+			if err != nil {
+				return err
+			}
+			if b != beastEscape {
+				continue
+			}
+		}
+		synced = false
+
+		typ, err := br.ReadByte()
+		if err != nil {
+			return err
+		}
+		n, ok := beastMessageLengths[typ]
+		if !ok {
+			continue
+		}
+		frame := make([]byte, 1, 8+n)
+		frame[0] = typ
+		for len(frame) < cap(frame) {
+			b, err := br.ReadByte()
+			if err != nil {
+				return err
+			}
+			if b == beastEscape {
+				next, err := br.Peek(1)
+				if err != nil {
+					return err
+				}
+				if next[0] != beastEscape {
+					synced = true
+					break
+				}
+				br.ReadByte()
+			}
+			frame = append(frame, b)
+		}
+		if synced {
+			metricParseErrors.Inc("beast_truncated")
+			continue
+		}
+		emit(frame)
+	}
+}
+
+// parseBeastLine decodes a Beast frame as read by readBeast, hex encoded.
+// Mode A/C frames carry no address and are skipped. Frames carrying
+// mlat-client's results, marked by beastMLATMagic in place of a timestamp,
+// are tagged with position source "mlat".
+func parseBeastLine(line string) (SBS1Message, bool) {
+	frame, err := hex.DecodeString(line)
+	if err != nil || len(frame) < 8 || len(frame) != 8+beastMessageLengths[frame[0]] {
+		metricParseErrors.Inc("beast_frame")
+		return SBS1Message{}, false
+	}
+	if frame[0] == '1' {
+		return SBS1Message{}, false
+	}
+	var timestamp uint64
+	for _, b := range frame[1:7] {
+		timestamp = timestamp<<8 | uint64(b)
+	}
+	mlat := timestamp == beastMLATMagic
+	msg, ok := decodeModeS(frame[8:], mlat)
+	if !ok {
+		return msg, false
+	}
+	if mlat {
+		msg.PositionSource = "mlat"
+	} else {
+		msg.MLATTimestamp = timestamp
+	}
+	if signal := float64(frame[7]) / 255; signal > 0 {
+		msg.SignalLevel = float32(math.Round(20*math.Log10(signal)*10) / 10)
+	}
+	return msg, true
+}
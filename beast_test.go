@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestReadBeast(t *testing.T) {
+	ident, _ := hex.DecodeString("8D4840D6202CC371C32CE0576098")
+	short, _ := hex.DecodeString("5D4840D61A1A1A")
+
+	var stream bytes.Buffer
+	// Noise before the first frame is skipped.
+	stream.Write([]byte{0x00, 0x42})
+	// A Mode S long frame whose timestamp and signal hold escapes.
+	stream.Write([]byte{0x1a, '3', 0x00, 0x1a, 0x1a, 0x02, 0x03, 0x04, 0x05, 0x1a, 0x1a})
+	stream.Write(ident)
+	// A Mode S short frame whose parity is all escapes.
+	stream.Write([]byte{0x1a, '2', 0, 0, 0, 0, 0, 1, 0x80})
+	stream.Write(bytes.ReplaceAll(short, []byte{0x1a}, []byte{0x1a, 0x1a}))
+	// A frame of an unknown type, then one cut short by the next.
+	stream.Write([]byte{0x1a, '9', 1, 2, 3})
+	stream.Write([]byte{0x1a, '3', 0, 0, 0, 0, 0, 1, 0x80, 0x8d, 0x48})
+	stream.Write([]byte{0x1a, '1', 0, 0, 0, 0, 0, 2, 0xff, 0x12, 0x34})
+	// A frame cut short by the end of the stream.
+	stream.Write([]byte{0x1a, '2', 0, 0})
+
+	truncated := metricParseErrors.Value("beast_truncated")
+	var frames []string
+	err := readBeast(&stream, func(frame []byte) {
+		frames = append(frames, fmt.Sprintf("%x", frame))
+	})
+	if err == nil {
+		t.Error("no error at the end of the stream")
+	}
+	want := []string{
+		"33" + "001a02030405" + "1a" + "8d4840d6202cc371c32ce0576098",
+		"32" + "000000000001" + "80" + "5d4840d61a1a1a",
+		"31" + "000000000002" + "ff" + "1234",
+	}
+	if !reflect.DeepEqual(frames, want) {
+		t.Errorf("frames\n%q\nwant\n%q", frames, want)
+	}
+	if got := metricParseErrors.Value("beast_truncated") - truncated; got != 1 {
+		t.Errorf("%v truncated frames counted, want 1", got)
+	}
+}
+
+func TestParseBeastLine(t *testing.T) {
+	tests := []struct {
+		name, line string
+		ok         bool
+		want       SBS1Message
+	}{
+		{
+			name: "identification",
+			line: "33" + "0000075bcd15" + "80" + "8d4840d6202cc371c32ce0576098",
+			ok:   true,
+			want: SBS1Message{TransmissionType: 1, Icao24: "4840D6", Callsign: "KLM1023", MLATTimestamp: 123456789, SignalLevel: -6},
+		},
+		{
+			name: "full signal",
+			line: "33" + "000000000001" + "ff" + "8d4840d6202cc371c32ce0576098",
+			ok:   true,
+			want: SBS1Message{TransmissionType: 1, Icao24: "4840D6", Callsign: "KLM1023", MLATTimestamp: 1},
+		},
+		{
+			name: "mlat-client result",
+			line: "33" + "ff004d4c4154" + "00" + "924840d6202cc371c32ce09a8e9d",
+			ok:   true,
+			want: SBS1Message{TransmissionType: 1, Icao24: "4840D6", Callsign: "KLM1023", PositionSource: "mlat"},
+		},
+		{name: "TIS-B fine without the mlat timestamp", line: "33" + "000000000001" + "80" + "924840d6202cc371c32ce09a8e9d"},
+		{name: "Mode A/C", line: "31" + "000000000001" + "80" + "1234"},
+		{name: "wrong length", line: "33" + "000000000001" + "80" + "8d4840d6"},
+		{name: "not hex", line: "33zz"},
+		{name: "bad parity", line: "33" + "000000000001" + "80" + "8d4840d6202cc371c32ce0576099"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, ok := parseBeastLine(tt.line)
+			if ok != tt.ok {
+				t.Fatalf("ok %v, want %v", ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+			got := SBS1Message{
+				TransmissionType: msg.TransmissionType, Icao24: msg.Icao24, Callsign: msg.Callsign,
+				MLATTimestamp: msg.MLATTimestamp, SignalLevel: msg.SignalLevel, PositionSource: msg.PositionSource,
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
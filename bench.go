@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/metrics"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// benchResult is the outcome of a bench run. It is also the --json output,
+// so keep field names stable for tools tracking regressions.
+type benchResult struct {
+	Version        string  `json:"version"`
+	GoVersion      string  `json:"go_version"`
+	GOMAXPROCS     int     `json:"gomaxprocs"`
+	Lines          int     `json:"lines"`
+	Events         int     `json:"events"`
+	Seconds        float64 `json:"seconds"`
+	LinesPerSecond float64 `json:"lines_per_second"`
+	AllocsPerLine  float64 `json:"allocs_per_line"`
+	BytesPerLine   float64 `json:"bytes_per_line"`
+	CPUSeconds     float64 `json:"cpu_seconds"`
+	GCCPUSeconds   float64 `json:"gc_cpu_seconds"`
+	GCCycles       uint32  `json:"gc_cycles"`
+}
+
+// benchCommand measures pipeline throughput on a recorded capture.
+func benchCommand() *cli.Command {
+	return &cli.Command{
+		Name:      "bench",
+		Usage:     "Push a recorded SBS-1 capture through parsing, filtering, tracking and payload encoding as fast as possible and report throughput, allocations and CPU time.",
+		ArgsUsage: "CAPTURE",
+		Flags: []cli.Flag{
+			&cli.IntFlag{
+				Name:  "repeat",
+				Value: 10,
+				Usage: "Number of passes over the capture.",
+			},
+			&cli.BoolFlag{
+				Name:  "json",
+				Usage: "Print the result as JSON.",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if c.NArg() != 1 {
+				return configErrorf("bench needs exactly one capture file")
+			}
+			if c.Int("repeat") < 1 {
+				return configErrorf("--repeat must be at least 1")
+			}
+			var err error
+			if surface, err = newSurfaceFilter(VEHICLE_ICAO_RANGES.Value(), OBSTACLE_ICAO_RANGES.Value(), VEHICLES, OBSTACLES); err != nil {
+				return err
+			}
+			if transmissionTypes, err = parseTransmissionTypes(TRANSMISSION_TYPES.Value()); err != nil {
+				return configErrorf("%v", err)
+			}
+			// Read the capture up front so disk speed does not count.
+			capture, err := os.ReadFile(c.Args().First())
+			if err != nil {
+				return err
+			}
+
+			res, err := runBench(capture, c.Int("repeat"))
+			if err != nil {
+				return err
+			}
+			if c.Bool("json") {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				return enc.Encode(res)
+			}
+			return res.Print()
+		},
+	}
+}
+
+// runBench runs the estimate pipeline over capture repeat times.
+func runBench(capture []byte, repeat int) (*benchResult, error) {
+	samples := []metrics.Sample{
+		{Name: "/cpu/classes/total:cpu-seconds"},
+		{Name: "/cpu/classes/idle:cpu-seconds"},
+		{Name: "/cpu/classes/gc/total:cpu-seconds"},
+	}
+	var before, after runtime.MemStats
+
+	res := &benchResult{Version: version, GoVersion: runtime.Version(), GOMAXPROCS: runtime.GOMAXPROCS(0)}
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	metrics.Read(samples)
+	cpuBefore := samples[0].Value.Float64() - samples[1].Value.Float64()
+	gcBefore := samples[2].Value.Float64()
+	start := time.Now()
+
+	for i := 0; i < repeat; i++ {
+		// A fresh clock per pass so every pass sees the same timestamps.
+		clock = &recordedClock{}
+		est, err := runEstimate(bytes.NewReader(capture))
+		if err != nil {
+			return nil, err
+		}
+		res.Lines += est.lines
+		res.Events += est.events
+	}
+
+	res.Seconds = time.Since(start).Seconds()
+	runtime.ReadMemStats(&after)
+	metrics.Read(samples)
+	res.CPUSeconds = samples[0].Value.Float64() - samples[1].Value.Float64() - cpuBefore
+	res.GCCPUSeconds = samples[2].Value.Float64() - gcBefore
+	res.GCCycles = after.NumGC - before.NumGC
+	if res.Lines > 0 {
+		res.LinesPerSecond = float64(res.Lines) / res.Seconds
+		res.AllocsPerLine = float64(after.Mallocs-before.Mallocs) / float64(res.Lines)
+		res.BytesPerLine = float64(after.TotalAlloc-before.TotalAlloc) / float64(res.Lines)
+	}
+	return res, nil
+}
+
+// Print writes the result as a table.
+func (r *benchResult) Print() error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "version\t%s (%s, GOMAXPROCS=%d)\n", r.Version, r.GoVersion, r.GOMAXPROCS)
+	fmt.Fprintf(w, "lines\t%d (%d events)\n", r.Lines, r.Events)
+	fmt.Fprintf(w, "elapsed\t%.3fs\n", r.Seconds)
+	fmt.Fprintf(w, "throughput\t%.0f lines/s\n", r.LinesPerSecond)
+	fmt.Fprintf(w, "allocations\t%.1f allocs/line, %.0f B/line\n", r.AllocsPerLine, r.BytesPerLine)
+	fmt.Fprintf(w, "cpu\t%.3fs (%.3fs GC, %d cycles)\n", r.CPUSeconds, r.GCCPUSeconds, r.GCCycles)
+	return w.Flush()
+}
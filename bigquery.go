@@ -0,0 +1,556 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// bigqueryPendingMax bounds the messages waiting to be written, which
+	// includes those kept for a retry while BigQuery is unreachable.
+	bigqueryPendingMax = 100000
+	// bigqueryBatchBytes bounds the rows of one AppendRows request, which
+	// takes up to 10 MB.
+	bigqueryBatchBytes = 5 << 20
+	// bigqueryScope is the OAuth2 scope creating tables and writing rows
+	// needs.
+	bigqueryScope = "https://www.googleapis.com/auth/bigquery"
+	// bigqueryAPI manages tables; bigqueryStorageAPI takes the rows.
+	bigqueryAPI        = "https://bigquery.googleapis.com/bigquery/v2"
+	bigqueryStorageAPI = "https://bigquerystorage.googleapis.com"
+)
+
+// bigqueryTableName matches a table as PROJECT.DATASET.TABLE.
+var bigqueryTableName = regexp.MustCompile(`^([a-z][a-z0-9-]{4,28}[a-z0-9])\.(\w+)\.([\w-]+)$`)
+
+// bigqueryColumn is a column of the table, as the tables API describes it,
+// and the field of SBS1Message it holds.
+type bigqueryColumn struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Mode string `json:"mode,omitempty"`
+
+	// field is the schemaField the column is written from; event_id has
+	// none.
+	field *schemaField
+}
+
+// bigqueryColumns returns the table's columns: the event ID, then a column
+// per field of the event, in order. Nested objects are JSON columns, and
+// the nanosecond timestamp becomes a TIMESTAMP the table is partitioned by.
+func bigqueryColumns() []bigqueryColumn {
+	columns := []bigqueryColumn{{Name: "event_id", Type: "STRING"}}
+	for _, f := range schemaFields(reflect.TypeOf(SBS1Message{})) {
+		f := f
+		col := bigqueryColumn{Name: f.Name, field: &f}
+		t := f.Type
+		if t.Kind() == reflect.Ptr && (t.Elem().Kind() != reflect.Struct || t.Elem() == timeType) {
+			t = t.Elem()
+		}
+		switch {
+		case f.Name == "timestamp" || t == timeType:
+			col.Type = "TIMESTAMP"
+		case t.Kind() == reflect.String:
+			col.Type = "STRING"
+		case t.Kind() == reflect.Bool:
+			col.Type = "BOOL"
+		case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+			col.Type = "INTEGER"
+		case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+			col.Type = "FLOAT"
+		case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.String:
+			col.Type, col.Mode = "STRING", "REPEATED"
+		default:
+			col.Type = "JSON"
+		}
+		columns = append(columns, col)
+	}
+	return columns
+}
+
+// bigqueryDescriptor encodes the DescriptorProto of a row, a message with a
+// field per column numbered from 1. JSON columns are written as strings
+// and TIMESTAMP ones as microseconds since the epoch.
+func bigqueryDescriptor(columns []bigqueryColumn) []byte {
+	var desc protoBuffer
+	desc.str(1, "Row")
+	for i, col := range columns {
+		var field protoBuffer
+		field.str(1, col.Name)
+		field.varint(3, uint64(i+1))
+		label := uint64(1) // optional
+		if col.Mode == "REPEATED" {
+			label = 3
+		}
+		field.varint(4, label)
+		field.varint(5, map[string]uint64{"STRING": 9, "JSON": 9, "BOOL": 8, "INTEGER": 3, "TIMESTAMP": 3, "FLOAT": 1}[col.Type])
+		desc.message(2, field.Bytes())
+	}
+	return desc.Bytes()
+}
+
+// bigqueryRow encodes msg as a row. Fields the event's JSON leaves out are
+// left NULL.
+func bigqueryRow(columns []bigqueryColumn, msg SBS1Message) ([]byte, error) {
+	var row protoBuffer
+	value := reflect.ValueOf(msg)
+	for i, col := range columns {
+		n := i + 1
+		if col.field == nil {
+			row.str(n, eventID(msg))
+			continue
+		}
+		v := value.Field(col.field.Index)
+		if v.Kind() == reflect.Ptr && v.IsNil() || col.field.OmitEmpty && bigqueryEmpty(v) {
+			continue
+		}
+		if v.Kind() == reflect.Ptr && col.Type != "JSON" {
+			v = v.Elem()
+		}
+		switch col.Type {
+		case "TIMESTAMP":
+			if v.Kind() == reflect.String {
+				ns, err := strconv.ParseInt(v.String(), 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("timestamp %q: %w", v.String(), err)
+				}
+				row.varint(n, uint64(ns/1000))
+			} else {
+				row.varint(n, uint64(v.Interface().(time.Time).UnixMicro()))
+			}
+		case "STRING":
+			if col.Mode == "REPEATED" {
+				for j := 0; j < v.Len(); j++ {
+					row.str(n, v.Index(j).String())
+				}
+			} else {
+				row.str(n, v.String())
+			}
+		case "BOOL":
+			if v.Bool() {
+				row.varint(n, 1)
+			} else {
+				row.varint(n, 0)
+			}
+		case "INTEGER":
+			if v.CanInt() {
+				row.varint(n, uint64(v.Int()))
+			} else {
+				row.varint(n, v.Uint())
+			}
+		case "FLOAT":
+			f := v.Float()
+			if v.Kind() == reflect.Float32 {
+				// Written as float32 prints, not as its float64 expansion.
+				f, _ = strconv.ParseFloat(strconv.FormatFloat(f, 'g', -1, 32), 64)
+			}
+			row.double(n, f)
+		case "JSON":
+			data, err := json.Marshal(v.Interface())
+			if err != nil {
+				return nil, err
+			}
+			row.message(n, data)
+		}
+	}
+	return row.Bytes(), nil
+}
+
+// bigqueryEmpty reports whether encoding/json leaves v out as empty.
+func bigqueryEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map, reflect.String:
+		return v.Len() == 0
+	}
+	return v.IsZero()
+}
+
+// bigquerySink streams every decoded aircraft message into a BigQuery
+// table every interval, through the default stream of the Storage Write
+// API, so rows can be queried seconds after they are written. The table is
+// created on the first flush, partitioned by day and clustered by ICAO
+// address, and columns that later versions add to events are added to it.
+type bigquerySink struct {
+	*batchSink
+	project, dataset, table string
+	token                   *gcpToken
+	client                  *http.Client
+	columns                 []bigqueryColumn
+	descriptor              []byte
+	// ready is set once the table has every column.
+	ready bool
+}
+
+// newBigQuerySink starts writing to table, PROJECT.DATASET.TABLE, in the
+// background. Without credentials, tokens come from the metadata server.
+func newBigQuerySink(table, credentials string, interval time.Duration) (*bigquerySink, error) {
+	parts := bigqueryTableName.FindStringSubmatch(table)
+	if parts == nil {
+		return nil, fmt.Errorf("invalid bigquery_table %q", table)
+	}
+	columns := bigqueryColumns()
+	s := &bigquerySink{
+		project: parts[1], dataset: parts[2], table: parts[3],
+		client:  withChaos("bigquery", newHTTPClient()),
+		columns: columns, descriptor: bigqueryDescriptor(columns),
+	}
+	var err error
+	if s.token, err = newGCPToken(credentials, bigqueryScope, newHTTPClient()); err != nil {
+		return nil, fmt.Errorf("bigquery_credentials: %w", err)
+	}
+	s.batchSink = newBatchSink("bigquery", "BigQuery", "BigQuery table "+table, bigqueryPendingMax, interval, s.write)
+	return s, nil
+}
+
+// write prepares the table if that has not succeeded yet and appends msgs
+// in requests of up to bigqueryBatchBytes, stopping at the first that
+// fails. It returns the messages not written.
+func (s *bigquerySink) write(msgs []SBS1Message) ([]SBS1Message, error) {
+	if !s.ready {
+		if err := s.prepareTable(); err != nil {
+			return msgs, err
+		}
+		s.ready = true
+	}
+	for len(msgs) > 0 {
+		n, err := s.writeBatch(msgs)
+		if err != nil {
+			return msgs, err
+		}
+		msgs = msgs[n:]
+	}
+	return nil, nil
+}
+
+// writeBatch appends as many of msgs as fit in one request and returns
+// how many it took care of. Rows BigQuery rejects, which the whole request
+// fails for, are dropped and the others sent again.
+func (s *bigquerySink) writeBatch(msgs []SBS1Message) (int, error) {
+	var rows [][]byte
+	size := 0
+	for _, msg := range msgs {
+		row, err := bigqueryRow(s.columns, msg)
+		if err != nil {
+			return 0, err
+		}
+		if len(rows) > 0 && size+len(row) > bigqueryBatchBytes {
+			break
+		}
+		rows = append(rows, row)
+		size += len(row)
+	}
+	n := len(rows)
+
+	rejected, err := s.appendRows(rows)
+	if err != nil {
+		return 0, err
+	}
+	if len(rejected) > 0 {
+		metricSinkErrors.Add("bigquery", float64(len(rejected)))
+		first := len(rows)
+		for index := range rejected {
+			if index < first {
+				first = index
+			}
+		}
+		log.Printf("BigQuery rejected %d row(s), which are dropped: %s", len(rejected), rejected[first])
+		kept := rows[:0]
+		for i, row := range rows {
+			if _, bad := rejected[i]; !bad {
+				kept = append(kept, row)
+			}
+		}
+		if len(kept) > 0 {
+			if again, err := s.appendRows(kept); err != nil {
+				return 0, err
+			} else if len(again) > 0 {
+				return 0, fmt.Errorf("BigQuery rejected %d more row(s)", len(again))
+			}
+		}
+		rows = kept
+	}
+	metricSinkEvents.Add("bigquery", float64(len(rows)))
+	return n, nil
+}
+
+// appendRows sends rows to the table's default stream in one AppendRows
+// call, a gRPC stream of one request and one response. It returns the
+// rows BigQuery rejected, by index, with why; the other rows are then not
+// written either.
+func (s *bigquerySink) appendRows(rows [][]byte) (map[int]string, error) {
+	stream := fmt.Sprintf("projects/%s/datasets/%s/tables/%s/streams/_default", s.project, s.dataset, s.table)
+	var protoRows, schema, data, req protoBuffer
+	for _, row := range rows {
+		protoRows.message(1, row)
+	}
+	schema.message(1, s.descriptor)
+	data.message(1, schema.Bytes())
+	data.message(2, protoRows.Bytes())
+	req.str(1, stream)
+	req.message(4, data.Bytes())
+	req.str(6, "adsb-go-dataset")
+
+	body := make([]byte, 5, 5+req.Len())
+	binary.BigEndian.PutUint32(body[1:], uint32(req.Len()))
+	body = append(body, req.Bytes()...)
+	httpReq, err := http.NewRequest(http.MethodPost, bigqueryStorageAPI+"/google.cloud.bigquery.storage.v1.BigQueryWrite/AppendRows", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/grpc")
+	httpReq.Header.Set("TE", "trailers")
+	httpReq.Header.Set("x-goog-request-params", "write_stream="+url.QueryEscape(stream))
+	if err := s.token.authorize(httpReq); err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	reply, err := io.ReadAll(io.LimitReader(resp.Body, 4<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("BigQuery Storage Write API returned %s", resp.Status)
+	}
+	// A failed call may end at once, with its status in the headers.
+	status, message := resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")
+	if status == "" {
+		status, message = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+	}
+	if status != "" && status != "0" {
+		if m, err := url.PathUnescape(message); err == nil {
+			message = m
+		}
+		err := fmt.Errorf("BigQuery Storage Write API returned gRPC status %s: %s", status, message)
+		if status == "7" || status == "16" { // PERMISSION_DENIED, UNAUTHENTICATED
+			return nil, newError(errAuth, err)
+		}
+		return nil, err
+	}
+	if len(reply) < 5 {
+		return nil, fmt.Errorf("BigQuery Storage Write API returned no response")
+	}
+	return parseAppendRowsResponse(reply[5:])
+}
+
+// parseAppendRowsResponse reads an AppendRowsResponse: its row errors, or
+// its error if the whole request failed.
+func parseAppendRowsResponse(data []byte) (map[int]string, error) {
+	rejected := map[int]string{}
+	var failure error
+	err := protoFields(data, func(field int, value uint64, b []byte) error {
+		switch field {
+		case 2: // error, a google.rpc.Status
+			var code uint64
+			var message string
+			err := protoFields(b, func(field int, value uint64, b []byte) error {
+				switch field {
+				case 1:
+					code = value
+				case 2:
+					message = string(b)
+				}
+				return nil
+			})
+			failure = fmt.Errorf("BigQuery Storage Write API error %d: %s", code, message)
+			return err
+		case 4: // row_errors
+			var index uint64
+			var message string
+			err := protoFields(b, func(field int, value uint64, b []byte) error {
+				switch field {
+				case 1:
+					index = value
+				case 3:
+					message = string(b)
+				}
+				return nil
+			})
+			rejected[int(index)] = message
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("decoding the AppendRows response: %w", err)
+	}
+	if len(rejected) == 0 && failure != nil {
+		return nil, failure
+	}
+	return rejected, nil
+}
+
+// protoFields calls fn with every field of the protobuf message in data:
+// the value of varint and fixed fields, the bytes of length-delimited ones.
+func protoFields(data []byte, fn func(field int, value uint64, b []byte) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return fmt.Errorf("bad field key")
+		}
+		data = data[n:]
+		field := int(key >> 3)
+		var value uint64
+		var b []byte
+		switch key & 7 {
+		case 0:
+			if value, n = binary.Uvarint(data); n <= 0 {
+				return fmt.Errorf("bad varint in field %d", field)
+			}
+			data = data[n:]
+		case 1:
+			if len(data) < 8 {
+				return fmt.Errorf("short field %d", field)
+			}
+			value, data = binary.LittleEndian.Uint64(data), data[8:]
+		case 2:
+			size, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < size {
+				return fmt.Errorf("short field %d", field)
+			}
+			b, data = data[n:n+int(size)], data[n+int(size):]
+		case 5:
+			if len(data) < 4 {
+				return fmt.Errorf("short field %d", field)
+			}
+			value, data = uint64(binary.LittleEndian.Uint32(data)), data[4:]
+		default:
+			return fmt.Errorf("unsupported wire type %d in field %d", key&7, field)
+		}
+		if err := fn(field, value, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prepareTable creates the table if it does not exist, and otherwise adds
+// the columns it lacks. Columns are only ever added, so older collectors
+// can keep writing to a table a newer one extended.
+func (s *bigquerySink) prepareTable() error {
+	tableURL := fmt.Sprintf("%s/projects/%s/datasets/%s/tables/%s", bigqueryAPI, s.project, s.dataset, s.table)
+	var table struct {
+		Schema struct {
+			Fields []json.RawMessage `json:"fields"`
+		} `json:"schema"`
+	}
+	status, err := s.call(http.MethodGet, tableURL, nil, &table)
+	if err != nil && status != http.StatusNotFound {
+		return err
+	}
+	if status == http.StatusNotFound {
+		create := map[string]interface{}{
+			"tableReference":   map[string]string{"projectId": s.project, "datasetId": s.dataset, "tableId": s.table},
+			"schema":           map[string]interface{}{"fields": s.columns},
+			"timePartitioning": map[string]string{"type": "DAY", "field": "timestamp"},
+			"clustering":       map[string][]string{"fields": {"icao24"}},
+			"description":      "ADS-B events written by adsb-go-dataset.",
+		}
+		status, err := s.call(http.MethodPost, fmt.Sprintf("%s/projects/%s/datasets/%s/tables", bigqueryAPI, s.project, s.dataset), create, nil)
+		switch {
+		case status == http.StatusConflict:
+			// Created by another collector meanwhile.
+			return s.prepareTable()
+		case status == http.StatusNotFound:
+			return fmt.Errorf("dataset %s.%s does not exist: create it in the location the table should be in", s.project, s.dataset)
+		case err != nil:
+			return fmt.Errorf("creating the table: %w", err)
+		}
+		log.Printf("Created BigQuery table %s.%s.%s", s.project, s.dataset, s.table)
+		return nil
+	}
+
+	have := map[string]bool{}
+	for _, f := range table.Schema.Fields {
+		var field struct {
+			Name string `json:"name"`
+		}
+		json.Unmarshal(f, &field)
+		have[strings.ToLower(field.Name)] = true
+	}
+	fields := table.Schema.Fields
+	var added []string
+	for _, col := range s.columns {
+		if !have[strings.ToLower(col.Name)] {
+			data, _ := json.Marshal(col)
+			fields = append(fields, data)
+			added = append(added, col.Name)
+		}
+	}
+	if len(added) == 0 {
+		return nil
+	}
+	if _, err := s.call(http.MethodPatch, tableURL, map[string]interface{}{"schema": map[string]interface{}{"fields": fields}}, nil); err != nil {
+		return fmt.Errorf("adding columns %s: %w", strings.Join(added, ", "), err)
+	}
+	log.Printf("Added columns %s to BigQuery table %s.%s.%s", strings.Join(added, ", "), s.project, s.dataset, s.table)
+	return nil
+}
+
+// call makes a request of the tables API with body as JSON, decoding the
+// reply into out if set. It returns the status along with any error.
+func (s *bigquerySink) call(method, u string, body, out interface{}) (int, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, u, reader)
+	if err != nil {
+		return 0, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if err := s.token.authorize(req); err != nil {
+		return 0, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 4<<20))
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	if resp.StatusCode/100 != 2 {
+		// Errors carry {"error": {"code": ..., "message": ..., "status": ...}}.
+		var reply struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		err := fmt.Errorf("BigQuery returned %s", resp.Status)
+		if json.Unmarshal(data, &reply) == nil && reply.Error.Message != "" {
+			err = fmt.Errorf("BigQuery returned %s: %s", resp.Status, reply.Error.Message)
+		}
+		if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+			return resp.StatusCode, newError(errAuth, err)
+		}
+		return resp.StatusCode, err
+	}
+	if out != nil {
+		if err := json.Unmarshal(data, out); err != nil {
+			return resp.StatusCode, fmt.Errorf("decoding %s: %w", u, err)
+		}
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery/storage/apiv1/storagepb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// bigqueryRowType builds the message type rows are written as from the
+// descriptor sent with them, as BigQuery does.
+func bigqueryRowType(t *testing.T, desc *descriptorpb.DescriptorProto) protoreflect.MessageDescriptor {
+	t.Helper()
+	file, err := protodesc.NewFile(&descriptorpb.FileDescriptorProto{
+		Name:        proto.String("row.proto"),
+		MessageType: []*descriptorpb.DescriptorProto{desc},
+	}, nil)
+	if err != nil {
+		t.Fatalf("descriptor: %v", err)
+	}
+	return file.Messages().Get(0)
+}
+
+// decodeBigQueryRow decodes a row into its set fields by column name.
+func decodeBigQueryRow(t *testing.T, rowType protoreflect.MessageDescriptor, row []byte) map[string]protoreflect.Value {
+	t.Helper()
+	msg := dynamicpb.NewMessage(rowType)
+	if err := proto.Unmarshal(row, msg); err != nil {
+		t.Fatalf("row: %v", err)
+	}
+	fields := map[string]protoreflect.Value{}
+	msg.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		fields[string(fd.Name())] = v
+		return true
+	})
+	return fields
+}
+
+func TestBigQueryRow(t *testing.T) {
+	columns := bigqueryColumns()
+	var desc descriptorpb.DescriptorProto
+	if err := proto.Unmarshal(bigqueryDescriptor(columns), &desc); err != nil {
+		t.Fatal(err)
+	}
+	rowType := bigqueryRowType(t, &desc)
+	if rowType.Fields().Len() != len(columns) {
+		t.Fatalf("descriptor has %d fields for %d columns", rowType.Fields().Len(), len(columns))
+	}
+	kinds := map[string]protoreflect.Kind{
+		"STRING": protoreflect.StringKind, "JSON": protoreflect.StringKind, "BOOL": protoreflect.BoolKind,
+		"INTEGER": protoreflect.Int64Kind, "TIMESTAMP": protoreflect.Int64Kind, "FLOAT": protoreflect.DoubleKind,
+	}
+	for i, col := range columns {
+		fd := rowType.Fields().Get(i)
+		if string(fd.Name()) != col.Name || int(fd.Number()) != i+1 || fd.Kind() != kinds[col.Type] || fd.IsList() != (col.Mode == "REPEATED") {
+			t.Errorf("column %s %s %s described as %s %d %s list %v", col.Name, col.Type, col.Mode, fd.Name(), fd.Number(), fd.Kind(), fd.IsList())
+		}
+	}
+
+	generated := time.Date(2026, 10, 16, 10, 0, 0, 500000000, time.UTC)
+	nic := int32(8)
+	msg := SBS1Message{
+		Timestamp:   "1760608800123456789",
+		MessageType: "MSG", TransmissionType: 3, Icao24: "4ca2d6", GeneratedDate: &generated,
+		Altitude: 35000, VerticalRate: -832, Lat: 53.1, OnGround: true, NIC: &nic,
+		NavModes:   []string{"autopilot", "tcas"},
+		Enrichment: &Enrichment{},
+	}
+	row, err := bigqueryRow(columns, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := decodeBigQueryRow(t, rowType, row)
+	for name, want := range map[string]interface{}{
+		"event_id":          eventID(msg),
+		"timestamp":         int64(1760608800123456),
+		"generated_date":    generated.UnixMicro(),
+		"message_type":      "MSG",
+		"transmission_type": int64(3),
+		"icao24":            "4ca2d6",
+		"altitude":          int64(35000),
+		"vertical_rate":     int64(-832),
+		"lat":               53.1,
+		"on_ground":         true,
+		"nic":               int64(8),
+		"enrichment":        "{}",
+	} {
+		if v, ok := got[name]; !ok || v.Interface() != want {
+			t.Errorf("%s decodes as %v, want %v", name, v, want)
+		}
+	}
+	if modes := got["nav_modes"].List(); modes.Len() != 2 || modes.Get(0).String() != "autopilot" || modes.Get(1).String() != "tcas" {
+		t.Errorf("nav_modes decodes as %v", got["nav_modes"])
+	}
+	// Fields the event's JSON leaves out stay NULL.
+	for _, name := range []string{"callsign", "lon", "alert", "nac_p", "logged_date"} {
+		if _, ok := got[name]; ok {
+			t.Errorf("%s set", name)
+		}
+	}
+}
+
+// fakeBigQueryWrite is the Storage Write API, rejecting rows of aircraft
+// named in reject and every call with fail when set.
+type fakeBigQueryWrite struct {
+	storagepb.UnimplementedBigQueryWriteServer
+	t      *testing.T
+	reject string
+	fail   error
+
+	mu       sync.Mutex
+	requests []*storagepb.AppendRowsRequest
+	headers  []metadata.MD
+	rows     []map[string]protoreflect.Value
+}
+
+func (f *fakeBigQueryWrite) AppendRows(stream storagepb.BigQueryWrite_AppendRowsServer) error {
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, req)
+	f.headers = append(f.headers, md)
+	if f.fail != nil {
+		return f.fail
+	}
+
+	data := req.GetProtoRows()
+	rowType := bigqueryRowType(f.t, data.GetWriterSchema().GetProtoDescriptor())
+	var rows []map[string]protoreflect.Value
+	resp := &storagepb.AppendRowsResponse{}
+	for i, row := range data.GetRows().GetSerializedRows() {
+		fields := decodeBigQueryRow(f.t, rowType, row)
+		if fields["icao24"].String() == f.reject {
+			resp.RowErrors = append(resp.RowErrors, &storagepb.RowError{
+				Index: int64(i), Code: storagepb.RowError_FIELDS_ERROR, Message: "altitude out of range",
+			})
+		}
+		rows = append(rows, fields)
+	}
+	if len(resp.RowErrors) == 0 {
+		f.rows = append(f.rows, rows...)
+		resp.Response = &storagepb.AppendRowsResponse_AppendResult_{AppendResult: &storagepb.AppendRowsResponse_AppendResult{}}
+	}
+	return stream.Send(resp)
+}
+
+// fakeBigQuery serves the tables API, with the table missing until
+// created, and write over gRPC. The sink's requests are sent to it.
+func fakeBigQuery(t *testing.T, s *bigquerySink, write *fakeBigQueryWrite) (tables *[]string) {
+	t.Helper()
+	write.t = t
+	server := grpc.NewServer()
+	storagepb.RegisterBigQueryWriteServer(server, write)
+	var mu sync.Mutex
+	var calls []string
+	created := false
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			server.ServeHTTP(w, r)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		calls = append(calls, r.Method+" "+r.URL.Path)
+		switch {
+		case r.Method == http.MethodGet && !created:
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": map[string]string{"message": "Not found: Table"}})
+		case r.Method == http.MethodPost:
+			created = true
+			w.Write([]byte("{}"))
+		default:
+			w.Write([]byte(`{"schema": {"fields": []}}`))
+		}
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	target, _ := url.Parse(srv.URL)
+	client := srv.Client()
+	transport := client.Transport
+	client.Transport = roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		r.URL.Scheme, r.URL.Host = target.Scheme, target.Host
+		return transport.RoundTrip(r)
+	})
+	s.client = client
+	s.token = &gcpToken{token: "test-token", expires: time.Now().Add(time.Hour)}
+	return &calls
+}
+
+// roundTripperFunc makes a function an http.RoundTripper.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+// testBigQuerySink is a sink that only writes when told to.
+func testBigQuerySink(t *testing.T) *bigquerySink {
+	t.Helper()
+	s, err := newBigQuerySink("adsb-project.adsb.messages", "", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestBigQuerySink(t *testing.T) {
+	s := testBigQuerySink(t)
+	write := &fakeBigQueryWrite{reject: "bad"}
+	tables := fakeBigQuery(t, s, write)
+	msgs := []SBS1Message{
+		{Timestamp: "1760608800000000000", MessageType: "MSG", TransmissionType: 3, Icao24: "4ca2d6", Altitude: 35000},
+		{Timestamp: "1760608801000000000", MessageType: "MSG", TransmissionType: 3, Icao24: "bad", Altitude: 99999},
+		{Timestamp: "1760608802000000000", MessageType: "MSG", TransmissionType: 1, Icao24: "a1b2c3", Callsign: "EIN123"},
+	}
+	unsent, err := s.write(msgs)
+	if err != nil || len(unsent) > 0 {
+		t.Fatalf("write left %d messages: %v", len(unsent), err)
+	}
+
+	base := "/bigquery/v2/projects/adsb-project/datasets/adsb/tables"
+	if want := []string{"GET " + base + "/messages", "POST " + base}; strings.Join(*tables, ", ") != strings.Join(want, ", ") {
+		t.Errorf("tables API calls %q, want %q", *tables, want)
+	}
+	// The rejected row is dropped and the others sent again.
+	if len(write.requests) != 2 || len(write.requests[1].GetProtoRows().GetRows().GetSerializedRows()) != 2 {
+		t.Fatalf("%d AppendRows calls", len(write.requests))
+	}
+	stream := "projects/adsb-project/datasets/adsb/tables/messages/streams/_default"
+	req, md := write.requests[0], write.headers[0]
+	if req.GetWriteStream() != stream || req.GetTraceId() != "adsb-go-dataset" {
+		t.Errorf("appended to %q with trace ID %q", req.GetWriteStream(), req.GetTraceId())
+	}
+	if got := md.Get("authorization"); len(got) != 1 || got[0] != "Bearer test-token" {
+		t.Errorf("authorized with %q", got)
+	}
+	if got := md.Get("x-goog-request-params"); len(got) != 1 || got[0] != "write_stream="+url.QueryEscape(stream) {
+		t.Errorf("request params %q", got)
+	}
+	if len(write.rows) != 2 || write.rows[0]["icao24"].String() != "4ca2d6" || write.rows[1]["callsign"].String() != "EIN123" ||
+		write.rows[0]["timestamp"].Int() != 1760608800000000 || write.rows[0]["event_id"].String() != eventID(msgs[0]) {
+		t.Errorf("wrote %v", write.rows)
+	}
+
+	// The table is only prepared once.
+	if _, err := s.write(msgs[:1]); err != nil || len(*tables) != 2 {
+		t.Errorf("second write: %v after %q", err, *tables)
+	}
+}
+
+func TestBigQueryErrors(t *testing.T) {
+	msgs := []SBS1Message{{Timestamp: "1760608800000000000", MessageType: "MSG", Icao24: "4ca2d6"}}
+	tests := []struct {
+		name string
+		fail error
+		auth bool
+	}{
+		{"permission denied", status.Error(codes.PermissionDenied, "Permission 'TABLES_UPDATE_DATA' denied"), true},
+		{"unauthenticated", status.Error(codes.Unauthenticated, "Request had invalid authentication credentials"), true},
+		{"unavailable", status.Error(codes.Unavailable, "The service is currently unavailable"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testBigQuerySink(t)
+			fakeBigQuery(t, s, &fakeBigQueryWrite{fail: tt.fail})
+			unsent, err := s.write(msgs)
+			if err == nil || len(unsent) != 1 || (errorKindOf(err) == errAuth) != tt.auth {
+				t.Fatalf("%d unsent, error %v of kind %s", len(unsent), err, errorKindOf(err))
+			}
+			if msg := status.Convert(tt.fail).Message(); !strings.Contains(err.Error(), msg) {
+				t.Errorf("error %q leaves out %q", err, msg)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// lookupCache is a size-bounded cache of lookup results that expire after a
+// TTL. Misses are cached too, as nil, for the shorter negativeTTL so an
+// unknown key is not looked up again on every message. When full, the least
+// recently used entry is evicted.
+type lookupCache struct {
+	mu          sync.Mutex
+	size        int
+	ttl         time.Duration
+	negativeTTL time.Duration
+	entries     map[string]*list.Element
+	lru         *list.List // of *cacheEntry, most recently used first
+}
+
+type cacheEntry struct {
+	key     string
+	value   []string
+	expires time.Time
+}
+
+func newLookupCache(size int, ttl, negativeTTL time.Duration) *lookupCache {
+	return &lookupCache{
+		size:        size,
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		entries:     map[string]*list.Element{},
+		lru:         list.New(),
+	}
+}
+
+// Get returns the cached value for key and whether there was one. A cached
+// miss is returned as nil, true.
+func (c *lookupCache) Get(key string, now time.Time) ([]string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*cacheEntry)
+	if !now.Before(entry.expires) {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return entry.value, true
+}
+
+// Put caches value for key, or a miss if value is nil.
+func (c *lookupCache) Put(key string, value []string, now time.Time) {
+	ttl := c.ttl
+	if value == nil {
+		ttl = c.negativeTTL
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		el.Value = &cacheEntry{key: key, value: value, expires: now.Add(ttl)}
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, value: value, expires: now.Add(ttl)})
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
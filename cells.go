@@ -0,0 +1,78 @@
+package main
+
+import "fmt"
+
+// geohashAlphabet is the base32 alphabet of geohashes.
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// geohash encodes a position as a geohash of precision characters.
+func geohash(lat, lon float64, precision int) string {
+	latRange, lonRange := [2]float64{-90, 90}, [2]float64{-180, 180}
+	hash := make([]byte, 0, precision)
+	bits, ch := 0, 0
+	even := true
+	for len(hash) < precision {
+		// Bits alternate between longitude and latitude, longitude first.
+		r, v := &latRange, lat
+		if even {
+			r, v = &lonRange, lon
+		}
+		mid := (r[0] + r[1]) / 2
+		ch <<= 1
+		if v >= mid {
+			ch |= 1
+			r[0] = mid
+		} else {
+			r[1] = mid
+		}
+		even = !even
+		if bits++; bits == 5 {
+			hash = append(hash, geohashAlphabet[ch])
+			bits, ch = 0, 0
+		}
+	}
+	return string(hash)
+}
+
+// cellIndexer adds the geohash and H3 cell of their position to messages,
+// so positions can be grouped by area in stores without geo functions.
+// Either is disabled when its precision or resolution is negative or, for
+// geohashes, zero.
+type cellIndexer struct {
+	geohashPrecision int
+	h3Resolution     int
+}
+
+// cells is the indexer configured on the command line, or nil.
+var cells *cellIndexer
+
+// newCellIndexer checks the geohash precision (1-12) and H3 resolution
+// (0-15), and returns nil if both are disabled.
+func newCellIndexer(geohashPrecision, h3Resolution int) (*cellIndexer, error) {
+	switch {
+	case geohashPrecision < 0 || geohashPrecision > 12:
+		return nil, fmt.Errorf("geohash_precision must be between 1 and 12, or 0 to disable it")
+	case h3Resolution > 15:
+		return nil, fmt.Errorf("h3_resolution must be between 0 and 15, or -1 to disable it")
+	case h3Resolution >= 0 && !h3Supported:
+		return nil, fmt.Errorf("h3_resolution needs a build with libh3: go build -tags h3")
+	case geohashPrecision == 0 && h3Resolution < 0:
+		return nil, nil
+	}
+	return &cellIndexer{geohashPrecision: geohashPrecision, h3Resolution: h3Resolution}, nil
+}
+
+// Apply sets the cells of msg if it has a position. A nil indexer does
+// nothing.
+func (c *cellIndexer) Apply(msg *SBS1Message) {
+	if c == nil || msg.Lat == 0 && msg.Lon == 0 {
+		return
+	}
+	lat, lon := decimal(msg.Lat), decimal(msg.Lon)
+	if c.geohashPrecision > 0 {
+		msg.Geohash = geohash(lat, lon, c.geohashPrecision)
+	}
+	if c.h3Resolution >= 0 {
+		msg.H3 = h3Cell(lat, lon, c.h3Resolution)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// chaosSinks are the HTTP sinks whose requests chaos mode can fail.
+var chaosSinks = []string{"dataset", "s3", "splunk", "kinesis", "firehose", "pubsub", "eventhubs", "bigquery", "webhook", "influx", "remote_write", "alert_webhook"}
+
+var metricChaosFaults = newCounter("adsb_chaos_faults_total", "Faults injected into sink requests by chaos mode, by fault: latency, failure or 429.", "fault")
+
+// chaosConfig is the developer mode that injects faults into the requests
+// of chosen sinks, so the spool, retries and dead letters can be exercised
+// end to end against a healthy endpoint. It is parsed from the CHAOS_*
+// options at startup.
+type chaosConfig struct {
+	sinks       map[string]bool
+	latency     time.Duration
+	latencyRate float64
+	failureRate float64
+	rate429     float64
+}
+
+// chaos is off unless chaos_sinks is set.
+var chaos chaosConfig
+
+// newChaosConfig checks the chaos options.
+func newChaosConfig(sinks []string, latency time.Duration, latencyRate, failureRate, rate429 float64) (chaosConfig, error) {
+	c := chaosConfig{sinks: map[string]bool{}, latency: latency, latencyRate: latencyRate, failureRate: failureRate, rate429: rate429}
+	for _, sink := range sinks {
+		if !containsFold(chaosSinks, sink) {
+			return c, fmt.Errorf("unknown chaos sink %q, expected one of %s", sink, strings.Join(chaosSinks, ", "))
+		}
+		c.sinks[strings.ToLower(sink)] = true
+	}
+	for _, rate := range []struct {
+		name  string
+		value float64
+	}{{"chaos_latency_rate", latencyRate}, {"chaos_failure_rate", failureRate}, {"chaos_429_rate", rate429}} {
+		if rate.value < 0 || rate.value > 1 {
+			return c, fmt.Errorf("%s must be between 0 and 1", rate.name)
+		}
+	}
+	switch {
+	case failureRate+rate429 > 1:
+		return c, fmt.Errorf("chaos_failure_rate and chaos_429_rate must add up to at most 1")
+	case latency < 0:
+		return c, fmt.Errorf("chaos_latency must not be negative")
+	case len(c.sinks) == 0 && latencyRate+failureRate+rate429 > 0:
+		return c, fmt.Errorf("chaos rates need chaos_sinks to name the sinks to fail")
+	}
+	return c, nil
+}
+
+// String describes the injected faults for the startup log.
+func (c chaosConfig) String() string {
+	var sinks []string
+	for _, sink := range chaosSinks {
+		if c.sinks[sink] {
+			sinks = append(sinks, sink)
+		}
+	}
+	return fmt.Sprintf("%s requests: %.0f%% delayed by up to %s, %.0f%% failed, %.0f%% answered 429",
+		strings.Join(sinks, ", "), c.latencyRate*100, c.latency, c.failureRate*100, c.rate429*100)
+}
+
+// withChaos returns client with chaos mode's faults injected into its
+// requests if sink is one of chaos_sinks, and client itself otherwise.
+func withChaos(sink string, client *http.Client) *http.Client {
+	if !chaos.sinks[sink] {
+		return client
+	}
+	wrapped := *client
+	wrapped.Transport = &chaosTransport{base: client.Transport, config: chaos}
+	return &wrapped
+}
+
+// chaosTransport delays requests, fails them as if the endpoint were
+// unreachable, or answers them with 429 Too Many Requests without sending
+// them.
+type chaosTransport struct {
+	base   http.RoundTripper
+	config chaosConfig
+}
+
+func (t *chaosTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c := t.config
+	if c.latency > 0 && rand.Float64() < c.latencyRate {
+		metricChaosFaults.Inc("latency")
+		select {
+		case <-time.After(time.Duration(rand.Int63n(int64(c.latency)) + 1)):
+		case <-req.Context().Done():
+			closeBody(req)
+			return nil, req.Context().Err()
+		}
+	}
+	switch r := rand.Float64(); {
+	case r < c.failureRate:
+		metricChaosFaults.Inc("failure")
+		closeBody(req)
+		return nil, fmt.Errorf("chaos mode: injected connection failure")
+	case r < c.failureRate+c.rate429:
+		metricChaosFaults.Inc("429")
+		closeBody(req)
+		return &http.Response{
+			Status:     "429 Too Many Requests",
+			StatusCode: http.StatusTooManyRequests,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     http.Header{"Retry-After": {"1"}, "Content-Type": {"application/json"}},
+			Body:       io.NopCloser(strings.NewReader(`{"status":"error/server/backoff","message":"injected by chaos mode"}`)),
+			Request:    req,
+		}, nil
+	}
+	return t.base.RoundTrip(req)
+}
+
+// closeBody closes the body of a request that is not sent, as RoundTrip
+// must.
+func closeBody(req *http.Request) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+}
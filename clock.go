@@ -0,0 +1,265 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Clock abstracts access to the current time so the pipeline can be driven
+// by recorded timestamps instead of the wall clock.
+type Clock interface {
+	Now() time.Time
+}
+
+// systemClock reads the wall clock, in UTC so that times are emitted the
+// same whatever the host's time zone.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now().UTC() }
+
+// recordedClock only moves when a recorded timestamp is observed, which makes
+// the output of a replayed capture independent of when it is replayed.
+type recordedClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// Now returns the most recently observed recorded time. Until a time has
+// been observed it reads the wall clock, so that what is set up before the
+// first message, such as archive files and alert timers, is not dated year
+// one.
+func (c *recordedClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.now.IsZero() {
+		return systemClock{}.Now()
+	}
+	return c.now
+}
+
+// Observe advances the clock to t. Recorded times never move the clock
+// backwards, so out-of-order messages reuse the latest known time.
+func (c *recordedClock) Observe(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if t.After(c.now) {
+		c.now = t
+	}
+}
+
+// ObserveMessage advances the clock to a message's generated date, or its
+// logged date when there is none. It reports whether a date was present.
+func (c *recordedClock) ObserveMessage(generated, logged *time.Time) bool {
+	switch {
+	case generated != nil:
+		c.Observe(*generated)
+	case logged != nil:
+		c.Observe(*logged)
+	default:
+		return false
+	}
+	return true
+}
+
+// clock is the time source used by the whole pipeline.
+var clock Clock = systemClock{}
+
+// newClock returns the clock for the given CLOCK setting.
+func newClock(source string) (Clock, error) {
+	switch source {
+	case "", "system":
+		return systemClock{}, nil
+	case "recorded":
+		return &recordedClock{}, nil
+	default:
+		return nil, fmt.Errorf("unknown clock %q, expected 'system' or 'recorded'", source)
+	}
+}
+
+// observeRecordedTime feeds a message's recorded time into the clock when
+// the pipeline runs on recorded time. It reports whether the clock moved.
+func observeRecordedTime(generated, logged *time.Time) bool {
+	rc, ok := clock.(*recordedClock)
+	if !ok {
+		return false
+	}
+	return rc.ObserveMessage(generated, logged)
+}
+
+// sbsLocation is the time zone the date and time fields of SBS-1 lines are
+// written in.
+var sbsLocation = time.UTC
+
+// newSBSLocation returns the time zone for the SBS_TIMEZONE setting.
+func newSBSLocation(name string) (*time.Location, error) {
+	switch name {
+	case "", "UTC":
+		return time.UTC, nil
+	case "Local", "local":
+		return time.Local, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown sbs_timezone %q, expected UTC, Local or a zone such as Europe/London", name)
+	}
+	return loc, nil
+}
+
+// sbsDateTime reads the date and time fields of an SBS-1 line, written in
+// sbsLocation, as a UTC time. ref is when the line is thought to be from,
+// the clock's time, and settles what the fields leave open:
+//
+//   - A time without a date is given the day that puts it nearest ref, so
+//     a feed a few seconds behind or ahead of the host across midnight
+//     does not jump a day. Without a ref it cannot be read.
+//   - A wall time that happens twice as daylight saving time ends is read
+//     as the one nearest ref, or as the earlier one without a ref.
+//   - A leap second, 23:59:60, is read as the last instant of 23:59:59,
+//     keeping it in its day and ahead of the next second's messages.
+func sbsDateTime(date, timeStr string, ref time.Time) (time.Time, error) {
+	date, timeStr = strings.TrimSpace(date), strings.TrimSpace(timeStr)
+	leap := false
+	if hm, sec, ok := strings.Cut(timeStr, ":60"); ok && strings.Count(hm, ":") == 1 && (sec == "" || sec[0] == '.') {
+		timeStr, leap = hm+":59", true
+	}
+	clockTime, err := time.Parse("15:04:05", timeStr)
+	if err != nil {
+		return time.Time{}, errInvalidDateTime
+	}
+	if leap {
+		clockTime = clockTime.Add(time.Second - time.Nanosecond)
+	}
+	hour, min, sec := clockTime.Clock()
+	nsec := clockTime.Nanosecond()
+
+	if date != "" {
+		day, err := time.Parse("2006/01/02", date)
+		if err != nil {
+			return time.Time{}, errInvalidDateTime
+		}
+		y, m, d := day.Date()
+		return sbsWallTime(y, m, d, hour, min, sec, nsec, ref), nil
+	}
+	if ref.IsZero() {
+		return time.Time{}, errInvalidDateTime
+	}
+	var best time.Time
+	y, m, d := ref.In(sbsLocation).Date()
+	for _, offset := range []int{-1, 0, 1} {
+		t := sbsWallTime(y, m, d+offset, hour, min, sec, nsec, ref)
+		if best.IsZero() || absDuration(t.Sub(ref)) < absDuration(best.Sub(ref)) {
+			best = t
+		}
+	}
+	return best, nil
+}
+
+// sbsMidnightWindow is how near midnight the time of a date/time pair has
+// to be for the pair to be taken as straddling it.
+const sbsMidnightWindow = 10 * time.Minute
+
+// fixMidnight corrects the generated and logged times of an SBS-1 line
+// that straddle midnight. Some decoders read the date and the time apart,
+// so a pair written just after midnight can carry the previous day's date,
+// or one written just before it the next day's, a day away from the other
+// pair and from ref, the clock's time. Such a pair, whose time is within
+// sbsMidnightWindow of midnight, is moved a day to agree with ref, or with
+// the generated time when there is no ref. It returns the name of each
+// corrected field, generated or logged.
+func fixMidnight(generated, logged *time.Time, ref time.Time) []string {
+	var fixed []string
+	fix := func(name string, t *time.Time, against time.Time) {
+		if t == nil || against.IsZero() || absDuration(t.Sub(against)) < 12*time.Hour || !nearMidnight(*t) {
+			return
+		}
+		for _, days := range []int{-1, 1} {
+			if c := t.In(sbsLocation).AddDate(0, 0, days).UTC(); absDuration(c.Sub(against)) <= sbsMidnightWindow {
+				*t = c
+				fixed = append(fixed, name)
+				return
+			}
+		}
+	}
+	fix("generated", generated, ref)
+	fix("logged", logged, ref)
+	if generated != nil && len(fixed) == 0 {
+		fix("logged", logged, *generated)
+	}
+	return fixed
+}
+
+// nearMidnight reports whether t is within sbsMidnightWindow of a midnight
+// in sbsLocation.
+func nearMidnight(t time.Time) bool {
+	hour, min, sec := t.In(sbsLocation).Clock()
+	since := time.Duration(hour)*time.Hour + time.Duration(min)*time.Minute + time.Duration(sec)*time.Second
+	return since < sbsMidnightWindow || 24*time.Hour-since <= sbsMidnightWindow
+}
+
+const sbsWallLayout = "2006-01-02 15:04:05.999999999"
+
+// sbsWallTime is the UTC time of a wall time in sbsLocation, the one
+// nearest ref when the wall time happens twice.
+func sbsWallTime(y int, m time.Month, d, hour, min, sec, nsec int, ref time.Time) time.Time {
+	t := time.Date(y, m, d, hour, min, sec, nsec, sbsLocation)
+	if sbsLocation == time.UTC {
+		return t
+	}
+	// The same wall time under the offsets in force half a day either side.
+	wall := time.Date(y, m, d, hour, min, sec, nsec, time.UTC)
+	best := t
+	for _, near := range []time.Time{t.Add(-12 * time.Hour), t.Add(12 * time.Hour)} {
+		_, offset := near.In(sbsLocation).Zone()
+		c := wall.Add(-time.Duration(offset) * time.Second)
+		if c.In(sbsLocation).Format(sbsWallLayout) != wall.Format(sbsWallLayout) {
+			continue
+		}
+		if ref.IsZero() {
+			if c.Before(best) {
+				best = c
+			}
+		} else if absDuration(c.Sub(ref)) < absDuration(best.Sub(ref)) {
+			best = c
+		}
+	}
+	return best.UTC()
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+// formatTimestamp renders t the way DataSet expects event timestamps.
+func formatTimestamp(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// parseTimestamp is the inverse of formatTimestamp.
+func parseTimestamp(s string) (time.Time, error) {
+	ns, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp %q", s)
+	}
+	return time.Unix(0, ns).UTC(), nil
+}
+
+// sessionNamespace scopes the deterministic session IDs used on recorded time.
+var sessionNamespace = uuid.MustParse("6f1c7a2e-5d0b-4e8a-9a43-0c2f4b1d8e37")
+
+// newSessionID returns the DataSet session for a batch. On the wall clock
+// every batch gets a random session; on recorded time the session is derived
+// from the batch contents so replays upload identical payloads.
+func newSessionID(messages []SBS1Message) uuid.UUID {
+	if _, ok := clock.(*recordedClock); !ok || len(messages) == 0 {
+		return uuid.New()
+	}
+	return uuid.NewSHA1(sessionNamespace, []byte(COLLECTOR_SOURCE+"/"+messages[0].Timestamp))
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+// withSBSLocation sets sbsLocation to the named zone for the rest of the
+// test.
+func withSBSLocation(t *testing.T, name string) {
+	t.Helper()
+	loc, err := newSBSLocation(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := sbsLocation
+	sbsLocation = loc
+	t.Cleanup(func() { sbsLocation = saved })
+}
+
+// utc parses an RFC 3339 time, or returns the zero time for "".
+func utc(t *testing.T, s string) time.Time {
+	t.Helper()
+	if s == "" {
+		return time.Time{}
+	}
+	v, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v.UTC()
+}
+
+func TestSBSDateTime(t *testing.T) {
+	tests := []struct {
+		name       string
+		zone       string
+		date, time string
+		ref        string
+		want       string
+		wantErr    bool
+	}{
+		{name: "utc", zone: "UTC", date: "2026/10/16", time: "10:00:00.250", want: "2026-10-16T10:00:00.25Z"},
+		{name: "summer time", zone: "Europe/London", date: "2026/07/01", time: "12:00:00.000", want: "2026-07-01T11:00:00Z"},
+		{name: "winter time", zone: "Europe/London", date: "2026/12/01", time: "12:00:00.000", want: "2026-12-01T12:00:00Z"},
+
+		// On 2026-10-25 London's clocks go back from 02:00 BST to 01:00 GMT,
+		// so 01:30 is 00:30 UTC and again 01:30 UTC.
+		{name: "fall back without ref", zone: "Europe/London", date: "2026/10/25", time: "01:30:00.000", want: "2026-10-25T00:30:00Z"},
+		{name: "fall back ref in first hour", zone: "Europe/London", date: "2026/10/25", time: "01:30:00.000", ref: "2026-10-25T00:31:00Z", want: "2026-10-25T00:30:00Z"},
+		{name: "fall back ref in second hour", zone: "Europe/London", date: "2026/10/25", time: "01:30:00.000", ref: "2026-10-25T01:31:00Z", want: "2026-10-25T01:30:00Z"},
+		{name: "fall back after the repeat", zone: "Europe/London", date: "2026/10/25", time: "02:30:00.000", ref: "2026-10-25T00:31:00Z", want: "2026-10-25T02:30:00Z"},
+
+		// On 2026-03-29 London's clocks go forward from 01:00 GMT to 02:00
+		// BST, so 01:30 never happens and is read under GMT.
+		{name: "spring forward gap", zone: "Europe/London", date: "2026/03/29", time: "01:30:00.000", want: "2026-03-29T01:30:00Z"},
+		{name: "spring forward gap with ref", zone: "Europe/London", date: "2026/03/29", time: "01:30:00.000", ref: "2026-03-29T01:30:00Z", want: "2026-03-29T01:30:00Z"},
+		{name: "spring forward after the gap", zone: "Europe/London", date: "2026/03/29", time: "02:30:00.000", want: "2026-03-29T01:30:00Z"},
+
+		{name: "leap second", zone: "UTC", date: "2016/12/31", time: "23:59:60", want: "2016-12-31T23:59:59.999999999Z"},
+		{name: "leap second with fraction", zone: "UTC", date: "2016/12/31", time: "23:59:60.500", want: "2016-12-31T23:59:59.999999999Z"},
+		{name: "leap second in local time", zone: "Europe/London", date: "2016/12/31", time: "23:59:60.000", want: "2016-12-31T23:59:59.999999999Z"},
+		{name: "sixty minutes", zone: "UTC", date: "2016/12/31", time: "23:60:00", wantErr: true},
+
+		{name: "time only", zone: "UTC", time: "10:00:00.000", ref: "2026-10-16T10:00:05Z", want: "2026-10-16T10:00:00Z"},
+		{name: "time only before midnight, ref after", zone: "UTC", time: "23:59:58.000", ref: "2026-10-17T00:00:05Z", want: "2026-10-16T23:59:58Z"},
+		{name: "time only after midnight, ref before", zone: "UTC", time: "00:00:02.000", ref: "2026-10-16T23:59:55Z", want: "2026-10-17T00:00:02Z"},
+		{name: "time only before local midnight", zone: "Europe/London", time: "23:59:58.000", ref: "2026-07-01T23:00:05Z", want: "2026-07-01T22:59:58Z"},
+		{name: "time only after local midnight", zone: "Europe/London", time: "00:00:02.000", ref: "2026-07-01T22:59:55Z", want: "2026-07-01T23:00:02Z"},
+		{name: "time only without ref", zone: "UTC", time: "10:00:00.000", wantErr: true},
+
+		{name: "invalid date", zone: "UTC", date: "2026/13/45", time: "10:00:00.000", wantErr: true},
+		{name: "invalid time", zone: "UTC", date: "2026/10/16", time: "25:61:61", wantErr: true},
+		{name: "empty", zone: "UTC", ref: "2026-10-16T10:00:00Z", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withSBSLocation(t, tt.zone)
+			got, err := sbsDateTime(tt.date, tt.time, utc(t, tt.ref))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("sbsDateTime(%q, %q) = %v, want an error", tt.date, tt.time, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("sbsDateTime(%q, %q): %v", tt.date, tt.time, err)
+			}
+			if want := utc(t, tt.want); !got.Equal(want) || got.Location() != time.UTC {
+				t.Errorf("sbsDateTime(%q, %q) = %v, want %v", tt.date, tt.time, got, want)
+			}
+		})
+	}
+}
+
+func TestSBSWallTime(t *testing.T) {
+	tests := []struct {
+		name string
+		zone string
+		wall string
+		ref  string
+		want string
+	}{
+		{name: "utc", zone: "UTC", wall: "2026-10-25T01:30:00Z", want: "2026-10-25T01:30:00Z"},
+		{name: "fall back without ref", zone: "Europe/London", wall: "2026-10-25T01:30:00Z", want: "2026-10-25T00:30:00Z"},
+		{name: "fall back ref before", zone: "Europe/London", wall: "2026-10-25T01:30:00Z", ref: "2026-10-24T20:00:00Z", want: "2026-10-25T00:30:00Z"},
+		{name: "fall back ref after", zone: "Europe/London", wall: "2026-10-25T01:30:00Z", ref: "2026-10-25T06:00:00Z", want: "2026-10-25T01:30:00Z"},
+		{name: "fall back first instant", zone: "Europe/London", wall: "2026-10-25T01:00:00Z", ref: "2026-10-25T01:00:00Z", want: "2026-10-25T01:00:00Z"},
+		{name: "spring forward gap", zone: "Europe/London", wall: "2026-03-29T01:30:00Z", want: "2026-03-29T01:30:00Z"},
+		{name: "new york fall back", zone: "America/New_York", wall: "2026-11-01T01:30:00Z", ref: "2026-11-01T06:31:00Z", want: "2026-11-01T06:30:00Z"},
+		{name: "new york fall back without ref", zone: "America/New_York", wall: "2026-11-01T01:30:00Z", want: "2026-11-01T05:30:00Z"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withSBSLocation(t, tt.zone)
+			w := utc(t, tt.wall)
+			y, m, d := w.Date()
+			got := sbsWallTime(y, m, d, w.Hour(), w.Minute(), w.Second(), w.Nanosecond(), utc(t, tt.ref))
+			if want := utc(t, tt.want); !got.Equal(want) {
+				t.Errorf("sbsWallTime(%s) = %v, want %v", tt.wall, got, want)
+			}
+		})
+	}
+}
+
+func TestFixMidnight(t *testing.T) {
+	tests := []struct {
+		name                      string
+		zone                      string
+		generated, logged, ref    string
+		wantGenerated, wantLogged string
+		wantFixed                 []string
+	}{
+		{
+			name:      "generated after midnight with the previous date",
+			zone:      "UTC",
+			generated: "2026-10-16T00:00:03Z", logged: "2026-10-17T00:00:03Z", ref: "2026-10-17T00:00:04Z",
+			wantGenerated: "2026-10-17T00:00:03Z", wantLogged: "2026-10-17T00:00:03Z",
+			wantFixed: []string{"generated"},
+		},
+		{
+			name:      "logged before midnight with the next date",
+			zone:      "UTC",
+			generated: "2026-10-16T23:59:58Z", logged: "2026-10-17T23:59:58Z", ref: "2026-10-16T23:59:59Z",
+			wantGenerated: "2026-10-16T23:59:58Z", wantLogged: "2026-10-16T23:59:58Z",
+			wantFixed: []string{"logged"},
+		},
+		{
+			name:      "both pairs a day off",
+			zone:      "UTC",
+			generated: "2026-10-16T00:00:01Z", logged: "2026-10-16T00:00:02Z", ref: "2026-10-17T00:00:05Z",
+			wantGenerated: "2026-10-17T00:00:01Z", wantLogged: "2026-10-17T00:00:02Z",
+			wantFixed: []string{"generated", "logged"},
+		},
+		{
+			name:      "logged against generated without ref",
+			zone:      "UTC",
+			generated: "2026-10-17T00:00:01Z", logged: "2026-10-16T00:00:02Z",
+			wantGenerated: "2026-10-17T00:00:01Z", wantLogged: "2026-10-17T00:00:02Z",
+			wantFixed: []string{"logged"},
+		},
+		{
+			name:      "local midnight",
+			zone:      "Europe/London",
+			generated: "2026-06-30T23:00:03Z", logged: "2026-07-01T23:00:03Z", ref: "2026-07-01T23:00:04Z",
+			wantGenerated: "2026-07-01T23:00:03Z", wantLogged: "2026-07-01T23:00:03Z",
+			wantFixed: []string{"generated"},
+		},
+		{
+			name:      "utc midnight is not local midnight",
+			zone:      "Europe/London",
+			generated: "2026-07-01T00:00:03Z", logged: "2026-07-02T00:00:03Z", ref: "2026-07-02T00:00:04Z",
+			wantGenerated: "2026-07-01T00:00:03Z", wantLogged: "2026-07-02T00:00:03Z",
+		},
+		{
+			name:      "a day off away from midnight",
+			zone:      "UTC",
+			generated: "2026-10-15T12:00:00Z", logged: "2026-10-16T12:00:00Z", ref: "2026-10-16T12:00:01Z",
+			wantGenerated: "2026-10-15T12:00:00Z", wantLogged: "2026-10-16T12:00:00Z",
+		},
+		{
+			name:      "outside the window",
+			zone:      "UTC",
+			generated: "2026-10-16T00:10:01Z", logged: "2026-10-17T00:10:01Z", ref: "2026-10-17T00:10:02Z",
+			wantGenerated: "2026-10-16T00:10:01Z", wantLogged: "2026-10-17T00:10:01Z",
+		},
+		{
+			name:      "two days off",
+			zone:      "UTC",
+			generated: "2026-10-15T00:00:03Z", ref: "2026-10-17T00:00:04Z",
+			wantGenerated: "2026-10-15T00:00:03Z",
+		},
+		{
+			name:      "in agreement across midnight",
+			zone:      "UTC",
+			generated: "2026-10-16T23:59:59Z", logged: "2026-10-17T00:00:01Z", ref: "2026-10-17T00:00:02Z",
+			wantGenerated: "2026-10-16T23:59:59Z", wantLogged: "2026-10-17T00:00:01Z",
+		},
+		{name: "no times", zone: "UTC", ref: "2026-10-17T00:00:02Z"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withSBSLocation(t, tt.zone)
+			ptr := func(s string) *time.Time {
+				if s == "" {
+					return nil
+				}
+				v := utc(t, s)
+				return &v
+			}
+			generated, logged := ptr(tt.generated), ptr(tt.logged)
+			fixed := fixMidnight(generated, logged, utc(t, tt.ref))
+			if !reflect.DeepEqual(fixed, tt.wantFixed) {
+				t.Errorf("fixed %v, want %v", fixed, tt.wantFixed)
+			}
+			for _, c := range []struct {
+				field string
+				got   *time.Time
+				want  string
+			}{{"generated", generated, tt.wantGenerated}, {"logged", logged, tt.wantLogged}} {
+				switch {
+				case c.got == nil && c.want != "":
+					t.Errorf("%s is nil, want %s", c.field, c.want)
+				case c.got != nil && !c.got.Equal(utc(t, c.want)):
+					t.Errorf("%s = %v, want %s", c.field, c.got, c.want)
+				}
+			}
+		})
+	}
+}
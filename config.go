@@ -0,0 +1,383 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// configFileKeys are the options whose effective value came from the
+// config file.
+var configFileKeys = map[string]bool{}
+
+// applyConfigFile reads the --config file and applies every setting in it
+// that was not given as a flag or environment variable. The file is a JSON
+// object keyed by flag name and is checked against the flag schema first:
+// unknown keys and values of the wrong type are rejected as a whole. Its
+// "pipelines" are kept in configPipelines.
+func applyConfigFile(c *cli.Context) error {
+	path := c.String("config")
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return newError(errConfig, fmt.Errorf("reading config file: %w", err))
+	}
+	var settings map[string]interface{}
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return configErrorf("parsing config file %s: %v", path, err)
+	}
+
+	flags := configFlags(c.App.Flags)
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var errs []error
+	values := map[string][]string{}
+	var pipelines map[string]pipelineSettings
+	for _, key := range keys {
+		if key == "pipelines" {
+			var perrs []error
+			pipelines, perrs = parsePipelines(path, settings[key], c.App.Flags)
+			errs = append(errs, perrs...)
+			continue
+		}
+		f, ok := flags[key]
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: unknown key %q%s", path, key, suggestKey(key, flags)))
+			continue
+		}
+		v, err := configValues(f, settings[key])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s: %w", path, key, err))
+			continue
+		}
+		values[key] = v
+	}
+	if len(errs) > 0 {
+		return newError(errConfig, errors.Join(errs...))
+	}
+	configPipelines = pipelines
+
+	for _, key := range keys {
+		// Flags and environment variables take precedence over the file.
+		if key == "pipelines" || c.IsSet(key) {
+			continue
+		}
+		for _, v := range values[key] {
+			if err := c.Set(key, v); err != nil {
+				return configErrorf("%s: %s: %v", path, key, err)
+			}
+		}
+		configFileKeys[key] = true
+	}
+	return nil
+}
+
+// configFlags returns the flags that can be set from a config file, by name.
+func configFlags(flags []cli.Flag) map[string]cli.Flag {
+	byName := map[string]cli.Flag{}
+	for _, f := range flags {
+		name := f.Names()[0]
+		if name == "config" || name == "help" {
+			continue
+		}
+		byName[name] = f
+	}
+	return byName
+}
+
+// configValues checks a config file value against the type of its flag and
+// returns it in the form the flag parses.
+func configValues(f cli.Flag, value interface{}) ([]string, error) {
+	switch f.(type) {
+	case *cli.StringFlag:
+		if s, ok := value.(string); ok {
+			return []string{s}, nil
+		}
+		return nil, errors.New("expected a string")
+	case *cli.IntFlag:
+		if n, ok := value.(float64); ok && n == math.Trunc(n) {
+			return []string{strconv.FormatInt(int64(n), 10)}, nil
+		}
+		return nil, errors.New("expected an integer")
+	case *cli.Float64Flag:
+		if n, ok := value.(float64); ok {
+			return []string{strconv.FormatFloat(n, 'g', -1, 64)}, nil
+		}
+		return nil, errors.New("expected a number")
+	case *cli.BoolFlag:
+		if b, ok := value.(bool); ok {
+			return []string{strconv.FormatBool(b)}, nil
+		}
+		return nil, errors.New("expected true or false")
+	case *cli.DurationFlag:
+		if s, ok := value.(string); ok {
+			if _, err := time.ParseDuration(s); err == nil {
+				return []string{s}, nil
+			}
+		}
+		return nil, errors.New(`expected a duration such as "90s" or "15m"`)
+	case *cli.StringSliceFlag:
+		if s, ok := value.(string); ok {
+			return []string{s}, nil
+		}
+		list, ok := value.([]interface{})
+		if !ok {
+			return nil, errors.New("expected a list of strings")
+		}
+		values := make([]string, len(list))
+		for i, item := range list {
+			s, ok := item.(string)
+			if !ok {
+				return nil, errors.New("expected a list of strings")
+			}
+			values[i] = s
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("%T cannot be set from a config file", f)
+}
+
+// suggestKey returns a "did you mean" hint naming the flag closest to an
+// unknown key, or nothing if no flag is close.
+func suggestKey(key string, flags map[string]cli.Flag) string {
+	normalized := strings.ReplaceAll(strings.ToLower(key), "-", "_")
+	best, bestDistance := "", len(key)/3+2
+	for name := range flags {
+		d := editDistance(normalized, name)
+		if d < bestDistance || (d == bestDistance && name < best) {
+			best, bestDistance = name, d
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return fmt.Sprintf(" (did you mean %q?)", best)
+}
+
+// editDistance is the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// warnLegacyEnv logs a deprecation notice for every option set through its
+// unprefixed environment variable rather than the ADSB_ one.
+func warnLegacyEnv(flags []cli.Flag) {
+	for _, f := range flags {
+		d, ok := f.(cli.DocGenerationFlag)
+		if !ok {
+			continue
+		}
+		envVars := d.GetEnvVars()
+		if len(envVars) < 2 {
+			continue
+		}
+		current := envVars[0]
+		legacy := strings.TrimPrefix(current, "ADSB_")
+		if _, set := os.LookupEnv(current); set {
+			continue
+		}
+		if _, set := os.LookupEnv(legacy); set {
+			log.Printf("%s is deprecated, set %s instead", legacy, current)
+		}
+	}
+}
+
+// configSource reports where the effective value of a flag came from.
+func configSource(c *cli.Context, f cli.Flag) string {
+	name := f.Names()[0]
+	switch {
+	case configFileKeys[name]:
+		return "file"
+	case onCommandLine(name):
+		return "flag"
+	case c.IsSet(name):
+		return "env"
+	}
+	return "default"
+}
+
+// onCommandLine reports whether a flag was given in the process arguments.
+func onCommandLine(name string) bool {
+	for _, arg := range os.Args[1:] {
+		if arg == "--" {
+			break
+		}
+		arg = strings.TrimLeft(arg, "-")
+		if arg == name || strings.HasPrefix(arg, name+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+// configCommand inspects the configuration without starting the collector.
+func configCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "config",
+		Usage: "Inspect the configuration merged from flags, environment variables and the config file.",
+		Subcommands: []*cli.Command{
+			{
+				Name:  "print-effective",
+				Usage: "Print every option with its effective value and where it came from. Secrets are masked.",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "json",
+						Usage: "Print the configuration as JSON.",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					return printEffectiveConfig(c, c.Bool("json"))
+				},
+			},
+			{
+				Name:  "schema",
+				Usage: "Print the JSON Schema of the config file, for editors and CI checks.",
+				Action: func(c *cli.Context) error {
+					data, err := json.MarshalIndent(configSchema(c.App.Flags), "", "  ")
+					if err != nil {
+						return err
+					}
+					_, err = fmt.Println(string(data))
+					return err
+				},
+			},
+		},
+	}
+}
+
+// effectiveSetting is one line of 'config print-effective'.
+type effectiveSetting struct {
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+// printEffectiveConfig prints the app options with their values and
+// sources. Lookups on c fall through to the app context, so this works from
+// a subcommand.
+func printEffectiveConfig(c *cli.Context, asJSON bool) error {
+	values := maskedConfig(c)
+
+	settings := map[string]effectiveSetting{}
+	names := make([]string, 0, len(values))
+	for name, f := range configFlags(c.App.Flags) {
+		settings[name] = effectiveSetting{Value: values[name], Source: configSource(c, f)}
+		names = append(names, name)
+	}
+	for name, p := range configPipelines {
+		for key, v := range p.values {
+			option := "pipelines." + name + "." + key
+			settings[option] = effectiveSetting{Value: maskedValue(key, strings.Join(v, ",")), Source: "file"}
+			names = append(names, option)
+		}
+	}
+	sort.Strings(names)
+
+	if asJSON {
+		data, err := json.MarshalIndent(settings, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Println(string(data))
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+	fmt.Fprintln(w, "OPTION\tVALUE\tSOURCE")
+	for _, name := range names {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", name, settings[name].Value, settings[name].Source)
+	}
+	return nil
+}
+
+// configSchema describes the config file as a JSON Schema derived from the
+// flags, so it cannot drift from what applyConfigFile accepts.
+func configSchema(flags []cli.Flag) map[string]interface{} {
+	properties := configSchemaProperties(configFlags(flags))
+	pipeline := configSchemaProperties(pipelineFlags(flags))
+	properties["pipelines"] = map[string]interface{}{
+		"description": "Named pipelines, each sending the messages that pass its filters to its own sinks.",
+		"type":        "object",
+		"additionalProperties": map[string]interface{}{
+			"type":                 "object",
+			"properties":           pipeline,
+			"additionalProperties": false,
+		},
+	}
+	return map[string]interface{}{
+		"$schema":              "http://json-schema.org/draft-07/schema#",
+		"title":                "adsb-go-dataset configuration",
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+}
+
+// configSchemaProperties describes flags as the properties of a JSON
+// Schema.
+func configSchemaProperties(flags map[string]cli.Flag) map[string]interface{} {
+	properties := map[string]interface{}{}
+	for name, f := range flags {
+		property := map[string]interface{}{}
+		if d, ok := f.(cli.DocGenerationFlag); ok {
+			property["description"] = d.GetUsage()
+		}
+		switch f.(type) {
+		case *cli.StringFlag:
+			property["type"] = "string"
+		case *cli.IntFlag:
+			property["type"] = "integer"
+		case *cli.Float64Flag:
+			property["type"] = "number"
+		case *cli.BoolFlag:
+			property["type"] = "boolean"
+		case *cli.DurationFlag:
+			property["type"] = "string"
+			property["pattern"] = `^([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+$`
+		case *cli.StringSliceFlag:
+			property["oneOf"] = []interface{}{
+				map[string]string{"type": "string"},
+				map[string]interface{}{"type": "array", "items": map[string]string{"type": "string"}},
+			}
+		}
+		properties[name] = property
+	}
+	return properties
+}
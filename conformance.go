@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// conformanceCorpus holds real-world SBS-1 oddities (one case per .sbs file)
+// together with the parser output expected for them (the matching .golden).
+//
+//go:embed conformance
+var conformanceCorpus embed.FS
+
+// conformanceEpoch seeds the recorded clock so lines without a generated or
+// logged date still get a stable timestamp.
+var conformanceEpoch = time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// conformanceResult is the golden representation of one parsed input line.
+type conformanceResult struct {
+	Line        string       `json:"line"`
+	OK          bool         `json:"ok"`
+	StrictError string       `json:"strict_error,omitempty"`
+	Message     *SBS1Message `json:"message,omitempty"`
+}
+
+// selftestCommand validates the parser against the conformance corpus.
+func selftestCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "selftest",
+		Usage: "Run the parser against the SBS-1 conformance corpus and report any deviations from the golden files.",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "corpus",
+				Usage: "Read the corpus from this directory instead of the copy built into the binary.",
+			},
+			&cli.BoolFlag{
+				Name:  "update",
+				Usage: "Rewrite the golden files in --corpus from the current parser output.",
+			},
+			&cli.IntFlag{
+				Name:  "fuzz",
+				Usage: "After the corpus, run this many randomly mutated corpus lines through both parser modes.",
+			},
+			&cli.Int64Flag{
+				Name:  "seed",
+				Usage: "Seed for --fuzz. Defaults to the current time; the seed is logged so failures can be reproduced.",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			var corpus fs.FS
+			if dir := c.String("corpus"); dir != "" {
+				corpus = os.DirFS(dir)
+			} else if c.Bool("update") {
+				return fmt.Errorf("--update needs --corpus pointing at the conformance directory to rewrite")
+			} else {
+				sub, err := fs.Sub(conformanceCorpus, "conformance")
+				if err != nil {
+					return err
+				}
+				corpus = sub
+			}
+
+			failed, err := runConformance(corpus, c.String("corpus"), c.Bool("update"))
+			if err != nil {
+				return err
+			}
+			if n := c.Int("fuzz"); n > 0 {
+				seed := c.Int64("seed")
+				if !c.IsSet("seed") {
+					seed = time.Now().UnixNano()
+				}
+				fuzzFailed, err := fuzzParser(corpus, n, seed)
+				if err != nil {
+					return err
+				}
+				failed += fuzzFailed
+			}
+			if failed > 0 {
+				return fmt.Errorf("%d conformance case(s) failed", failed)
+			}
+			return nil
+		},
+	}
+}
+
+// runConformance parses every case in corpus and compares the output with its
+// golden file, returning the number of failing cases. With update set, golden
+// files are rewritten in dir instead of compared.
+func runConformance(corpus fs.FS, dir string, update bool) (int, error) {
+	cases, err := fs.Glob(corpus, "*.sbs")
+	if err != nil {
+		return 0, err
+	}
+	if len(cases) == 0 {
+		return 0, fmt.Errorf("no conformance cases found")
+	}
+	sort.Strings(cases)
+
+	// The goldens hold the output of the default pipeline, whatever the
+	// flags of this run.
+	saved := clock
+	savedMode, savedCase, savedCallsign := PARSE_MODE, ICAO24_CASE, CALLSIGN_FORMAT
+	defer func() {
+		clock = saved
+		PARSE_MODE, ICAO24_CASE, CALLSIGN_FORMAT = savedMode, savedCase, savedCallsign
+	}()
+	PARSE_MODE, ICAO24_CASE, CALLSIGN_FORMAT = "lenient", "lower", "clean"
+
+	failed := 0
+	for _, name := range cases {
+		input, err := fs.ReadFile(corpus, name)
+		if err != nil {
+			return failed, err
+		}
+		clock = &recordedClock{now: conformanceEpoch}
+		got, err := conformanceOutput(input)
+		if err != nil {
+			return failed, fmt.Errorf("%s: %w", name, err)
+		}
+
+		golden := strings.TrimSuffix(name, path.Ext(name)) + ".golden"
+		if update {
+			if err := os.WriteFile(filepath.Join(dir, golden), got, 0o644); err != nil {
+				return failed, err
+			}
+			log.Printf("UPDATED %s", golden)
+			continue
+		}
+
+		want, err := fs.ReadFile(corpus, golden)
+		if err != nil {
+			log.Printf("FAIL %s: %v", name, err)
+			failed++
+			continue
+		}
+		if line, ok := firstDifference(want, got); !ok {
+			log.Printf("FAIL %s: output differs from %s at line %d", name, golden, line)
+			failed++
+			continue
+		}
+		log.Printf("PASS %s", name)
+	}
+	return failed, nil
+}
+
+// conformanceOutput parses each line of input as the feed reader does and
+// renders the results in golden file form.
+func conformanceOutput(input []byte) ([]byte, error) {
+	results := []conformanceResult{}
+	scanner := bufio.NewScanner(bytes.NewReader(input))
+	for scanner.Scan() {
+		line := scanner.Text()
+		result := conformanceResult{Line: line}
+		if msg, ok := parseLineAs("sbs", line); ok {
+			result.OK = true
+			result.Message = &msg
+		}
+		if _, err := ParseStrict(line); err != nil {
+			result.StrictError = err.Error()
+		}
+		results = append(results, result)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	out, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(out, '\n'), nil
+}
+
+// firstDifference compares two golden renderings line by line and returns
+// the first differing line number, or ok when they are identical.
+func firstDifference(want, got []byte) (int, bool) {
+	if bytes.Equal(want, got) {
+		return 0, true
+	}
+	wantLines := bytes.Split(want, []byte("\n"))
+	gotLines := bytes.Split(got, []byte("\n"))
+	for i := 0; i < len(wantLines) && i < len(gotLines); i++ {
+		if !bytes.Equal(wantLines[i], gotLines[i]) {
+			return i + 1, false
+		}
+	}
+	if len(wantLines) < len(gotLines) {
+		return len(wantLines) + 1, false
+	}
+	return len(gotLines) + 1, false
+}
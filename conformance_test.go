@@ -0,0 +1,20 @@
+package main
+
+import (
+	"io/fs"
+	"testing"
+)
+
+func TestConformance(t *testing.T) {
+	corpus, err := fs.Sub(conformanceCorpus, "conformance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed, err := runConformance(corpus, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failed > 0 {
+		t.Errorf("%d conformance case(s) differ from their golden files; rerun selftest --update --corpus conformance after checking the change is intended", failed)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// errStopped is returned while waiting for the feed when a shutdown signal
+// arrives first.
+var errStopped = errors.New("stopped before the feed was reached")
+
+// inContainer reports whether the collector runs in a Docker, Podman or
+// Kubernetes container.
+func inContainer() bool {
+	for _, marker := range []string{"/.dockerenv", "/run/.containerenv"} {
+		if _, err := os.Stat(marker); err == nil {
+			return true
+		}
+	}
+	return os.Getenv("KUBERNETES_SERVICE_HOST") != ""
+}
+
+// configureLogging applies LOG_FORMAT. In 'auto' mode logs are JSON on
+// stdout inside a container and plain text on stderr elsewhere. JSON logs
+// go to stderr instead when the stdout sink is on.
+func configureLogging(format string) error {
+	switch format {
+	case "auto":
+		if !inContainer() {
+			return nil
+		}
+	case "text":
+		return nil
+	case "json":
+	default:
+		return configErrorf("log_format must be 'auto', 'text' or 'json', got %q", format)
+	}
+	log.SetFlags(0)
+	log.SetOutput(jsonLogWriter{})
+	return nil
+}
+
+// jsonLogWriter turns each line written by the log package into a JSON
+// object on logOutput.
+type jsonLogWriter struct{}
+
+func (jsonLogWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimSuffix(string(p), "\n")
+	level := "info"
+	switch {
+	case strings.HasPrefix(msg, "Fatal"):
+		level = "fatal"
+	case strings.HasPrefix(msg, "Error"), strings.HasPrefix(msg, "Recovered panic"):
+		level = "error"
+	}
+	line, err := json.Marshal(map[string]string{
+		"time":  time.Now().UTC().Format(time.RFC3339Nano),
+		"level": level,
+		"msg":   msg,
+	})
+	if err != nil {
+		return 0, err
+	}
+	if _, err := logOutput().Write(append(line, '\n')); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// dialFeed connects to addr, retrying with backoff for up to wait so the
+// collector can start before dump1090 does. It gives up early with
+// errStopped once stop is closed.
+func dialFeed(addr string, wait time.Duration, stop <-chan struct{}) (net.Conn, error) {
+	var conn net.Conn
+	err := waitForFeed(addr, wait, stop, func() (err error) {
+		conn, err = net.DialTimeout("tcp", addr, 10*time.Second)
+		return err
+	})
+	return conn, err
+}
+
+// waitForFeed calls try until it succeeds, retrying with backoff for up to
+// wait. It gives up early with errStopped once stop is closed.
+func waitForFeed(addr string, wait time.Duration, stop <-chan struct{}, try func() error) error {
+	deadline := time.Now().Add(wait)
+	backoff := time.Second
+	for {
+		err := try()
+		if err == nil {
+			return nil
+		}
+		if time.Now().Add(backoff).After(deadline) {
+			return newError(errConnect, fmt.Errorf("connecting to DUMP1090: %w", err))
+		}
+		log.Printf("Waiting for DUMP1090 at %s: %v", addr, err)
+		select {
+		case <-time.After(backoff):
+		case <-stop:
+			return errStopped
+		}
+		if backoff < 10*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+// healthcheckCommand checks a running collector over its control socket and
+// exits non-zero when it is unhealthy, for Docker HEALTHCHECK.
+func healthcheckCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "healthcheck",
+		Usage: "Exit 0 if the collector behind the control socket is reading data, 1 otherwise. Meant for Docker HEALTHCHECK.",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "socket",
+				Usage: "Path of the collector's control socket. Defaults to control_socket.",
+			},
+			&cli.DurationFlag{
+				Name:  "max_silence",
+				Value: 2 * time.Minute,
+				Usage: "Report unhealthy when no line was read for this long, or when none was read this long after start.",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			socket := c.String("socket")
+			if socket == "" {
+				socket = CONTROL_SOCKET
+			}
+			if socket == "" {
+				return configErrorf("no control socket given. Use --socket or set ADSB_CONTROL_SOCKET to the path the collector was started with")
+			}
+			// Health check failures must exit with 1, whatever their cause.
+			body, err := controlRequest(socket, "GET", "/health")
+			if err != nil {
+				return fmt.Errorf("unhealthy: %v", err)
+			}
+			var st healthStatus
+			if err := json.Unmarshal(body, &st); err != nil {
+				return fmt.Errorf("unhealthy: %v", err)
+			}
+			if !st.Healthy(time.Now(), c.Duration("max_silence")) {
+				last := "nothing read yet"
+				if st.LastRead != nil {
+					last = fmt.Sprintf("last line read %s ago", time.Since(*st.LastRead).Round(time.Second))
+				}
+				return fmt.Errorf("unhealthy: connected=%t, %s", st.Connected, last)
+			}
+			fmt.Println("healthy")
+			return nil
+		},
+	}
+}
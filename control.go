@@ -0,0 +1,349 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errNoArchive = errors.New("archiving is not enabled, set archive_dir")
+	errNoAlerts  = errors.New("alerting is not enabled, set alert_rules or rules_webhook_listen")
+	errNotFound  = errors.New("not found")
+)
+
+// controlServer is the local operator API for maintenance windows and
+// incidents: pausing and resuming uploads, flipping the runtime toggles,
+// rotating the raw archive and inspecting the tracker. Toggle changes are
+// logged and sent to DataSet as AUDIT events.
+type controlServer struct {
+	token    string
+	uploader *uploader
+	tracker  *Tracker
+	archive  *archive
+	alerter  *Alerter
+	flush    chan<- chan int
+	audits   chan<- SBS1Message
+	health   *feedHealth
+	started  time.Time
+}
+
+// controlStatus is returned by GET /status.
+type controlStatus struct {
+	Version        string    `json:"version"`
+	Started        time.Time `json:"started"`
+	Paused         bool      `json:"paused"`
+	SpooledBatches int       `json:"spooled_batches"`
+	Aircraft       int       `json:"aircraft"`
+	Vehicles       int       `json:"vehicles,omitempty"`
+	Obstacles      int       `json:"obstacles,omitempty"`
+	Archive        string    `json:"archive,omitempty"`
+	DisabledSinks  []string  `json:"disabled_sinks,omitempty"`
+	SampleRate     float64   `json:"sample_rate"`
+	AlertsMuted    string    `json:"alerts_muted,omitempty"`
+	// PositionHistory is the memory taken by the tracker's position
+	// histories.
+	PositionHistory PositionHistoryUsage `json:"position_history"`
+}
+
+// routes returns the endpoints of the control API.
+func (s *controlServer) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", s.get(s.status))
+	mux.HandleFunc("/aircraft", s.get(s.aircraft))
+	mux.HandleFunc("/aircraft/", s.getRequest(s.aircraftPositions))
+	mux.HandleFunc("/positions", s.get(s.positions))
+	mux.HandleFunc("/health", s.get(s.healthStatus))
+	mux.HandleFunc("/pause", s.post(s.pause))
+	mux.HandleFunc("/resume", s.post(s.resume))
+	mux.HandleFunc("/flush", s.post(s.flushBatch))
+	mux.HandleFunc("/archive/rotate", s.post(s.rotateArchive))
+	mux.HandleFunc("/sinks/", s.postRequest(s.toggleSink))
+	mux.HandleFunc("/sampling", s.postRequest(s.setSampling))
+	mux.HandleFunc("/alerts/mute", s.postRequest(s.muteAlerts))
+	mux.HandleFunc("/alerts/unmute", s.postRequest(s.unmuteAlerts))
+	return mux
+}
+
+// serve runs the control API on a TCP addr in the background. Every request
+// must carry the bearer token.
+func (s *controlServer) serve(addr string) {
+	go func() {
+		log.Printf("Serving control API on %s", addr)
+		if err := http.ListenAndServe(addr, s.authenticate(s.routes())); err != nil {
+			log.Println("Control API stopped:", err)
+		}
+	}()
+}
+
+// serveSocket runs the control API on a unix socket in the background.
+// Access is governed by the socket's file permissions, which only allow the
+// user running the collector, so no token is needed. The socket is created
+// in a directory only that user can enter and renamed into place once it is
+// 0600, so it cannot be connected to in between.
+func (s *controlServer) serveSocket(path string) error {
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".control-")
+	if err != nil {
+		return fmt.Errorf("creating control socket: %w", err)
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "sock")
+	l, err := net.Listen("unix", tmp)
+	if err != nil {
+		return fmt.Errorf("listening on control socket: %w", err)
+	}
+	// The socket is removed from path on exit, not from where it was
+	// created.
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err := os.Chmod(tmp, 0o600); err != nil {
+		l.Close()
+		return err
+	}
+	// Renaming replaces a stale socket left by a collector that crashed.
+	if err := os.Rename(tmp, path); err != nil {
+		l.Close()
+		return fmt.Errorf("creating control socket: %w", err)
+	}
+	go func() {
+		log.Printf("Serving control API on unix socket %s", path)
+		if err := http.Serve(l, s.routes()); err != nil {
+			log.Println("Control socket stopped:", err)
+		}
+	}()
+	return nil
+}
+
+func (s *controlServer) authenticate(next http.Handler) http.Handler {
+	return requireToken(s.token, next)
+}
+
+// requireToken rejects requests without the bearer token.
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *controlServer) get(fn func() (interface{}, error)) http.HandlerFunc {
+	return s.method(http.MethodGet, func(*http.Request) (interface{}, error) { return fn() })
+}
+
+// getRequest is get for endpoints that read the request.
+func (s *controlServer) getRequest(fn func(*http.Request) (interface{}, error)) http.HandlerFunc {
+	return s.method(http.MethodGet, fn)
+}
+
+func (s *controlServer) post(fn func() (interface{}, error)) http.HandlerFunc {
+	return s.method(http.MethodPost, func(*http.Request) (interface{}, error) { return fn() })
+}
+
+// postRequest is post for endpoints that read the request.
+func (s *controlServer) postRequest(fn func(*http.Request) (interface{}, error)) http.HandlerFunc {
+	return s.method(http.MethodPost, fn)
+}
+
+func (s *controlServer) method(method string, fn func(*http.Request) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		v, err := fn(r)
+		switch {
+		case errors.Is(err, errInvalidToggle):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case errors.Is(err, errNoArchive), errors.Is(err, errNoAlerts):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case errors.Is(err, errNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	}
+}
+
+func (s *controlServer) status() (interface{}, error) {
+	spooled, err := s.uploader.spool.Files()
+	if err != nil {
+		return nil, err
+	}
+	st := controlStatus{
+		Version:        version,
+		Started:        s.started,
+		Paused:         s.uploader.Paused(),
+		SpooledBatches: len(spooled),
+	}
+	st.Aircraft, st.Vehicles, st.Obstacles = s.tracker.Counts()
+	st.PositionHistory = s.tracker.HistoryUsage()
+	if s.archive != nil {
+		st.Archive = s.archive.Current()
+	}
+	st.DisabledSinks = toggles.Disabled()
+	st.SampleRate = toggles.SampleRate()
+	if s.alerter != nil {
+		if muted, until := s.alerter.Muted(); muted {
+			st.AlertsMuted = formatMuteUntil(until)
+		}
+	}
+	return st, nil
+}
+
+func (s *controlServer) healthStatus() (interface{}, error) {
+	return s.health.Status(), nil
+}
+
+func (s *controlServer) aircraft() (interface{}, error) {
+	return s.tracker.Snapshot(), nil
+}
+
+// aircraftPositions handles GET /aircraft/{icao24}/positions.
+func (s *controlServer) aircraftPositions(r *http.Request) (interface{}, error) {
+	icao24, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/aircraft/"), "/")
+	if rest != "positions" {
+		return nil, fmt.Errorf("%w: expected /aircraft/{icao24}/positions", errNotFound)
+	}
+	icao24 = normalizeICAO24(icao24, ICAO24_CASE)
+	positions, ok := s.tracker.Positions(icao24)
+	if !ok {
+		return nil, fmt.Errorf("%w: aircraft %s is not tracked", errNotFound, icao24)
+	}
+	return aircraftPositions{Icao24: icao24, Positions: positions}, nil
+}
+
+// positions handles GET /positions.
+func (s *controlServer) positions() (interface{}, error) {
+	return sortedPositions(s.tracker.AllPositions()), nil
+}
+
+func (s *controlServer) pause() (interface{}, error) {
+	s.uploader.Pause()
+	return s.status()
+}
+
+func (s *controlServer) resume() (interface{}, error) {
+	s.uploader.Resume()
+	return s.status()
+}
+
+func (s *controlServer) flushBatch() (interface{}, error) {
+	reply := make(chan int, 1)
+	select {
+	case s.flush <- reply:
+	case <-time.After(5 * time.Second):
+		return nil, errors.New("pipeline did not accept the flush request")
+	}
+	return map[string]int{"flushed": <-reply}, nil
+}
+
+func (s *controlServer) rotateArchive() (interface{}, error) {
+	if s.archive == nil {
+		return nil, errNoArchive
+	}
+	closed, err := s.archive.Rotate()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"closed": closed, "current": s.archive.Current()}, nil
+}
+
+// toggleSink handles POST /sinks/{name}/enable and /sinks/{name}/disable.
+func (s *controlServer) toggleSink(r *http.Request) (interface{}, error) {
+	sink, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/sinks/"), "/")
+	if action != "enable" && action != "disable" {
+		return nil, fmt.Errorf("%w: expected /sinks/{name}/enable or /sinks/{name}/disable", errInvalidToggle)
+	}
+	changed, err := toggles.SetEnabled(sink, action == "enable")
+	if err != nil {
+		return nil, err
+	}
+	if changed {
+		s.audit(r, ToggleAudit{Action: action, Toggle: "sink " + strings.ToLower(sink)})
+	}
+	return s.status()
+}
+
+// setSampling handles POST /sampling?rate=R.
+func (s *controlServer) setSampling(r *http.Request) (interface{}, error) {
+	rate, err := strconv.ParseFloat(r.URL.Query().Get("rate"), 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: rate must be a number between 0 and 1", errInvalidToggle)
+	}
+	previous, err := toggles.SetSampleRate(rate)
+	if err != nil {
+		return nil, err
+	}
+	if rate != previous {
+		s.audit(r, ToggleAudit{Action: "set", Toggle: "sample_rate", Value: strconv.FormatFloat(rate, 'g', -1, 64), Previous: strconv.FormatFloat(previous, 'g', -1, 64)})
+	}
+	return s.status()
+}
+
+// muteAlerts handles POST /alerts/mute, optionally ?for=DURATION.
+func (s *controlServer) muteAlerts(r *http.Request) (interface{}, error) {
+	if s.alerter == nil {
+		return nil, errNoAlerts
+	}
+	var until time.Time
+	if v := r.URL.Query().Get("for"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("%w: for must be a positive duration such as 30m", errInvalidToggle)
+		}
+		until = clock.Now().Add(d)
+	}
+	audit := ToggleAudit{Action: "mute", Toggle: "alerts", Value: formatMuteUntil(until)}
+	if previous, was := s.alerter.Mute(until); was {
+		audit.Previous = formatMuteUntil(previous)
+	}
+	s.audit(r, audit)
+	return s.status()
+}
+
+// unmuteAlerts handles POST /alerts/unmute.
+func (s *controlServer) unmuteAlerts(r *http.Request) (interface{}, error) {
+	if s.alerter == nil {
+		return nil, errNoAlerts
+	}
+	if s.alerter.Unmute() {
+		s.audit(r, ToggleAudit{Action: "unmute", Toggle: "alerts"})
+	}
+	return s.status()
+}
+
+// audit logs a toggle change and hands its AUDIT event to the main loop.
+func (s *controlServer) audit(r *http.Request, a ToggleAudit) {
+	// Requests over the control socket have no address.
+	a.Remote = remoteHost(r)
+	if a.Remote == "" || a.Remote == "@" {
+		a.Remote = "control socket"
+	}
+	a.UserAgent = r.UserAgent()
+	log.Printf("Toggle changed: %s", toggleAuditText(&a))
+	msg := SBS1Message{Timestamp: formatTimestamp(clock.Now()), MessageType: "AUDIT", ToggleAudit: &a}
+	select {
+	case s.audits <- msg:
+	case <-time.After(5 * time.Second):
+		log.Printf("Dropped the audit event for toggle %s: pipeline did not accept it", a.Toggle)
+	}
+}
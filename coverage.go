@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CoverageSLA is the traffic a healthy receiver is expected to see per
+// interval. Missing it for Consecutive intervals in a row raises an alert,
+// which catches failing antennas and coax before the data visibly thins.
+type CoverageSLA struct {
+	Name        string  `json:"name"`
+	Interval    string  `json:"interval"`
+	ActiveHours []int   `json:"active_hours,omitempty"`
+	MinAircraft int     `json:"min_aircraft,omitempty"`
+	MinRangeNM  float64 `json:"min_range_nm,omitempty"`
+	Consecutive int     `json:"consecutive,omitempty"`
+
+	interval time.Duration
+}
+
+// loadCoverageSLAs reads a JSON array of SLAs from path.
+func loadCoverageSLAs(path string) ([]*CoverageSLA, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var slas []*CoverageSLA
+	if err := json.Unmarshal(data, &slas); err != nil {
+		return nil, fmt.Errorf("parsing coverage SLAs %s: %w", path, err)
+	}
+	for i, sla := range slas {
+		if sla.Name == "" {
+			return nil, fmt.Errorf("coverage SLA %d has no name", i+1)
+		}
+		if sla.interval, err = time.ParseDuration(sla.Interval); err != nil || sla.interval < time.Minute {
+			return nil, fmt.Errorf("coverage SLA %q needs an interval of at least 1m, e.g. \"1h\"", sla.Name)
+		}
+		if sla.MinAircraft <= 0 && sla.MinRangeNM <= 0 {
+			return nil, fmt.Errorf("coverage SLA %q sets neither min_aircraft nor min_range_nm", sla.Name)
+		}
+		if len(sla.ActiveHours) != 0 && (len(sla.ActiveHours) != 2 || sla.ActiveHours[0] < 0 || sla.ActiveHours[1] > 24) {
+			return nil, fmt.Errorf("coverage SLA %q: active_hours must be [from, to] local hours, e.g. [7, 21]", sla.Name)
+		}
+		if sla.Consecutive < 1 {
+			sla.Consecutive = 1
+		}
+	}
+	return slas, nil
+}
+
+// active reports whether the SLA applies to an interval starting at t.
+func (sla *CoverageSLA) active(t time.Time) bool {
+	if len(sla.ActiveHours) != 2 {
+		return true
+	}
+	h, from, to := t.Local().Hour(), sla.ActiveHours[0], sla.ActiveHours[1]
+	if from <= to {
+		return h >= from && h < to
+	}
+	return h >= from || h < to // spans midnight
+}
+
+// CoverageReport describes an interval in which an SLA was missed.
+type CoverageReport struct {
+	SLA        string    `json:"sla"`
+	Start      time.Time `json:"start"`
+	End        time.Time `json:"end"`
+	Aircraft   int       `json:"aircraft"`
+	MaxRangeNM float64   `json:"max_range_nm"`
+	Misses     int       `json:"misses"`
+	Reasons    []string  `json:"reasons"`
+}
+
+// coverageState is the progress of one SLA through its current interval.
+type coverageState struct {
+	start    time.Time
+	aircraft map[string]bool
+	maxRange float64
+	misses   int
+}
+
+// coverageMonitor measures aircraft counts and range per SLA interval.
+type coverageMonitor struct {
+	slas      []*CoverageSLA
+	alerter   *Alerter
+	lat, lon  float64
+	hasOrigin bool
+
+	mu     sync.Mutex
+	states []*coverageState
+}
+
+// newCoverageMonitor starts checking interval boundaries in the background,
+// so an interval in which nothing at all is heard is still judged.
+func newCoverageMonitor(slas []*CoverageSLA, alerter *Alerter, lat, lon float64, hasOrigin bool) *coverageMonitor {
+	m := &coverageMonitor{slas: slas, alerter: alerter, lat: lat, lon: lon, hasOrigin: hasOrigin}
+	for range slas {
+		m.states = append(m.states, &coverageState{aircraft: map[string]bool{}})
+	}
+	safeGo("coverage", true, func() {
+		for range time.Tick(10 * time.Second) {
+			m.Tick(clock.Now())
+		}
+	})
+	return m
+}
+
+// Observe records an aircraft update. Range is measured from the fixed
+// receiver location, or from the receiver's GPS position when it moves.
+// Ghosts, surface vehicles and obstacles do not count.
+func (m *coverageMonitor) Observe(a Aircraft, receiver *ReceiverPosition) {
+	if a.Ghost || a.Kind != "" {
+		return
+	}
+	now := clock.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tickLocked(now)
+
+	rangeNM := -1.0
+	switch {
+	case !a.HasPosition():
+	case receiver != nil:
+		rangeNM = distanceNM(receiver.Lat, receiver.Lon, float64(a.Lat), float64(a.Lon))
+	case m.hasOrigin:
+		rangeNM = distanceNM(m.lat, m.lon, float64(a.Lat), float64(a.Lon))
+	}
+	for _, st := range m.states {
+		st.aircraft[a.Icao24] = true
+		if rangeNM > st.maxRange {
+			st.maxRange = rangeNM
+		}
+	}
+}
+
+// Tick closes every interval that has ended.
+func (m *coverageMonitor) Tick(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tickLocked(now)
+}
+
+func (m *coverageMonitor) tickLocked(now time.Time) {
+	for i, sla := range m.slas {
+		st := m.states[i]
+		current := now.Truncate(sla.interval)
+		if st.start.IsZero() {
+			// The first interval is partial, so it is not judged.
+			st.start = current
+			continue
+		}
+		if !current.After(st.start) {
+			continue
+		}
+		m.judgeLocked(sla, st, st.start.Add(sla.interval))
+		st.start, st.aircraft, st.maxRange = current, map[string]bool{}, 0
+	}
+}
+
+// judgeLocked checks a finished interval against its SLA.
+func (m *coverageMonitor) judgeLocked(sla *CoverageSLA, st *coverageState, end time.Time) {
+	if !sla.active(st.start) {
+		return
+	}
+	var reasons []string
+	if sla.MinAircraft > 0 && len(st.aircraft) < sla.MinAircraft {
+		reasons = append(reasons, fmt.Sprintf("%d aircraft, expected at least %d", len(st.aircraft), sla.MinAircraft))
+	}
+	if sla.MinRangeNM > 0 && st.maxRange < sla.MinRangeNM {
+		reasons = append(reasons, fmt.Sprintf("max range %.1f nm, expected at least %.0f nm", st.maxRange, sla.MinRangeNM))
+	}
+	if len(reasons) == 0 {
+		st.misses = 0
+		return
+	}
+	st.misses++
+	log.Printf("Coverage SLA %s missed (%d in a row): %s", sla.Name, st.misses, strings.Join(reasons, "; "))
+	// Alert once when the run of misses reaches the threshold; the SLA
+	// re-arms after an interval that meets it.
+	if st.misses == sla.Consecutive {
+		m.alerter.Raise(Alert{Rule: sla.Name, Time: end, Coverage: &CoverageReport{
+			SLA: sla.Name, Start: st.start, End: end, Aircraft: len(st.aircraft),
+			MaxRangeNM: st.maxRange, Misses: st.misses, Reasons: reasons,
+		}})
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// recentLineCount is how many raw feed lines a crash bundle includes.
+const recentLineCount = 200
+
+// ringBuffer keeps the last few lines read from the feed.
+type ringBuffer struct {
+	mu    sync.Mutex
+	lines []string
+	next  int
+}
+
+func newRingBuffer(size int) *ringBuffer {
+	return &ringBuffer{lines: make([]string, 0, size)}
+}
+
+// Add appends a line, dropping the oldest when full.
+func (r *ringBuffer) Add(line string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.lines) < cap(r.lines) {
+		r.lines = append(r.lines, line)
+		return
+	}
+	r.lines[r.next] = line
+	r.next = (r.next + 1) % len(r.lines)
+}
+
+// Lines returns the buffered lines, oldest first.
+func (r *ringBuffer) Lines() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append(append([]string(nil), r.lines[r.next:]...), r.lines[:r.next]...)
+}
+
+var (
+	// recentLines feeds the crash bundle with what was being processed.
+	recentLines = newRingBuffer(recentLineCount)
+	// configSnapshot is the effective configuration with secrets masked,
+	// captured at startup for crash bundles.
+	configSnapshot map[string]string
+)
+
+// secretFlags are masked wherever the configuration is shown.
+var secretFlags = []string{"token", "password", "secret", "api_key"}
+
+// maskedConfig returns every option of the app and its effective value,
+// with secrets replaced by asterisks.
+func maskedConfig(c *cli.Context) map[string]string {
+	config := map[string]string{}
+	for name := range configFlags(c.App.Flags) {
+		value := fmt.Sprint(c.Value(name))
+		if v, ok := c.Value(name).(cli.StringSlice); ok {
+			value = strings.Join(v.Value(), ",")
+		}
+		config[name] = maskedValue(name, value)
+	}
+	return config
+}
+
+// maskedValue returns value, or asterisks when option name holds a secret.
+func maskedValue(name, value string) string {
+	for _, secret := range secretFlags {
+		if strings.Contains(name, secret) && value != "" {
+			return "********"
+		}
+	}
+	return value
+}
+
+// crashBundle is written to CRASH_DIR when a goroutine panics.
+type crashBundle struct {
+	Time        time.Time         `json:"time"`
+	Version     string            `json:"version"`
+	GoVersion   string            `json:"go_version"`
+	Goroutine   string            `json:"goroutine"`
+	Panic       string            `json:"panic"`
+	Stack       string            `json:"stack"`
+	Config      map[string]string `json:"config"`
+	RecentLines []string          `json:"recent_lines"`
+}
+
+// writeCrashBundle saves everything needed for a bug report and returns the
+// path of the bundle.
+func writeCrashBundle(where string, value interface{}, stack []byte) (string, error) {
+	if CRASH_DIR == "" {
+		return "", nil
+	}
+	if err := os.MkdirAll(CRASH_DIR, 0o755); err != nil {
+		return "", err
+	}
+	bundle := crashBundle{
+		Time:        time.Now().UTC(),
+		Version:     version,
+		GoVersion:   runtime.Version(),
+		Goroutine:   where,
+		Panic:       fmt.Sprint(value),
+		Stack:       string(stack),
+		Config:      configSnapshot,
+		RecentLines: recentLines.Lines(),
+	}
+	data, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(CRASH_DIR, fmt.Sprintf("crash-%s-%s.json", bundle.Time.Format("20060102T150405.000Z"), where))
+	return path, os.WriteFile(path, data, 0o600)
+}
+
+// reportPanic records a recovered panic: it is logged, counted and written
+// as a crash bundle.
+func reportPanic(where string, value interface{}) {
+	stack := debug.Stack()
+	metricPanics.Inc(where)
+	log.Printf("Recovered panic in %s: %v", where, value)
+	path, err := writeCrashBundle(where, value, stack)
+	switch {
+	case err != nil:
+		log.Println("Error writing crash bundle:", err)
+	case path != "":
+		log.Printf("Wrote crash bundle %s, please attach it to a bug report", path)
+	}
+}
+
+// safeGo runs fn in a goroutine and reports any panic in it. With restart
+// set, fn is started again a second later, for workers that hold no state
+// that a panic could have left inconsistent.
+func safeGo(where string, restart bool, fn func()) {
+	go func() {
+		for {
+			panicked := func() (panicked bool) {
+				defer func() {
+					if v := recover(); v != nil {
+						reportPanic(where, v)
+						panicked = true
+					}
+				}()
+				fn()
+				return false
+			}()
+			if !panicked || !restart {
+				return
+			}
+			time.Sleep(time.Second)
+		}
+	}()
+}
+
+// crashOnPanic writes a crash bundle for a panic on the main goroutine
+// before letting it terminate the process.
+func crashOnPanic() {
+	if v := recover(); v != nil {
+		reportPanic("main", v)
+		panic(v)
+	}
+}
+
+var metricPanics = newCounter("adsb_panics_total", "Panics recovered, by goroutine.", "goroutine")
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// csvColumnAliases are the header names BaseStation exports and other
+// loggers use for each SBS-1 field, normalized by normalizeColumn. The
+// combined "generated" and "logged" fields hold a date and time in one
+// column.
+var csvColumnAliases = map[string][]string{
+	"message_type":      {"messagetype", "msgtype"},
+	"transmission_type": {"transmissiontype", "transmission", "transtype", "tt", "subtype"},
+	"session_id":        {"sessionid", "session"},
+	"aircraft_id":       {"aircraftid"},
+	"icao24":            {"icao24", "icao", "hex", "hexident", "modes", "modescode", "address"},
+	"flight_id":         {"flightid"},
+	"generated_date":    {"generateddate", "dategenerated", "datemessagegenerated", "date"},
+	"generated_time":    {"generatedtime", "timegenerated", "timemessagegenerated", "time"},
+	"generated":         {"generated", "generatedat", "timestamp", "datetime"},
+	"logged_date":       {"loggeddate", "datelogged", "datemessagelogged"},
+	"logged_time":       {"loggedtime", "timelogged", "timemessagelogged"},
+	"logged":            {"logged", "loggedat", "received", "receivedat"},
+	"callsign":          {"callsign", "flight", "flightnumber"},
+	"altitude":          {"altitude", "alt", "altbaro"},
+	"ground_speed":      {"groundspeed", "speed", "gs"},
+	"track":             {"track", "heading", "hdg"},
+	"lat":               {"lat", "latitude"},
+	"lon":               {"lon", "lng", "long", "longitude"},
+	"vertical_rate":     {"verticalrate", "vrate", "vertrate", "climbrate"},
+	"squawk":            {"squawk"},
+	"alert":             {"alert", "squawkchange"},
+	"emergency":         {"emergency"},
+	"spi":               {"spi", "ident"},
+	"on_ground":         {"onground", "isonground", "ground"},
+}
+
+// normalizeColumn lowercases a header name and drops everything but
+// letters and digits, so "Hex Ident", "hex_ident" and "HexIdent" match.
+func normalizeColumn(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(strings.TrimPrefix(name, "\ufeff")) {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// csvSchema maps the columns of a CSV log to SBS-1 fields.
+type csvSchema struct {
+	comma   rune
+	columns map[string]int // field name to column index
+}
+
+// readFirstLine returns the first line of r without its line ending.
+func readFirstLine(r io.Reader) (string, error) {
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// sniffCSV works out the delimiter and column layout of a CSV log from its
+// header line. Columns it does not recognise are ignored; the ICAO address
+// and a generated time are required.
+func sniffCSV(header string) (*csvSchema, error) {
+	schema := &csvSchema{comma: ',', columns: map[string]int{}}
+	best := strings.Count(header, ",")
+	for _, comma := range []rune{';', '\t', '|'} {
+		if n := strings.Count(header, string(comma)); n > best {
+			schema.comma, best = comma, n
+		}
+	}
+
+	lookup := map[string]string{}
+	for field, aliases := range csvColumnAliases {
+		for _, alias := range aliases {
+			lookup[alias] = field
+		}
+	}
+	for i, name := range strings.Split(header, string(schema.comma)) {
+		field, ok := lookup[normalizeColumn(strings.Trim(name, `" `))]
+		if !ok {
+			continue
+		}
+		if _, dup := schema.columns[field]; !dup {
+			schema.columns[field] = i
+		}
+	}
+
+	if _, ok := schema.columns["icao24"]; !ok {
+		return nil, fmt.Errorf("no ICAO address column in CSV header %q. CSV logs need a header line unless they hold SBS-1 MSG lines", header)
+	}
+	_, date := schema.columns["generated_date"]
+	_, combined := schema.columns["generated"]
+	if !date && !combined {
+		return nil, fmt.Errorf("no date column in CSV header %q", header)
+	}
+	return schema, nil
+}
+
+// Line rewrites a CSV record as an SBS-1 MSG line, so it is parsed and
+// validated like any other. Records of other message types are skipped.
+// A missing transmission type is inferred from the fields that are set.
+func (s *csvSchema) Line(record []string) (string, bool) {
+	get := func(field string) string {
+		if i, ok := s.columns[field]; ok && i < len(record) {
+			// A comma inside a quoted value would shift the SBS-1 fields.
+			return strings.TrimSpace(strings.ReplaceAll(record[i], ",", " "))
+		}
+		return ""
+	}
+	if mt := get("message_type"); mt != "" && !strings.EqualFold(mt, "MSG") {
+		return "", false
+	}
+
+	var fields [22]string
+	fields[0] = "MSG"
+	for i, name := range sbs1FieldNames {
+		if i > 0 {
+			fields[i] = get(name)
+		}
+	}
+	fields[6], fields[7] = csvDateTime(get("generated_date"), get("generated_time"), get("generated"))
+	fields[8], fields[9] = csvDateTime(get("logged_date"), get("logged_time"), get("logged"))
+	if fields[8] == "" {
+		fields[8], fields[9] = fields[6], fields[7]
+	}
+	for i := 18; i <= 21; i++ {
+		fields[i] = csvFlag(fields[i])
+	}
+	if fields[1] == "" {
+		switch {
+		case fields[14] != "" && fields[15] != "":
+			fields[1] = "3"
+		case fields[12] != "":
+			fields[1] = "4"
+		case fields[10] != "":
+			fields[1] = "1"
+		default:
+			fields[1] = "5"
+		}
+	}
+	return strings.Join(fields[:], ","), true
+}
+
+// csvDateLayouts and csvTimeLayouts are the date and time formats logs
+// write; csvDateTimeLayouts those of a combined column.
+var (
+	csvDateLayouts     = []string{"2006/01/02", "2006-01-02"}
+	csvTimeLayouts     = []string{"15:04:05.999999999", "15:04:05"}
+	csvDateTimeLayouts = []string{time.RFC3339Nano, "2006-01-02 15:04:05.999999999", "2006/01/02 15:04:05.999999999", "2006-01-02T15:04:05.999999999"}
+)
+
+// csvDateTime returns the SBS-1 date and time fields of a date and time
+// column, or of a combined column. Values it cannot read are passed on as
+// they are, for the parser to report.
+func csvDateTime(date, clock, combined string) (string, string) {
+	if combined != "" && date == "" {
+		for _, layout := range csvDateTimeLayouts {
+			if t, err := time.Parse(layout, combined); err == nil {
+				t = t.UTC()
+				return t.Format("2006/01/02"), t.Format("15:04:05.000")
+			}
+		}
+		return combined, ""
+	}
+	for _, layout := range csvDateLayouts {
+		if t, err := time.Parse(layout, date); err == nil {
+			date = t.Format("2006/01/02")
+			break
+		}
+	}
+	for _, layout := range csvTimeLayouts {
+		if t, err := time.Parse(layout, clock); err == nil {
+			clock = t.Format("15:04:05.000")
+			break
+		}
+	}
+	return date, clock
+}
+
+// csvFlag converts the booleans of CSV exports to SBS-1's -1 and 0.
+func csvFlag(s string) string {
+	switch strings.ToLower(s) {
+	case "true", "yes", "y", "1", "-1":
+		return "-1"
+	case "false", "no", "n", "0":
+		return "0"
+	}
+	return s
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// ctlCommand talks to a running collector over its control socket.
+func ctlCommand() *cli.Command {
+	return &cli.Command{
+		Name:      "ctl",
+		Usage:     "Inspect and control a running collector over its unix control socket.",
+		ArgsUsage: "status|pause|resume|flush|aircraft|positions ICAO24|enable SINK|disable SINK|sample RATE|mute [DURATION]|unmute",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "socket",
+				Usage: "Path of the collector's control socket. Defaults to control_socket.",
+			},
+			&cli.BoolFlag{
+				Name:  "json",
+				Usage: "Print the raw JSON response.",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			socket := c.String("socket")
+			if socket == "" {
+				socket = CONTROL_SOCKET
+			}
+			if socket == "" {
+				return configErrorf("no control socket given. Use --socket or set CONTROL_SOCKET to the path the collector was started with")
+			}
+
+			action, arg := c.Args().First(), c.Args().Get(1)
+			method, path := http.MethodGet, ""
+			switch action {
+			case "status", "aircraft":
+				path = "/" + action
+			case "positions":
+				if arg == "" {
+					return configErrorf("ctl positions needs an ICAO address")
+				}
+				path = "/aircraft/" + url.PathEscape(arg) + "/positions"
+			case "pause", "resume", "flush":
+				method, path = http.MethodPost, "/"+action
+			case "enable", "disable":
+				if arg == "" {
+					return configErrorf("ctl %s needs a sink: %s", action, strings.Join(toggleSinks, ", "))
+				}
+				method, path = http.MethodPost, "/sinks/"+url.PathEscape(arg)+"/"+action
+			case "sample":
+				if arg == "" {
+					return configErrorf("ctl sample needs a rate between 0 and 1")
+				}
+				method, path = http.MethodPost, "/sampling?rate="+url.QueryEscape(arg)
+			case "mute":
+				method, path = http.MethodPost, "/alerts/mute"
+				if arg != "" {
+					path += "?for=" + url.QueryEscape(arg)
+				}
+			case "unmute":
+				method, path = http.MethodPost, "/alerts/unmute"
+			default:
+				return configErrorf("unknown ctl action %q, expected status, pause, resume, flush, aircraft, positions, enable, disable, sample, mute or unmute", action)
+			}
+
+			body, err := controlRequest(socket, method, path)
+			if err != nil {
+				return err
+			}
+			if c.Bool("json") {
+				_, err := os.Stdout.Write(indentJSON(body))
+				return err
+			}
+			return printControlResponse(action, body)
+		},
+	}
+}
+
+// controlRequest performs one request against the control socket.
+func controlRequest(socket, method, path string) ([]byte, error) {
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+	req, err := http.NewRequest(method, "http://collector"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, newError(errConnect, fmt.Errorf("contacting collector: %w", err))
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("collector returned %s: %s", res.Status, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+// printControlResponse renders a control API response for a terminal.
+func printControlResponse(action string, body []byte) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+
+	switch action {
+	case "aircraft":
+		var aircraft []Aircraft
+		if err := json.Unmarshal(body, &aircraft); err != nil {
+			return err
+		}
+		fmt.Fprintln(w, "ICAO\tCALLSIGN\tALT\tSPD\tTRK\tLAT\tLON\tSQWK\tMSGS\tSEEN")
+		for _, a := range aircraft {
+			squawk := ""
+			if a.Squawk != 0 {
+				squawk = fmt.Sprintf("%04d", a.Squawk)
+			}
+			position := "\t"
+			if a.HasPosition() {
+				position = fmt.Sprintf("%.4f\t%.4f", a.Lat, a.Lon)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%.0f\t%.0f\t%s\t%s\t%d\t%s ago\n",
+				a.Icao24, a.Callsign, a.Altitude, a.GroundSpeed, a.Track, position, squawk, a.Messages,
+				time.Since(a.LastSeen).Round(time.Second))
+		}
+	case "positions":
+		var res aircraftPositions
+		if err := json.Unmarshal(body, &res); err != nil {
+			return err
+		}
+		fmt.Fprintln(w, "TIME\tLAT\tLON\tALT\tSPD\tTRK\tV/S")
+		for _, p := range res.Positions {
+			fmt.Fprintf(w, "%s\t%.4f\t%.4f\t%d\t%.0f\t%.0f\t%d\n",
+				p.At.Format("15:04:05"), p.Lat, p.Lon, p.Altitude, p.GroundSpeed, p.Track, p.VerticalRate)
+		}
+	case "flush":
+		var res map[string]int
+		if err := json.Unmarshal(body, &res); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "flushed\t%d messages\n", res["flushed"])
+	default:
+		var st controlStatus
+		if err := json.Unmarshal(body, &st); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "version\t%s\n", st.Version)
+		fmt.Fprintf(w, "started\t%s (%s ago)\n", st.Started.Format(time.RFC3339), time.Since(st.Started).Round(time.Second))
+		fmt.Fprintf(w, "paused\t%t\n", st.Paused)
+		fmt.Fprintf(w, "spooled\t%d batches\n", st.SpooledBatches)
+		fmt.Fprintf(w, "aircraft\t%d\n", st.Aircraft)
+		if st.Vehicles+st.Obstacles > 0 {
+			fmt.Fprintf(w, "vehicles\t%d\n", st.Vehicles)
+			fmt.Fprintf(w, "obstacles\t%d\n", st.Obstacles)
+		}
+		if h := st.PositionHistory; h.Depth > 0 {
+			fmt.Fprintf(w, "positions\t%d of %d aircraft, %s (depth %d)\n", h.Samples, h.Aircraft, formatBytes(float64(h.Bytes)), h.Depth)
+		}
+		if st.Archive != "" {
+			fmt.Fprintf(w, "archive\t%s\n", st.Archive)
+		}
+		if len(st.DisabledSinks) > 0 {
+			fmt.Fprintf(w, "disabled\t%s\n", strings.Join(st.DisabledSinks, ", "))
+		}
+		if st.SampleRate < 1 {
+			fmt.Fprintf(w, "sample rate\t%g\n", st.SampleRate)
+		}
+		if st.AlertsMuted != "" {
+			fmt.Fprintf(w, "alerts muted\t%s\n", st.AlertsMuted)
+		}
+	}
+	return nil
+}
+
+// indentJSON is used for --json output so responses are readable as-is.
+func indentJSON(body []byte) []byte {
+	var out bytes.Buffer
+	if json.Indent(&out, body, "", "  ") != nil {
+		return body
+	}
+	return out.Bytes()
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// datasetQueryPageSize is the number of events requested per query page.
+const datasetQueryPageSize = 5000
+
+// datasetClient uploads batches to the DataSet addEvents API. It holds a
+// single http.Client for the lifetime of the process so connections are
+// reused across batches.
+type datasetClient struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+// newDatasetClient creates a client authenticating with token against
+// DATASET_URL.
+func newDatasetClient(token string) *datasetClient {
+	return &datasetClient{
+		url:    strings.TrimSuffix(DATASET_URL, "/"),
+		token:  token,
+		client: withChaos("dataset", newGatewayClient()),
+	}
+}
+
+// Send sends a batch of SBS1Messages to DataSet.
+func (d *datasetClient) Send(messages []SBS1Message) error {
+	log.Printf("Sending %d messages to the service", len(messages))
+
+	data, err := buildPayload(messages)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", d.url+"/api/addEvents", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+d.token)
+	req.Header.Set("Idempotency-Key", idempotencyKey(messages))
+
+	res, err := d.client.Do(req)
+	if err != nil {
+		metricSinkErrors.Inc("dataset")
+		return newError(errSink, err)
+	}
+	defer res.Body.Close()
+
+	// Drain the body so the connection goes back to the pool.
+	body, _ := io.ReadAll(res.Body)
+	log.Printf("Response: %s", body)
+	var status struct {
+		Status string `json:"status"`
+	}
+	json.Unmarshal(body, &status)
+	if res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden ||
+		strings.HasPrefix(status.Status, "error/client/noPermission") {
+		metricSinkErrors.Inc("dataset")
+		return &appError{Kind: errAuth, Err: fmt.Errorf("DataSet rejected the write token: %s", res.Status)}
+	}
+	if res.StatusCode >= 300 {
+		metricSinkErrors.Inc("dataset")
+		return &appError{Kind: errSink, Err: fmt.Errorf("DataSet returned %s", res.Status)}
+	}
+	metricSinkEvents.Add("dataset", float64(len(messages)))
+	return nil
+}
+
+// datasetQuery is the body of a DataSet log query.
+type datasetQuery struct {
+	Token             string `json:"token"`
+	QueryType         string `json:"queryType"`
+	Filter            string `json:"filter"`
+	StartTime         string `json:"startTime"`
+	EndTime           string `json:"endTime"`
+	MaxCount          int    `json:"maxCount"`
+	PageMode          string `json:"pageMode"`
+	Columns           string `json:"columns"`
+	ContinuationToken string `json:"continuationToken,omitempty"`
+}
+
+// datasetQueryResult is the part of a query response we use.
+type datasetQueryResult struct {
+	Status  string `json:"status"`
+	Message string `json:"message"`
+	Matches []struct {
+		Attributes map[string]interface{} `json:"attributes"`
+	} `json:"matches"`
+	ContinuationToken string `json:"continuationToken"`
+}
+
+// EventIDs queries DataSet with readToken for the event_id of every event
+// uploaded by receiver with a timestamp in [start, end).
+func (d *datasetClient) EventIDs(readToken, receiver string, start, end time.Time) (map[string]bool, error) {
+	query := datasetQuery{
+		Token:     readToken,
+		QueryType: "log",
+		Filter:    "receiver == " + strconv.Quote(receiver),
+		StartTime: strconv.FormatInt(start.UnixNano(), 10),
+		EndTime:   strconv.FormatInt(end.UnixNano(), 10),
+		MaxCount:  datasetQueryPageSize,
+		PageMode:  "head",
+		Columns:   "event_id",
+	}
+
+	ids := map[string]bool{}
+	for {
+		body, err := json.Marshal(query)
+		if err != nil {
+			return nil, err
+		}
+		res, err := d.client.Post(d.url+"/api/query", "application/json", bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		var result datasetQueryResult
+		err = json.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("decoding DataSet query response: %w", err)
+		}
+		if res.StatusCode >= 300 || result.Status != "success" {
+			return nil, fmt.Errorf("DataSet query returned %s: %s", res.Status, result.Message)
+		}
+
+		for _, match := range result.Matches {
+			if id, ok := match.Attributes["event_id"].(string); ok {
+				ids[id] = true
+			}
+		}
+		if result.ContinuationToken == "" || len(result.Matches) == 0 {
+			return ids, nil
+		}
+		query.ContinuationToken = result.ContinuationToken
+	}
+}
+
+// eventID identifies a message by the receiver that heard it and what was
+// received, leaving out the upload timestamp and everything the tracker,
+// enrichment, GPS, cells and derived fields add, so the same SBS-1 line
+// gets the same ID whether it was uploaded live, retried or backfilled
+// from an archive. The generated time and ICAO address are part of what
+// was received. The position is left out too: fusion moves or drops the
+// positions of messages from several receivers, and backfilled lines,
+// which name no receiver, are never fused.
+func eventID(msg SBS1Message) string {
+	receiver, t := msg.Receiver, eventTime(msg)
+	if receiver == "" {
+		receiver = RECEIVER_NAME
+	}
+	msg.Timestamp, msg.FlightUUID, msg.Ghost, msg.Kind = "", "", false, ""
+	// Like flight IDs, event IDs hash the address in upper case.
+	msg.Icao24 = strings.ToUpper(msg.Icao24)
+	msg.Enrichment, msg.ReceiverPosition, msg.Derived = nil, nil, nil
+	msg.Geohash, msg.H3 = "", ""
+	msg.Receiver, msg.Receivers, msg.LinkType = "", nil, ""
+	msg.Lat, msg.Lon = 0, 0
+	data, _ := json.Marshal(msg)
+	return ids.Derived(eventNamespace, t, append([]byte(receiver+"\n"), data...))
+}
+
+// eventNamespace scopes event IDs.
+var eventNamespace = uuid.MustParse("3d2a9c4e-71b8-4f06-a5e2-8c0d6b9f1a47")
+
+// eventTime is the time event IDs are ordered by: when the message was
+// generated, or else logged, or else uploaded.
+func eventTime(msg SBS1Message) time.Time {
+	switch {
+	case msg.GeneratedDate != nil:
+		return *msg.GeneratedDate
+	case msg.LoggedDate != nil:
+		return *msg.LoggedDate
+	}
+	ts, _ := parseTimestamp(msg.Timestamp)
+	return ts
+}
+
+// idempotencyKey identifies a batch by the IDs of its events, so a batch
+// sent again after a timeout, from the spool or from a dead letter carries
+// the same key as the first attempt.
+func idempotencyKey(messages []SBS1Message) string {
+	h := sha1.New()
+	for _, msg := range messages {
+		h.Write([]byte(eventID(msg)))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// eventClasses are the kinds of events that can be given their own DataSet
+// parser and severity.
+var eventClasses = []string{"raw", "summary", "alert", "audit", "heartbeat"}
+
+// eventClass returns the class of msg: decoded messages and their
+// enrichment are raw, receiver statistics and airspace snapshots a summary,
+// gain advisories an alert and changes to alert rules and toggles an audit.
+// No heartbeat events are sent yet.
+func eventClass(msg SBS1Message) string {
+	switch msg.MessageType {
+	case "STATS", "SNAPSHOT":
+		return "summary"
+	case "ADVISORY":
+		return "alert"
+	case "AUDIT":
+		return "audit"
+	}
+	return "raw"
+}
+
+// eventParsers and eventSeverities are the DataSet parser and severity of
+// each event class, parsed from DATASET_PARSER and DATASET_SEVERITY.
+// Classes not listed use "adsb" and 3 (info).
+var (
+	eventParsers    map[string]string
+	eventSeverities map[string]int
+)
+
+// parseEventClassValues parses "class=value" options for the event
+// classes.
+func parseEventClassValues(option string, specs []string) (map[string]string, error) {
+	values := map[string]string{}
+	for _, spec := range specs {
+		class, value, ok := strings.Cut(spec, "=")
+		class, value = strings.TrimSpace(class), strings.TrimSpace(value)
+		if !ok || value == "" {
+			return nil, fmt.Errorf("invalid %s %q, expected 'class=value'", option, spec)
+		}
+		known := false
+		for _, c := range eventClasses {
+			known = known || c == class
+		}
+		if !known {
+			return nil, fmt.Errorf("%s names unknown event class %q, expected one of %s", option, class, strings.Join(eventClasses, ", "))
+		}
+		values[class] = value
+	}
+	return values, nil
+}
+
+// parseEventSeverities parses "class=sev" options. DataSet severities run
+// from 0 (finest) to 6 (fatal).
+func parseEventSeverities(specs []string) (map[string]int, error) {
+	values, err := parseEventClassValues("dataset_severity", specs)
+	if err != nil {
+		return nil, err
+	}
+	sevs := map[string]int{}
+	for class, value := range values {
+		sev, err := strconv.Atoi(value)
+		if err != nil || sev < 0 || sev > 6 {
+			return nil, fmt.Errorf("invalid dataset_severity %q for %s, expected 0 to 6", value, class)
+		}
+		sevs[class] = sev
+	}
+	return sevs, nil
+}
+
+// eventParser returns the DataSet parser of msg.
+func eventParser(msg SBS1Message) string {
+	if parser, ok := eventParsers[eventClass(msg)]; ok {
+		return parser
+	}
+	return "adsb"
+}
+
+// eventSeverity returns the DataSet severity of msg.
+func eventSeverity(msg SBS1Message) int {
+	if sev, ok := eventSeverities[eventClass(msg)]; ok {
+		return sev
+	}
+	return 3
+}
+
+var (
+	metricSinkEvents = newCounter("adsb_sink_events_total", "Events delivered, by sink.", "sink")
+	metricSinkErrors = newCounter("adsb_sink_errors_total", "Failed deliveries, by sink.", "sink")
+)
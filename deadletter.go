@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// deadLetters keeps batches a sink failed to accept, one NDJSON file per
+// batch in the spool format, so they can be inspected and re-sent with
+// backfill. Each entry's ID is attached to the sink's error counter as an
+// exemplar, linking a spike on a dashboard to the batch that caused it.
+type deadLetters struct {
+	dir string
+}
+
+// newDeadLetters creates the dead-letter directory if needed.
+func newDeadLetters(dir string) (*deadLetters, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating dead-letter directory: %w", err)
+	}
+	return &deadLetters{dir: dir}, nil
+}
+
+// Write stores a failed batch along with the error, and returns its ID.
+func (d *deadLetters) Write(sink string, messages []SBS1Message, sendErr error) (string, error) {
+	id := ids.Random(clock.Now())
+	name := fmt.Sprintf("%s-%s-%s", clock.Now().UTC().Format("20060102T150405Z"), sink, id)
+	path := filepath.Join(d.dir, name+".ndjson")
+
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return "", err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, msg := range messages {
+		if err := enc.Encode(msg); err != nil {
+			f.Close()
+			return "", err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filepath.Join(d.dir, name+".error"), []byte(sendErr.Error()+"\n"), 0o644); err != nil {
+		return "", err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return "", err
+	}
+	log.Printf("Dead-lettered %d messages for %s as %s", len(messages), sink, id)
+	return id, nil
+}
+
+// Record dead-letters a batch that sink failed to accept, if dead-lettering
+// is enabled, and points the sink's error counter at it. A nil deadLetters
+// only returns sendErr.
+func (d *deadLetters) Record(sink string, messages []SBS1Message, sendErr error) error {
+	if d == nil {
+		return sendErr
+	}
+	id, err := d.Write(sink, messages, sendErr)
+	if err != nil {
+		log.Println("Error writing dead letter:", err)
+		return sendErr
+	}
+	metricSinkErrors.SetExemplar(sink, "dead_letter_id", id)
+	metricDeadLetters.Add(sink, float64(len(messages)))
+	return sendErr
+}
+
+var metricDeadLetters = newCounter("adsb_dead_letter_events_total", "Events written to the dead-letter directory, by sink.", "sink")
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sync"
+)
+
+const (
+	// rtlsdrFrequency is the 1090 MHz Mode S downlink.
+	rtlsdrFrequency = 1090000000
+	// demodSampleRate is the rate demodulate expects: two samples per
+	// Mode S bit.
+	demodSampleRate = 2000000
+	// demodPreamble is the length of the Mode S preamble in samples.
+	demodPreamble = 16
+	// demodLongest is the length of a preamble and a long reply in samples.
+	demodLongest = demodPreamble + 112*2
+)
+
+var (
+	// demodMagnitudes maps an I/Q sample pair to its magnitude.
+	demodMagnitudes     []uint16
+	demodMagnitudesOnce sync.Once
+)
+
+// openRTLSDR opens the RTL-SDR dongle with the given index and serves the
+// replies demodulated from it as AVR lines, until stop is closed. gain and
+// ppm are passed to openRTLSDRDevice.
+func openRTLSDR(index int, gain string, ppm int, stop <-chan struct{}) (io.ReadCloser, error) {
+	dev, err := openRTLSDRDevice(index, gain, ppm)
+	if err != nil {
+		return nil, newError(errConnect, err)
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		defer dev.Close()
+		err := demodulate(stoppableReader{dev, stop}, func(frame []byte) error {
+			_, err := fmt.Fprintf(pw, "*%X;\n", frame)
+			return err
+		})
+		if err == io.EOF {
+			err = nil
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr, nil
+}
+
+// stoppableReader ends with io.EOF once stop is closed.
+type stoppableReader struct {
+	r    io.Reader
+	stop <-chan struct{}
+}
+
+func (s stoppableReader) Read(p []byte) (int, error) {
+	select {
+	case <-s.stop:
+		return 0, io.EOF
+	default:
+	}
+	return s.r.Read(p)
+}
+
+// demodulate reads 8-bit unsigned I/Q samples taken around 1090 MHz at
+// demodSampleRate from r, finds Mode S replies by their preamble, the way
+// dump1090 does, and passes each to emit until r ends or emit fails. DF 11,
+// 17 and 18 replies are only passed when their parity checks; the others
+// carry the address in their parity and are left to the decoder, which
+// checks them against the addresses it has confirmed.
+func demodulate(r io.Reader, emit func(frame []byte) error) error {
+	demodMagnitudesOnce.Do(func() {
+		demodMagnitudes = make([]uint16, 256*256)
+		for i := 0; i < 256; i++ {
+			for q := 0; q < 256; q++ {
+				fi, fq := float64(i)-127.5, float64(q)-127.5
+				demodMagnitudes[i<<8|q] = uint16(math.Sqrt(fi*fi+fq*fq) * 360)
+			}
+		}
+	})
+
+	buf := make([]byte, 256*1024)
+	// mag carries the samples of a reply that may continue in the next
+	// read.
+	var mag []uint16
+	odd := -1
+	for {
+		n, err := r.Read(buf)
+		for _, b := range buf[:n] {
+			if odd < 0 {
+				odd = int(b)
+				continue
+			}
+			mag = append(mag, demodMagnitudes[odd<<8|int(b)])
+			odd = -1
+		}
+		done, ferr := scanModeS(mag, emit)
+		if ferr != nil {
+			return ferr
+		}
+		mag = append(mag[:0], mag[done:]...)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// scanModeS passes the replies starting in m to emit and returns how many
+// samples it is done with: the last demodLongest are kept for when the
+// reply starting there is complete.
+func scanModeS(m []uint16, emit func(frame []byte) error) (int, error) {
+	j := 0
+	for ; j+demodLongest <= len(m); j++ {
+		// Pulses at 0, 1, 3.5 and 4.5 µs, with quiet between them.
+		if !(m[j] > m[j+1] && m[j+1] < m[j+2] && m[j+2] > m[j+3] && m[j+3] < m[j] &&
+			m[j+4] < m[j] && m[j+5] < m[j] && m[j+6] < m[j] &&
+			m[j+7] > m[j+8] && m[j+8] < m[j+9] && m[j+9] > m[j+6]) {
+			continue
+		}
+		pulses := uint32(m[j]) + uint32(m[j+2]) + uint32(m[j+7]) + uint32(m[j+9])
+		quiet := uint32(m[j+1]) + uint32(m[j+3]) + uint32(m[j+4]) + uint32(m[j+5]) + uint32(m[j+6]) + uint32(m[j+8])
+		// The pulses must stand out from the noise by about 6 dB.
+		if pulses/4 < quiet/6*2 {
+			continue
+		}
+		high := pulses / 6
+		if uint32(m[j+4]) >= high || uint32(m[j+5]) >= high {
+			continue
+		}
+		if uint32(m[j+11]) >= high || uint32(m[j+12]) >= high || uint32(m[j+13]) >= high || uint32(m[j+14]) >= high {
+			continue
+		}
+
+		frame := make([]byte, 14)
+		bits := 112
+		for i := 0; i < bits; i++ {
+			a := j + demodPreamble + 2*i
+			if m[a] > m[a+1] {
+				frame[i/8] |= 0x80 >> (i % 8)
+			}
+			if i == 7 && frame[0]>>3 < 16 {
+				bits = 56
+			}
+		}
+		frame = frame[:bits/8]
+		if !plausibleModeS(frame) {
+			continue
+		}
+		if err := emit(frame); err != nil {
+			return j, err
+		}
+		j += demodPreamble + bits*2 - 1
+	}
+	return j, nil
+}
+
+// plausibleModeS reports whether a demodulated frame is worth decoding.
+func plausibleModeS(frame []byte) bool {
+	switch frame[0] >> 3 {
+	case 11:
+		return modeSResidual(frame)&^0x7f == 0
+	case 17, 18:
+		return modeSResidual(frame) == 0
+	case 0, 4, 5, 16, 20, 21:
+		return true
+	}
+	return false
+}
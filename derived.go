@@ -0,0 +1,997 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// derivedType is the type of an expression's value.
+type derivedType int
+
+const (
+	derivedNull derivedType = iota
+	derivedNumber
+	derivedString
+	derivedBool
+)
+
+func (t derivedType) String() string {
+	return [...]string{"NULL", "a number", "a string", "a boolean"}[t]
+}
+
+// derivedExpr is a compiled expression. eval returns nil, a float64, a
+// string or a bool, as typ says; an expression of type derivedNull only
+// returns nil.
+type derivedExpr struct {
+	typ  derivedType
+	eval func(env *derivedEnv) interface{}
+}
+
+// derivedEnv is what expressions are evaluated on: the message and the
+// derived fields computed so far.
+type derivedEnv struct {
+	msg    reflect.Value
+	fields DerivedValues
+}
+
+// DerivedValues are the derived fields of a message, by name.
+type DerivedValues map[string]interface{}
+
+// derivedField is one line of the file.
+type derivedField struct {
+	name string
+	expr derivedExpr
+}
+
+// derivedFields are computed from every decoded aircraft message with
+// SQL-style expressions and sent in its "derived" object, so common
+// conversions need no transformation downstream. They are read from a file
+// of "name = expression" lines:
+//
+//	-- Altitude in metres, and whether the aircraft is low.
+//	alt_meters = ROUND(altitude * 0.3048)
+//	is_low = altitude < 3000 AND NOT on_ground
+//	operator = CASE WHEN callsign LIKE 'RYR%' THEN 'Ryanair' ELSE enrichment.operator END
+//
+// Expressions name the event's fields as in its JSON, nested ones with a
+// dot, and the derived fields defined above them. A field the message
+// leaves out is NULL, except that booleans are false, and so is anything
+// computed from NULL, as in SQL; a derived field that is NULL is left out
+// in turn. Expressions are type checked when the file is loaded, so they
+// cannot fail on a message.
+type derivedFields []derivedField
+
+// derived are the derived fields configured on the command line.
+var derived derivedFields
+
+var derivedNameRE = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// loadDerivedFields reads and compiles a derived_fields file. An empty
+// path configures none.
+func loadDerivedFields(path string) (derivedFields, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var fields derivedFields
+	types := map[string]derivedType{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "--") {
+			continue
+		}
+		name, source, ok := strings.Cut(line, "=")
+		name = strings.TrimSpace(name)
+		if !ok || !derivedNameRE.MatchString(name) {
+			return nil, fmt.Errorf("%s:%d: expected 'name = expression'", path, n)
+		}
+		if _, dup := types[name]; dup {
+			return nil, fmt.Errorf("%s:%d: %s is defined twice", path, n, name)
+		}
+		expr, err := compileDerived(source, types)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s: %w", path, n, name, err)
+		}
+		types[name] = expr.typ
+		fields = append(fields, derivedField{name, expr})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// Apply sets the derived fields of msg. It does nothing without derived
+// fields.
+func (d derivedFields) Apply(msg *SBS1Message) {
+	if len(d) == 0 {
+		return
+	}
+	env := &derivedEnv{msg: reflect.ValueOf(msg).Elem(), fields: make(DerivedValues, len(d))}
+	for _, f := range d {
+		if v := f.expr.eval(env); v != nil {
+			env.fields[f.name] = v
+		}
+	}
+	msg.Derived = nil
+	if len(env.fields) > 0 {
+		msg.Derived = env.fields
+	}
+}
+
+// derivedToken is a token of an expression. Keywords and identifiers are
+// words; kind is 'w', 'n' for numbers, 's' for strings and 'o' for
+// operators and punctuation.
+type derivedToken struct {
+	kind byte
+	text string
+	pos  int
+}
+
+// lexDerived splits an expression into tokens.
+func lexDerived(src string) ([]derivedToken, error) {
+	var tokens []derivedToken
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '\'':
+			var b strings.Builder
+			j := i + 1
+			for {
+				if j >= len(src) {
+					return nil, fmt.Errorf("unterminated string at column %d", i+1)
+				}
+				if src[j] == '\'' {
+					if j+1 < len(src) && src[j+1] == '\'' {
+						b.WriteByte('\'')
+						j += 2
+						continue
+					}
+					break
+				}
+				b.WriteByte(src[j])
+				j++
+			}
+			tokens = append(tokens, derivedToken{'s', b.String(), i})
+			i = j + 1
+		case c >= '0' && c <= '9' || c == '.' && i+1 < len(src) && src[i+1] >= '0' && src[i+1] <= '9':
+			j := i
+			for j < len(src) && (src[j] >= '0' && src[j] <= '9' || src[j] == '.') {
+				j++
+			}
+			if j < len(src) && (src[j] == 'e' || src[j] == 'E') {
+				j++
+				if j < len(src) && (src[j] == '+' || src[j] == '-') {
+					j++
+				}
+				for j < len(src) && src[j] >= '0' && src[j] <= '9' {
+					j++
+				}
+			}
+			tokens = append(tokens, derivedToken{'n', src[i:j], i})
+			i = j
+		case c == '_' || unicode.IsLetter(rune(c)):
+			j := i
+			for j < len(src) && (src[j] == '_' || src[j] == '.' || unicode.IsLetter(rune(src[j])) || unicode.IsDigit(rune(src[j]))) {
+				j++
+			}
+			tokens = append(tokens, derivedToken{'w', src[i:j], i})
+			i = j
+		default:
+			op := ""
+			for _, candidate := range []string{"<=", ">=", "<>", "!=", "==", "||", "(", ")", ",", "+", "-", "*", "/", "%", "=", "<", ">"} {
+				if strings.HasPrefix(src[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected %q at column %d", c, i+1)
+			}
+			tokens = append(tokens, derivedToken{'o', op, i})
+			i += len(op)
+		}
+	}
+	return tokens, nil
+}
+
+// derivedParser compiles an expression by recursive descent. Precedence
+// rises from OR, AND and NOT through comparisons to +, - and ||, then *, /
+// and %, then unary minus.
+type derivedParser struct {
+	tokens []derivedToken
+	pos    int
+	// fields are the types of the derived fields defined so far.
+	fields map[string]derivedType
+}
+
+// compileDerived compiles the expression src.
+func compileDerived(src string, fields map[string]derivedType) (derivedExpr, error) {
+	tokens, err := lexDerived(src)
+	if err != nil {
+		return derivedExpr{}, err
+	}
+	if len(tokens) == 0 {
+		return derivedExpr{}, fmt.Errorf("missing expression")
+	}
+	p := &derivedParser{tokens: tokens, fields: fields}
+	expr, err := p.or()
+	if err != nil {
+		return derivedExpr{}, err
+	}
+	if p.pos < len(p.tokens) {
+		return derivedExpr{}, p.unexpected()
+	}
+	return expr, nil
+}
+
+// peek reports whether the next token is the operator or keyword text.
+func (p *derivedParser) peek(text string) bool {
+	if p.pos >= len(p.tokens) {
+		return false
+	}
+	t := p.tokens[p.pos]
+	return (t.kind == 'o' || t.kind == 'w') && strings.EqualFold(t.text, text)
+}
+
+// accept consumes the next token if it is text.
+func (p *derivedParser) accept(text string) bool {
+	if p.peek(text) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// expect consumes text or fails.
+func (p *derivedParser) expect(text string) error {
+	if !p.accept(text) {
+		if p.pos >= len(p.tokens) {
+			return fmt.Errorf("expected %s at the end", text)
+		}
+		return fmt.Errorf("expected %s at column %d", text, p.tokens[p.pos].pos+1)
+	}
+	return nil
+}
+
+// unexpected is the error for the next token.
+func (p *derivedParser) unexpected() error {
+	if p.pos >= len(p.tokens) {
+		return fmt.Errorf("unexpected end of expression")
+	}
+	t := p.tokens[p.pos]
+	return fmt.Errorf("unexpected %q at column %d", t.text, t.pos+1)
+}
+
+// checkType fails unless e has type want, or is NULL.
+func checkType(e derivedExpr, want derivedType, what string) error {
+	if e.typ != want && e.typ != derivedNull {
+		return fmt.Errorf("%s needs %s, not %s", what, want, e.typ)
+	}
+	return nil
+}
+
+// derivedTruth returns v as a SQL boolean: true, false or nil for NULL.
+func derivedTruth(v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	return v.(bool)
+}
+
+func (p *derivedParser) or() (derivedExpr, error) {
+	left, err := p.and()
+	if err != nil {
+		return left, err
+	}
+	for p.accept("OR") {
+		right, err := p.and()
+		if err != nil {
+			return right, err
+		}
+		if err := checkType(left, derivedBool, "OR"); err != nil {
+			return left, err
+		}
+		if err := checkType(right, derivedBool, "OR"); err != nil {
+			return right, err
+		}
+		l, r := left.eval, right.eval
+		left = derivedExpr{derivedBool, func(env *derivedEnv) interface{} {
+			a := derivedTruth(l(env))
+			if a == true {
+				return true
+			}
+			b := derivedTruth(r(env))
+			if b == true {
+				return true
+			}
+			if a == nil || b == nil {
+				return nil
+			}
+			return false
+		}}
+	}
+	return left, nil
+}
+
+func (p *derivedParser) and() (derivedExpr, error) {
+	left, err := p.not()
+	if err != nil {
+		return left, err
+	}
+	for p.accept("AND") {
+		right, err := p.not()
+		if err != nil {
+			return right, err
+		}
+		if err := checkType(left, derivedBool, "AND"); err != nil {
+			return left, err
+		}
+		if err := checkType(right, derivedBool, "AND"); err != nil {
+			return right, err
+		}
+		l, r := left.eval, right.eval
+		left = derivedExpr{derivedBool, func(env *derivedEnv) interface{} {
+			a := derivedTruth(l(env))
+			if a == false {
+				return false
+			}
+			b := derivedTruth(r(env))
+			if b == false {
+				return false
+			}
+			if a == nil || b == nil {
+				return nil
+			}
+			return true
+		}}
+	}
+	return left, nil
+}
+
+func (p *derivedParser) not() (derivedExpr, error) {
+	if !p.accept("NOT") {
+		return p.comparison()
+	}
+	operand, err := p.not()
+	if err != nil {
+		return operand, err
+	}
+	if err := checkType(operand, derivedBool, "NOT"); err != nil {
+		return operand, err
+	}
+	return derivedExpr{derivedBool, func(env *derivedEnv) interface{} {
+		if v := operand.eval(env); v != nil {
+			return !v.(bool)
+		}
+		return nil
+	}}, nil
+}
+
+// comparison parses comparisons and IS [NOT] NULL, [NOT] IN and [NOT]
+// LIKE tests.
+func (p *derivedParser) comparison() (derivedExpr, error) {
+	left, err := p.additive()
+	if err != nil {
+		return left, err
+	}
+	if p.accept("IS") {
+		negate := p.accept("NOT")
+		if err := p.expect("NULL"); err != nil {
+			return left, err
+		}
+		return derivedExpr{derivedBool, func(env *derivedEnv) interface{} {
+			return (left.eval(env) == nil) != negate
+		}}, nil
+	}
+	negate := p.peek("NOT") && p.pos+1 < len(p.tokens) && (strings.EqualFold(p.tokens[p.pos+1].text, "IN") || strings.EqualFold(p.tokens[p.pos+1].text, "LIKE"))
+	if negate {
+		p.pos++
+	}
+	switch {
+	case p.accept("IN"):
+		return p.in(left, negate)
+	case p.accept("LIKE"):
+		return p.like(left, negate)
+	}
+	for _, op := range []string{"<=", ">=", "<>", "!=", "==", "=", "<", ">"} {
+		if !p.accept(op) {
+			continue
+		}
+		right, err := p.additive()
+		if err != nil {
+			return right, err
+		}
+		typ := left.typ
+		if typ == derivedNull {
+			typ = right.typ
+		}
+		if err := checkType(right, typ, op); err != nil {
+			return right, err
+		}
+		if typ == derivedBool && op != "=" && op != "==" && op != "<>" && op != "!=" {
+			return left, fmt.Errorf("%s cannot compare booleans", op)
+		}
+		l, r := left.eval, right.eval
+		return derivedExpr{derivedBool, func(env *derivedEnv) interface{} {
+			a, b := l(env), r(env)
+			if a == nil || b == nil {
+				return nil
+			}
+			c := derivedCompare(a, b)
+			switch op {
+			case "<":
+				return c < 0
+			case "<=":
+				return c <= 0
+			case ">":
+				return c > 0
+			case ">=":
+				return c >= 0
+			case "<>", "!=":
+				return c != 0
+			}
+			return c == 0
+		}}, nil
+	}
+	return left, nil
+}
+
+// derivedCompare orders two non-NULL values of the same type.
+func derivedCompare(a, b interface{}) int {
+	switch a := a.(type) {
+	case float64:
+		b := b.(float64)
+		switch {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		}
+		return 0
+	case string:
+		return strings.Compare(a, b.(string))
+	}
+	if a == b {
+		return 0
+	}
+	return 1
+}
+
+// in parses the list of an IN test.
+func (p *derivedParser) in(left derivedExpr, negate bool) (derivedExpr, error) {
+	if err := p.expect("("); err != nil {
+		return left, err
+	}
+	var items []derivedExpr
+	for {
+		item, err := p.additive()
+		if err != nil {
+			return item, err
+		}
+		typ := left.typ
+		if typ == derivedNull {
+			typ = item.typ
+		}
+		if err := checkType(item, typ, "IN"); err != nil {
+			return item, err
+		}
+		items = append(items, item)
+		if !p.accept(",") {
+			break
+		}
+	}
+	if err := p.expect(")"); err != nil {
+		return left, err
+	}
+	return derivedExpr{derivedBool, func(env *derivedEnv) interface{} {
+		v := left.eval(env)
+		if v == nil {
+			return nil
+		}
+		var sawNull bool
+		for _, item := range items {
+			w := item.eval(env)
+			if w == nil {
+				sawNull = true
+			} else if derivedCompare(v, w) == 0 {
+				return !negate
+			}
+		}
+		if sawNull {
+			return nil
+		}
+		return negate
+	}}, nil
+}
+
+// like parses the pattern of a LIKE test, where % matches any run of
+// characters and _ any one. The pattern must be a string literal.
+func (p *derivedParser) like(left derivedExpr, negate bool) (derivedExpr, error) {
+	if err := checkType(left, derivedString, "LIKE"); err != nil {
+		return left, err
+	}
+	if p.pos >= len(p.tokens) || p.tokens[p.pos].kind != 's' {
+		return left, fmt.Errorf("LIKE needs a string pattern")
+	}
+	pattern := p.tokens[p.pos].text
+	p.pos++
+	var re strings.Builder
+	re.WriteString("(?s)^")
+	for _, r := range pattern {
+		switch r {
+		case '%':
+			re.WriteString(".*")
+		case '_':
+			re.WriteString(".")
+		default:
+			re.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	re.WriteString("$")
+	matcher := regexp.MustCompile(re.String())
+	return derivedExpr{derivedBool, func(env *derivedEnv) interface{} {
+		v := left.eval(env)
+		if v == nil {
+			return nil
+		}
+		return matcher.MatchString(v.(string)) != negate
+	}}, nil
+}
+
+func (p *derivedParser) additive() (derivedExpr, error) {
+	left, err := p.multiplicative()
+	if err != nil {
+		return left, err
+	}
+	for {
+		var op string
+		for _, candidate := range []string{"+", "-", "||"} {
+			if p.accept(candidate) {
+				op = candidate
+				break
+			}
+		}
+		if op == "" {
+			return left, nil
+		}
+		right, err := p.multiplicative()
+		if err != nil {
+			return right, err
+		}
+		if op == "||" {
+			left, err = derivedConcat(left, right)
+		} else {
+			left, err = derivedArithmetic(op, left, right)
+		}
+		if err != nil {
+			return left, err
+		}
+	}
+}
+
+func (p *derivedParser) multiplicative() (derivedExpr, error) {
+	left, err := p.unary()
+	if err != nil {
+		return left, err
+	}
+	for {
+		var op string
+		for _, candidate := range []string{"*", "/", "%"} {
+			if p.accept(candidate) {
+				op = candidate
+				break
+			}
+		}
+		if op == "" {
+			return left, nil
+		}
+		right, err := p.unary()
+		if err != nil {
+			return right, err
+		}
+		if left, err = derivedArithmetic(op, left, right); err != nil {
+			return left, err
+		}
+	}
+}
+
+// derivedArithmetic combines two numbers. Division by zero is NULL.
+func derivedArithmetic(op string, left, right derivedExpr) (derivedExpr, error) {
+	if err := checkType(left, derivedNumber, op); err != nil {
+		return left, err
+	}
+	if err := checkType(right, derivedNumber, op); err != nil {
+		return right, err
+	}
+	l, r := left.eval, right.eval
+	return derivedExpr{derivedNumber, func(env *derivedEnv) interface{} {
+		a, b := l(env), r(env)
+		if a == nil || b == nil {
+			return nil
+		}
+		x, y := a.(float64), b.(float64)
+		switch op {
+		case "+":
+			return x + y
+		case "-":
+			return x - y
+		case "*":
+			return x * y
+		}
+		if y == 0 {
+			return nil
+		}
+		if op == "%" {
+			return math.Mod(x, y)
+		}
+		return x / y
+	}}, nil
+}
+
+// derivedConcat joins two values as strings.
+func derivedConcat(left, right derivedExpr) (derivedExpr, error) {
+	l, r := left.eval, right.eval
+	return derivedExpr{derivedString, func(env *derivedEnv) interface{} {
+		a, b := l(env), r(env)
+		if a == nil || b == nil {
+			return nil
+		}
+		return derivedText(a) + derivedText(b)
+	}}, nil
+}
+
+// derivedText formats a value for ||.
+func derivedText(v interface{}) string {
+	switch v := v.(type) {
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return v.(string)
+}
+
+func (p *derivedParser) unary() (derivedExpr, error) {
+	if !p.accept("-") {
+		return p.primary()
+	}
+	operand, err := p.unary()
+	if err != nil {
+		return operand, err
+	}
+	if err := checkType(operand, derivedNumber, "-"); err != nil {
+		return operand, err
+	}
+	return derivedExpr{derivedNumber, func(env *derivedEnv) interface{} {
+		if v := operand.eval(env); v != nil {
+			return -v.(float64)
+		}
+		return nil
+	}}, nil
+}
+
+// derivedConst is an expression of a literal.
+func derivedConst(typ derivedType, v interface{}) derivedExpr {
+	return derivedExpr{typ, func(*derivedEnv) interface{} { return v }}
+}
+
+func (p *derivedParser) primary() (derivedExpr, error) {
+	if p.pos >= len(p.tokens) {
+		return derivedExpr{}, p.unexpected()
+	}
+	t := p.tokens[p.pos]
+	switch t.kind {
+	case 'n':
+		p.pos++
+		n, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return derivedExpr{}, fmt.Errorf("invalid number %q at column %d", t.text, t.pos+1)
+		}
+		return derivedConst(derivedNumber, n), nil
+	case 's':
+		p.pos++
+		return derivedConst(derivedString, t.text), nil
+	case 'o':
+		if !p.accept("(") {
+			return derivedExpr{}, p.unexpected()
+		}
+		expr, err := p.or()
+		if err != nil {
+			return expr, err
+		}
+		return expr, p.expect(")")
+	}
+	p.pos++
+	switch strings.ToUpper(t.text) {
+	case "NULL":
+		return derivedConst(derivedNull, nil), nil
+	case "TRUE":
+		return derivedConst(derivedBool, true), nil
+	case "FALSE":
+		return derivedConst(derivedBool, false), nil
+	case "CASE":
+		return p.caseWhen()
+	case "AND", "OR", "NOT", "IS", "IN", "LIKE", "WHEN", "THEN", "ELSE", "END":
+		p.pos--
+		return derivedExpr{}, p.unexpected()
+	}
+	if p.accept("(") {
+		return p.call(t)
+	}
+	return p.field(t)
+}
+
+// caseWhen parses CASE WHEN ... THEN ... [ELSE ...] END. Without ELSE,
+// no match is NULL.
+func (p *derivedParser) caseWhen() (derivedExpr, error) {
+	var conds, results []derivedExpr
+	typ := derivedNull
+	for p.accept("WHEN") {
+		cond, err := p.or()
+		if err != nil {
+			return cond, err
+		}
+		if err := checkType(cond, derivedBool, "WHEN"); err != nil {
+			return cond, err
+		}
+		if err := p.expect("THEN"); err != nil {
+			return cond, err
+		}
+		result, err := p.or()
+		if err != nil {
+			return result, err
+		}
+		if typ == derivedNull {
+			typ = result.typ
+		}
+		if err := checkType(result, typ, "CASE"); err != nil {
+			return result, err
+		}
+		conds, results = append(conds, cond), append(results, result)
+	}
+	if len(conds) == 0 {
+		return derivedExpr{}, fmt.Errorf("CASE needs WHEN")
+	}
+	otherwise := derivedConst(derivedNull, nil)
+	if p.accept("ELSE") {
+		var err error
+		if otherwise, err = p.or(); err != nil {
+			return otherwise, err
+		}
+		if typ == derivedNull {
+			typ = otherwise.typ
+		}
+		if err := checkType(otherwise, typ, "CASE"); err != nil {
+			return otherwise, err
+		}
+	}
+	if err := p.expect("END"); err != nil {
+		return otherwise, err
+	}
+	return derivedExpr{typ, func(env *derivedEnv) interface{} {
+		for i, cond := range conds {
+			if cond.eval(env) == true {
+				return results[i].eval(env)
+			}
+		}
+		return otherwise.eval(env)
+	}}, nil
+}
+
+// derivedFunctions are the functions expressions can call besides
+// COALESCE: the types of their arguments, of which the first min are
+// required, and of their result. A NULL argument makes the result NULL.
+var derivedFunctions = map[string]struct {
+	args   []derivedType
+	min    int
+	result derivedType
+	eval   func(args []interface{}) interface{}
+}{
+	"ABS":   {[]derivedType{derivedNumber}, 1, derivedNumber, func(a []interface{}) interface{} { return math.Abs(a[0].(float64)) }},
+	"FLOOR": {[]derivedType{derivedNumber}, 1, derivedNumber, func(a []interface{}) interface{} { return math.Floor(a[0].(float64)) }},
+	"CEIL":  {[]derivedType{derivedNumber}, 1, derivedNumber, func(a []interface{}) interface{} { return math.Ceil(a[0].(float64)) }},
+	"SQRT": {[]derivedType{derivedNumber}, 1, derivedNumber, func(a []interface{}) interface{} {
+		if a[0].(float64) < 0 {
+			return nil
+		}
+		return math.Sqrt(a[0].(float64))
+	}},
+	// ROUND rounds half away from zero, to a number of decimal places.
+	"ROUND": {[]derivedType{derivedNumber, derivedNumber}, 1, derivedNumber, func(a []interface{}) interface{} {
+		scale := 1.0
+		if len(a) == 2 {
+			scale = math.Pow(10, math.Trunc(a[1].(float64)))
+		}
+		return math.Round(a[0].(float64)*scale) / scale
+	}},
+	"LOWER":  {[]derivedType{derivedString}, 1, derivedString, func(a []interface{}) interface{} { return strings.ToLower(a[0].(string)) }},
+	"UPPER":  {[]derivedType{derivedString}, 1, derivedString, func(a []interface{}) interface{} { return strings.ToUpper(a[0].(string)) }},
+	"TRIM":   {[]derivedType{derivedString}, 1, derivedString, func(a []interface{}) interface{} { return strings.TrimSpace(a[0].(string)) }},
+	"LENGTH": {[]derivedType{derivedString}, 1, derivedNumber, func(a []interface{}) interface{} { return float64(len([]rune(a[0].(string)))) }},
+	// SUBSTR takes 1-based positions, as in SQL.
+	"SUBSTR": {[]derivedType{derivedString, derivedNumber, derivedNumber}, 2, derivedString, func(a []interface{}) interface{} {
+		r := []rune(a[0].(string))
+		start := int(a[1].(float64)) - 1
+		if start < 0 {
+			start = 0
+		}
+		end := len(r)
+		if len(a) == 3 && start+int(a[2].(float64)) < end {
+			end = start + int(a[2].(float64))
+		}
+		if start >= end {
+			return ""
+		}
+		return string(r[start:end])
+	}},
+}
+
+// call parses the arguments of a call to function name.
+func (p *derivedParser) call(name derivedToken) (derivedExpr, error) {
+	var args []derivedExpr
+	if !p.accept(")") {
+		for {
+			arg, err := p.or()
+			if err != nil {
+				return arg, err
+			}
+			args = append(args, arg)
+			if !p.accept(",") {
+				break
+			}
+		}
+		if err := p.expect(")"); err != nil {
+			return derivedExpr{}, err
+		}
+	}
+	fn := strings.ToUpper(name.text)
+	if fn == "COALESCE" {
+		return derivedCoalesce(args)
+	}
+	def, ok := derivedFunctions[fn]
+	if !ok {
+		return derivedExpr{}, fmt.Errorf("unknown function %s at column %d", name.text, name.pos+1)
+	}
+	if len(args) < def.min || len(args) > len(def.args) {
+		return derivedExpr{}, fmt.Errorf("%s takes %d to %d arguments, not %d", fn, def.min, len(def.args), len(args))
+	}
+	for i, arg := range args {
+		if err := checkType(arg, def.args[i], fn); err != nil {
+			return arg, err
+		}
+	}
+	return derivedExpr{def.result, func(env *derivedEnv) interface{} {
+		values := make([]interface{}, len(args))
+		for i, arg := range args {
+			if values[i] = arg.eval(env); values[i] == nil {
+				return nil
+			}
+		}
+		return def.eval(values)
+	}}, nil
+}
+
+// derivedCoalesce is the first of its arguments that is not NULL.
+func derivedCoalesce(args []derivedExpr) (derivedExpr, error) {
+	if len(args) == 0 {
+		return derivedExpr{}, fmt.Errorf("COALESCE needs arguments")
+	}
+	typ := derivedNull
+	for _, arg := range args {
+		if typ == derivedNull {
+			typ = arg.typ
+		}
+		if err := checkType(arg, typ, "COALESCE"); err != nil {
+			return arg, err
+		}
+	}
+	return derivedExpr{typ, func(env *derivedEnv) interface{} {
+		for _, arg := range args {
+			if v := arg.eval(env); v != nil {
+				return v
+			}
+		}
+		return nil
+	}}, nil
+}
+
+// field compiles a reference to a derived field defined above, or else to
+// a field of the event by its JSON path.
+func (p *derivedParser) field(t derivedToken) (derivedExpr, error) {
+	if typ, ok := p.fields[t.text]; ok {
+		name := t.text
+		return derivedExpr{typ, func(env *derivedEnv) interface{} { return env.fields[name] }}, nil
+	}
+	typ := reflect.TypeOf(SBS1Message{})
+	var path []schemaField
+	for _, part := range strings.Split(t.text, ".") {
+		for typ.Kind() == reflect.Ptr {
+			typ = typ.Elem()
+		}
+		if typ.Kind() != reflect.Struct || typ == timeType {
+			return derivedExpr{}, fmt.Errorf("unknown field %s", t.text)
+		}
+		var found *schemaField
+		for _, f := range schemaFields(typ) {
+			if f.Name == part {
+				f := f
+				found = &f
+				break
+			}
+		}
+		if found == nil {
+			return derivedExpr{}, fmt.Errorf("unknown field %s", t.text)
+		}
+		path = append(path, *found)
+		typ = found.Type
+	}
+
+	leaf := typ
+	for leaf.Kind() == reflect.Ptr {
+		leaf = leaf.Elem()
+	}
+	var result derivedType
+	switch {
+	case leaf == timeType || leaf.Kind() == reflect.String:
+		result = derivedString
+	case leaf.Kind() == reflect.Bool:
+		result = derivedBool
+	case leaf.Kind() >= reflect.Int && leaf.Kind() <= reflect.Float64:
+		result = derivedNumber
+	default:
+		return derivedExpr{}, fmt.Errorf("field %s is not a number, string or boolean", t.text)
+	}
+	return derivedExpr{result, func(env *derivedEnv) interface{} {
+		v := env.msg
+		for _, f := range path {
+			for v.Kind() == reflect.Ptr {
+				if v.IsNil() {
+					return nil
+				}
+				v = v.Elem()
+			}
+			v = v.Field(f.Index)
+			if f.OmitEmpty && v.Kind() != reflect.Bool && v.IsZero() {
+				return nil
+			}
+		}
+		for v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return nil
+			}
+			v = v.Elem()
+		}
+		switch {
+		case v.Type() == timeType:
+			return v.Interface().(time.Time).UTC().Format(time.RFC3339Nano)
+		case v.Kind() == reflect.String:
+			return v.String()
+		case v.Kind() == reflect.Bool:
+			return v.Bool()
+		case v.CanInt():
+			return float64(v.Int())
+		case v.CanUint():
+			return float64(v.Uint())
+		case v.Kind() == reflect.Float32:
+			return decimal(float32(v.Float()))
+		}
+		return v.Float()
+	}}, nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// evalDerived compiles src and evaluates it on msg.
+func evalDerived(src string, msg SBS1Message) (interface{}, error) {
+	expr, err := compileDerived(src, map[string]derivedType{})
+	if err != nil {
+		return nil, err
+	}
+	return expr.eval(&derivedEnv{msg: reflect.ValueOf(&msg).Elem(), fields: DerivedValues{}}), nil
+}
+
+func TestCompileDerived(t *testing.T) {
+	full := SBS1Message{
+		Callsign:    "RYR123",
+		Altitude:    35000,
+		Squawk:      7700,
+		GroundSpeed: 451.3,
+		Mach:        0.78,
+		Enrichment:  &Enrichment{Operator: "Ryanair"},
+	}
+	// empty leaves every field out, so they are NULL.
+	var empty SBS1Message
+
+	tests := []struct {
+		name string
+		src  string
+		msg  SBS1Message
+		want interface{}
+	}{
+		// Precedence and associativity.
+		{"times before plus", "1 + 2 * 3", full, 7.0},
+		{"parentheses", "(1 + 2) * 3", full, 9.0},
+		{"minus from the left", "10 - 4 - 3", full, 3.0},
+		{"divide from the left", "12 / 3 / 2", full, 2.0},
+		{"modulo with times", "7 % 4 * 2", full, 6.0},
+		{"unary minus", "2 - -3 * 2", full, 8.0},
+		{"concat with plus", "1 + 2 || 'x'", full, "3x"},
+		{"comparison before NOT", "NOT 1 > 2", full, true},
+		{"NOT before AND", "NOT TRUE AND FALSE", full, false},
+		{"AND before OR", "TRUE OR FALSE AND FALSE", full, true},
+		{"arithmetic before comparison", "altitude / 1000 = 35 AND squawk - 7000 >= 700", full, true},
+		{"keywords in any case", "not true or TRUE", full, true},
+
+		// NULL propagation.
+		{"NULL arithmetic", "altitude + 1", empty, nil},
+		{"NULL negated", "-altitude", empty, nil},
+		{"NULL comparison", "altitude > 1000", empty, nil},
+		{"NULL concat", "callsign || 'x'", empty, nil},
+		{"NULL function argument", "ABS(altitude)", empty, nil},
+		{"NOT NULL", "NOT (altitude > 1000)", empty, nil},
+		{"NULL AND TRUE", "altitude > 1000 AND TRUE", empty, nil},
+		{"NULL AND FALSE", "altitude > 1000 AND FALSE", empty, false},
+		{"NULL OR TRUE", "altitude > 1000 OR TRUE", empty, true},
+		{"NULL OR FALSE", "altitude > 1000 OR FALSE", empty, nil},
+		{"IS NULL", "altitude IS NULL", empty, true},
+		{"IS NOT NULL", "altitude IS NOT NULL", full, true},
+		{"COALESCE", "COALESCE(altitude, squawk, 0)", empty, 0.0},
+		{"COALESCE of a value", "COALESCE(altitude, 0)", full, 35000.0},
+		{"NULL nested field", "enrichment.operator", empty, nil},
+		{"nested field", "enrichment.operator", full, "Ryanair"},
+		{"omitted boolean is false", "on_ground", empty, false},
+		{"NULL condition does not match", "CASE WHEN altitude > 1 THEN 'a' ELSE 'b' END", empty, "b"},
+		{"CASE without ELSE", "CASE WHEN altitude > 1 THEN 'a' END", empty, nil},
+		{"NULL literal", "NULL", full, nil},
+
+		// Division by zero is NULL.
+		{"divide by zero", "1 / 0", full, nil},
+		{"modulo by zero", "5 % 0", full, nil},
+		{"divide by a zero field", "altitude / (squawk - 7700)", full, nil},
+		{"divide by zero coalesced", "COALESCE(1 / 0, -1)", full, -1.0},
+		{"zero divided", "0 / 5", full, 0.0},
+		{"modulo", "altitude % 1000", SBS1Message{Altitude: 35250}, 250.0},
+
+		// LIKE and IN.
+		{"LIKE prefix", "callsign LIKE 'RYR%'", full, true},
+		{"LIKE one character", "callsign LIKE 'RYR_'", full, false},
+		{"LIKE each character", "callsign LIKE 'RYR___'", full, true},
+		{"LIKE anywhere", "callsign LIKE '%R1%'", full, true},
+		{"LIKE is case sensitive", "callsign LIKE 'ryr%'", full, false},
+		{"LIKE quotes the rest", "'abc' LIKE 'a.c'", full, false},
+		{"LIKE matches newlines", "'a' || '\n' || 'b' LIKE 'a%b'", full, true},
+		{"NOT LIKE", "callsign NOT LIKE 'EZY%'", full, true},
+		{"NULL LIKE", "callsign LIKE '%'", empty, nil},
+		{"IN", "squawk IN (7500, 7600, 7700)", full, true},
+		{"IN strings", "callsign IN ('EZY1', 'RYR123')", full, true},
+		{"IN expressions", "altitude IN (1000 * 35, 0)", full, true},
+		{"NOT IN", "squawk NOT IN (7500, 7600)", full, true},
+		{"not IN", "squawk IN (7500, 7600)", full, false},
+		{"IN with a NULL item", "squawk IN (7500, NULL)", full, nil},
+		{"IN a NULL item and a match", "squawk IN (NULL, 7700)", full, true},
+		{"NOT IN with a NULL item", "squawk NOT IN (7500, NULL)", full, nil},
+		{"NULL IN", "altitude IN (1, 2)", empty, nil},
+
+		// float32 fields are widened by their shortest decimal form, not
+		// to their exact binary value.
+		{"float32 field", "ground_speed", full, 451.3},
+		{"float32 arithmetic", "ground_speed * 10", full, 4513.0},
+		{"float32 comparison", "mach = 0.78", full, true},
+		{"float32 concat", "'M' || mach", full, "M0.78"},
+		{"integer field", "altitude * 0.3048", full, 10668.0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := evalDerived(tt.src, tt.msg)
+			if err != nil {
+				t.Fatalf("%s: %v", tt.src, err)
+			}
+			if got != tt.want {
+				t.Errorf("%s = %#v, want %#v", tt.src, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileDerivedErrors(t *testing.T) {
+	tests := []struct {
+		src, want string
+	}{
+		{"altitude + 'x'", "+ needs a number, not a string"},
+		{"'x' || 1 + 2", "+ needs a number, not a string"},
+		{"-callsign", "- needs a number, not a string"},
+		{"altitude = 'x'", "= needs a number, not a string"},
+		{"on_ground < TRUE", "< cannot compare booleans"},
+		{"NOT altitude", "NOT needs a boolean, not a number"},
+		{"altitude AND TRUE", "AND needs a boolean, not a number"},
+		{"TRUE OR callsign", "OR needs a boolean, not a string"},
+		{"altitude LIKE '1%'", "LIKE needs a string, not a number"},
+		{"callsign LIKE callsign", "LIKE needs a string pattern"},
+		{"squawk IN ('7700')", "IN needs a number, not a string"},
+		{"CASE WHEN 1 THEN 2 END", "WHEN needs a boolean, not a number"},
+		{"CASE WHEN on_ground THEN 1 ELSE 'x' END", "CASE needs a number, not a string"},
+		{"CASE END", "CASE needs WHEN"},
+		{"COALESCE(altitude, callsign)", "COALESCE needs a number, not a string"},
+		{"ROUND('x')", "ROUND needs a number, not a string"},
+		{"SUBSTR(callsign)", "SUBSTR takes 2 to 3 arguments, not 1"},
+		{"NOSUCH(1)", "unknown function NOSUCH at column 1"},
+		{"nosuch + 1", "unknown field nosuch"},
+		{"enrichment.nosuch", "unknown field enrichment.nosuch"},
+		{"enrichment", "field enrichment is not a number, string or boolean"},
+		{"1 +", "unexpected end of expression"},
+		{"(1 + 2", "expected ) at the end"},
+		{"1 2", `unexpected "2" at column 3`},
+		{"", "missing expression"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			_, err := compileDerived(tt.src, map[string]derivedType{})
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("%s: error %v, want %q", tt.src, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadDerivedFields(t *testing.T) {
+	load := func(src string) (derivedFields, error) {
+		path := filepath.Join(t.TempDir(), "derived.sql")
+		if err := os.WriteFile(path, []byte(src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return loadDerivedFields(path)
+	}
+
+	// Derived fields are typed by their expressions, so a misuse further
+	// down fails when the file is loaded.
+	_, err := load("-- Altitude in metres.\nalt_m = altitude * 0.3048\n\nlabel = alt_m || ' m'\nhalf = label / 2\n")
+	if err == nil || !strings.HasSuffix(err.Error(), "derived.sql:5: half: / needs a number, not a string") {
+		t.Errorf("error %v, want line 5 to need a number", err)
+	}
+	if _, err := load("a = 1\na = 2\n"); err == nil || !strings.Contains(err.Error(), ":2: a is defined twice") {
+		t.Errorf("error %v, want a defined twice", err)
+	}
+	if _, err := load("1a = 1\n"); err == nil || !strings.Contains(err.Error(), ":1: expected 'name = expression'") {
+		t.Errorf("error %v, want a bad name", err)
+	}
+
+	fields, err := load("alt_m = ROUND(altitude * 0.3048)\nhigh = alt_m > 10000\nnothing = altitude / 0\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := SBS1Message{Altitude: 35000}
+	fields.Apply(&msg)
+	want := DerivedValues{"alt_m": 10668.0, "high": true}
+	if !reflect.DeepEqual(msg.Derived, want) {
+		t.Errorf("derived %v, want %v: NULL fields are left out", msg.Derived, want)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+)
+
+// volatileFields change with nearly every message without saying anything
+// new about the aircraft, so a message that only changes them is dropped.
+var volatileFields = map[string]bool{
+	"timestamp": true, "transmission_type": true, "session_id": true, "aircraft_id": true, "flight_id": true,
+	"generated_date": true, "logged_date": true, "signal_dbfs": true, "mlat_timestamp": true,
+	"receiver": true, "receivers": true,
+}
+
+var metricDiffMessages = newCounter("adsb_diff_messages_total", "Messages by how message_diff sent them: full, patch or unchanged (dropped).", "kind")
+
+// messageDiffer keeps the state of every aircraft as consumers who apply
+// the patches see it, and reduces each message to the fields that change
+// that state. Every aircraft's full state is sent again every interval, so
+// a consumer that joins late or misses a patch catches up.
+type messageDiffer struct {
+	interval time.Duration
+	aircraft map[string]*diffState
+	pruned   time.Time
+}
+
+// diffState is what has been sent for an aircraft.
+type diffState struct {
+	fields map[string]json.RawMessage
+	full   time.Time
+	seen   time.Time
+}
+
+func newMessageDiffer(interval time.Duration) *messageDiffer {
+	return &messageDiffer{interval: interval, aircraft: map[string]*diffState{}}
+}
+
+// Apply merges msg into its aircraft's state and sets msg.Diff and
+// msg.Changes to what is sent: "full" with the whole state, or "patch" with
+// the fields that changed, in the manner of a JSON merge patch. It reports
+// false when msg changes nothing and can be dropped. Only aircraft messages
+// are diffed; everything else, and every message of a nil differ, is sent
+// as is.
+func (d *messageDiffer) Apply(msg *SBS1Message, now time.Time) bool {
+	if d == nil || msg.MessageType != "MSG" || msg.Icao24 == "" {
+		return true
+	}
+	d.prune(now)
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return true
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return true
+	}
+
+	state := d.aircraft[msg.Icao24]
+	if state == nil || now.Sub(state.full) >= d.interval {
+		if state == nil {
+			state = &diffState{fields: map[string]json.RawMessage{}}
+			d.aircraft[msg.Icao24] = state
+		}
+		for k, v := range fields {
+			state.fields[k] = v
+		}
+		state.full, state.seen = now, now
+		msg.Diff, msg.Changes = "full", mustMarshal(state.fields)
+		metricDiffMessages.Inc("full")
+		return true
+	}
+
+	patch := map[string]json.RawMessage{}
+	changed := false
+	for k, v := range fields {
+		if prev, ok := state.fields[k]; ok && bytes.Equal(prev, v) {
+			continue
+		}
+		state.fields[k] = v
+		patch[k] = v
+		changed = changed || !volatileFields[k]
+	}
+	state.seen = now
+	if !changed {
+		metricDiffMessages.Inc("unchanged")
+		return false
+	}
+	patch["icao24"], patch["timestamp"] = fields["icao24"], fields["timestamp"]
+	msg.Diff, msg.Changes = "patch", mustMarshal(patch)
+	metricDiffMessages.Inc("patch")
+	return true
+}
+
+// prune forgets aircraft not heard from for an interval, at most once an
+// interval. Their next message would have been a full snapshot anyway.
+func (d *messageDiffer) prune(now time.Time) {
+	if now.Sub(d.pruned) < d.interval {
+		return
+	}
+	d.pruned = now
+	for icao, state := range d.aircraft {
+		if now.Sub(state.seen) >= d.interval {
+			delete(d.aircraft, icao)
+		}
+	}
+}
+
+// mustMarshal encodes a map of encoded values, which cannot fail.
+func mustMarshal(fields map[string]json.RawMessage) json.RawMessage {
+	data, _ := json.Marshal(fields)
+	return data
+}
@@ -0,0 +1,89 @@
+//go:build duckdb
+
+package main
+
+/*
+#cgo LDFLAGS: -lduckdb
+#include <stdlib.h>
+#include <duckdb.h>
+*/
+import "C"
+
+import (
+	"errors"
+	"unsafe"
+)
+
+// duckdbSupported is set in builds with the duckdb tag, which link
+// libduckdb.
+const duckdbSupported = true
+
+// cgoDuckDB is an in-memory DuckDB database and its connection.
+type cgoDuckDB struct {
+	db  C.duckdb_database
+	con C.duckdb_connection
+}
+
+// openDuckDB opens an in-memory DuckDB database.
+func openDuckDB() (queryDB, error) {
+	d := &cgoDuckDB{}
+	if C.duckdb_open(nil, &d.db) != C.DuckDBSuccess {
+		return nil, errors.New("opening DuckDB failed")
+	}
+	if C.duckdb_connect(d.db, &d.con) != C.DuckDBSuccess {
+		C.duckdb_close(&d.db)
+		return nil, errors.New("connecting to DuckDB failed")
+	}
+	return d, nil
+}
+
+// Query runs the statements in query and calls row for each row the last
+// of them returns.
+func (d *cgoDuckDB) Query(query string, row func(columns []string, values []interface{}) error) error {
+	cquery := C.CString(query)
+	defer C.free(unsafe.Pointer(cquery))
+	var res C.duckdb_result
+	defer C.duckdb_destroy_result(&res)
+	if C.duckdb_query(d.con, cquery, &res) != C.DuckDBSuccess {
+		return errors.New(C.GoString(C.duckdb_result_error(&res)))
+	}
+
+	ncols := C.duckdb_column_count(&res)
+	columns := make([]string, ncols)
+	for i := range columns {
+		columns[i] = C.GoString(C.duckdb_column_name(&res, C.idx_t(i)))
+	}
+	nrows := C.duckdb_row_count(&res)
+	for r := C.idx_t(0); r < nrows; r++ {
+		values := make([]interface{}, ncols)
+		for i := range values {
+			col := C.idx_t(i)
+			if C.duckdb_value_is_null(&res, col, r) {
+				continue
+			}
+			switch C.duckdb_column_type(&res, col) {
+			case C.DUCKDB_TYPE_BOOLEAN:
+				values[i] = bool(C.duckdb_value_boolean(&res, col, r))
+			case C.DUCKDB_TYPE_TINYINT, C.DUCKDB_TYPE_SMALLINT, C.DUCKDB_TYPE_INTEGER, C.DUCKDB_TYPE_BIGINT,
+				C.DUCKDB_TYPE_UTINYINT, C.DUCKDB_TYPE_USMALLINT, C.DUCKDB_TYPE_UINTEGER:
+				values[i] = int64(C.duckdb_value_int64(&res, col, r))
+			case C.DUCKDB_TYPE_FLOAT, C.DUCKDB_TYPE_DOUBLE:
+				values[i] = float64(C.duckdb_value_double(&res, col, r))
+			default:
+				s := C.duckdb_value_varchar(&res, col, r)
+				values[i] = C.GoString(s)
+				C.duckdb_free(unsafe.Pointer(s))
+			}
+		}
+		if err := row(columns, values); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *cgoDuckDB) Close() error {
+	C.duckdb_disconnect(&d.con)
+	C.duckdb_close(&d.db)
+	return nil
+}
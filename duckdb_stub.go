@@ -0,0 +1,13 @@
+//go:build !duckdb
+
+package main
+
+import "errors"
+
+// duckdbSupported is unset in builds without the duckdb tag, which do not
+// need libduckdb.
+const duckdbSupported = false
+
+func openDuckDB() (queryDB, error) {
+	return nil, errors.New("this build has no DuckDB support, rebuild it with -tags duckdb")
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Enrichment is reference data about an aircraft and its flight, looked up
+// in the enrichment databases.
+type Enrichment struct {
+	Registration    string `json:"registration,omitempty"`
+	AircraftType    string `json:"aircraft_type,omitempty"`
+	Operator        string `json:"operator,omitempty"`
+	Origin          string `json:"origin,omitempty"`
+	OriginName      string `json:"origin_name,omitempty"`
+	Destination     string `json:"destination,omitempty"`
+	DestinationName string `json:"destination_name,omitempty"`
+}
+
+// lookupTimeout bounds a lookup API request.
+const lookupTimeout = 2 * time.Second
+
+// lookupConcurrency is how many lookup API requests a database has in
+// flight at once.
+const lookupConcurrency = 4
+
+// referenceDB is a CSV file keyed by its first column, held in memory. The
+// records are replaced as a whole when the source changes, so lookups never
+// see a half-loaded file and need no lock.
+//
+// A source URL containing {key} is instead a lookup API queried per key in
+// the background, with the results cached.
+type referenceDB struct {
+	name   string
+	source string
+	key    string
+	fields []string
+	client *http.Client
+	cache  *lookupCache
+
+	mu       sync.Mutex
+	inflight map[string]bool
+	slots    chan struct{}
+	// fetched is called when a lookup API answer has been cached.
+	fetched func(key string, found bool)
+
+	records atomic.Value // map[string][]string
+
+	// For files: the state that was loaded and the one seen at the last
+	// check. A change is only loaded once the file stops changing, so a
+	// copy in progress is not picked up half-written.
+	loaded, seen fileState
+	// For URLs: validators for conditional downloads.
+	etag, lastModified string
+}
+
+// fileState identifies a version of a file.
+type fileState struct {
+	size    int64
+	modTime time.Time
+}
+
+// newReferenceDB loads a database from a file path or an http(s) URL. Each
+// row must have the key followed by fields; a first row whose first field is
+// the key column's name is a header and skipped.
+func newReferenceDB(name, source, key string, fields []string) (*referenceDB, error) {
+	db := &referenceDB{name: name, source: source, key: key, fields: fields, client: &http.Client{Timeout: 5 * time.Minute}}
+	if db.perKey() {
+		db.client.Timeout = lookupTimeout
+		db.cache = newLookupCache(ENRICHMENT_CACHE_SIZE, ENRICHMENT_CACHE_TTL, ENRICHMENT_NEGATIVE_TTL)
+		db.inflight = map[string]bool{}
+		db.slots = make(chan struct{}, lookupConcurrency)
+		return db, nil
+	}
+	if _, err := db.refresh(); err != nil {
+		return nil, fmt.Errorf("loading %s database: %w", name, err)
+	}
+	return db, nil
+}
+
+// Lookup returns the fields after the key of the row for key. For a lookup
+// API, pending reports that the key is not cached and is being looked up.
+func (db *referenceDB) Lookup(key string) (row []string, pending bool) {
+	if db == nil || key == "" {
+		return nil, false
+	}
+	key = strings.ToUpper(key)
+	if db.cache != nil {
+		return db.query(key)
+	}
+	records, _ := db.records.Load().(map[string][]string)
+	return records[key], false
+}
+
+// query looks key up in the cache. On a miss the lookup API is asked in the
+// background, so a slow API never holds up the pipeline.
+func (db *referenceDB) query(key string) ([]string, bool) {
+	if row, ok := db.cache.Get(key, time.Now()); ok {
+		metricEnrichmentCacheHits.Inc(db.name)
+		return row, false
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if !db.inflight[key] {
+		metricEnrichmentCacheMisses.Inc(db.name)
+		db.inflight[key] = true
+		go db.resolve(key)
+	}
+	return nil, true
+}
+
+// resolve asks the lookup API about key and caches the answer. A failed
+// request is cached like an unknown key, so a struggling API is asked again
+// only after the negative TTL.
+func (db *referenceDB) resolve(key string) {
+	db.slots <- struct{}{}
+	row, err := db.fetch(key)
+	<-db.slots
+	if err != nil {
+		metricEnrichmentLookupErrors.Inc(db.name)
+	}
+	db.cache.Put(key, row, time.Now())
+	db.mu.Lock()
+	delete(db.inflight, key)
+	db.mu.Unlock()
+	if db.fetched != nil {
+		db.fetched(key, row != nil)
+	}
+}
+
+// fetch asks the lookup API about key. The response is a JSON object with
+// the database's field names; 404 means the key is unknown.
+func (db *referenceDB) fetch(key string) ([]string, error) {
+	req, err := http.NewRequest(http.MethodGet, strings.ReplaceAll(db.source, "{key}", url.PathEscape(key)), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgent())
+	req.Header.Set("Accept", "application/json")
+	res, err := db.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	switch {
+	case res.StatusCode == http.StatusNotFound:
+		return nil, nil
+	case res.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("looking up %s returned %s", key, res.Status)
+	}
+	var record map[string]interface{}
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&record); err != nil {
+		return nil, fmt.Errorf("decoding %s lookup: %w", key, err)
+	}
+	row := make([]string, len(db.fields))
+	found := false
+	for i, field := range db.fields {
+		if value, ok := record[field]; ok && value != nil {
+			row[i] = strings.TrimSpace(fmt.Sprint(value))
+			found = found || row[i] != ""
+		}
+	}
+	if !found {
+		return nil, nil
+	}
+	return row, nil
+}
+
+// Len returns the number of records.
+func (db *referenceDB) Len() int {
+	records, _ := db.records.Load().(map[string][]string)
+	return len(records)
+}
+
+// perKey reports whether the source is a lookup API rather than a database
+// loaded whole.
+func (db *referenceDB) perKey() bool {
+	return strings.Contains(db.source, "{key}")
+}
+
+// remote reports whether the database is downloaded rather than read from
+// a local file.
+func (db *referenceDB) remote() bool {
+	return strings.HasPrefix(db.source, "http://") || strings.HasPrefix(db.source, "https://")
+}
+
+// refresh reloads the database if its source changed, reporting whether it
+// did. On error the current records stay in use.
+func (db *referenceDB) refresh() (bool, error) {
+	if db.perKey() {
+		return false, nil
+	}
+	if db.remote() {
+		return db.download()
+	}
+	info, err := os.Stat(db.source)
+	if err != nil {
+		return false, err
+	}
+	state := fileState{size: info.Size(), modTime: info.ModTime()}
+	settled := state == db.seen
+	db.seen = state
+	if db.records.Load() != nil && (state == db.loaded || !settled) {
+		return false, nil
+	}
+	f, err := os.Open(db.source)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	if err := db.load(f); err != nil {
+		return false, err
+	}
+	db.loaded = state
+	return true, nil
+}
+
+// download fetches the database unless the server reports it unchanged.
+func (db *referenceDB) download() (bool, error) {
+	req, err := http.NewRequest(http.MethodGet, db.source, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("User-Agent", userAgent())
+	if db.etag != "" {
+		req.Header.Set("If-None-Match", db.etag)
+	}
+	if db.lastModified != "" {
+		req.Header.Set("If-Modified-Since", db.lastModified)
+	}
+	res, err := db.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+	switch {
+	case res.StatusCode == http.StatusNotModified:
+		return false, nil
+	case res.StatusCode != http.StatusOK:
+		return false, fmt.Errorf("downloading %s returned %s", db.source, res.Status)
+	}
+	if err := db.load(res.Body); err != nil {
+		return false, err
+	}
+	db.etag, db.lastModified = res.Header.Get("ETag"), res.Header.Get("Last-Modified")
+	return true, nil
+}
+
+// load parses a complete CSV and swaps it in.
+func (db *referenceDB) load(r io.Reader) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	records := map[string][]string{}
+	for line := 1; ; line++ {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if line == 1 && strings.EqualFold(row[0], db.key) {
+			continue
+		}
+		if len(row) < 1+len(db.fields) {
+			return fmt.Errorf("line %d has %d fields, expected %d", line, len(row), 1+len(db.fields))
+		}
+		for i := range row {
+			row[i] = strings.TrimSpace(row[i])
+		}
+		records[strings.ToUpper(row[0])] = row[1:]
+	}
+	if len(records) == 0 {
+		return errors.New("no records")
+	}
+	db.records.Store(records)
+	return nil
+}
+
+// enricher looks up aircraft in the registry, route and airport databases
+// and keeps them current while the collector runs.
+//
+// Lookup API answers usually arrive after the message that asked for them
+// was sent, so the flights that were waiting get an ENRICHMENT_UPDATE event
+// on updates instead.
+type enricher struct {
+	registry *referenceDB
+	airports *referenceDB
+	routes   *referenceDB
+
+	updates chan<- SBS1Message
+	done    <-chan struct{}
+
+	mu sync.Mutex
+	// waiting holds, by database name and key, the aircraft whose last
+	// lookup is pending on it, by flight UUID.
+	waiting map[string]map[string]Aircraft
+}
+
+// newEnricher loads the configured databases. Each may be empty. Late
+// updates are sent on updates until done is closed.
+func newEnricher(registry, airports, routes string, updates chan<- SBS1Message, done <-chan struct{}) (*enricher, error) {
+	e := &enricher{updates: updates, done: done, waiting: map[string]map[string]Aircraft{}}
+	for _, db := range []struct {
+		ptr    **referenceDB
+		name   string
+		source string
+		key    string
+		fields []string
+	}{
+		{&e.registry, "registry", registry, "icao24", []string{"registration", "type", "operator"}},
+		{&e.airports, "airport", airports, "icao", []string{"name"}},
+		{&e.routes, "route", routes, "callsign", []string{"origin", "destination"}},
+	} {
+		if db.source == "" {
+			continue
+		}
+		var err error
+		if *db.ptr, err = newReferenceDB(db.name, db.source, db.key, db.fields); err != nil {
+			return nil, err
+		}
+		if (*db.ptr).perKey() {
+			name := db.name
+			(*db.ptr).fetched = func(key string, found bool) { e.fetched(name, key, found) }
+			log.Printf("Looking up %s records at %s", db.name, db.source)
+			continue
+		}
+		log.Printf("Loaded %d %s records from %s", (*db.ptr).Len(), db.name, db.source)
+	}
+	return e, nil
+}
+
+// Watch checks local files every fileInterval and downloads remote ones
+// every downloadInterval, swapping in new versions as they appear.
+func (e *enricher) Watch(fileInterval, downloadInterval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(fileInterval)
+	defer ticker.Stop()
+	lastDownload := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+		download := time.Since(lastDownload) >= downloadInterval
+		if download {
+			lastDownload = time.Now()
+		}
+		for _, db := range []*referenceDB{e.registry, e.airports, e.routes} {
+			if db == nil || (db.remote() && !download) {
+				continue
+			}
+			reloaded, err := db.refresh()
+			switch {
+			case err != nil:
+				metricEnrichmentReloadErrors.Inc(db.name)
+				log.Printf("Error reloading %s database, keeping the current one: %v", db.name, err)
+			case reloaded:
+				metricEnrichmentReloads.Inc(db.name)
+				log.Printf("Reloaded %d %s records from %s", db.Len(), db.name, db.source)
+			}
+		}
+	}
+}
+
+// Lookup returns what the databases know about an aircraft, or nil.
+func (e *enricher) Lookup(a Aircraft) *Enrichment {
+	if e == nil {
+		return nil
+	}
+	// Holding mu until the pending lookups are noted means an answer
+	// cannot arrive in between and be missed.
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var en Enrichment
+	if row := e.lookup(e.registry, a.Icao24, a); row != nil {
+		en.Registration, en.AircraftType, en.Operator = row[0], row[1], row[2]
+	}
+	if row := e.lookup(e.routes, a.Callsign, a); row != nil {
+		en.Origin, en.Destination = row[0], row[1]
+		if airport := e.lookup(e.airports, en.Origin, a); airport != nil {
+			en.OriginName = airport[0]
+		}
+		if airport := e.lookup(e.airports, en.Destination, a); airport != nil {
+			en.DestinationName = airport[0]
+		}
+	}
+	if en == (Enrichment{}) {
+		return nil
+	}
+	return &en
+}
+
+// lookup looks key up in db, noting a as waiting if the answer is pending.
+func (e *enricher) lookup(db *referenceDB, key string, a Aircraft) []string {
+	row, pending := db.Lookup(key)
+	if pending && a.FlightUUID != "" {
+		id := db.name + " " + strings.ToUpper(key)
+		if e.waiting[id] == nil {
+			e.waiting[id] = map[string]Aircraft{}
+		}
+		e.waiting[id][a.FlightUUID] = a
+	}
+	return row
+}
+
+// fetched sends an update to each flight that was waiting for key, if the
+// lookup API knew it. The update is timestamped with the flight's last
+// message, which is when it was missing.
+func (e *enricher) fetched(name, key string, found bool) {
+	id := name + " " + key
+	e.mu.Lock()
+	waiting := e.waiting[id]
+	delete(e.waiting, id)
+	e.mu.Unlock()
+	if !found {
+		return
+	}
+	for _, a := range waiting {
+		en := e.Lookup(a)
+		if en == nil {
+			continue
+		}
+		update := SBS1Message{
+			Timestamp:   formatTimestamp(a.LastSeen),
+			MessageType: "ENRICHMENT_UPDATE",
+			Icao24:      a.Icao24,
+			Callsign:    a.Callsign,
+			FlightUUID:  a.FlightUUID,
+			Enrichment:  en,
+		}
+		select {
+		case e.updates <- update:
+			metricEnrichmentUpdates.Inc("")
+		case <-e.done:
+			return
+		}
+	}
+}
+
+var (
+	metricEnrichmentReloads      = newCounter("adsb_enrichment_reloads_total", "Enrichment databases swapped in after a change, by database.", "db")
+	metricEnrichmentReloadErrors = newCounter("adsb_enrichment_reload_errors_total", "Failed enrichment database reloads, by database.", "db")
+	metricEnrichmentCacheHits    = newCounter("adsb_enrichment_cache_hits_total", "Enrichment API lookups answered from the cache, including cached misses, by database.", "db")
+	metricEnrichmentCacheMisses  = newCounter("adsb_enrichment_cache_misses_total", "Enrichment API lookups sent to the API, by database.", "db")
+	metricEnrichmentUpdates      = newCounter("adsb_enrichment_updates_total", "ENRICHMENT_UPDATE events sent after a lookup API answered.", "")
+	metricEnrichmentLookupErrors = newCounter("adsb_enrichment_lookup_errors_total", "Failed enrichment API lookups, by database.", "db")
+)
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+)
+
+// errorKind classifies fatal errors so supervisors can react to the exit
+// code instead of parsing log text. The codes follow sysexits.h.
+type errorKind string
+
+const (
+	errConfig   errorKind = "config"
+	errConnect  errorKind = "connect"
+	errAuth     errorKind = "auth"
+	errSink     errorKind = "sink"
+	errInternal errorKind = "internal"
+)
+
+// exitCodes maps each kind to its process exit code.
+var exitCodes = map[errorKind]int{
+	errConfig:   78, // EX_CONFIG: fix the configuration before restarting
+	errConnect:  69, // EX_UNAVAILABLE: the feed is down, retry later
+	errAuth:     77, // EX_NOPERM: the token was rejected, restarting won't help
+	errSink:     75, // EX_TEMPFAIL: a sink failed, retry later
+	errInternal: 1,
+}
+
+// appError is an error with a kind.
+type appError struct {
+	Kind errorKind
+	Err  error
+}
+
+func (e *appError) Error() string { return e.Err.Error() }
+func (e *appError) Unwrap() error { return e.Err }
+
+// newError wraps err with kind. Errors that already have a kind keep it.
+func newError(kind errorKind, err error) error {
+	var ae *appError
+	if err == nil || errors.As(err, &ae) {
+		return err
+	}
+	return &appError{Kind: kind, Err: err}
+}
+
+// configErrorf creates a configuration error.
+func configErrorf(format string, args ...interface{}) error {
+	return &appError{Kind: errConfig, Err: fmt.Errorf(format, args...)}
+}
+
+// errorKindOf returns the kind of err, or errInternal for untyped errors.
+func errorKindOf(err error) errorKind {
+	var ae *appError
+	if errors.As(err, &ae) {
+		return ae.Kind
+	}
+	return errInternal
+}
+
+// exit reports a fatal error and exits with the code for its kind. In json
+// format the last line on stderr is a single JSON object for tooling.
+func exit(err error, format string) {
+	kind := errorKindOf(err)
+	code := exitCodes[kind]
+	if format == "json" {
+		line, _ := json.Marshal(map[string]interface{}{
+			"level":     "fatal",
+			"kind":      kind,
+			"exit_code": code,
+			"error":     err.Error(),
+		})
+		fmt.Fprintln(os.Stderr, string(line))
+	} else {
+		log.Printf("Fatal %s error: %v", kind, err)
+	}
+	os.Exit(code)
+}
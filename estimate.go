@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// sinkPayload renders a batch the way a sink would upload it, for estimating
+// volume without sending anything.
+type sinkPayload struct {
+	name   string
+	encode func([]SBS1Message) ([]byte, error)
+}
+
+// sinkPayloads lists every sink the estimate command reports on.
+var sinkPayloads = []sinkPayload{
+	{"dataset", buildPayload},
+}
+
+// estimateCommand projects daily event and byte volumes per sink.
+func estimateCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "estimate",
+		Usage: "Run the pipeline on the live feed or a capture without uploading and report projected events and bytes per day for each sink.",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "capture",
+				Usage: "Read this raw SBS-1 capture instead of the live feed. The projection uses the time the capture spans.",
+			},
+			&cli.DurationFlag{
+				Name:  "duration",
+				Value: 10 * time.Minute,
+				Usage: "How long to read the live feed for.",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			var err error
+			if surface, err = newSurfaceFilter(VEHICLE_ICAO_RANGES.Value(), OBSTACLE_ICAO_RANGES.Value(), VEHICLES, OBSTACLES); err != nil {
+				return err
+			}
+			if transmissionTypes, err = parseTransmissionTypes(TRANSMISSION_TYPES.Value()); err != nil {
+				return configErrorf("%v", err)
+			}
+			if ids, err = newIDScheme(ID_FORMAT); err != nil {
+				return configErrorf("%v", err)
+			}
+			if eventParsers, err = parseEventClassValues("dataset_parser", DATASET_PARSER.Value()); err != nil {
+				return configErrorf("%v", err)
+			}
+			if eventSeverities, err = parseEventSeverities(DATASET_SEVERITY.Value()); err != nil {
+				return configErrorf("%v", err)
+			}
+			if SOURCE == "" {
+				SOURCE = INPUT_FORMAT
+			}
+			name, _, err := splitHosts()
+			if err != nil {
+				return configErrorf("%v", err)
+			}
+			if RECEIVER_NAME == "" {
+				RECEIVER_NAME = name
+			}
+
+			var r io.Reader
+			if path := c.String("capture"); path != "" {
+				f, err := openCapture(path)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				r = f
+				clock = &recordedClock{}
+			} else {
+				if DUMP1090_HOST == "" && SERIAL_DEVICE == "" {
+					return configErrorf("dump1090_host is not set. Give a --capture or the feed to sample")
+				}
+				// A polled feed or stdin ends at stop; a connection at its deadline.
+				stop := make(chan struct{})
+				defer time.AfterFunc(c.Duration("duration"), func() { close(stop) }).Stop()
+				conn, err := openFeed(feedAddr(), 0, stop)
+				if err != nil {
+					return err
+				}
+				defer conn.Close()
+				if nc, ok := conn.(net.Conn); ok {
+					nc.SetReadDeadline(time.Now().Add(c.Duration("duration")))
+				}
+				log.Printf("Sampling %s for %s", feedAddr(), c.Duration("duration"))
+				r = feedReader(conn)
+			}
+
+			est, err := runEstimate(r)
+			if err != nil {
+				return err
+			}
+			return est.Print(os.Stdout)
+		},
+	}
+}
+
+// estimate is the outcome of an estimate run.
+type estimate struct {
+	lines, events int
+	span          time.Duration
+	bytes         map[string]int
+}
+
+// runEstimate sends the lines in r through parsing, filtering and tracking,
+// and encodes the surviving events in batches for every sink. Reading stops
+// at the end of r or when a live feed's read deadline passes.
+func runEstimate(r io.Reader) (*estimate, error) {
+	est := &estimate{bytes: map[string]int{}}
+	tracker := newTracker()
+	sizer := newBatchSizer()
+	batch := make([]SBS1Message, 0, sizer.min)
+	var first, last time.Time
+
+	encode := func() error {
+		for _, sink := range sinkPayloads {
+			data, err := sink.encode(batch)
+			if err != nil {
+				return fmt.Errorf("encoding for %s: %w", sink.name, err)
+			}
+			est.bytes[sink.name] += len(data)
+		}
+		batch = batch[:0]
+		return nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		est.lines++
+		parsed, ok := parseLine(scanner.Text())
+		if !ok || !transmissionTypes.Keep(parsed) || !surface.Apply(&parsed) {
+			continue
+		}
+		tracker.annotate(&parsed)
+		if ts, err := parseTimestamp(parsed.Timestamp); err == nil {
+			if first.IsZero() {
+				first = ts
+			}
+			last = ts
+		}
+		est.events++
+		batch = append(batch, parsed)
+		sizer.Observe(1, clock.Now())
+		if sizer.Full(len(batch)) {
+			if err := encode(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			return nil, err
+		}
+	}
+	if len(batch) > 0 {
+		if err := encode(); err != nil {
+			return nil, err
+		}
+	}
+	est.span = last.Sub(first)
+	return est, nil
+}
+
+// Print writes the projection as a table.
+func (e *estimate) Print(w io.Writer) error {
+	if e.span <= 0 {
+		return fmt.Errorf("read %d lines (%d events) without a measurable time span; sample for longer", e.lines, e.events)
+	}
+	perDay := float64(24*time.Hour) / float64(e.span)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "sampled\t%s, %d lines, %d events after filters\n", e.span.Round(time.Second), e.lines, e.events)
+	fmt.Fprintln(tw)
+	fmt.Fprintln(tw, "SINK\tEVENTS/DAY\tBYTES/DAY\tBYTES/EVENT")
+	for _, sink := range sinkPayloads {
+		bytes := e.bytes[sink.name]
+		perEvent := 0.0
+		if e.events > 0 {
+			perEvent = float64(bytes) / float64(e.events)
+		}
+		fmt.Fprintf(tw, "%s\t%.0f\t%s\t%.0f\n", sink.name, float64(e.events)*perDay, formatBytes(float64(bytes)*perDay), perEvent)
+	}
+	return tw.Flush()
+}
+
+// formatBytes renders a byte count with a binary unit.
+func formatBytes(n float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
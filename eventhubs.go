@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// eventhubsPendingMax bounds the messages waiting to be sent, which
+	// includes those kept for a retry while Event Hubs is unreachable.
+	eventhubsPendingMax = 100000
+	// eventhubsBatchBytes is the most a batch may hold, below the 1 MB
+	// Event Hubs takes in one request on the Standard tier.
+	eventhubsBatchBytes = 1000 << 10
+	// eventhubsConcurrency is how many partition keys are sent at once.
+	// Each key's batches still go out one after the other.
+	eventhubsConcurrency = 8
+	// eventhubsTokenLife is how long a shared access signature is valid.
+	eventhubsTokenLife = time.Hour
+)
+
+// eventhubsConnection is a parsed Event Hubs connection string, as copied
+// from a shared access policy in the Azure portal.
+type eventhubsConnection struct {
+	endpoint string // https://NAMESPACE.servicebus.windows.net
+	keyName  string
+	key      string
+	entity   string // the event hub, if the policy belongs to one
+}
+
+// parseEventHubsConnection parses a connection string of the form
+// "Endpoint=sb://NAMESPACE.servicebus.windows.net/;SharedAccessKeyName=NAME;SharedAccessKey=KEY[;EntityPath=HUB]".
+// sb:// endpoints are reached over HTTPS; http:// and https:// ones are
+// taken as they are, e.g. for a proxy.
+func parseEventHubsConnection(s string) (eventhubsConnection, error) {
+	var c eventhubsConnection
+	for _, part := range strings.Split(s, ";") {
+		name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch strings.ToLower(name) {
+		case "endpoint":
+			c.endpoint = value
+		case "sharedaccesskeyname":
+			c.keyName = value
+		case "sharedaccesskey":
+			c.key = value
+		case "entitypath":
+			c.entity = value
+		}
+	}
+	if c.endpoint == "" || c.keyName == "" || c.key == "" {
+		return c, fmt.Errorf("expected 'Endpoint=sb://NAMESPACE.servicebus.windows.net/;SharedAccessKeyName=NAME;SharedAccessKey=KEY'")
+	}
+	u, err := url.Parse(c.endpoint)
+	if err != nil || u.Host == "" {
+		return c, fmt.Errorf("invalid Endpoint %q", c.endpoint)
+	}
+	switch u.Scheme {
+	case "sb":
+		u.Scheme = "https"
+	case "http", "https":
+	default:
+		return c, fmt.Errorf("invalid Endpoint %q, expected an sb:// URL", c.endpoint)
+	}
+	c.endpoint = u.Scheme + "://" + u.Host
+	return c, nil
+}
+
+// sign returns a shared access signature for resource that is valid until
+// expiry.
+func (c eventhubsConnection) sign(resource string, expiry time.Time) string {
+	encoded := url.QueryEscape(resource)
+	se := fmt.Sprint(expiry.Unix())
+	mac := hmac.New(sha256.New, []byte(c.key))
+	mac.Write([]byte(encoded + "\n" + se))
+	sig := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	return "SharedAccessSignature sr=" + encoded + "&sig=" + url.QueryEscape(sig) + "&se=" + se + "&skn=" + url.QueryEscape(c.keyName)
+}
+
+// eventhubsSink sends every decoded aircraft message to an Azure event hub
+// every interval through its REST API, as the message's JSON. Messages are
+// batched by partition key, the ICAO address or receiver as configured, so
+// each aircraft's messages land on one partition in order: a key's batches
+// are sent one at a time, and those that fail are sent again before
+// anything queued since. Without a partition key, Event Hubs spreads the
+// batches over its partitions.
+type eventhubsSink struct {
+	*batchSink
+	conn eventhubsConnection
+	hub  string
+	// partitionKey is "icao24", "receiver" or "none".
+	partitionKey string
+	client       *http.Client
+}
+
+// newEventHubsSink starts sending in the background. connection has been
+// checked by sinkConfig.validate.
+func newEventHubsSink(connection, hub, partitionKey string, interval time.Duration) *eventhubsSink {
+	conn, _ := parseEventHubsConnection(connection)
+	if hub == "" {
+		hub = conn.entity
+	}
+	s := &eventhubsSink{
+		conn: conn, hub: hub, partitionKey: partitionKey,
+		client: withChaos("eventhubs", newHTTPClient()),
+	}
+	s.batchSink = newBatchSink("eventhubs", "Event Hubs", "event hub "+hub, eventhubsPendingMax, interval, s.write)
+	return s
+}
+
+// key returns the partition key of msg, empty for none.
+func (s *eventhubsSink) key(msg SBS1Message) string {
+	switch s.partitionKey {
+	case "icao24":
+		return msg.Icao24
+	case "receiver":
+		return msg.Receiver
+	}
+	return ""
+}
+
+// write sends msgs, several partition keys at once, and returns the
+// messages of the keys that failed from their first unsent batch on.
+func (s *eventhubsSink) write(msgs []SBS1Message) ([]SBS1Message, error) {
+	// Group by partition key, in the order the keys first appear.
+	var keys []string
+	groups := map[string][]SBS1Message{}
+	for _, msg := range msgs {
+		key := s.key(msg)
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], msg)
+	}
+
+	unsent := make([][]SBS1Message, len(keys))
+	errs := make([]error, len(keys))
+	slots := make(chan struct{}, eventhubsConcurrency)
+	var wg sync.WaitGroup
+	for i, key := range keys {
+		i, key := i, key
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			unsent[i], errs[i] = s.sendKey(key, groups[key])
+		}()
+	}
+	wg.Wait()
+
+	var err error
+	var retry []SBS1Message
+	for i := range keys {
+		if err == nil {
+			err = errs[i]
+		}
+		retry = append(retry, unsent[i]...)
+	}
+	return retry, err
+}
+
+// sendKey sends the messages of one partition key in batches of up to
+// eventhubsBatchBytes, stopping at the first that fails. It returns the
+// messages not sent.
+func (s *eventhubsSink) sendKey(key string, msgs []SBS1Message) ([]SBS1Message, error) {
+	for len(msgs) > 0 {
+		body, n, err := eventhubsBatch(msgs)
+		if err != nil {
+			return msgs, err
+		}
+		if err := s.send(key, body); err != nil {
+			return msgs, err
+		}
+		metricSinkEvents.Add("eventhubs", float64(n))
+		msgs = msgs[n:]
+	}
+	return nil, nil
+}
+
+// eventhubsEvent is an event of a batch send.
+type eventhubsEvent struct {
+	Body           string            `json:"Body"`
+	UserProperties map[string]string `json:"UserProperties"`
+}
+
+// eventhubsBatch encodes as many of msgs as fit in one request, at least
+// one, and returns the body and how many it holds.
+func eventhubsBatch(msgs []SBS1Message) ([]byte, int, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('[')
+	n := 0
+	for _, msg := range msgs {
+		data, err := json.Marshal(msg)
+		if err != nil {
+			return nil, 0, err
+		}
+		event := eventhubsEvent{
+			Body:           string(data),
+			UserProperties: map[string]string{"event_id": eventID(msg), "message_type": msg.MessageType},
+		}
+		if msg.Icao24 != "" {
+			event.UserProperties["icao24"] = msg.Icao24
+		}
+		encoded, err := json.Marshal(event)
+		if err != nil {
+			return nil, 0, err
+		}
+		if n > 0 && buf.Len()+1+len(encoded)+1 > eventhubsBatchBytes {
+			break
+		}
+		if n > 0 {
+			buf.WriteByte(',')
+		}
+		buf.Write(encoded)
+		n++
+	}
+	buf.WriteByte(']')
+	return buf.Bytes(), n, nil
+}
+
+// send posts one batch with partition key key, if any.
+func (s *eventhubsSink) send(key string, body []byte) error {
+	resource := s.conn.endpoint + "/" + s.hub
+	req, err := http.NewRequest(http.MethodPost, resource+"/messages?api-version=2014-01&timeout=60", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/vnd.microsoft.servicebus.json")
+	req.Header.Set("Authorization", s.conn.sign(resource, time.Now().Add(eventhubsTokenLife)))
+	if key != "" {
+		props, _ := json.Marshal(map[string]string{"PartitionKey": key})
+		req.Header.Set("BrokerProperties", string(props))
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		// Errors carry <Error><Code>...</Code><Detail>...</Detail></Error>.
+		var reply struct {
+			Detail string `xml:"Detail"`
+		}
+		err := fmt.Errorf("Event Hubs returned %s", resp.Status)
+		if xml.Unmarshal(data, &reply) == nil && reply.Detail != "" {
+			err = fmt.Errorf("Event Hubs returned %s: %s", resp.Status, reply.Detail)
+		}
+		if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+			return newError(errAuth, err)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// feedRetry is how long an additional feed is waited for before the failure
+// is logged and waiting starts over.
+const feedRetry = time.Hour
+
+// feedLine is a line read from a feed. receiver is only set when several
+// feeds are read, and format only for a feed that is not in INPUT_FORMAT.
+type feedLine struct {
+	receiver string
+	text     string
+	format   string
+}
+
+// extraFeed is a receiver read alongside the main dump1090 feed, parsed
+// from a "name=host[:port]" feed option. Its lines are tagged with
+// receiver, which is its name unless it only adds to another receiver's
+// messages, as mlat-client's results do. A feed with a format is read in
+// it rather than INPUT_FORMAT; for an ADS-C feed, addr is the URL polled.
+type extraFeed struct {
+	name     string
+	addr     string
+	receiver string
+	format   string
+}
+
+// extraFeeds are the additional receivers to read.
+var extraFeeds []extraFeed
+
+// receiverTrust are the position fusion weights of receivers, parsed from
+// RECEIVER_TRUST. Receivers not listed have a weight of 1.
+var receiverTrust map[string]float64
+
+// defaultFeedPorts are dump1090's standard output ports by format.
+var defaultFeedPorts = map[string]string{"sbs": "30003", "avr": "30002", "beast": "30005", "aircraft_json": "80", "readsb_json": "30047", "uat": "30978", "vrs": "80"}
+
+// defaultMLATPort is where piaware and mlat-client serve multilaterated
+// positions as Beast frames.
+const defaultMLATPort = "30105"
+
+// stdinHost is the dump1090_host that reads the feed from standard input.
+const stdinHost = "-"
+
+// feedAddr is the address of the dump1090 output for INPUT_FORMAT,
+// stdinHost or the serial device.
+func feedAddr() string {
+	if SERIAL_DEVICE != "" {
+		return SERIAL_DEVICE
+	}
+	if DUMP1090_HOST == stdinHost {
+		return stdinHost
+	}
+	return net.JoinHostPort(DUMP1090_HOST, feedPort())
+}
+
+// feedPort is the port of the dump1090 output for INPUT_FORMAT.
+func feedPort() string {
+	if DUMP1090_PORT != "" {
+		return DUMP1090_PORT
+	}
+	return defaultFeedPorts[INPUT_FORMAT]
+}
+
+// splitHosts splits a comma-separated DUMP1090_HOST of host[:port]
+// entries. The first is left in DUMP1090_HOST and DUMP1090_PORT as the main
+// feed; the others are returned as additional feeds. Each receiver is
+// named by its entry as given, and the main one's name is returned. Only
+// the main feed can be read from standard input, and it is named "stdin".
+func splitHosts() (string, []extraFeed, error) {
+	if DUMP1090_HOST == "" {
+		return "", nil, nil
+	}
+	var name, mainHost, mainPort string
+	var feeds []extraFeed
+	for i, entry := range strings.Split(DUMP1090_HOST, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			return "", nil, fmt.Errorf("dump1090_host %q has an empty entry", DUMP1090_HOST)
+		}
+		host, port, err := net.SplitHostPort(entry)
+		if err != nil {
+			host, port = entry, ""
+		}
+		if i == 0 {
+			name, mainHost, mainPort = entry, host, port
+			if entry == stdinHost {
+				name = "stdin"
+			}
+			continue
+		}
+		if entry == stdinHost {
+			return "", nil, fmt.Errorf("only the first entry of dump1090_host %q can be '-' (standard input)", DUMP1090_HOST)
+		}
+		if port == "" {
+			port = defaultFeedPorts[INPUT_FORMAT]
+		}
+		feeds = append(feeds, extraFeed{name: entry, addr: net.JoinHostPort(host, port), receiver: entry})
+	}
+	DUMP1090_HOST = mainHost
+	if mainPort != "" {
+		DUMP1090_PORT = mainPort
+	}
+	return name, feeds, nil
+}
+
+// parseFeeds parses "name=host[:port]" feed options, adding them to feeds.
+// Names must be unique and differ from the main receiver's.
+func parseFeeds(specs []string, feeds []extraFeed) ([]extraFeed, error) {
+	names := map[string]bool{RECEIVER_NAME: true}
+	for _, f := range feeds {
+		if names[f.name] {
+			return nil, fmt.Errorf("receiver %q is given twice", f.name)
+		}
+		names[f.name] = true
+	}
+	for _, spec := range specs {
+		name, addr, ok := strings.Cut(spec, "=")
+		name, addr = strings.TrimSpace(name), strings.TrimSpace(addr)
+		if !ok || name == "" || addr == "" || addr == stdinHost {
+			return nil, fmt.Errorf("invalid feed %q, expected 'name=host[:port]'", spec)
+		}
+		if names[name] {
+			return nil, fmt.Errorf("feed name %q is used twice. The main feed is named by receiver_name (%q)", name, RECEIVER_NAME)
+		}
+		names[name] = true
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, defaultFeedPorts[INPUT_FORMAT])
+		}
+		feeds = append(feeds, extraFeed{name: name, addr: addr, receiver: name})
+	}
+	return feeds, nil
+}
+
+// parseTrust parses "name=weight" receiver trust options. Every name must
+// be a receiver that is read.
+func parseTrust(specs []string) (map[string]float64, error) {
+	known := map[string]bool{RECEIVER_NAME: true}
+	for _, f := range extraFeeds {
+		known[f.name] = true
+	}
+	trust := map[string]float64{}
+	for _, spec := range specs {
+		name, value, ok := strings.Cut(spec, "=")
+		name = strings.TrimSpace(name)
+		weight, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if !ok || err != nil || weight < 0 {
+			return nil, fmt.Errorf("invalid receiver trust %q, expected 'name=weight' with a weight of 0 or more", spec)
+		}
+		if !known[name] {
+			return nil, fmt.Errorf("receiver trust names unknown receiver %q. Receivers are named by receiver_name and feed", name)
+		}
+		trust[name] = weight
+	}
+	return trust, nil
+}
+
+// openFeed connects to the dump1090 output at addr, or starts polling its
+// aircraft.json, Virtual Radar Server, an aggregator or OpenSky, or opens
+// the RTL-SDR dongle or a serial device, waiting for up to wait for it to come up. A polled feed
+// ends when stop is closed. With replay, the capture is opened instead.
+func openFeed(addr string, wait time.Duration, stop <-chan struct{}) (io.ReadCloser, error) {
+	if REPLAY != "" {
+		return openCapture(REPLAY)
+	}
+	if addr == stdinHost {
+		return openStdin(stop), nil
+	}
+	if SERIAL_DEVICE != "" {
+		return openSerialFeed(SERIAL_DEVICE, SERIAL_BAUD, wait, stop)
+	}
+	if INPUT_FORMAT == "opensky" {
+		return openOpenSky(OPENSKY_URL, openskyQuery, OPENSKY_CLIENT_ID, OPENSKY_CLIENT_SECRET, OPENSKY_TOKEN_URL, POLL_INTERVAL, wait, stop)
+	}
+	if INPUT_FORMAT == "aircraft_json" {
+		return openAircraftJSON("http://"+addr+AIRCRAFT_JSON_PATH, nil, POLL_INTERVAL, wait, stop)
+	}
+	if INPUT_FORMAT == "vrs" {
+		return openVRS("http://"+addr+VRS_PATH, POLL_INTERVAL, wait, stop)
+	}
+	if INPUT_FORMAT == "rtlsdr" {
+		return openRTLSDR(RTLSDR_DEVICE, SDR_GAIN, RTLSDR_PPM, stop)
+	}
+	if INPUT_FORMAT == "aggregator" {
+		return openAircraftJSON(aggregatorURL(AGGREGATOR_URL, RECEIVER_LAT, RECEIVER_LON, AGGREGATOR_RADIUS), aggregatorHeaders(AGGREGATOR_URL, AGGREGATOR_API_KEY), POLL_INTERVAL, wait, stop)
+	}
+	return dialFeed(addr, wait, stop)
+}
+
+// openStdin returns standard input as a feed that ends when stop is closed.
+// A read from stdin cannot be interrupted, so it is copied through a pipe
+// whose Close ends the feed at once.
+func openStdin(stop <-chan struct{}) io.ReadCloser {
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := io.Copy(pw, os.Stdin)
+		pw.CloseWithError(err)
+	}()
+	go func() {
+		select {
+		case <-stop:
+			pw.Close()
+		case <-done:
+		}
+	}()
+	return pr
+}
+
+// readFeed reads an additional receiver into lines until done is closed.
+// Unlike the main feed, losing it does not stop the collector: it is
+// reconnected.
+func readFeed(f extraFeed, lines chan<- feedLine, done <-chan struct{}) {
+	for {
+		var conn io.ReadCloser
+		var err error
+		switch f.format {
+		case "adsc":
+			conn, err = openADSC(f.addr, ADSC_API_KEY, ADSC_INTERVAL, feedRetry, done)
+		case "":
+			conn, err = openFeed(f.addr, feedRetry, done)
+		default:
+			conn, err = dialFeed(f.addr, feedRetry, done)
+		}
+		if errors.Is(err, errStopped) {
+			return
+		}
+		if err != nil {
+			log.Printf("Error connecting to receiver %s: %v", f.name, err)
+			continue
+		}
+		log.Printf("Reading receiver %s at %s", f.name, f.addr)
+		closed := make(chan struct{})
+		go func() {
+			select {
+			case <-done:
+				conn.Close()
+			case <-closed:
+			}
+		}()
+		var r io.Reader = conn
+		switch f.format {
+		case "":
+			r = feedReader(conn)
+		case "beast":
+			r = beastLines(conn)
+		}
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			select {
+			case lines <- feedLine{receiver: f.receiver, text: scanner.Text(), format: f.format}:
+			case <-done:
+			}
+		}
+		close(closed)
+		conn.Close()
+		select {
+		case <-done:
+			return
+		case <-time.After(time.Second):
+		}
+		log.Printf("Receiver %s disconnected, reconnecting", f.name)
+	}
+}
+
+// feedReader returns the feed as text lines. SBS, AVR, UAT and polled
+// feeds already are; Beast frames are hex encoded one per line, which is also how
+// they are archived and how parseLine expects them. A replayed capture is
+// read as archived.
+func feedReader(conn io.Reader) io.Reader {
+	if INPUT_FORMAT != "beast" || REPLAY != "" {
+		return conn
+	}
+	return beastLines(conn)
+}
+
+// beastLines returns the Beast frames read from conn hex encoded, one per
+// line.
+func beastLines(conn io.Reader) io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(readBeast(conn, func(frame []byte) {
+			fmt.Fprintf(pw, "%x\n", frame)
+		}))
+	}()
+	return pr
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// Surface vehicles (airport tugs, fire trucks, follow-me cars) and obstacle
+// beacons (masts, wind turbines) are assigned ICAO addresses from blocks
+// set aside by the local authority. They show up as aircraft otherwise.
+const (
+	kindVehicle  = "vehicle"
+	kindObstacle = "obstacle"
+)
+
+// icaoRange is an inclusive range of 24-bit ICAO addresses.
+type icaoRange struct {
+	lo, hi uint32
+}
+
+// parseICAORanges parses ranges given as "ADF7C8-ADF7CF" or single addresses.
+func parseICAORanges(specs []string) ([]icaoRange, error) {
+	var ranges []icaoRange
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		loStr, hiStr, isRange := strings.Cut(spec, "-")
+		if !isRange {
+			hiStr = loStr
+		}
+		lo, err := strconv.ParseUint(strings.TrimSpace(loStr), 16, 24)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ICAO range %q: %w", spec, err)
+		}
+		hi, err := strconv.ParseUint(strings.TrimSpace(hiStr), 16, 24)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ICAO range %q: %w", spec, err)
+		}
+		if hi < lo {
+			return nil, fmt.Errorf("invalid ICAO range %q: end is before start", spec)
+		}
+		ranges = append(ranges, icaoRange{uint32(lo), uint32(hi)})
+	}
+	return ranges, nil
+}
+
+// containsICAO reports whether icao falls in any of ranges.
+func containsICAO(ranges []icaoRange, icao string) bool {
+	addr, err := strconv.ParseUint(icao, 16, 24)
+	if err != nil {
+		return false
+	}
+	for _, r := range ranges {
+		if uint32(addr) >= r.lo && uint32(addr) <= r.hi {
+			return true
+		}
+	}
+	return false
+}
+
+// surfaceFilter classifies messages from surface vehicles and obstacles, by
+// their address or the emitter category they broadcast, and keeps, tags or
+// drops them. Each kind has its own mode:
+//
+//	keep  pass the message through unchanged
+//	tag   pass it through with "kind" set, and count it separately
+//	drop  discard it before tracking, alerting and uploading
+type surfaceFilter struct {
+	vehicles     []icaoRange
+	obstacles    []icaoRange
+	vehicleMode  string
+	obstacleMode string
+}
+
+// surface is the filter configured on the command line.
+var surface *surfaceFilter
+
+// newSurfaceFilter parses the configured ranges and modes.
+func newSurfaceFilter(vehicles, obstacles []string, vehicleMode, obstacleMode string) (*surfaceFilter, error) {
+	for _, mode := range []string{vehicleMode, obstacleMode} {
+		if mode != "keep" && mode != "tag" && mode != "drop" {
+			return nil, fmt.Errorf("unknown surface filter mode %q, expected 'keep', 'tag' or 'drop'", mode)
+		}
+	}
+	f := &surfaceFilter{vehicleMode: vehicleMode, obstacleMode: obstacleMode}
+	var err error
+	if f.vehicles, err = parseICAORanges(vehicles); err != nil {
+		return nil, err
+	}
+	if f.obstacles, err = parseICAORanges(obstacles); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Apply tags msg according to its kind and reports whether it should be
+// kept. A nil filter keeps everything.
+func (f *surfaceFilter) Apply(msg *SBS1Message) bool {
+	if f == nil {
+		return true
+	}
+	kind, mode := "", "keep"
+	switch {
+	case containsICAO(f.vehicles, msg.Icao24), msg.Category == "C1", msg.Category == "C2":
+		kind, mode = kindVehicle, f.vehicleMode
+	case containsICAO(f.obstacles, msg.Icao24), msg.Category == "C3", msg.Category == "C4", msg.Category == "C5":
+		kind, mode = kindObstacle, f.obstacleMode
+	}
+	switch mode {
+	case "drop":
+		metricFiltered.Inc(kind)
+		return false
+	case "tag":
+		msg.Kind = kind
+	}
+	return true
+}
+
+var metricFiltered = newCounter("adsb_messages_filtered_total", "Messages dropped by filters, by reason.", "reason")
+
+// typeFilter keeps MSG lines of the listed transmission types. Other
+// message types (AIR, ID, STA, ...) carry no transmission type and are
+// always kept.
+type typeFilter map[int32]bool
+
+// transmissionTypes is the filter configured on the command line.
+var transmissionTypes typeFilter
+
+// parseTransmissionTypes parses transmission types 1 to 8. No types
+// returns a nil filter, which keeps everything.
+func parseTransmissionTypes(specs []string) (typeFilter, error) {
+	var f typeFilter
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		t, err := strconv.Atoi(spec)
+		if err != nil || t < 1 || t > 8 {
+			return nil, fmt.Errorf("invalid transmission type %q, expected 1 to 8", spec)
+		}
+		if f == nil {
+			f = typeFilter{}
+		}
+		f[int32(t)] = true
+	}
+	return f, nil
+}
+
+// Keep reports whether msg should be kept.
+func (f typeFilter) Keep(msg SBS1Message) bool {
+	if f == nil || msg.MessageType != "MSG" || f[msg.TransmissionType] {
+		return true
+	}
+	metricFiltered.Inc("transmission_type")
+	return false
+}
+
+// messageFilter selects a subset of a capture by time range, aircraft and
+// callsign. Empty criteria match everything.
+type messageFilter struct {
+	from, to  time.Time
+	icao      []string
+	callsigns []string
+}
+
+// filterFlags are the selection flags shared by commands that push a
+// capture, such as backfill.
+func filterFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  "from",
+			Usage: "Only include messages received at or after this time (RFC 3339, or a UTC date such as 2024-03-01).",
+		},
+		&cli.StringFlag{
+			Name:  "to",
+			Usage: "Only include messages received before this time (RFC 3339, or a UTC date).",
+		},
+		&cli.StringSliceFlag{
+			Name:  "icao",
+			Usage: "Only include these ICAO addresses. Repeat the flag or separate with commas.",
+		},
+		&cli.StringSliceFlag{
+			Name:  "callsign",
+			Usage: "Only include callsigns starting with this prefix. Repeat the flag or separate with commas.",
+		},
+	}
+}
+
+// newMessageFilter builds the filter from filterFlags.
+func newMessageFilter(c *cli.Context) (*messageFilter, error) {
+	f := &messageFilter{icao: c.StringSlice("icao"), callsigns: c.StringSlice("callsign")}
+	var err error
+	if f.from, err = parseTimeFlag(c.String("from")); err != nil {
+		return nil, fmt.Errorf("invalid --from: %w", err)
+	}
+	if f.to, err = parseTimeFlag(c.String("to")); err != nil {
+		return nil, fmt.Errorf("invalid --to: %w", err)
+	}
+	if !f.from.IsZero() && !f.to.IsZero() && !f.to.After(f.from) {
+		return nil, fmt.Errorf("--to must be after --from")
+	}
+	return f, nil
+}
+
+// parseTimeFlag parses an RFC 3339 time or a UTC date. Empty means unset.
+func parseTimeFlag(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", s)
+}
+
+// Match reports whether msg from aircraft a is selected. The callsign is
+// taken from the tracked aircraft, since most messages do not carry one.
+// Messages without a usable timestamp never match a time range.
+func (f *messageFilter) Match(msg SBS1Message, a Aircraft) bool {
+	if f == nil {
+		return true
+	}
+	if !f.from.IsZero() || !f.to.IsZero() {
+		ts, err := parseTimestamp(msg.Timestamp)
+		if err != nil || ts.Before(f.from) || (!f.to.IsZero() && !ts.Before(f.to)) {
+			return false
+		}
+	}
+	if len(f.icao) > 0 && !containsFold(f.icao, msg.Icao24) {
+		return false
+	}
+	if len(f.callsigns) > 0 && !hasAnyPrefix(a.Callsign, f.callsigns) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// firehosePendingMax bounds the messages waiting to be written, which
+	// includes those kept for a retry while the delivery stream is
+	// unreachable or throttled.
+	firehosePendingMax = 100000
+	// firehoseBatchMax and firehoseBatchBytes are the most records and bytes
+	// PutRecordBatch takes in one request, and firehoseRecordBytes the most
+	// one record holds.
+	firehoseBatchMax    = 500
+	firehoseBatchBytes  = 4 << 20
+	firehoseRecordBytes = 1000 << 10
+	// firehoseRetries is how often the records Firehose rejected are sent
+	// again within a flush, after a growing pause, before they wait for the
+	// next one.
+	firehoseRetries = 3
+)
+
+// firehoseSink writes every decoded aircraft message to a Kinesis Data
+// Firehose delivery stream every interval with PutRecordBatch. Firehose
+// bills and limits by record, not by message, so messages are aggregated:
+// each record holds as many messages as fit in firehoseRecordBytes, as
+// lines of JSON, which Firehose delivers to S3 or Redshift as they are.
+// Records it rejects, usually because the stream is over its throughput,
+// are sent again after a pause; what still fails is kept and sent with the
+// next flush.
+type firehoseSink struct {
+	*batchSink
+	stream string
+	// endpoint is set for Firehose-compatible services such as LocalStack.
+	endpoint string
+	creds    awsCredentials
+	client   *http.Client
+}
+
+// newFirehoseSink starts writing in the background. Close keeps flushing
+// for up to ten seconds while Firehose throttles.
+func newFirehoseSink(stream, region, endpoint, accessKey, secretKey, sessionToken string, interval time.Duration) *firehoseSink {
+	if endpoint == "" {
+		endpoint = "https://firehose." + region + ".amazonaws.com"
+	}
+	s := &firehoseSink{
+		stream: stream, endpoint: strings.TrimSuffix(endpoint, "/"),
+		creds:  awsCredentials{region: region, accessKey: accessKey, secretKey: secretKey, sessionToken: sessionToken},
+		client: withChaos("firehose", newHTTPClient()),
+	}
+	s.batchSink = newBatchSink("firehose", "Firehose", "Firehose stream "+stream, firehosePendingMax, interval, s.write)
+	s.linger = 10 * time.Second
+	return s
+}
+
+// write sends msgs, aggregated into records, in requests of up to
+// firehoseBatchMax records and firehoseBatchBytes, returning the messages
+// of the records Firehose still rejected after the retries and of those
+// not sent after an error.
+func (s *firehoseSink) write(msgs []SBS1Message) ([]SBS1Message, error) {
+	records, err := firehoseRecords(msgs)
+	if err != nil {
+		return nil, err
+	}
+	var unsent []firehoseRecord
+	for len(records) > 0 && err == nil {
+		n, size := 0, 0
+		for n < len(records) && n < firehoseBatchMax && size+len(records[n].Data) <= firehoseBatchBytes {
+			size += len(records[n].Data)
+			n++
+		}
+		if n == 0 {
+			// Firehose rejects the oversized record on its own.
+			n = 1
+		}
+		var failed []firehoseRecord
+		failed, err = s.putWithRetries(records[:n])
+		unsent = append(unsent, failed...)
+		records = records[n:]
+	}
+	unsent = append(unsent, records...)
+	var retry []SBS1Message
+	for _, r := range unsent {
+		retry = append(retry, r.msgs...)
+	}
+	return retry, err
+}
+
+// firehoseRecord is a record of PutRecordBatch and the messages it holds.
+type firehoseRecord struct {
+	Data []byte `json:"Data"`
+	msgs []SBS1Message
+}
+
+// firehoseRecords aggregates msgs, in order, into records of up to
+// firehoseRecordBytes of JSON lines.
+func firehoseRecords(msgs []SBS1Message) ([]firehoseRecord, error) {
+	var records []firehoseRecord
+	var current firehoseRecord
+	for _, msg := range msgs {
+		data, err := json.Marshal(msg)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, '\n')
+		if len(current.msgs) > 0 && len(current.Data)+len(data) > firehoseRecordBytes {
+			records = append(records, current)
+			current = firehoseRecord{}
+		}
+		current.Data = append(current.Data, data...)
+		current.msgs = append(current.msgs, msg)
+	}
+	if len(current.msgs) > 0 {
+		records = append(records, current)
+	}
+	return records, nil
+}
+
+// putWithRetries sends records, then sends the ones Firehose rejected again
+// up to firehoseRetries times, returning those that still failed.
+func (s *firehoseSink) putWithRetries(records []firehoseRecord) ([]firehoseRecord, error) {
+	pause := 100 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		failed, err := s.put(records)
+		if err != nil {
+			return records, err
+		}
+		sent := 0
+		for _, r := range records {
+			sent += len(r.msgs)
+		}
+		for _, r := range failed {
+			sent -= len(r.msgs)
+		}
+		metricSinkEvents.Add("firehose", float64(sent))
+		if len(failed) == 0 || attempt == firehoseRetries {
+			return failed, nil
+		}
+		metricFirehoseRetries.Add("", float64(len(failed)))
+		time.Sleep(pause)
+		pause *= 2
+		records = failed
+	}
+}
+
+// put sends records in one PutRecordBatch request, returning those
+// Firehose rejected.
+func (s *firehoseSink) put(records []firehoseRecord) ([]firehoseRecord, error) {
+	body, err := json.Marshal(struct {
+		DeliveryStreamName string           `json:"DeliveryStreamName"`
+		Records            []firehoseRecord `json:"Records"`
+	}{s.stream, records})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.endpoint+"/", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "Firehose_20150804.PutRecordBatch")
+	s.creds.sign(req, "firehose", body, time.Now().UTC())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		// Errors carry {"__type": "...", "message": "..."}.
+		var reply struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		err := fmt.Errorf("Firehose returned %s", resp.Status)
+		if json.Unmarshal(data, &reply) == nil && reply.Type != "" {
+			err = fmt.Errorf("Firehose returned %s: %s: %s", resp.Status, reply.Type[strings.LastIndex(reply.Type, "#")+1:], reply.Message)
+		}
+		if resp.StatusCode == http.StatusForbidden || strings.Contains(reply.Type, "UnrecognizedClient") {
+			return nil, newError(errAuth, err)
+		}
+		return nil, err
+	}
+	var reply struct {
+		FailedPutCount   int `json:"FailedPutCount"`
+		RequestResponses []struct {
+			ErrorCode string `json:"ErrorCode"`
+		} `json:"RequestResponses"`
+	}
+	if err := json.Unmarshal(data, &reply); err != nil {
+		return nil, fmt.Errorf("reading Firehose's reply: %w", err)
+	}
+	if reply.FailedPutCount == 0 {
+		return nil, nil
+	}
+	if len(reply.RequestResponses) != len(records) {
+		return nil, fmt.Errorf("Firehose answered %d of %d records", len(reply.RequestResponses), len(records))
+	}
+	var failed []firehoseRecord
+	for i, r := range reply.RequestResponses {
+		if r.ErrorCode != "" {
+			failed = append(failed, records[i])
+		}
+	}
+	return failed, nil
+}
+
+var metricFirehoseRetries = newCounter("adsb_firehose_retried_records_total", "Records sent to Firehose again after it rejected them.", "")
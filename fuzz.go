@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"math/rand"
+	"reflect"
+	"strings"
+)
+
+// fuzzValues are field values that have historically tripped up SBS-1
+// parsers.
+var fuzzValues = []string{
+	"", " ", "-", "~", "0", "-1", "1", "NaN", "Inf", "-Inf", "1e40", "-0",
+	"2147483648", "-2147483649", "99999999999999999999", "0x1F", "+12",
+	"2023/13/45", "25:61:61", "2023/02/29", "FL350", "\x00", "ééé",
+	"MSG", "N123,ABC", "\t",
+}
+
+// fuzzParser runs n mutated corpus lines through both parser modes and
+// checks that neither panics and that they agree with each other. It
+// returns the number of failing inputs.
+func fuzzParser(corpus fs.FS, n int, seed int64) (int, error) {
+	seeds, err := fuzzSeeds(corpus)
+	if err != nil {
+		return 0, err
+	}
+
+	log.Printf("Fuzzing parser with %d inputs, seed %d", n, seed)
+	rng := rand.New(rand.NewSource(seed))
+
+	saved := clock
+	defer func() { clock = saved }()
+
+	failed := 0
+	for i := 0; i < n; i++ {
+		line := mutateLine(rng, seeds[rng.Intn(len(seeds))])
+		if err := checkParserModes(line); err != nil {
+			log.Printf("FAIL fuzz input %q: %v", line, err)
+			failed++
+		}
+	}
+	if failed == 0 {
+		log.Printf("PASS fuzz (%d inputs)", n)
+	}
+	return failed, nil
+}
+
+// fuzzSeeds collects every line of the corpus as mutation input.
+func fuzzSeeds(corpus fs.FS) ([]string, error) {
+	cases, err := fs.Glob(corpus, "*.sbs")
+	if err != nil {
+		return nil, err
+	}
+	var seeds []string
+	for _, name := range cases {
+		data, err := fs.ReadFile(corpus, name)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			seeds = append(seeds, scanner.Text())
+		}
+	}
+	if len(seeds) == 0 {
+		return nil, fmt.Errorf("no fuzz seeds found in corpus")
+	}
+	return seeds, nil
+}
+
+// mutateLine applies one to three random mutations to line.
+func mutateLine(rng *rand.Rand, line string) string {
+	for m := rng.Intn(3) + 1; m > 0; m-- {
+		fields := strings.Split(line, ",")
+		switch rng.Intn(6) {
+		case 0: // replace a field with a known-troublesome value
+			fields[rng.Intn(len(fields))] = fuzzValues[rng.Intn(len(fuzzValues))]
+		case 1: // drop a field
+			if len(fields) > 1 {
+				i := rng.Intn(len(fields))
+				fields = append(fields[:i], fields[i+1:]...)
+			}
+		case 2: // duplicate a field
+			i := rng.Intn(len(fields))
+			fields = append(fields[:i+1], append([]string{fields[i]}, fields[i+1:]...)...)
+		case 3: // flip a byte
+			if len(line) > 0 {
+				b := []byte(line)
+				b[rng.Intn(len(b))] = byte(rng.Intn(256))
+				return string(b)
+			}
+		case 4: // truncate
+			if len(line) > 0 {
+				return line[:rng.Intn(len(line))]
+			}
+		case 5: // swap two fields
+			i, j := rng.Intn(len(fields)), rng.Intn(len(fields))
+			fields[i], fields[j] = fields[j], fields[i]
+		}
+		line = strings.Join(fields, ",")
+	}
+	return line
+}
+
+// checkParserModes parses line in both modes and verifies their contract:
+// no panics, strict success implies an identical lenient result, and only
+// line-level strict errors make the lenient parser reject a line.
+func checkParserModes(line string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	clock = &recordedClock{now: conformanceEpoch}
+	lenient, ok := Parse(line)
+	clock = &recordedClock{now: conformanceEpoch}
+	strict, strictErr := ParseStrict(line)
+
+	var fieldErrs ParseErrors
+	isFieldErr := errors.As(strictErr, &fieldErrs)
+	switch {
+	case strictErr != nil && strictErr.Error() == "":
+		return fmt.Errorf("strict parser returned an empty error")
+	case strictErr == nil && !ok:
+		return fmt.Errorf("strict parser accepted a line the lenient parser rejected")
+	case isFieldErr && !ok:
+		return fmt.Errorf("lenient parser rejected a line with only field errors: %v", strictErr)
+	case strictErr != nil && !isFieldErr && ok:
+		return fmt.Errorf("lenient parser accepted a structurally invalid line: %v", strictErr)
+	case ok && (strictErr == nil || isFieldErr) && !reflect.DeepEqual(lenient, strict):
+		return fmt.Errorf("parsers disagree: lenient %+v, strict %+v", lenient, strict)
+	}
+	if ok {
+		if _, err := json.Marshal(lenient); err != nil {
+			return fmt.Errorf("parsed message cannot be encoded: %v", err)
+		}
+	}
+	return nil
+}
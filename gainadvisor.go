@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// gainAdvisorWindow is how many one-minute stats periods are pooled
+	// before judging the gain, so a single close aircraft does not count.
+	gainAdvisorWindow = 15
+	// gainAdvisorMinMessages is the least traffic a window needs to be judged.
+	gainAdvisorMinMessages = 1000
+	// gainAdvisorRepeat is how often a standing advisory is repeated.
+	gainAdvisorRepeat = 6 * time.Hour
+
+	// A well-tuned receiver sees a few percent of messages above -3 dBFS.
+	// Many more means the front end is overloaded; hardly any means weak
+	// signals are probably being lost in the noise.
+	strongSignalHigh = 5.0
+	strongSignalLow  = 0.5
+)
+
+// GainAdvisory is an event advising how to change the SDR gain.
+type GainAdvisory struct {
+	Verdict             string   `json:"verdict"`
+	Message             string   `json:"message"`
+	StrongSignalPercent float64  `json:"strong_signal_percent"`
+	Periods             int      `json:"periods"`
+	Gain                *float64 `json:"gain_db,omitempty"`
+}
+
+// gainAdvisor watches the strong-signal share over a sliding window of
+// receiver stats and advises when the gain looks wrong.
+type gainAdvisor struct {
+	window      []*ReceiverStats
+	verdict     string
+	lastAdvised time.Time
+}
+
+// Observe adds a stats period and returns an ADVISORY event when the
+// verdict changes, or when a bad verdict has stood for gainAdvisorRepeat.
+func (g *gainAdvisor) Observe(rs *ReceiverStats, now time.Time) (SBS1Message, bool) {
+	g.window = append(g.window, rs)
+	if len(g.window) > gainAdvisorWindow {
+		g.window = g.window[1:]
+	}
+
+	strong, accepted := 0, 0
+	for _, s := range g.window {
+		strong += s.StrongSignals
+		accepted += s.Accepted
+	}
+	if len(g.window) < gainAdvisorWindow || accepted < gainAdvisorMinMessages {
+		return SBS1Message{}, false
+	}
+	percent := float64(strong) * 100 / float64(accepted)
+
+	advisory := &GainAdvisory{StrongSignalPercent: percent, Periods: len(g.window), Gain: rs.Gain}
+	switch {
+	case percent > strongSignalHigh:
+		advisory.Verdict = "gain_too_high"
+		advisory.Message = fmt.Sprintf("gain likely too high: %.1f%% strong signals, aim for under %.0f%%", percent, strongSignalHigh)
+	case percent < strongSignalLow:
+		advisory.Verdict = "gain_too_low"
+		advisory.Message = fmt.Sprintf("gain may be too low: %.2f%% strong signals, aim for at least %.1f%%", percent, strongSignalLow)
+	default:
+		advisory.Verdict = "ok"
+		advisory.Message = fmt.Sprintf("gain looks right: %.1f%% strong signals", percent)
+	}
+
+	changed := advisory.Verdict != g.verdict
+	standing := advisory.Verdict != "ok" && now.Sub(g.lastAdvised) >= gainAdvisorRepeat
+	// Stay quiet about a receiver that has been fine from the start.
+	if g.verdict == "" && advisory.Verdict == "ok" {
+		changed = false
+	}
+	g.verdict = advisory.Verdict
+	if !changed && !standing {
+		return SBS1Message{}, false
+	}
+	g.lastAdvised = now
+	return SBS1Message{Timestamp: formatTimestamp(now), MessageType: "ADVISORY", GainAdvisory: advisory}, true
+}
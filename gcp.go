@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gcpMetadataTokenURL hands out tokens of the service account of the GCE
+// instance or GKE workload the collector runs on.
+const gcpMetadataTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+// gcpToken fetches and caches OAuth2 access tokens for Google Cloud APIs,
+// either by signing a JWT with the key of a service account or, without
+// one, from the metadata server.
+type gcpToken struct {
+	scope  string
+	client *http.Client
+	// key is nil to use the metadata server.
+	key *gcpServiceAccount
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// gcpServiceAccount is the part of a service account key file needed to
+// sign token requests.
+type gcpServiceAccount struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+	ProjectID   string `json:"project_id"`
+
+	signer *rsa.PrivateKey
+}
+
+// loadGCPServiceAccount reads a service account key file as downloaded
+// from the Cloud console.
+func loadGCPServiceAccount(path string) (*gcpServiceAccount, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var key gcpServiceAccount
+	if err := json.Unmarshal(data, &key); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if key.ClientEmail == "" || key.PrivateKey == "" {
+		return nil, fmt.Errorf("%s is not a service account key: client_email or private_key is missing", path)
+	}
+	if key.TokenURI == "" {
+		key.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+	block, _ := pem.Decode([]byte(key.PrivateKey))
+	if block == nil {
+		return nil, fmt.Errorf("%s: private_key is not PEM", path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		if parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+			return nil, fmt.Errorf("%s: private_key: %w", path, err)
+		}
+	}
+	rsaKey, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: private_key is not an RSA key", path)
+	}
+	key.signer = rsaKey
+	return &key, nil
+}
+
+// newGCPToken returns tokens for scope, signed with the service account
+// key at keyFile, or from the metadata server when keyFile is empty.
+func newGCPToken(keyFile, scope string, client *http.Client) (*gcpToken, error) {
+	t := &gcpToken{scope: scope, client: client}
+	if keyFile != "" {
+		var err error
+		if t.key, err = loadGCPServiceAccount(keyFile); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// Get returns a token that is valid for at least another minute.
+func (t *gcpToken) Get() (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.token != "" && time.Until(t.expires) > time.Minute {
+		return t.token, nil
+	}
+
+	var req *http.Request
+	var err error
+	if t.key != nil {
+		assertion, err := t.key.assertion(t.scope, time.Now())
+		if err != nil {
+			return "", err
+		}
+		form := url.Values{"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"}, "assertion": {assertion}}
+		if req, err = http.NewRequest(http.MethodPost, t.key.TokenURI, strings.NewReader(form.Encode())); err != nil {
+			return "", err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		if req, err = http.NewRequest(http.MethodGet, gcpMetadataTokenURL+"?scopes="+url.QueryEscape(t.scope), nil); err != nil {
+			return "", err
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+	}
+	req.Header.Set("User-Agent", userAgent())
+	res, err := t.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("fetching a Google Cloud token: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", newError(errAuth, fmt.Errorf("fetching a Google Cloud token: %s returned %s", req.URL.Host, res.Status))
+	}
+	var body struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil || body.AccessToken == "" {
+		return "", fmt.Errorf("fetching a Google Cloud token: %s returned no access_token", req.URL.Host)
+	}
+	t.token = body.AccessToken
+	t.expires = time.Now().Add(time.Duration(body.ExpiresIn) * time.Second)
+	return t.token, nil
+}
+
+// authorize adds the token to req.
+func (t *gcpToken) authorize(req *http.Request) error {
+	token, err := t.Get()
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+// assertion returns the signed JWT a token is requested with.
+func (k *gcpServiceAccount) assertion(scope string, now time.Time) (string, error) {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   k.ClientEmail,
+		"scope": scope,
+		"aud":   k.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	signed := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	hash := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, k.signer, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", fmt.Errorf("signing the token request: %w", err)
+	}
+	return signed + "." + enc.EncodeToString(sig), nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"math"
+	"strconv"
+)
+
+const earthRadiusNM = 3440.065
+
+// distanceNM returns the great-circle distance between two points in
+// nautical miles.
+func distanceNM(lat1, lon1, lat2, lon2 float64) float64 {
+	rlat1, rlat2 := radians(lat1), radians(lat2)
+	dlat, dlon := radians(lat2-lat1), radians(lon2-lon1)
+	h := math.Sin(dlat/2)*math.Sin(dlat/2) + math.Cos(rlat1)*math.Cos(rlat2)*math.Sin(dlon/2)*math.Sin(dlon/2)
+	return 2 * earthRadiusNM * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+func radians(deg float64) float64 {
+	return deg * math.Pi / 180
+}
+
+// decimal widens f to the float64 of the decimal it prints as, not its
+// float64 expansion, so 57.64911 stays 57.64911 rather than 57.649108886.
+func decimal(f float32) float64 {
+	d, _ := strconv.ParseFloat(strconv.FormatFloat(float64(f), 'g', -1, 32), 64)
+	return d
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// ReceiverPosition is where a mobile receiver was when it heard a message.
+type ReceiverPosition struct {
+	Lat     float64   `json:"lat"`
+	Lon     float64   `json:"lon"`
+	Alt     float64   `json:"alt,omitempty"`
+	Track   float64   `json:"track,omitempty"`
+	Speed   float64   `json:"speed,omitempty"`
+	FixTime time.Time `json:"fix_time"`
+}
+
+// gpsdTPV is the part of a gpsd time-position-velocity report we use.
+type gpsdTPV struct {
+	Class string    `json:"class"`
+	Mode  int       `json:"mode"`
+	Time  time.Time `json:"time"`
+	Lat   *float64  `json:"lat"`
+	Lon   *float64  `json:"lon"`
+	Alt   float64   `json:"altMSL"`
+	Track float64   `json:"track"`
+	Speed float64   `json:"speed"`
+}
+
+// gpsd follows the receiver's position through a gpsd daemon, reconnecting
+// whenever the connection drops.
+type gpsd struct {
+	addr   string
+	maxAge time.Duration
+
+	mu       sync.Mutex
+	position *ReceiverPosition
+	received time.Time
+}
+
+// newGPSD starts watching the gpsd at addr in the background.
+func newGPSD(addr string, maxAge time.Duration) *gpsd {
+	g := &gpsd{addr: addr, maxAge: maxAge}
+	safeGo("gpsd", true, g.run)
+	return g
+}
+
+// Position returns the latest fix, or nil when there is none younger than
+// maxAge. A nil gpsd has no position.
+func (g *gpsd) Position() *ReceiverPosition {
+	if g == nil {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.position == nil || time.Since(g.received) > g.maxAge {
+		return nil
+	}
+	return g.position
+}
+
+func (g *gpsd) run() {
+	backoff := time.Second
+	for {
+		err := g.watch()
+		log.Println("Error reading gpsd:", err)
+		time.Sleep(backoff)
+		if backoff < time.Minute {
+			backoff *= 2
+		}
+	}
+}
+
+// watch streams reports from one connection until it fails.
+func (g *gpsd) watch() error {
+	conn, err := net.DialTimeout("tcp", g.addr, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := fmt.Fprint(conn, `?WATCH={"enable":true,"json":true};`); err != nil {
+		return err
+	}
+	log.Printf("Watching gpsd at %s", g.addr)
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		var tpv gpsdTPV
+		if json.Unmarshal(scanner.Bytes(), &tpv) != nil || tpv.Class != "TPV" {
+			continue
+		}
+		// Mode 2 and 3 are 2D and 3D fixes; anything less has no position.
+		if tpv.Mode < 2 || tpv.Lat == nil || tpv.Lon == nil {
+			continue
+		}
+		g.mu.Lock()
+		g.position = &ReceiverPosition{Lat: *tpv.Lat, Lon: *tpv.Lon, Alt: tpv.Alt, Track: tpv.Track, Speed: tpv.Speed, FixTime: tpv.Time}
+		g.received = time.Now()
+		g.mu.Unlock()
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("gpsd closed the connection")
+}
@@ -0,0 +1,28 @@
+//go:build h3
+
+package main
+
+/*
+#cgo LDFLAGS: -lh3
+#include <h3/h3api.h>
+*/
+import "C"
+
+// h3Supported is set in builds with the h3 tag, which link libh3.
+const h3Supported = true
+
+// h3Cell returns the H3 cell of a position at resolution res, as the
+// hexadecimal string H3 libraries and databases accept, or "" if libh3
+// cannot index it.
+func h3Cell(lat, lon float64, res int) string {
+	g := C.LatLng{lat: C.degsToRads(C.double(lat)), lng: C.degsToRads(C.double(lon))}
+	var cell C.H3Index
+	if C.latLngToCell(&g, C.int(res), &cell) != 0 {
+		return ""
+	}
+	var buf [17]C.char
+	if C.h3ToString(cell, &buf[0], C.size_t(len(buf))) != 0 {
+		return ""
+	}
+	return C.GoString(&buf[0])
+}
@@ -0,0 +1,11 @@
+//go:build !h3
+
+package main
+
+// h3Supported is unset in builds without the h3 tag, which do not need
+// libh3 and refuse h3_resolution.
+const h3Supported = false
+
+func h3Cell(lat, lon float64, res int) string {
+	return ""
+}
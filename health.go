@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// feed is the health of this collector's feed, served on /health, /readyz
+// and /livez.
+var feed = newFeedHealth()
+
+// feedHealth tracks whether the feed is connected and data is flowing. It
+// is updated by the reader and read by health checks.
+type feedHealth struct {
+	started   atomic.Int64
+	standby   atomic.Bool
+	connected atomic.Bool
+	lastRead  atomic.Int64
+}
+
+// healthStatus is returned by GET /health on the control API.
+type healthStatus struct {
+	Started   time.Time  `json:"started"`
+	Standby   bool       `json:"standby,omitempty"`
+	Connected bool       `json:"connected"`
+	LastRead  *time.Time `json:"last_read,omitempty"`
+}
+
+func newFeedHealth() *feedHealth {
+	h := &feedHealth{}
+	h.started.Store(time.Now().UnixNano())
+	return h
+}
+
+// SetStandby records whether this replica is waiting for leadership
+// rather than reading. Leaving standby restarts the grace period for the
+// first read.
+func (h *feedHealth) SetStandby(standby bool) {
+	if !standby {
+		h.started.Store(time.Now().UnixNano())
+	}
+	h.standby.Store(standby)
+}
+
+// SetConnected records whether the feed connection is up.
+func (h *feedHealth) SetConnected(connected bool) {
+	h.connected.Store(connected)
+}
+
+// Read records that a line was read from the feed.
+func (h *feedHealth) Read() {
+	h.lastRead.Store(time.Now().UnixNano())
+}
+
+// Status returns the current health.
+func (h *feedHealth) Status() healthStatus {
+	st := healthStatus{Started: time.Unix(0, h.started.Load()), Standby: h.standby.Load(), Connected: h.connected.Load()}
+	if n := h.lastRead.Load(); n != 0 {
+		t := time.Unix(0, n)
+		st.LastRead = &t
+	}
+	return st
+}
+
+// Healthy reports whether a line was read within maxSilence, allowing a
+// collector that started less than maxSilence ago time to connect. A
+// standby replica is healthy: it is not meant to read.
+func (st healthStatus) Healthy(now time.Time, maxSilence time.Duration) bool {
+	if st.Standby {
+		return true
+	}
+	if st.LastRead == nil {
+		return now.Sub(st.Started) < maxSilence
+	}
+	return st.Connected && now.Sub(*st.LastRead) < maxSilence
+}
+
+// Ready reports whether the feed has delivered its first line, which is
+// when a pod should count as ready.
+func (st healthStatus) Ready() bool {
+	return st.Connected && st.LastRead != nil
+}
+
+// readyHandler serves the Kubernetes readiness probe.
+func (h *feedHealth) readyHandler(w http.ResponseWriter, r *http.Request) {
+	st := h.Status()
+	writeHealth(w, st, st.Ready())
+}
+
+// liveHandler serves the Kubernetes liveness probe, failing once data has
+// stopped flowing for maxSilence.
+func (h *feedHealth) liveHandler(maxSilence time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		st := h.Status()
+		writeHealth(w, st, st.Healthy(time.Now(), maxSilence))
+	}
+}
+
+func writeHealth(w http.ResponseWriter, st healthStatus, ok bool) {
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(st)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+)
+
+// httpHeaders are added to the requests of the DataSet and webhook sinks,
+// the ones that may sit behind a proxy or ingestion gateway. They are
+// parsed from HTTP_HEADERS at startup.
+var httpHeaders = http.Header{}
+
+// httpTLSConfig is the TLS configuration shared by every HTTP sink, holding
+// the client certificate and private CA when mutual TLS is configured.
+var httpTLSConfig = &tls.Config{}
+
+// newHTTPClient builds the client shared by every HTTP sink. Connections are
+// pooled and kept alive between batches, HTTP/2 is negotiated when the
+// server offers it, and TLS sessions are cached so reconnects skip the full
+// handshake.
+func newHTTPClient() *http.Client {
+	return newHeaderClient(nil)
+}
+
+// newGatewayClient builds a client like newHTTPClient that also adds the
+// configured extra headers, for sinks that may sit behind a gateway.
+// Credentials in those headers must not reach token endpoints, tile
+// servers or other sinks, so only the DataSet and webhook sinks use it.
+func newGatewayClient() *http.Client {
+	return newHeaderClient(httpHeaders)
+}
+
+// newHeaderClient builds the client of newHTTPClient, adding headers to
+// its requests.
+func newHeaderClient(headers http.Header) *http.Client {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          HTTP_MAX_IDLE_CONNS,
+		MaxIdleConnsPerHost:   HTTP_MAX_IDLE_CONNS,
+		IdleConnTimeout:       HTTP_IDLE_TIMEOUT,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+		TLSClientConfig:       httpTLSConfig.Clone(),
+	}
+	transport.TLSClientConfig.ClientSessionCache = tls.NewLRUClientSessionCache(64)
+	return &http.Client{
+		Transport: &headerTransport{base: transport, headers: headers},
+		Timeout:   HTTP_TIMEOUT,
+	}
+}
+
+// headerTransport stamps the User-Agent and extra headers on outgoing
+// requests. Extra headers never replace one the sink set itself, such as
+// its Authorization.
+type headerTransport struct {
+	base    http.RoundTripper
+	headers http.Header
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", userAgent())
+	for name, values := range t.headers {
+		if _, ok := req.Header[name]; !ok {
+			req.Header[name] = values
+		}
+	}
+	return t.base.RoundTrip(req)
+}
+
+// parseHeaders parses "Name: value" pairs into a header set.
+func parseHeaders(pairs []string) (http.Header, error) {
+	headers := http.Header{}
+	for _, pair := range pairs {
+		name, value, ok := strings.Cut(pair, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("invalid HTTP header %q, expected 'Name: value'", pair)
+		}
+		headers.Add(textproto.CanonicalMIMEHeaderKey(name), strings.TrimSpace(value))
+	}
+	return headers, nil
+}
+
+// newTLSConfig loads the client certificate and CA bundle for mutual TLS.
+// certFile and keyFile must be given together; caFile adds a private CA to
+// the system roots for gateways with internally issued server certificates.
+func newTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	config := &tls.Config{}
+	switch {
+	case certFile != "" && keyFile != "":
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	case certFile != "" || keyFile != "":
+		return nil, fmt.Errorf("http_client_cert and http_client_key must be set together")
+	}
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA bundle: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
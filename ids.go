@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// IDScheme generates the IDs of flights, events and dead letters, so that
+// deployments loading them into a database can pick IDs that sort by time.
+type IDScheme interface {
+	// Derived returns the ID of something that happened at t and is
+	// identified by key within namespace. The same arguments always give
+	// the same ID, which keeps replays and backfills deduplicable.
+	Derived(namespace uuid.UUID, t time.Time, key []byte) string
+	// Random returns a new, unique ID for something happening at t.
+	Random(t time.Time) string
+}
+
+// ids is the scheme configured on the command line.
+var ids IDScheme = uuidScheme{}
+
+// newIDScheme returns the scheme for an id_format setting.
+func newIDScheme(format string) (IDScheme, error) {
+	switch format {
+	case "", "uuid":
+		return uuidScheme{}, nil
+	case "uuidv7":
+		return uuidV7Scheme{}, nil
+	case "ulid":
+		return ulidScheme{}, nil
+	default:
+		return nil, fmt.Errorf("unknown id_format %q, expected 'uuid', 'uuidv7' or 'ulid'", format)
+	}
+}
+
+// uuidScheme makes name-based (version 5) and random (version 4) UUIDs,
+// which do not sort by time.
+type uuidScheme struct{}
+
+func (uuidScheme) Derived(namespace uuid.UUID, _ time.Time, key []byte) string {
+	return uuid.NewSHA1(namespace, key).String()
+}
+
+func (uuidScheme) Random(time.Time) string { return uuid.NewString() }
+
+// uuidV7Scheme makes version 7 UUIDs: the Unix time in milliseconds
+// followed by random bits, or by a hash of the key for derived IDs.
+type uuidV7Scheme struct{}
+
+func (uuidV7Scheme) Derived(namespace uuid.UUID, t time.Time, key []byte) string {
+	return newUUIDv7(t, keyBits(namespace, key)).String()
+}
+
+func (uuidV7Scheme) Random(t time.Time) string {
+	return newUUIDv7(t, randomBits()).String()
+}
+
+// newUUIDv7 lays out a version 7 UUID from t and the last 10 bytes of bits.
+func newUUIDv7(t time.Time, bits [16]byte) uuid.UUID {
+	u := uuid.UUID(bits)
+	putMillis(u[:6], t)
+	u[6] = 0x70 | u[6]&0x0f
+	u[8] = 0x80 | u[8]&0x3f
+	return u
+}
+
+// ulidScheme makes ULIDs: 26 characters of Crockford base32 holding the Unix
+// time in milliseconds and 80 random bits, or a hash of the key for derived
+// IDs.
+type ulidScheme struct{}
+
+func (ulidScheme) Derived(namespace uuid.UUID, t time.Time, key []byte) string {
+	return newULID(t, keyBits(namespace, key))
+}
+
+func (ulidScheme) Random(t time.Time) string {
+	return newULID(t, randomBits())
+}
+
+// crockford is the base32 alphabet of ULIDs.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// newULID encodes t and the last 10 bytes of bits as a ULID.
+func newULID(t time.Time, bits [16]byte) string {
+	putMillis(bits[:6], t)
+	var hi, lo uint64
+	for i := 0; i < 8; i++ {
+		hi = hi<<8 | uint64(bits[i])
+		lo = lo<<8 | uint64(bits[8+i])
+	}
+	var out [26]byte
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i] = crockford[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
+
+// putMillis writes t as 48 bits of Unix milliseconds. Times before 1970
+// are written as 0.
+func putMillis(b []byte, t time.Time) {
+	ms := t.UnixMilli()
+	if ms < 0 {
+		ms = 0
+	}
+	for i := 5; i >= 0; i-- {
+		b[i] = byte(ms)
+		ms >>= 8
+	}
+}
+
+// keyBits hashes key within namespace.
+func keyBits(namespace uuid.UUID, key []byte) [16]byte {
+	h := sha1.New()
+	h.Write(namespace[:])
+	h.Write(key)
+	var bits [16]byte
+	copy(bits[:], h.Sum(nil))
+	return bits
+}
+
+// randomBits returns 16 random bytes.
+func randomBits() [16]byte {
+	return uuid.New()
+}
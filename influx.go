@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// influxWriter writes each recently heard aircraft's position and velocity
+// to InfluxDB every interval, as line protocol points tagged with its
+// icao24, callsign and receiver and timestamped when it was last heard.
+// With a database it uses the 1.x /write API, with a bucket the 2.x
+// /api/v2/write API. Ghosts are left out.
+type influxWriter struct {
+	writeURL    string
+	measurement string
+	username    string
+	password    string
+	token       string
+	interval    time.Duration
+	tracker     *Tracker
+	client      *http.Client
+}
+
+// newInfluxWriter builds the write URL for a database (1.x) or an
+// organization and bucket (2.x) on the server at base.
+func newInfluxWriter(base, database, org, bucket, measurement, username, password, token string, interval time.Duration, tracker *Tracker) *influxWriter {
+	w := &influxWriter{measurement: measurement, username: username, password: password, token: token, interval: interval, tracker: tracker, client: withChaos("influx", newHTTPClient())}
+	q := url.Values{"precision": {"ms"}}
+	base = strings.TrimSuffix(base, "/")
+	if bucket != "" {
+		q.Set("org", org)
+		q.Set("bucket", bucket)
+		w.writeURL = base + "/api/v2/write?" + q.Encode()
+	} else {
+		q.Set("db", database)
+		w.writeURL = base + "/write?" + q.Encode()
+	}
+	return w
+}
+
+// Run writes every interval until done is closed. Failures are logged once
+// until a write succeeds again; the points of a failed write are not
+// retried, as the next one carries newer values.
+func (w *influxWriter) Run(done <-chan struct{}) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	failing := false
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		err := w.write(clock.Now())
+		switch {
+		case err != nil && !failing:
+			log.Printf("Error writing aircraft to InfluxDB: %v", err)
+		case err == nil && failing:
+			log.Printf("Writing aircraft to InfluxDB again")
+		}
+		failing = err != nil
+	}
+}
+
+// write sends the aircraft heard within the last interval before now.
+func (w *influxWriter) write(now time.Time) error {
+	var body bytes.Buffer
+	points := 0
+	for _, a := range w.tracker.Snapshot() {
+		if a.Ghost || now.Sub(a.LastSeen) > w.interval || w.tracker.expired(&a, now) {
+			continue
+		}
+		w.appendPoint(&body, &a)
+		points++
+	}
+	if points == 0 {
+		return nil
+	}
+	if !toggles.Enabled("influx") {
+		metricDisabledSink.Add("influx", float64(points))
+		return nil
+	}
+
+	req, err := http.NewRequest(http.MethodPost, w.writeURL, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	switch {
+	case w.token != "":
+		req.Header.Set("Authorization", "Token "+w.token)
+	case w.username != "":
+		req.SetBasicAuth(w.username, w.password)
+	}
+	res, err := w.client.Do(req)
+	if err != nil {
+		metricSinkErrors.Inc("influx")
+		return err
+	}
+	defer res.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+	if res.StatusCode >= 300 {
+		metricSinkErrors.Inc("influx")
+		return fmt.Errorf("%s: %s", res.Status, bytes.TrimSpace(msg))
+	}
+	metricSinkEvents.Add("influx", float64(points))
+	return nil
+}
+
+// appendPoint writes the aircraft as a line protocol point. Values the
+// aircraft has not reported are left out; on_ground is always present, so
+// a point always has a field.
+func (w *influxWriter) appendPoint(b *bytes.Buffer, a *Aircraft) {
+	b.WriteString(influxEscape(w.measurement, ", "))
+	b.WriteString(",icao24=")
+	b.WriteString(influxEscape(a.Icao24, ",= "))
+	if a.Callsign != "" {
+		b.WriteString(",callsign=")
+		b.WriteString(influxEscape(a.Callsign, ",= "))
+	}
+	if a.Kind != "" {
+		b.WriteString(",kind=")
+		b.WriteString(influxEscape(a.Kind, ",= "))
+	}
+	if RECEIVER_NAME != "" {
+		b.WriteString(",receiver=")
+		b.WriteString(influxEscape(RECEIVER_NAME, ",= "))
+	}
+
+	fields := []string{"on_ground=" + strconv.FormatBool(a.OnGround)}
+	if a.Altitude != 0 || a.OnGround {
+		fields = append(fields, fmt.Sprintf("altitude=%di", a.Altitude))
+	}
+	if a.GroundSpeed != 0 {
+		// The vertical rate comes with the speed in velocity messages.
+		fields = append(fields,
+			"ground_speed="+strconv.FormatFloat(float64(a.GroundSpeed), 'f', -1, 32),
+			"track="+strconv.FormatFloat(float64(a.Track), 'f', -1, 32),
+			fmt.Sprintf("vertical_rate=%di", a.VerticalRate))
+	}
+	if a.HasPosition() {
+		fields = append(fields,
+			"lat="+strconv.FormatFloat(float64(a.Lat), 'f', -1, 32),
+			"lon="+strconv.FormatFloat(float64(a.Lon), 'f', -1, 32))
+	}
+	if a.Squawk != 0 {
+		fields = append(fields, fmt.Sprintf(`squawk="%04d"`, a.Squawk))
+	}
+	if a.Emergency {
+		fields = append(fields, "emergency=true")
+	}
+	b.WriteByte(' ')
+	b.WriteString(strings.Join(fields, ","))
+	fmt.Fprintf(b, " %d\n", a.LastSeen.UnixMilli())
+}
+
+// influxEscape backslash-escapes the characters in special, as line
+// protocol requires for measurements and tags.
+func influxEscape(s, special string) string {
+	if !strings.ContainsAny(s, special) {
+		return s
+	}
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(special, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	"github.com/twmb/franz-go/pkg/sasl"
+	"github.com/twmb/franz-go/pkg/sasl/plain"
+	"github.com/twmb/franz-go/pkg/sasl/scram"
+)
+
+const (
+	// kafkaDefaultPort is the port of brokers given without one.
+	kafkaDefaultPort = "9092"
+	// kafkaFetchWait is how long a broker holds a fetch open for new
+	// records.
+	kafkaFetchWait = 500 * time.Millisecond
+	// kafkaPartitionBytes and kafkaFetchBytes bound the records a fetch
+	// returns per partition and in total.
+	kafkaPartitionBytes = 1 << 20
+	kafkaFetchBytes     = 8 << 20
+	// kafkaCommitInterval is how often a consumer group's offsets are
+	// committed.
+	kafkaCommitInterval = 5 * time.Second
+)
+
+// kafkaSASLMechanisms are the SASL mechanisms of kafka_sasl_mechanism.
+var kafkaSASLMechanisms = []string{"plain", "scram-sha-256", "scram-sha-512"}
+
+var metricKafkaRecords = newCounter("adsb_kafka_records_total", "Kafka records consumed, by partition.", "partition")
+
+// kafka is the consumer configuration of the kafka_* settings.
+var kafka kafkaConfig
+
+// parseKafkaBrokers parses a comma-separated list of host[:port] brokers.
+func parseKafkaBrokers(list string) ([]string, error) {
+	var brokers []string
+	for _, b := range strings.Split(list, ",") {
+		b = strings.TrimSpace(b)
+		if b == "" {
+			return nil, fmt.Errorf("kafka_brokers %q has an empty entry", list)
+		}
+		if _, _, err := net.SplitHostPort(b); err != nil {
+			b = net.JoinHostPort(b, kafkaDefaultPort)
+		}
+		brokers = append(brokers, b)
+	}
+	return brokers, nil
+}
+
+// kafkaConfig is how the consumer reaches the brokers. tls is nil for a
+// plaintext listener and mechanism empty without SASL.
+type kafkaConfig struct {
+	brokers             []string
+	tls                 *tls.Config
+	mechanism           string
+	username, password  string
+	topic, group, start string
+}
+
+// kafkaSASL returns the SASL mechanism of config, nil for none.
+func kafkaSASL(config kafkaConfig) sasl.Mechanism {
+	switch config.mechanism {
+	case "plain":
+		return plain.Auth{User: config.username, Pass: config.password}.AsMechanism()
+	case "scram-sha-256":
+		return scram.Auth{User: config.username, Pass: config.password}.AsSha256Mechanism()
+	case "scram-sha-512":
+		return scram.Auth{User: config.username, Pass: config.password}.AsSha512Mechanism()
+	}
+	return nil
+}
+
+// kafkaConsumer reads every partition of a topic with franz-go, which
+// decompresses gzip, snappy, lz4 and zstd batches. Without a group it
+// starts at the earliest or latest offset each time; with one, it joins
+// the group, shares the partitions with its other members and resumes
+// from the offsets committed for it.
+type kafkaConsumer struct {
+	topic, group string
+	brokers      string
+	client       *kgo.Client
+}
+
+func newKafkaConsumer(config kafkaConfig) (*kafkaConsumer, error) {
+	start := kgo.NewOffset().AtEnd()
+	if config.start == "earliest" {
+		start = kgo.NewOffset().AtStart()
+	}
+	opts := []kgo.Opt{
+		kgo.SeedBrokers(config.brokers...),
+		kgo.ConsumeTopics(config.topic),
+		kgo.ConsumeResetOffset(start),
+		kgo.FetchMaxWait(kafkaFetchWait),
+		kgo.FetchMaxBytes(kafkaFetchBytes),
+		kgo.FetchMaxPartitionBytes(kafkaPartitionBytes),
+		kgo.ClientID("adsb-go-dataset"),
+	}
+	if config.group != "" {
+		opts = append(opts, kgo.ConsumerGroup(config.group), kgo.AutoCommitInterval(kafkaCommitInterval))
+	}
+	if config.tls != nil {
+		opts = append(opts, kgo.DialTLSConfig(config.tls))
+	}
+	if mechanism := kafkaSASL(config); mechanism != nil {
+		opts = append(opts, kgo.SASL(mechanism))
+	}
+	client, err := kgo.NewClient(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &kafkaConsumer{topic: config.topic, group: config.group, brokers: strings.Join(config.brokers, ","), client: client}, nil
+}
+
+// Connect looks the topic up, waiting for up to wait for the brokers like
+// dialFeed waits for DUMP1090.
+func (c *kafkaConsumer) Connect(wait time.Duration, stop <-chan struct{}) error {
+	err := waitForFeed(c.brokers, wait, stop, c.metadata)
+	if err != nil {
+		c.client.Close()
+	}
+	return err
+}
+
+// metadata checks that the brokers know the topic and let it be read.
+func (c *kafkaConsumer) metadata() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req := kmsg.NewPtrMetadataRequest()
+	topic := kmsg.NewMetadataRequestTopic()
+	topic.Topic = kmsg.StringPtr(c.topic)
+	req.Topics = append(req.Topics, topic)
+	resp, err := req.RequestWith(ctx, c.client)
+	if err != nil {
+		return kafkaError(err)
+	}
+	if len(resp.Topics) != 1 {
+		return fmt.Errorf("Kafka answered for %d topics", len(resp.Topics))
+	}
+	if err := kerr.ErrorForCode(resp.Topics[0].ErrorCode); err != nil {
+		return kafkaError(err)
+	}
+	if len(resp.Topics[0].Partitions) == 0 {
+		return fmt.Errorf("topic %s has no partitions", c.topic)
+	}
+	return nil
+}
+
+// kafkaError marks the errors of refused credentials or permissions as
+// authentication errors.
+func kafkaError(err error) error {
+	switch {
+	case errors.Is(err, kerr.SaslAuthenticationFailed), errors.Is(err, kerr.IllegalSaslState), errors.Is(err, kerr.UnsupportedSaslMechanism):
+		return newError(errAuth, err)
+	case errors.Is(err, kerr.TopicAuthorizationFailed):
+		return newError(errAuth, errors.New("not authorized to read the topic"))
+	case errors.Is(err, kerr.GroupAuthorizationFailed):
+		return newError(errAuth, errors.New("not authorized to use the consumer group"))
+	}
+	return err
+}
+
+// Run reads records into lines, one line per line of a record's value,
+// until stop is closed. Lost brokers and leader changes are retried by
+// the client. A group's offsets are committed every kafkaCommitInterval
+// and before leaving it.
+func (c *kafkaConsumer) Run(lines chan<- feedLine, receiver string, stop <-chan struct{}) {
+	defer c.client.Close()
+	defer c.commit()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	failing := false
+	for {
+		fetches := c.client.PollFetches(ctx)
+		if ctx.Err() != nil && fetches.NumRecords() == 0 {
+			return
+		}
+		var err error
+		fetches.EachError(func(topic string, partition int32, e error) {
+			if err == nil && !errors.Is(e, context.Canceled) {
+				err = fmt.Errorf("partition %d: %w", partition, kafkaError(e))
+			}
+		})
+		switch {
+		case err != nil && !failing:
+			log.Printf("Error reading Kafka topic %s, retrying: %v", c.topic, err)
+		case err == nil && failing && !fetches.Empty():
+			log.Printf("Reading Kafka topic %s again", c.topic)
+		}
+		if err != nil || !fetches.Empty() {
+			failing = err != nil
+		}
+		fetches.EachRecord(func(r *kgo.Record) {
+			metricKafkaRecords.Inc(strconv.Itoa(int(r.Partition)))
+			for _, line := range strings.Split(string(r.Value), "\n") {
+				if line = strings.TrimRight(line, "\r"); line == "" {
+					continue
+				}
+				feed.Read()
+				lines <- feedLine{receiver: receiver, text: kafkaLine(line, r.Timestamp)}
+			}
+		})
+	}
+}
+
+// commit commits the offsets read since the last commit, if there is a
+// group.
+func (c *kafkaConsumer) commit() {
+	if c.group == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := c.client.CommitUncommittedOffsets(ctx); err != nil {
+		log.Printf("Error committing Kafka offsets for group %s: %v", c.group, kafkaError(err))
+	}
+}
+
+// kafkaLine prepares a line of a record for parsing. aircraft.json records
+// published without the snapshot time get the record's time.
+func kafkaLine(line string, ts time.Time) string {
+	if INPUT_FORMAT != "aircraft_json" {
+		return line
+	}
+	var rec aircraftRecord
+	if err := json.Unmarshal([]byte(line), &rec); err != nil || rec.Now != 0 {
+		return line
+	}
+	rec.Now = float64(ts.UnixNano()) / float64(time.Second)
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return line
+	}
+	return string(data)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kfake"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/sasl/scram"
+)
+
+// kafkaTestTLS returns a server configuration with a self-signed
+// certificate for 127.0.0.1 and a client configuration trusting it.
+func kafkaTestTLS(t *testing.T) (server, client *tls.Config) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "kafka"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	server = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	return server, &tls.Config{RootCAs: pool}
+}
+
+func TestKafkaConsumer(t *testing.T) {
+	serverTLS, clientTLS := kafkaTestTLS(t)
+	cluster, err := kfake.NewCluster(
+		kfake.NumBrokers(1),
+		kfake.SeedTopics(2, "adsb"),
+		kfake.EnableSASL(),
+		kfake.Superuser("SCRAM-SHA-256", "adsb", "secret"),
+		kfake.TLS(serverTLS),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cluster.Close()
+	brokers := cluster.ListenAddrs()
+
+	// A batch of each codec, each record holding two lines.
+	codecs := map[string]kgo.CompressionCodec{
+		"none":   kgo.NoCompression(),
+		"gzip":   kgo.GzipCompression(),
+		"snappy": kgo.SnappyCompression(),
+		"lz4":    kgo.Lz4Compression(),
+		"zstd":   kgo.ZstdCompression(),
+	}
+	produce := func(codec kgo.CompressionCodec, key, value string) {
+		t.Helper()
+		producer, err := kgo.NewClient(
+			kgo.SeedBrokers(brokers...),
+			kgo.DialTLSConfig(clientTLS),
+			kgo.SASL(scram.Auth{User: "adsb", Pass: "secret"}.AsSha256Mechanism()),
+			kgo.ProducerBatchCompression(codec),
+			kgo.DefaultProduceTopic("adsb"),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer producer.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := producer.ProduceSync(ctx, &kgo.Record{Key: []byte(key), Value: []byte(value)}).FirstErr(); err != nil {
+			t.Fatalf("producing %s: %v", key, err)
+		}
+	}
+	var want []string
+	for name, codec := range codecs {
+		produce(codec, name, name+" 1\r\n"+name+" 2\n")
+		want = append(want, name+" 1", name+" 2")
+	}
+	sort.Strings(want)
+
+	config := kafkaConfig{
+		brokers: brokers, tls: clientTLS,
+		mechanism: "scram-sha-256", username: "adsb", password: "secret",
+		topic: "adsb", group: "collector", start: "earliest",
+	}
+	// consume reads n lines with a new consumer.
+	consume := func(n int) []string {
+		t.Helper()
+		consumer, err := newKafkaConsumer(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stop := make(chan struct{})
+		if err := consumer.Connect(5*time.Second, stop); err != nil {
+			t.Fatal(err)
+		}
+		lines := make(chan feedLine)
+		done := make(chan struct{})
+		go func() {
+			consumer.Run(lines, "rx", stop)
+			close(done)
+		}()
+		defer func() {
+			close(stop)
+			<-done
+		}()
+
+		var got []string
+		timeout := time.After(10 * time.Second)
+		for len(got) < n {
+			select {
+			case line := <-lines:
+				if line.receiver != "rx" {
+					t.Errorf("line %q from receiver %q, want rx", line.text, line.receiver)
+				}
+				got = append(got, line.text)
+			case <-timeout:
+				t.Fatalf("read %q, want %d lines", got, n)
+			}
+		}
+		sort.Strings(got)
+		return got
+	}
+
+	if got := consume(len(want)); !reflect.DeepEqual(got, want) {
+		t.Errorf("read %q, want %q", got, want)
+	}
+	// The group's offsets were committed on stopping, so the next
+	// consumer of the group starts after what was read.
+	produce(kgo.NoCompression(), "after", "after")
+	if got := consume(1); !reflect.DeepEqual(got, []string{"after"}) {
+		t.Errorf("resumed with %q, want [after]", got)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// kinesisPendingMax bounds the messages waiting to be written, which
+	// includes those kept for a retry while the stream is unreachable or
+	// throttled.
+	kinesisPendingMax = 100000
+	// kinesisBatchMax and kinesisBatchBytes are the most records and bytes
+	// PutRecords takes in one request.
+	kinesisBatchMax   = 500
+	kinesisBatchBytes = 5 << 20
+	// kinesisRetries is how often the records a shard throttled are sent
+	// again within a flush, after a growing pause, before they wait for the
+	// next one.
+	kinesisRetries = 3
+)
+
+// kinesisSink writes every decoded aircraft message to a Kinesis data
+// stream every interval with PutRecords, as one record per message holding
+// its JSON and a newline, partitioned by ICAO address so each aircraft's
+// messages stay in order on one shard. Records a shard rejects, usually
+// because it is over its throughput, are sent again after a pause; what
+// still fails is kept and sent with the next flush.
+type kinesisSink struct {
+	*batchSink
+	stream string
+	// endpoint is set for Kinesis-compatible services such as LocalStack.
+	endpoint string
+	creds    awsCredentials
+	client   *http.Client
+}
+
+// newKinesisSink starts writing in the background. Close keeps flushing
+// for up to ten seconds while shards throttle.
+func newKinesisSink(stream, region, endpoint, accessKey, secretKey, sessionToken string, interval time.Duration) *kinesisSink {
+	if endpoint == "" {
+		endpoint = "https://kinesis." + region + ".amazonaws.com"
+	}
+	s := &kinesisSink{
+		stream: stream, endpoint: strings.TrimSuffix(endpoint, "/"),
+		creds:  awsCredentials{region: region, accessKey: accessKey, secretKey: secretKey, sessionToken: sessionToken},
+		client: withChaos("kinesis", newHTTPClient()),
+	}
+	s.batchSink = newBatchSink("kinesis", "Kinesis", "Kinesis stream "+stream, kinesisPendingMax, interval, s.write)
+	s.linger = 10 * time.Second
+	return s
+}
+
+// write sends msgs in requests of up to kinesisBatchMax records and
+// kinesisBatchBytes, returning the messages of the records shards still
+// throttled after the retries and of those not sent after an error.
+func (s *kinesisSink) write(msgs []SBS1Message) ([]SBS1Message, error) {
+	records, err := kinesisRecords(msgs)
+	if err != nil {
+		return nil, err
+	}
+	var unsent []kinesisRecord
+	for len(records) > 0 && err == nil {
+		n, size := 0, 0
+		for n < len(records) && n < kinesisBatchMax && size+records[n].size() <= kinesisBatchBytes {
+			size += records[n].size()
+			n++
+		}
+		if n == 0 {
+			// Kinesis rejects the oversized record on its own.
+			n = 1
+		}
+		var failed []kinesisRecord
+		failed, err = s.putWithRetries(records[:n])
+		unsent = append(unsent, failed...)
+		records = records[n:]
+	}
+	unsent = append(unsent, records...)
+	var retry []SBS1Message
+	for _, r := range unsent {
+		retry = append(retry, r.msg)
+	}
+	return retry, err
+}
+
+// kinesisRecord is a record of PutRecords and the message it holds.
+type kinesisRecord struct {
+	Data         []byte `json:"Data"`
+	PartitionKey string `json:"PartitionKey"`
+	msg          SBS1Message
+}
+
+// size is what the record counts against the request limit.
+func (r kinesisRecord) size() int {
+	return len(r.Data) + len(r.PartitionKey)
+}
+
+// kinesisRecords turns msgs into records keyed by ICAO address. Messages
+// without one, such as those of the collector itself, are keyed by
+// receiver.
+func kinesisRecords(msgs []SBS1Message) ([]kinesisRecord, error) {
+	records := make([]kinesisRecord, len(msgs))
+	for i, msg := range msgs {
+		data, err := json.Marshal(msg)
+		if err != nil {
+			return nil, err
+		}
+		key := strings.ToLower(msg.Icao24)
+		if key == "" {
+			key = msg.Receiver
+		}
+		if key == "" {
+			key = RECEIVER_NAME
+		}
+		if key == "" {
+			key = "adsb"
+		}
+		records[i] = kinesisRecord{Data: append(data, '\n'), PartitionKey: key, msg: msg}
+	}
+	return records, nil
+}
+
+// putWithRetries sends records, then sends the ones a shard rejected again
+// up to kinesisRetries times, returning those that still failed.
+func (s *kinesisSink) putWithRetries(records []kinesisRecord) ([]kinesisRecord, error) {
+	pause := 100 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		failed, err := s.put(records)
+		if err != nil {
+			return records, err
+		}
+		metricSinkEvents.Add("kinesis", float64(len(records)-len(failed)))
+		if len(failed) == 0 || attempt == kinesisRetries {
+			return failed, nil
+		}
+		metricKinesisRetries.Add("", float64(len(failed)))
+		time.Sleep(pause)
+		pause *= 2
+		records = failed
+	}
+}
+
+// put sends records in one PutRecords request, returning those a shard
+// rejected.
+func (s *kinesisSink) put(records []kinesisRecord) ([]kinesisRecord, error) {
+	body, err := json.Marshal(struct {
+		StreamName string          `json:"StreamName"`
+		Records    []kinesisRecord `json:"Records"`
+	}{s.stream, records})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.endpoint+"/", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "Kinesis_20131202.PutRecords")
+	s.creds.sign(req, "kinesis", body, time.Now().UTC())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		// Errors carry {"__type": "...", "message": "..."}.
+		var reply struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		err := fmt.Errorf("Kinesis returned %s", resp.Status)
+		if json.Unmarshal(data, &reply) == nil && reply.Type != "" {
+			err = fmt.Errorf("Kinesis returned %s: %s: %s", resp.Status, reply.Type[strings.LastIndex(reply.Type, "#")+1:], reply.Message)
+		}
+		if resp.StatusCode == http.StatusForbidden || strings.Contains(reply.Type, "UnrecognizedClient") {
+			return nil, newError(errAuth, err)
+		}
+		return nil, err
+	}
+	var reply struct {
+		FailedRecordCount int `json:"FailedRecordCount"`
+		Records           []struct {
+			ErrorCode string `json:"ErrorCode"`
+		} `json:"Records"`
+	}
+	if err := json.Unmarshal(data, &reply); err != nil {
+		return nil, fmt.Errorf("reading Kinesis's reply: %w", err)
+	}
+	if reply.FailedRecordCount == 0 {
+		return nil, nil
+	}
+	if len(reply.Records) != len(records) {
+		return nil, fmt.Errorf("Kinesis answered %d of %d records", len(reply.Records), len(records))
+	}
+	var failed []kinesisRecord
+	for i, r := range reply.Records {
+		if r.ErrorCode != "" {
+			failed = append(failed, records[i])
+		}
+	}
+	return failed, nil
+}
+
+var metricKinesisRetries = newCounter("adsb_kinesis_retried_records_total", "Records sent to Kinesis again after a shard rejected them.", "")
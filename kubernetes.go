@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// serviceAccountDir holds the credentials Kubernetes mounts into every pod.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// leaseTimeFormat is the MicroTime format of Lease timestamps.
+const leaseTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+// lease is the part of a coordination.k8s.io/v1 Lease the elector uses.
+type lease struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name            string `json:"name"`
+		Namespace       string `json:"namespace"`
+		ResourceVersion string `json:"resourceVersion,omitempty"`
+	} `json:"metadata"`
+	Spec struct {
+		HolderIdentity       string `json:"holderIdentity"`
+		LeaseDurationSeconds int    `json:"leaseDurationSeconds"`
+		AcquireTime          string `json:"acquireTime,omitempty"`
+		RenewTime            string `json:"renewTime,omitempty"`
+		LeaseTransitions     int    `json:"leaseTransitions"`
+	} `json:"spec"`
+}
+
+// leaseElector makes sure only one replica of a Deployment uploads, using a
+// Lease object in the pod's namespace. It talks to the API server directly
+// with the pod's service account, which needs get, create and update on
+// leases.
+type leaseElector struct {
+	leases    string
+	namespace string
+	name      string
+	token     string
+	identity  string
+	duration  time.Duration
+	client    *http.Client
+}
+
+// newLeaseElector configures an elector for the Lease called name from the
+// in-cluster environment.
+func newLeaseElector(name string, duration time.Duration) (*leaseElector, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, configErrorf("leader election needs to run in a Kubernetes pod, KUBERNETES_SERVICE_HOST is not set")
+	}
+	token, err := os.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, configErrorf("reading service account token: %v", err)
+	}
+	namespace, err := os.ReadFile(serviceAccountDir + "/namespace")
+	if err != nil {
+		return nil, configErrorf("reading service account namespace: %v", err)
+	}
+	ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, configErrorf("reading service account CA: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, configErrorf("no certificates found in the service account CA")
+	}
+	identity := os.Getenv("POD_NAME")
+	if identity == "" {
+		if identity, err = os.Hostname(); err != nil {
+			return nil, err
+		}
+	}
+	ns := strings.TrimSpace(string(namespace))
+	return &leaseElector{
+		leases:    fmt.Sprintf("https://%s/apis/coordination.k8s.io/v1/namespaces/%s/leases", net.JoinHostPort(host, port), ns),
+		namespace: ns,
+		name:      name,
+		token:     strings.TrimSpace(string(token)),
+		identity:  identity,
+		duration:  duration,
+		client: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+	}, nil
+}
+
+// Acquire blocks until this replica holds the lease. It returns errStopped
+// if stop is closed first.
+func (e *leaseElector) Acquire(stop <-chan struct{}) error {
+	log.Printf("Waiting to become leader as %s", e.identity)
+	for {
+		ok, err := e.tryAcquire()
+		if err != nil {
+			log.Println("Error acquiring lease:", err)
+		}
+		if ok {
+			log.Printf("Became leader as %s", e.identity)
+			return nil
+		}
+		select {
+		case <-time.After(e.duration / 2):
+		case <-stop:
+			return errStopped
+		}
+	}
+}
+
+// Hold renews the lease until stop is closed. If another replica took it,
+// or renewals keep failing until it is close to expiry, lost is called and
+// Hold returns, leaving a margin before a standby can take over.
+func (e *leaseElector) Hold(stop <-chan struct{}, lost func()) {
+	ticker := time.NewTicker(e.duration / 3)
+	defer ticker.Stop()
+	renewed := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		ok, err := e.tryAcquire()
+		if err != nil {
+			log.Println("Error renewing lease:", err)
+		}
+		if ok {
+			renewed = time.Now()
+			continue
+		}
+		if err == nil || time.Since(renewed) >= e.duration*2/3 {
+			log.Printf("Lost the leader lease")
+			lost()
+			return
+		}
+	}
+}
+
+// Release gives up the lease so a standby replica can take over without
+// waiting for it to expire.
+func (e *leaseElector) Release() {
+	l, status, err := e.get()
+	if err != nil || status != http.StatusOK || l.Spec.HolderIdentity != e.identity {
+		return
+	}
+	l.Spec.HolderIdentity = ""
+	l.Spec.RenewTime = time.Now().Add(-e.duration).UTC().Format(leaseTimeFormat)
+	if _, err := e.write(http.MethodPut, e.leases+"/"+e.name, l); err != nil {
+		log.Println("Error releasing lease:", err)
+	}
+}
+
+// tryAcquire takes or renews the lease if it is free, expired or already
+// ours. Writes carry the resourceVersion that was read, so when two
+// replicas race the API server accepts only one.
+func (e *leaseElector) tryAcquire() (bool, error) {
+	l, status, err := e.get()
+	if err != nil {
+		return false, err
+	}
+	now := time.Now().UTC()
+	if status == http.StatusNotFound {
+		l = &lease{APIVersion: "coordination.k8s.io/v1", Kind: "Lease"}
+		l.Metadata.Name, l.Metadata.Namespace = e.name, e.namespace
+		l.Spec.HolderIdentity = e.identity
+		l.Spec.LeaseDurationSeconds = int(e.duration / time.Second)
+		l.Spec.AcquireTime = now.Format(leaseTimeFormat)
+		l.Spec.RenewTime = l.Spec.AcquireTime
+		return e.write(http.MethodPost, e.leases, l)
+	}
+
+	if l.Spec.HolderIdentity != e.identity {
+		renewed, _ := time.Parse(leaseTimeFormat, l.Spec.RenewTime)
+		expiry := renewed.Add(time.Duration(l.Spec.LeaseDurationSeconds) * time.Second)
+		if l.Spec.HolderIdentity != "" && now.Before(expiry) {
+			return false, nil
+		}
+		l.Spec.HolderIdentity = e.identity
+		l.Spec.AcquireTime = now.Format(leaseTimeFormat)
+		l.Spec.LeaseTransitions++
+	}
+	l.Spec.LeaseDurationSeconds = int(e.duration / time.Second)
+	l.Spec.RenewTime = now.Format(leaseTimeFormat)
+	return e.write(http.MethodPut, e.leases+"/"+e.name, l)
+}
+
+// get reads the lease, returning the HTTP status so a missing lease can be
+// told apart from a failure.
+func (e *leaseElector) get() (*lease, int, error) {
+	req, err := http.NewRequest(http.MethodGet, e.leases+"/"+e.name, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+e.token)
+	res, err := e.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, res.StatusCode, nil
+	default:
+		body, _ := io.ReadAll(res.Body)
+		return nil, res.StatusCode, fmt.Errorf("reading lease returned %s: %s", res.Status, bytes.TrimSpace(body))
+	}
+	var l lease
+	if err := json.NewDecoder(res.Body).Decode(&l); err != nil {
+		return nil, res.StatusCode, fmt.Errorf("decoding lease: %w", err)
+	}
+	return &l, res.StatusCode, nil
+}
+
+// write creates or updates the lease. A conflict means another replica
+// wrote it first and is not an error.
+func (e *leaseElector) write(method, url string, l *lease) (bool, error) {
+	body, err := json.Marshal(l)
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Authorization", "Bearer "+e.token)
+	req.Header.Set("Content-Type", "application/json")
+	res, err := e.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+	switch {
+	case res.StatusCode == http.StatusConflict:
+		return false, nil
+	case res.StatusCode >= 300:
+		body, _ := io.ReadAll(res.Body)
+		return false, fmt.Errorf("writing lease returned %s: %s", res.Status, bytes.TrimSpace(body))
+	}
+	return true, nil
+}
+
+// downwardAPIInfo returns the pod metadata exposed through the downward
+// API as environment variables, keyed by the session attribute it is
+// uploaded as.
+func downwardAPIInfo() (map[string]string, error) {
+	info := map[string]string{}
+	for attr, env := range map[string]string{
+		"k8s_pod":       "POD_NAME",
+		"k8s_namespace": "POD_NAMESPACE",
+		"k8s_node":      "NODE_NAME",
+	} {
+		if value := os.Getenv(env); value != "" {
+			info[attr] = value
+		}
+	}
+	if len(info) == 0 {
+		return nil, fmt.Errorf("downward_api is set but none of POD_NAME, POD_NAMESPACE and NODE_NAME are. Expose them in the pod spec with env valueFrom.fieldRef metadata.name, metadata.namespace and spec.nodeName")
+	}
+	return info, nil
+}
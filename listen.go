@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxDatagram is the largest UDP payload.
+const maxDatagram = 65535
+
+// listenAllow are the networks pushed feeds are accepted from, parsed from
+// LISTEN_ALLOW. Empty accepts every sender.
+var listenAllow []*net.IPNet
+
+// parseAllow parses addresses and CIDR networks.
+func parseAllow(specs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		if !strings.Contains(spec, "/") {
+			ip := net.ParseIP(spec)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid listen_allow %q, expected an address or CIDR network", spec)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid listen_allow %q, expected an address or CIDR network", spec)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// senderIP returns the IP address of a pushed feed's sender.
+func senderIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+// allowed reports whether a feed may be pushed from ip.
+func allowed(ip net.IP) bool {
+	if len(listenAllow) == 0 {
+		return true
+	}
+	for _, n := range listenAllow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+var metricListenRejected = newCounter("adsb_listen_rejected_total", "Datagrams and connections from senders not in listen_allow, by protocol.", "protocol")
+
+// listenUDP opens the UDP socket that forwarders push SBS lines to.
+func listenUDP(addr string) (net.PacketConn, error) {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, newError(errConnect, fmt.Errorf("listening on %s: %w", addr, err))
+	}
+	log.Printf("Receiving SBS datagrams on %s", pc.LocalAddr())
+	return pc, nil
+}
+
+// readDatagrams sends the lines of every datagram received on pc until pc
+// is closed. A datagram ends its last line even without a newline, so a
+// lost datagram never merges two lines. Lines are tagged with the sender's
+// address as their receiver.
+func readDatagrams(pc net.PacketConn, lines chan<- feedLine) {
+	buf := make([]byte, maxDatagram)
+	for {
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		ip := senderIP(from)
+		if !allowed(ip) {
+			metricListenRejected.Inc("udp")
+			continue
+		}
+		receiver := ip.String()
+		for _, line := range bytes.Split(buf[:n], []byte("\n")) {
+			line = bytes.TrimSuffix(line, []byte("\r"))
+			if len(line) == 0 {
+				continue
+			}
+			feed.Read()
+			lines <- feedLine{receiver: receiver, text: string(line)}
+		}
+	}
+}
+
+// listenTCP opens the port receivers connect to in order to push their feed.
+func listenTCP(addr string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, newError(errConnect, fmt.Errorf("listening on %s: %w", addr, err))
+	}
+	log.Printf("Accepting receivers on %s", ln.Addr())
+	return ln, nil
+}
+
+// acceptFeeds reads every connection accepted on ln into lines, tagged with
+// the sender's address as their receiver, until stop is closed. It returns
+// once the listener and all connections are closed.
+func acceptFeeds(ln net.Listener, lines chan<- feedLine, stop <-chan struct{}) {
+	var (
+		mu      sync.Mutex
+		conns   = map[net.Conn]bool{}
+		stopped bool
+		wg      sync.WaitGroup
+	)
+	go func() {
+		<-stop
+		ln.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		stopped = true
+		for conn := range conns {
+			conn.Close()
+		}
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-stop:
+				wg.Wait()
+				return
+			default:
+			}
+			log.Println("Error accepting a receiver:", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		ip := senderIP(conn.RemoteAddr())
+		if !allowed(ip) {
+			metricListenRejected.Inc("tcp")
+			log.Printf("Refusing receiver %s, which is not in listen_allow", ip)
+			conn.Close()
+			continue
+		}
+		mu.Lock()
+		if stopped {
+			mu.Unlock()
+			conn.Close()
+			continue
+		}
+		conns[conn] = true
+		mu.Unlock()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			receiver := ip.String()
+			log.Printf("Receiver %s connected", receiver)
+			scanner := bufio.NewScanner(feedReader(conn))
+			for scanner.Scan() {
+				feed.Read()
+				lines <- feedLine{receiver: receiver, text: scanner.Text()}
+			}
+			mu.Lock()
+			delete(conns, conn)
+			mu.Unlock()
+			conn.Close()
+			log.Printf("Receiver %s disconnected", receiver)
+		}()
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Default SMTP ports: submission with STARTTLS, and submissions with TLS
+// from the first byte.
+const (
+	defaultSMTPPort    = "587"
+	defaultSMTPTLSPort = "465"
+)
+
+const (
+	defaultMailAlertSubject = `ADS-B alert: {{.First.Message}}{{if .More}} and {{.More}} more{{end}}`
+	defaultMailAlertBody    = `{{range .Alerts}}{{.Message}}
+{{range .Fields}}  {{.Name}}: {{.Value}}
+{{end}}{{if .HasPosition}}  Position: {{printf "%.4f, %.4f" .Lat .Lon}}
+{{end}}{{if .MapURL}}  Map: {{.MapURL}}
+{{end}}{{if .PhotoURL}}  Photo: {{.PhotoURL}}
+{{end}}
+{{end}}{{if .Suppressed}}{{.Suppressed}} alert(s) suppressed by throttling.
+{{end}}`
+	defaultMailSummarySubject = `ADS-B summary for {{.Start.Format "2006-01-02"}}: {{.Aircraft}} aircraft`
+	defaultMailSummaryBody    = `Between {{.Start.Format "2006-01-02 15:04"}} and {{.End.Format "2006-01-02 15:04 MST"}}:
+
+  Aircraft:  {{.Aircraft}}
+  Messages:  {{.Messages}}
+{{if .Farthest}}  Farthest:  {{.Farthest}} at {{printf "%.1f" .MaxRangeNM}} nm
+{{end}}{{if .BusiestHourMessages}}  Busiest hour: {{printf "%02d:00" .BusiestHour}} with {{.BusiestHourMessages}} messages
+{{end}}{{if .Alerts}}
+Alerts:
+{{range .Alerts}}  {{.Name}}: {{.Count}}
+{{end}}{{end}}{{if .Emergencies}}
+Emergencies:
+{{range .Emergencies}}  {{.}}
+{{end}}{{end}}`
+)
+
+// smtpMail is the mailer configured on the command line, if any.
+var smtpMail *mailer
+
+// mailer sends alerts and daily summaries by email. security is "starttls"
+// to upgrade the connection before authenticating, "tls" for TLS from the
+// start or "none". Subjects and bodies are text/templates.
+type mailer struct {
+	addr, host, security string
+	username, password   string
+	from                 string
+	to                   []string
+
+	alertSubject, alertBody     *template.Template
+	summarySubject, summaryBody *template.Template
+}
+
+// mailAlert is what alert mail templates see of an alert: the fields of
+// alert_webhook_format's templates, the text from alert_template, the
+// reference data, and the map and photo URLs.
+type mailAlert struct {
+	alertView
+	Message          string
+	MapURL, PhotoURL string
+	Fields           []mailField
+}
+
+type mailField struct {
+	Name, Value string
+}
+
+// mailNotification is what alert mail templates see: the alerts, the
+// first of them, how many more there are, and how many were suppressed.
+type mailNotification struct {
+	Alerts     []mailAlert
+	First      mailAlert
+	More       int
+	Suppressed int
+}
+
+// newMailer checks the settings and parses the templates. alertBodyPath and
+// summaryBodyPath are files; the subjects are templates themselves. Empty
+// ones get the defaults.
+func newMailer(server, security, username, password, from, to, alertSubject, alertBodyPath, summarySubject, summaryBodyPath string) (*mailer, error) {
+	m := &mailer{security: security, username: username, password: password, from: from}
+	switch security {
+	case "starttls", "none":
+		m.addr = server
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			m.addr = net.JoinHostPort(server, defaultSMTPPort)
+		}
+	case "tls":
+		m.addr = server
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			m.addr = net.JoinHostPort(server, defaultSMTPTLSPort)
+		}
+	default:
+		return nil, fmt.Errorf("unknown smtp_tls %q, expected 'starttls', 'tls' or 'none'", security)
+	}
+	m.host, _, _ = net.SplitHostPort(m.addr)
+	if from == "" {
+		return nil, fmt.Errorf("smtp_from is not set")
+	}
+	for _, addr := range strings.Split(to, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			m.to = append(m.to, addr)
+		}
+	}
+	if len(m.to) == 0 {
+		return nil, fmt.Errorf("smtp_to is not set")
+	}
+
+	var err error
+	if m.alertSubject, err = parseMailTemplate("smtp_alert_subject", alertSubject, "", defaultMailAlertSubject); err != nil {
+		return nil, err
+	}
+	if m.alertBody, err = parseMailTemplate("smtp_alert_template", "", alertBodyPath, defaultMailAlertBody); err != nil {
+		return nil, err
+	}
+	if m.summarySubject, err = parseMailTemplate("smtp_summary_subject", summarySubject, "", defaultMailSummarySubject); err != nil {
+		return nil, err
+	}
+	if m.summaryBody, err = parseMailTemplate("smtp_summary_template", "", summaryBodyPath, defaultMailSummaryBody); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// parseMailTemplate parses text, or else the file at path, or else def.
+func parseMailTemplate(name, text, path, def string) (*template.Template, error) {
+	if text == "" {
+		text = def
+	}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		text = string(data)
+	}
+	return template.New(name).Parse(text)
+}
+
+// SendAlerts mails a notification, formatted with f for the alert text,
+// map and photo.
+func (m *mailer) SendAlerts(n Notification, f *alertFormatter) error {
+	view := mailNotification{Suppressed: n.Suppressed}
+	for _, alert := range n.Alerts {
+		v, text, mapURL, photoURL := f.details(alert)
+		ma := mailAlert{alertView: v, Message: text, MapURL: mapURL, PhotoURL: photoURL}
+		for _, field := range alertFields(v) {
+			ma.Fields = append(ma.Fields, mailField{field[0], field[1]})
+		}
+		view.Alerts = append(view.Alerts, ma)
+	}
+	if len(view.Alerts) > 0 {
+		view.First, view.More = view.Alerts[0], len(view.Alerts)-1
+	}
+	return m.sendTemplates(m.alertSubject, m.alertBody, view)
+}
+
+// SendSummary mails a daily summary.
+func (m *mailer) SendSummary(s summaryView) error {
+	return m.sendTemplates(m.summarySubject, m.summaryBody, s)
+}
+
+func (m *mailer) sendTemplates(subject, body *template.Template, data interface{}) error {
+	if !toggles.Enabled("smtp") {
+		metricDisabledSink.Inc("smtp")
+		return nil
+	}
+	var s, b strings.Builder
+	if err := subject.Execute(&s, data); err != nil {
+		metricParseErrors.Inc("mail_template")
+		return err
+	}
+	if err := body.Execute(&b, data); err != nil {
+		metricParseErrors.Inc("mail_template")
+		return err
+	}
+	// A subject is a single line.
+	return m.send(strings.Join(strings.Fields(s.String()), " "), b.String())
+}
+
+// send delivers a plain-text message to every recipient.
+func (m *mailer) send(subject, body string) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", m.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(m.to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Message-ID: <%s@adsb-go-dataset>\r\n", uuid.NewString())
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n")
+	qp := quotedprintable.NewWriter(&msg)
+	qp.Write([]byte(body))
+	qp.Close()
+
+	if err := m.deliver(msg.Bytes()); err != nil {
+		metricSinkErrors.Inc("smtp")
+		return err
+	}
+	metricSinkEvents.Inc("smtp")
+	return nil
+}
+
+// deliver runs one SMTP session. Credentials are only sent over TLS, or to
+// a server on localhost.
+func (m *mailer) deliver(msg []byte) error {
+	tlsConfig := &tls.Config{ServerName: m.host}
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if m.security == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", m.addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", m.addr)
+	}
+	if err != nil {
+		return newError(errConnect, err)
+	}
+	conn.SetDeadline(time.Now().Add(time.Minute))
+	c, err := smtp.NewClient(conn, m.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if m.security == "starttls" {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("SMTP server %s does not offer STARTTLS; set smtp_tls to 'tls' or 'none'", m.addr)
+		}
+		if err := c.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if m.username != "" {
+		if err := c.Auth(smtp.PlainAuth("", m.username, m.password, m.host)); err != nil {
+			var tpErr *textproto.Error
+			if errors.As(err, &tpErr) && tpErr.Code == 535 {
+				return newError(errAuth, err)
+			}
+			return err
+		}
+	}
+	if err := c.Mail(m.from); err != nil {
+		return err
+	}
+	for _, to := range m.to {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
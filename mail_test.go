@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewMailer(t *testing.T) {
+	tests := []struct {
+		name, server, security, from, to string
+		addr                             string
+		recipients                       []string
+		err                              string
+	}{
+		{name: "submission", server: "smtp.example.com", security: "starttls", from: "a@example.com", to: "b@example.com",
+			addr: "smtp.example.com:587", recipients: []string{"b@example.com"}},
+		{name: "submissions", server: "smtp.example.com", security: "tls", from: "a@example.com", to: "b@example.com, ,c@example.com",
+			addr: "smtp.example.com:465", recipients: []string{"b@example.com", "c@example.com"}},
+		{name: "port", server: "localhost:25", security: "none", from: "a@example.com", to: "b@example.com",
+			addr: "localhost:25", recipients: []string{"b@example.com"}},
+		{name: "unknown security", server: "localhost", security: "ssl", from: "a@example.com", to: "b@example.com", err: "unknown smtp_tls"},
+		{name: "no sender", server: "localhost", security: "none", to: "b@example.com", err: "smtp_from is not set"},
+		{name: "no recipients", server: "localhost", security: "none", from: "a@example.com", to: " , ", err: "smtp_to is not set"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := newMailer(tt.server, tt.security, "", "", tt.from, tt.to, "", "", "", "")
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.addr != tt.addr || !reflect.DeepEqual(m.to, tt.recipients) {
+				t.Errorf("mailing %v through %s, want %v through %s", m.to, m.addr, tt.recipients, tt.addr)
+			}
+		})
+	}
+
+	if _, err := newMailer("localhost", "none", "", "", "a@example.com", "b@example.com", "{{.Missing", "", "", ""); err == nil {
+		t.Error("a subject that does not parse was accepted")
+	}
+}
+
+// smtpSession is what a fake SMTP server received.
+type smtpSession struct {
+	commands []string
+	data     string
+}
+
+// fakeSMTP serves one SMTP session, advertising extensions and answering
+// AUTH with authReply.
+func fakeSMTP(t *testing.T, extensions []string, authReply string) (addr string, session <-chan smtpSession) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	ch := make(chan smtpSession, 1)
+	go func() {
+		var got smtpSession
+		defer func() { ch <- got }()
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		reply := func(s string) { io.WriteString(conn, s+"\r\n") }
+		reply("220 fake ESMTP")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			got.commands = append(got.commands, line)
+			verb := strings.ToUpper(strings.Fields(line + " x")[0])
+			switch verb {
+			case "EHLO":
+				for _, ext := range extensions {
+					reply("250-" + ext)
+				}
+				reply("250 fake")
+			case "AUTH":
+				reply(authReply)
+			case "MAIL", "RCPT":
+				reply("250 OK")
+			case "DATA":
+				reply("354 go ahead")
+				var data strings.Builder
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil || line == ".\r\n" {
+						break
+					}
+					data.WriteString(line)
+				}
+				got.data = data.String()
+				reply("250 queued")
+			case "QUIT":
+				reply("221 bye")
+				return
+			default:
+				reply("502 unknown command")
+			}
+		}
+	}()
+	return ln.Addr().String(), ch
+}
+
+func TestMailerSend(t *testing.T) {
+	addr, session := fakeSMTP(t, []string{"AUTH PLAIN"}, "235 accepted")
+	m, err := newMailer(addr, "none", "user", "secret", "adsb@example.com", "a@example.com,b@example.com", "", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	err = m.SendSummary(summaryView{
+		Start: day, End: day.Add(24 * time.Hour), Aircraft: 412, Messages: 1200000,
+		MaxRangeNM: 212.34, Farthest: "EIN123 (4CA2D6)", BusiestHour: 9, BusiestHourMessages: 90000,
+		Alerts: []summaryCount{{"emergency", 2}}, Emergencies: []string{"EIN123 squawked 7700 at 09:12"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := <-session
+	want := []string{
+		"EHLO localhost",
+		"AUTH PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00user\x00secret")),
+		"MAIL FROM:<adsb@example.com>",
+		"RCPT TO:<a@example.com>",
+		"RCPT TO:<b@example.com>",
+		"DATA",
+		"QUIT",
+	}
+	if !reflect.DeepEqual(got.commands, want) {
+		t.Errorf("commands\n%q\nwant\n%q", got.commands, want)
+	}
+
+	msg, err := mail.ReadMessage(strings.NewReader(got.data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject, _ := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if subject != "ADS-B summary for 2026-03-01: 412 aircraft" {
+		t.Errorf("subject %q", subject)
+	}
+	if to := msg.Header.Get("To"); to != "a@example.com, b@example.com" {
+		t.Errorf("to %q", to)
+	}
+	body, err := io.ReadAll(quotedprintable.NewReader(msg.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"Between 2026-03-01 00:00 and 2026-03-02 00:00 UTC:",
+		"  Aircraft:  412",
+		"  Farthest:  EIN123 (4CA2D6) at 212.3 nm",
+		"  Busiest hour: 09:00 with 90000 messages",
+		"  emergency: 2",
+		"  EIN123 squawked 7700 at 09:12",
+	} {
+		if !strings.Contains(string(body), line+"\r\n") {
+			t.Errorf("body lacks %q:\n%s", line, body)
+		}
+	}
+}
+
+func TestMailerErrors(t *testing.T) {
+	addr, _ := fakeSMTP(t, []string{"AUTH PLAIN"}, "535 5.7.8 authentication failed")
+	m, err := newMailer(addr, "none", "user", "wrong", "adsb@example.com", "a@example.com", "", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.send("test", "test"); errorKindOf(err) != errAuth {
+		t.Errorf("rejected credentials: error %v, want an auth error", err)
+	}
+
+	addr, _ = fakeSMTP(t, nil, "")
+	if m, err = newMailer(addr, "starttls", "", "", "adsb@example.com", "a@example.com", "", "", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.send("test", "test"); err == nil || !strings.Contains(err.Error(), "does not offer STARTTLS") {
+		t.Errorf("no STARTTLS: error %v", err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+	if m, err = newMailer(ln.Addr().String(), "none", "", "", "adsb@example.com", "a@example.com", "", "", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.send("test", "test"); errorKindOf(err) != errConnect {
+		t.Errorf("nothing listening: error %v, want a connect error", err)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// messageText renders msg as a line for DataSet's event list, e.g.
+// "AAL123 at FL350 450kt 37.7749,-122.4194". Fields the message does not
+// carry are left out.
+func messageText(msg SBS1Message) string {
+	switch msg.MessageType {
+	case "STATS":
+		rs := msg.ReceiverStats
+		if rs == nil {
+			break
+		}
+		text := fmt.Sprintf("receiver stats: %d messages, %d tracks", rs.Messages, rs.Tracks)
+		if rs.Signal != nil {
+			text += fmt.Sprintf(", signal %.1f dBFS", *rs.Signal)
+		}
+		return text
+	case "ADVISORY":
+		if msg.GainAdvisory != nil {
+			return msg.GainAdvisory.Message
+		}
+	case "AUDIT":
+		if a := msg.RuleAudit; a != nil {
+			text := fmt.Sprintf("alert rule %s: %s", a.Rule, a.Action)
+			if a.Remote != "" {
+				text += " by " + a.Remote
+			}
+			return text
+		}
+		if a := msg.ToggleAudit; a != nil {
+			return toggleAuditText(a)
+		}
+	case "ENRICHMENT_UPDATE":
+		parts := []string{aircraftName(msg), "is"}
+		if e := msg.Enrichment; e != nil {
+			parts = appendNonEmpty(parts, e.Registration, e.AircraftType, e.Operator)
+			if e.Origin != "" || e.Destination != "" {
+				parts = append(parts, e.Origin+"-"+e.Destination)
+			}
+		}
+		return strings.Join(parts, " ")
+	case "MSG", "SNAPSHOT":
+		parts := []string{aircraftName(msg)}
+		switch {
+		case msg.OnGround:
+			parts = append(parts, "on ground")
+		case msg.Altitude >= 18000:
+			parts = append(parts, fmt.Sprintf("at FL%03d", msg.Altitude/100))
+		case msg.Altitude != 0:
+			parts = append(parts, fmt.Sprintf("at %dft", msg.Altitude))
+		}
+		if msg.GroundSpeed != 0 {
+			parts = append(parts, fmt.Sprintf("%.0fkt", msg.GroundSpeed))
+		}
+		if msg.Lat != 0 || msg.Lon != 0 {
+			parts = append(parts, fmt.Sprintf("%.4f,%.4f", msg.Lat, msg.Lon))
+		}
+		if msg.Squawk != 0 {
+			parts = append(parts, fmt.Sprintf("squawk %04d", msg.Squawk))
+		}
+		if msg.Emergency {
+			parts = append(parts, "emergency")
+		}
+		if msg.Ghost {
+			parts = append(parts, "ghost")
+		}
+		return strings.Join(parts, " ")
+	}
+	return msg.MessageType
+}
+
+// aircraftName is the callsign of msg's aircraft, or its ICAO address.
+func aircraftName(msg SBS1Message) string {
+	if msg.Callsign != "" {
+		return msg.Callsign
+	}
+	return msg.Icao24
+}
+
+// appendNonEmpty appends the values that are set.
+func appendNonEmpty(parts []string, values ...string) []string {
+	for _, v := range values {
+		if v != "" {
+			parts = append(parts, v)
+		}
+	}
+	return parts
+}
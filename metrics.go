@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Counter is a monotonically increasing metric, optionally split by a
+// single label.
+type Counter struct {
+	name  string
+	help  string
+	label string
+
+	mu        sync.Mutex
+	values    map[string]float64
+	exemplars map[string]exemplar
+}
+
+// exemplar points from a series at one example of what it counts, such as
+// the dead-letter entry of a failed upload. Only OpenMetrics scrapes see it.
+type exemplar struct {
+	label string
+	value string
+	time  time.Time
+}
+
+var (
+	metricsMu sync.Mutex
+	counters  []*Counter
+)
+
+// newCounter registers a counter. label names the label used to split the
+// counter, or is empty for a plain counter.
+func newCounter(name, help, label string) *Counter {
+	c := &Counter{name: name, help: help, label: label, values: map[string]float64{}}
+	metricsMu.Lock()
+	counters = append(counters, c)
+	metricsMu.Unlock()
+	return c
+}
+
+// Inc adds one to the series for labelValue.
+func (c *Counter) Inc(labelValue string) {
+	c.Add(labelValue, 1)
+}
+
+// Add adds v to the series for labelValue.
+func (c *Counter) Add(labelValue string, v float64) {
+	c.mu.Lock()
+	c.values[labelValue] += v
+	c.mu.Unlock()
+}
+
+// SetExemplar attaches an exemplar with a single label to the series for
+// labelValue, replacing the previous one.
+func (c *Counter) SetExemplar(labelValue, name, value string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.exemplars == nil {
+		c.exemplars = map[string]exemplar{}
+	}
+	c.exemplars[labelValue] = exemplar{label: name, value: value, time: time.Now()}
+}
+
+// Value returns the current value of the series for labelValue.
+func (c *Counter) Value(labelValue string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[labelValue]
+}
+
+// writeMetrics renders every registered metric in the Prometheus text
+// exposition format, or in OpenMetrics with exemplars.
+func writeMetrics(w io.Writer, openMetrics bool) {
+	metricsMu.Lock()
+	cs := append([]*Counter(nil), counters...)
+	metricsMu.Unlock()
+
+	for _, c := range cs {
+		family := c.name
+		if openMetrics {
+			// OpenMetrics names the counter family without its _total suffix.
+			family = strings.TrimSuffix(c.name, "_total")
+		}
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", family, c.help, family)
+		c.mu.Lock()
+		keys := make([]string, 0, len(c.values))
+		for k := range c.values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		if c.label == "" && len(keys) == 0 {
+			fmt.Fprintf(w, "%s 0\n", c.name)
+		}
+		for _, k := range keys {
+			if c.label == "" {
+				fmt.Fprintf(w, "%s %s", c.name, formatMetricValue(c.values[k]))
+			} else {
+				fmt.Fprintf(w, "%s{%s=%q} %s", c.name, c.label, k, formatMetricValue(c.values[k]))
+			}
+			if e, ok := c.exemplars[k]; ok && openMetrics {
+				fmt.Fprintf(w, " # {%s=%q} 1 %.3f", e.label, e.value, float64(e.time.UnixNano())/1e9)
+			}
+			fmt.Fprintln(w)
+		}
+		c.mu.Unlock()
+	}
+	if openMetrics {
+		fmt.Fprintln(w, "# EOF")
+	}
+}
+
+func formatMetricValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// metricsHandler serves the registered metrics for Prometheus, using
+// OpenMetrics when the scraper asks for it.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text") {
+		w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+		writeMetrics(w, true)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetrics(w, false)
+}
+
+// serveMetrics exposes /metrics on addr in the background.
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.HandleFunc("/readyz", feed.readyHandler)
+	mux.HandleFunc("/livez", feed.liveHandler(LIVENESS_MAX_SILENCE))
+	mux.HandleFunc("/schema", schemaHandler)
+	mux.HandleFunc("/schema.proto", schemaHandler)
+	if alertMaps != nil {
+		mux.Handle("/alert_maps/", alertMaps)
+	}
+	go func() {
+		log.Printf("Serving metrics on %s", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Println("Metrics server stopped:", err)
+		}
+	}()
+}
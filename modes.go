@@ -0,0 +1,507 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// modeSDecoder turns raw Mode S replies into SBS1Messages. It keeps the
+// state decoding needs across frames: addresses confirmed by a clean parity
+// check, without which replies whose parity is overlaid with the address
+// cannot be trusted, and the CPR frames positions are computed from.
+type modeSDecoder struct {
+	mu        sync.Mutex
+	known     map[uint32]time.Time
+	positions map[uint32]*cprState
+	lastSweep time.Time
+}
+
+// cprState holds the latest even and odd position frames of an aircraft and
+// its last decoded position.
+type cprState struct {
+	frames   [2]cprFrame
+	lat, lon float64
+	fixed    time.Time
+}
+
+// cprFrame is one encoded position, as fractions of a zone.
+type cprFrame struct {
+	lat, lon float64
+	at       time.Time
+}
+
+const (
+	// knownAddressTTL is how long a confirmed address is trusted for
+	// replies that carry no parity of their own.
+	knownAddressTTL = time.Minute
+	// cprPairWindow is the longest gap between an even and an odd frame
+	// that are combined into a global position.
+	cprPairWindow = 10 * time.Second
+	// cprLocalWindow is how long a decoded position is used as the
+	// reference for decoding single frames.
+	cprLocalWindow = 10 * time.Minute
+	// cprMaxJumpNM rejects local decodes implausibly far from the
+	// reference.
+	cprMaxJumpNM = 100
+	// receiverMaxRangeNM rejects positions implausibly far from a fixed
+	// receiver.
+	receiverMaxRangeNM = 400
+)
+
+// modeS is the decoder shared by binary and hex inputs.
+var modeS = newModeSDecoder()
+
+func newModeSDecoder() *modeSDecoder {
+	return &modeSDecoder{known: map[uint32]time.Time{}, positions: map[uint32]*cprState{}}
+}
+
+// decodeModeS decodes a reply received now with the shared decoder,
+// counting parity and address failures as parse errors. mlat is set for
+// the frames mlat-client synthesises from its results.
+func decodeModeS(frame []byte, mlat bool) (SBS1Message, bool) {
+	msg, ok, reason := modeS.Decode(frame, clock.Now(), mlat)
+	if reason != "" {
+		metricParseErrors.Inc(reason)
+	}
+	return msg, ok
+}
+
+// Decode decodes one Mode S reply of 7 or 14 bytes received at now. It
+// returns false for replies that fail the parity check, come from an
+// unconfirmed address or carry nothing the message model holds; for the
+// first two, reason names the problem for the parse error metric. With
+// mlat, DF18 fine TIS-B replies (CF 2) are decoded too: mlat-client sends
+// its results as those, so they are not mistaken for ADS-B.
+func (d *modeSDecoder) Decode(frame []byte, now time.Time, mlat bool) (msg SBS1Message, ok bool, reason string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.sweepLocked(now)
+
+	msg = NewSBS1Message()
+	msg.MessageType = "MSG"
+	msg.GeneratedDate, msg.LoggedDate = &now, &now
+
+	df := frame[0] >> 3
+	if long := df >= 16; (long && len(frame) != 14) || (!long && len(frame) != 7) {
+		return msg, false, "length"
+	}
+	residual := modeSResidual(frame)
+
+	switch df {
+	case 11:
+		// All-call reply. The interrogator ID may be overlaid on the low
+		// bits of the parity.
+		if residual&^0x7f != 0 {
+			return msg, false, "crc"
+		}
+		icao := addressOf(frame)
+		d.known[icao] = now
+		msg.TransmissionType = 8
+		msg.Icao24 = formatICAO(icao)
+		return msg, true, ""
+
+	case 17, 18:
+		if residual != 0 {
+			return msg, false, "crc"
+		}
+		// DF18 is only decoded for ADS-B with an ICAO address (CF 0),
+		// rebroadcasts of it (CF 6) and multilaterated positions.
+		if cf := frame[0] & 7; df == 18 && cf != 0 && cf != 6 && !(mlat && cf == 2) {
+			return msg, false, ""
+		}
+		icao := addressOf(frame)
+		d.known[icao] = now
+		msg.Icao24 = formatICAO(icao)
+		return d.decodeExtendedSquitter(msg, icao, frame[4:11], now)
+
+	case 0, 4, 5, 16, 20, 21:
+		// Surveillance replies: the parity is overlaid with the address,
+		// which is only accepted if it was confirmed recently.
+		if _, ok := d.known[residual]; !ok {
+			return msg, false, "unknown_address"
+		}
+		msg.Icao24 = formatICAO(residual)
+		field := uint32(frame[2]&0x1f)<<8 | uint32(frame[3])
+		if df == 4 || df == 5 || df == 20 || df == 21 {
+			setFlightStatus(&msg, frame[0]&7)
+		}
+		switch df {
+		case 5, 21:
+			msg.TransmissionType = 6
+			msg.Squawk = squawkOf(field)
+			msg.Emergency = msg.Squawk == 7500 || msg.Squawk == 7600 || msg.Squawk == 7700
+		case 0, 16:
+			msg.TransmissionType = 7
+			msg.Altitude = altitude13(field)
+		default:
+			msg.TransmissionType = 5
+			msg.Altitude = altitude13(field)
+		}
+		return msg, true, ""
+	}
+	return msg, false, ""
+}
+
+// decodeExtendedSquitter decodes the ME field of an ADS-B message.
+func (d *modeSDecoder) decodeExtendedSquitter(msg SBS1Message, icao uint32, me []byte, now time.Time) (SBS1Message, bool, string) {
+	tc := me[0] >> 3
+	switch {
+	case tc >= 1 && tc <= 4:
+		msg.TransmissionType = 1
+		msg.Callsign = callsignOf(me)
+		return msg, msg.Callsign != "", ""
+
+	case tc >= 5 && tc <= 8:
+		msg.TransmissionType = 2
+		msg.OnGround = true
+		if me[1]&0x08 != 0 {
+			trk := (uint32(me[1]&0x07)<<4 | uint32(me[2])>>4)
+			msg.Track = float32(float64(trk) * 360 / 128)
+		}
+		if lat, lon, ok := d.position(icao, me, true, now); ok {
+			msg.Lat, msg.Lon = float32(lat), float32(lon)
+		}
+		return msg, true, ""
+
+	case tc >= 9 && tc <= 18, tc >= 20 && tc <= 22:
+		msg.TransmissionType = 3
+		if tc <= 18 {
+			msg.Altitude = altitude12(uint32(me[1])<<4 | uint32(me[2])>>4)
+		}
+		if lat, lon, ok := d.position(icao, me, false, now); ok {
+			msg.Lat, msg.Lon = float32(lat), float32(lon)
+		}
+		return msg, msg.Altitude != 0 || msg.Lat != 0 || msg.Lon != 0, ""
+
+	case tc == 19:
+		msg.TransmissionType = 4
+		subtype := me[0] & 7
+		if subtype == 1 || subtype == 2 {
+			ew := int(uint32(me[1]&0x03)<<8|uint32(me[2])) - 1
+			ns := int(uint32(me[3]&0x7f)<<3|uint32(me[4])>>5) - 1
+			if ew >= 0 && ns >= 0 {
+				scale := 1.0
+				if subtype == 2 {
+					scale = 4
+				}
+				vx, vy := float64(ew)*scale, float64(ns)*scale
+				if me[1]&0x04 != 0 {
+					vx = -vx
+				}
+				if me[3]&0x80 != 0 {
+					vy = -vy
+				}
+				msg.GroundSpeed = float32(math.Hypot(vx, vy))
+				msg.Track = float32(math.Mod(math.Atan2(vx, vy)*180/math.Pi+360, 360))
+			}
+		}
+		if vr := int32(uint32(me[4]&0x07)<<6|uint32(me[5])>>2) - 1; vr >= 0 {
+			msg.VerticalRate = vr * 64
+			if me[4]&0x08 != 0 {
+				msg.VerticalRate = -msg.VerticalRate
+			}
+		}
+		return msg, true, ""
+	}
+	return msg, false, ""
+}
+
+// position records a CPR frame and decodes a position: globally from an
+// even and odd pair, or locally from a single frame near a recent position
+// of the same aircraft or, on the surface, near the receiver.
+func (d *modeSDecoder) position(icao uint32, me []byte, surface bool, now time.Time) (float64, float64, bool) {
+	odd := int(me[2]>>2) & 1
+	frame := cprFrame{
+		lat: float64(uint32(me[2]&0x03)<<15|uint32(me[3])<<7|uint32(me[4])>>1) / 131072,
+		lon: float64(uint32(me[4]&0x01)<<16|uint32(me[5])<<8|uint32(me[6])) / 131072,
+		at:  now,
+	}
+	st := d.positions[icao]
+	if st == nil {
+		st = &cprState{}
+		d.positions[icao] = st
+	}
+	st.frames[odd] = frame
+
+	var lat, lon float64
+	var ok bool
+	switch {
+	case !st.fixed.IsZero() && now.Sub(st.fixed) < cprLocalWindow:
+		lat, lon = cprLocal(frame, odd, surface, st.lat, st.lon)
+		ok = distanceNM(lat, lon, st.lat, st.lon) < cprMaxJumpNM
+	case surface:
+		if RECEIVER_LAT == 0 && RECEIVER_LON == 0 {
+			return 0, 0, false
+		}
+		lat, lon = cprLocal(frame, odd, true, RECEIVER_LAT, RECEIVER_LON)
+		ok = distanceNM(lat, lon, RECEIVER_LAT, RECEIVER_LON) < 45
+	default:
+		other := st.frames[1-odd]
+		if other.at.IsZero() || now.Sub(other.at) > cprPairWindow {
+			return 0, 0, false
+		}
+		even, oddFrame := st.frames[0], st.frames[1]
+		lat, lon, ok = cprGlobal(even, oddFrame, odd == 1)
+		if ok && (RECEIVER_LAT != 0 || RECEIVER_LON != 0) {
+			ok = distanceNM(lat, lon, RECEIVER_LAT, RECEIVER_LON) < receiverMaxRangeNM
+		}
+	}
+	if !ok {
+		return 0, 0, false
+	}
+	st.lat, st.lon, st.fixed = lat, lon, now
+	return lat, lon, true
+}
+
+// sweepLocked forgets addresses and positions that went stale.
+func (d *modeSDecoder) sweepLocked(now time.Time) {
+	if now.Sub(d.lastSweep) < time.Minute {
+		return
+	}
+	d.lastSweep = now
+	for icao, seen := range d.known {
+		if now.Sub(seen) > knownAddressTTL {
+			delete(d.known, icao)
+		}
+	}
+	for icao, st := range d.positions {
+		latest := st.fixed
+		for _, f := range st.frames {
+			if f.at.After(latest) {
+				latest = f.at
+			}
+		}
+		if now.Sub(latest) > cprLocalWindow {
+			delete(d.positions, icao)
+		}
+	}
+}
+
+// cprGlobal decodes an airborne position from an even and an odd frame,
+// using the latitude of the newer one.
+func cprGlobal(even, odd cprFrame, oddNewer bool) (float64, float64, bool) {
+	j := math.Floor(59*even.lat - 60*odd.lat + 0.5)
+	latEven := 360.0 / 60 * (cprMod(j, 60) + even.lat)
+	latOdd := 360.0 / 59 * (cprMod(j, 59) + odd.lat)
+	if latEven >= 270 {
+		latEven -= 360
+	}
+	if latOdd >= 270 {
+		latOdd -= 360
+	}
+	if latEven < -90 || latEven > 90 || latOdd < -90 || latOdd > 90 {
+		return 0, 0, false
+	}
+	if cprNL(latEven) != cprNL(latOdd) {
+		return 0, 0, false
+	}
+
+	lat, lonCPR, nl := latEven, even.lon, cprNL(latEven)
+	ni := nl
+	if oddNewer {
+		lat, lonCPR, ni = latOdd, odd.lon, nl-1
+	}
+	if ni < 1 {
+		ni = 1
+	}
+	m := math.Floor(even.lon*float64(nl-1) - odd.lon*float64(nl) + 0.5)
+	lon := 360 / float64(ni) * (cprMod(m, float64(ni)) + lonCPR)
+	if lon >= 180 {
+		lon -= 360
+	}
+	return lat, lon, true
+}
+
+// cprLocal decodes a single frame relative to a reference position within
+// half a zone of it.
+func cprLocal(f cprFrame, odd int, surface bool, refLat, refLon float64) (float64, float64) {
+	span := 360.0
+	if surface {
+		span = 90
+	}
+	dLat := span / float64(60-odd)
+	j := math.Floor(refLat/dLat) + math.Floor(0.5+cprMod(refLat, dLat)/dLat-f.lat)
+	lat := dLat * (j + f.lat)
+
+	dLon := span
+	if ni := cprNL(lat) - odd; ni > 0 {
+		dLon = span / float64(ni)
+	}
+	m := math.Floor(refLon/dLon) + math.Floor(0.5+cprMod(refLon, dLon)/dLon-f.lon)
+	return lat, dLon * (m + f.lon)
+}
+
+// cprNL is the number of longitude zones at a latitude.
+func cprNL(lat float64) int {
+	lat = math.Abs(lat)
+	switch {
+	case lat == 0:
+		return 59
+	case lat == 87:
+		return 2
+	case lat > 87:
+		return 1
+	}
+	a := 1 - math.Cos(math.Pi/30)
+	b := math.Pow(math.Cos(math.Pi/180*lat), 2)
+	return int(math.Floor(2 * math.Pi / math.Acos(1-a/b)))
+}
+
+// cprMod is a modulo that is never negative.
+func cprMod(a, b float64) float64 {
+	r := math.Mod(a, b)
+	if r < 0 {
+		r += b
+	}
+	return r
+}
+
+// modeSResidual returns the parity of a reply XORed with its parity field:
+// zero for clean DF11/17/18 replies, the address for surveillance replies.
+func modeSResidual(frame []byte) uint32 {
+	var crc uint32
+	n := len(frame) - 3
+	for _, b := range frame[:n] {
+		crc ^= uint32(b) << 16
+		for i := 0; i < 8; i++ {
+			crc <<= 1
+			if crc&0x1000000 != 0 {
+				crc ^= 0x1fff409
+			}
+		}
+	}
+	return (crc ^ (uint32(frame[n])<<16 | uint32(frame[n+1])<<8 | uint32(frame[n+2]))) & 0xffffff
+}
+
+// addressOf returns the AA field of an all-call reply or extended squitter.
+func addressOf(frame []byte) uint32 {
+	return uint32(frame[1])<<16 | uint32(frame[2])<<8 | uint32(frame[3])
+}
+
+func formatICAO(icao uint32) string {
+	const digits = "0123456789ABCDEF"
+	b := make([]byte, 6)
+	for i := 5; i >= 0; i-- {
+		b[i] = digits[icao&0xf]
+		icao >>= 4
+	}
+	return string(b)
+}
+
+// setFlightStatus applies the FS field of a surveillance reply.
+func setFlightStatus(msg *SBS1Message, fs byte) {
+	msg.OnGround = fs == 1 || fs == 3
+	msg.Alert = fs >= 2 && fs <= 4
+	msg.Spi = fs == 4 || fs == 5
+}
+
+// callsignAlphabet maps the 6-bit characters of an identification message.
+const callsignAlphabet = "#ABCDEFGHIJKLMNOPQRSTUVWXYZ##### ###############0123456789######"
+
+// callsignOf decodes the eight characters of an identification message.
+func callsignOf(me []byte) string {
+	bits := uint64(0)
+	for _, b := range me[1:7] {
+		bits = bits<<8 | uint64(b)
+	}
+	var sb strings.Builder
+	for i := 7; i >= 0; i-- {
+		c := callsignAlphabet[(bits>>(uint(i)*6))&0x3f]
+		if c == '#' {
+			return ""
+		}
+		sb.WriteByte(c)
+	}
+	return strings.TrimSpace(sb.String())
+}
+
+// gillham reorders a 13-bit ID or AC field into the C1 A1 C2 A2 C4 A4 B1 D1
+// B2 D2 B4 D4 layout as hex digits ABCD.
+func gillham(field uint32) uint32 {
+	var code uint32
+	for _, bit := range []struct{ from, to uint32 }{
+		{0x1000, 0x0010}, {0x0800, 0x1000}, {0x0400, 0x0020}, {0x0200, 0x2000},
+		{0x0100, 0x0040}, {0x0080, 0x4000}, {0x0020, 0x0100}, {0x0010, 0x0001},
+		{0x0008, 0x0200}, {0x0004, 0x0002}, {0x0002, 0x0400}, {0x0001, 0x0004},
+	} {
+		if field&bit.from != 0 {
+			code |= bit.to
+		}
+	}
+	return code
+}
+
+// squawkOf decodes a 13-bit identity field into the four-digit code as it
+// is written, e.g. 7700.
+func squawkOf(field uint32) int32 {
+	code := gillham(field)
+	return int32((code>>12&7)*1000 + (code>>8&7)*100 + (code>>4&7)*10 + code&7)
+}
+
+// altitude13 decodes the 13-bit AC field of a surveillance reply in feet.
+// Metric altitudes are not supported and decode as 0.
+func altitude13(field uint32) int32 {
+	if field&0x40 != 0 {
+		return 0
+	}
+	if field&0x10 != 0 {
+		n := (field&0x1f80)>>2 | (field&0x20)>>1 | field&0x0f
+		return int32(n)*25 - 1000
+	}
+	return gillhamAltitude(field)
+}
+
+// altitude12 decodes the 12-bit altitude of an airborne position in feet.
+func altitude12(field uint32) int32 {
+	if field&0x10 != 0 {
+		n := (field&0x0fe0)>>1 | field&0x0f
+		return int32(n)*25 - 1000
+	}
+	return gillhamAltitude((field&0x0fc0)<<1 | field&0x3f)
+}
+
+// gillhamAltitude decodes a Gillham (Mode C) coded altitude in feet, or 0
+// if the code is invalid.
+func gillhamAltitude(field uint32) int32 {
+	code := gillham(field)
+	if code&0xffff8889 != 0 || code&0xf0 == 0 {
+		return 0
+	}
+	var hundreds, fiveHundreds int32
+	if code&0x0010 != 0 {
+		hundreds ^= 7
+	}
+	if code&0x0020 != 0 {
+		hundreds ^= 3
+	}
+	if code&0x0040 != 0 {
+		hundreds ^= 1
+	}
+	if hundreds&5 == 5 {
+		hundreds ^= 2
+	}
+	if hundreds > 5 {
+		return 0
+	}
+	for _, bit := range []struct {
+		mask uint32
+		flip int32
+	}{
+		{0x0002, 0xff}, {0x0004, 0x7f}, {0x1000, 0x3f}, {0x2000, 0x1f},
+		{0x4000, 0x0f}, {0x0100, 0x07}, {0x0200, 0x03}, {0x0400, 0x01},
+	} {
+		if code&bit.mask != 0 {
+			fiveHundreds ^= bit.flip
+		}
+	}
+	if fiveHundreds&1 != 0 {
+		hundreds = 6 - hundreds
+	}
+	n := fiveHundreds*5 + hundreds - 13
+	if n < -12 {
+		return 0
+	}
+	return n * 100
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/hex"
+	"math"
+	"testing"
+	"time"
+)
+
+// modeSFrame decodes a hex reply. With parity, the parity field is
+// recomputed and overlaid with addr, as in a surveillance reply from that
+// address.
+func modeSFrame(t *testing.T, s string, parity bool, addr uint32) []byte {
+	t.Helper()
+	frame, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parity {
+		n := len(frame) - 3
+		frame[n], frame[n+1], frame[n+2] = 0, 0, 0
+		p := modeSResidual(frame) ^ addr
+		frame[n], frame[n+1], frame[n+2] = byte(p>>16), byte(p>>8), byte(p)
+	}
+	return frame
+}
+
+func TestModeSDecode(t *testing.T) {
+	saved := [2]float64{RECEIVER_LAT, RECEIVER_LON}
+	defer func() { RECEIVER_LAT, RECEIVER_LON = saved[0], saved[1] }()
+	RECEIVER_LAT, RECEIVER_LON = 0, 0
+
+	// The frames are the worked examples of "The 1090 Megahertz Riddle".
+	const (
+		ident    = "8D4840D6202CC371C32CE0576098"
+		posEven  = "8D40621D58C382D690C8AC2863A7"
+		posOdd   = "8D40621D58C386435CC412692AD6"
+		velocity = "8D485020994409940838175B284F"
+	)
+	type frame struct {
+		hex string
+		// parity recomputes the parity field, overlaid with addr.
+		parity bool
+		addr   uint32
+		// after is the time since the previous frame, a second if zero.
+		after time.Duration
+	}
+	tests := []struct {
+		name   string
+		frames []frame
+		// The last frame decodes as ok, with reason and want.
+		ok     bool
+		reason string
+		want   SBS1Message
+	}{
+		{
+			name:   "identification",
+			frames: []frame{{hex: ident}},
+			ok:     true,
+			want:   SBS1Message{TransmissionType: 1, Icao24: "4840D6", Callsign: "KLM1023"},
+		},
+		{
+			name:   "velocity",
+			frames: []frame{{hex: velocity}},
+			ok:     true,
+			want:   SBS1Message{TransmissionType: 4, Icao24: "485020", GroundSpeed: 159.2, Track: 182.88, VerticalRate: -832},
+		},
+		{
+			name:   "one position frame has no position",
+			frames: []frame{{hex: posOdd}},
+			ok:     true,
+			want:   SBS1Message{TransmissionType: 3, Icao24: "40621D", Altitude: 38000},
+		},
+		{
+			name:   "global position, even newer",
+			frames: []frame{{hex: posOdd}, {hex: posEven}},
+			ok:     true,
+			want:   SBS1Message{TransmissionType: 3, Icao24: "40621D", Altitude: 38000, Lat: 52.25720, Lon: 3.91937},
+		},
+		{
+			name:   "global position, odd newer",
+			frames: []frame{{hex: posEven}, {hex: posOdd}},
+			ok:     true,
+			want:   SBS1Message{TransmissionType: 3, Icao24: "40621D", Altitude: 38000, Lat: 52.26578, Lon: 3.93891},
+		},
+		{
+			name:   "local position from the last fix",
+			frames: []frame{{hex: posOdd}, {hex: posEven}, {hex: posEven, after: time.Minute}},
+			ok:     true,
+			want:   SBS1Message{TransmissionType: 3, Icao24: "40621D", Altitude: 38000, Lat: 52.25720, Lon: 3.91937},
+		},
+		{
+			name:   "pair too far apart",
+			frames: []frame{{hex: posOdd}, {hex: posEven, after: 11 * time.Second}},
+			ok:     true,
+			want:   SBS1Message{TransmissionType: 3, Icao24: "40621D", Altitude: 38000},
+		},
+		{
+			name:   "bad parity",
+			frames: []frame{{hex: "8D4840D6202CC371C32CE0576099"}},
+			reason: "crc",
+		},
+		{
+			name:   "wrong length",
+			frames: []frame{{hex: "8D4840D6202CC371C32CE0"}},
+			reason: "length",
+		},
+		{
+			name:   "DF18 without an ICAO address",
+			frames: []frame{{hex: "91" + ident[2:], parity: true}},
+		},
+		{
+			name:   "surveillance reply from an unknown address",
+			frames: []frame{{hex: "20001838000000", parity: true, addr: 0x4840D6}},
+			reason: "unknown_address",
+		},
+		{
+			name:   "altitude reply",
+			frames: []frame{{hex: ident}, {hex: "20001838000000", parity: true, addr: 0x4840D6}},
+			ok:     true,
+			want:   SBS1Message{TransmissionType: 5, Icao24: "4840D6", Altitude: 38000},
+		},
+		{
+			name:   "altitude reply on the ground",
+			frames: []frame{{hex: ident}, {hex: "21001838000000", parity: true, addr: 0x4840D6}},
+			ok:     true,
+			want:   SBS1Message{TransmissionType: 5, Icao24: "4840D6", Altitude: 38000, OnGround: true},
+		},
+		{
+			name:   "identity reply with an emergency squawk and alert",
+			frames: []frame{{hex: ident}, {hex: "2A000AAA000000", parity: true, addr: 0x4840D6}},
+			ok:     true,
+			want:   SBS1Message{TransmissionType: 6, Icao24: "4840D6", Squawk: 7700, Emergency: true, Alert: true},
+		},
+		{
+			name:   "identity reply with SPI",
+			frames: []frame{{hex: ident}, {hex: "2D000808000000", parity: true, addr: 0x4840D6}},
+			ok:     true,
+			want:   SBS1Message{TransmissionType: 6, Icao24: "4840D6", Squawk: 1200, Spi: true},
+		},
+		{
+			name:   "address confirmed by an all-call reply",
+			frames: []frame{{hex: "5D4840D6000000", parity: true, addr: 0x4d}, {hex: "20001838000000", parity: true, addr: 0x4840D6}},
+			ok:     true,
+			want:   SBS1Message{TransmissionType: 5, Icao24: "4840D6", Altitude: 38000},
+		},
+		{
+			name:   "confirmed address forgotten",
+			frames: []frame{{hex: ident}, {hex: "20001838000000", parity: true, addr: 0x4840D6, after: 2 * time.Minute}},
+			reason: "unknown_address",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newModeSDecoder()
+			now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+			var (
+				msg    SBS1Message
+				ok     bool
+				reason string
+			)
+			for _, f := range tt.frames {
+				if f.after == 0 {
+					f.after = time.Second
+				}
+				now = now.Add(f.after)
+				msg, ok, reason = d.Decode(modeSFrame(t, f.hex, f.parity, f.addr), now, false)
+			}
+			if ok != tt.ok || reason != tt.reason {
+				t.Fatalf("ok %v, reason %q; want %v, %q", ok, reason, tt.ok, tt.reason)
+			}
+			if !ok {
+				return
+			}
+			if msg.MessageType != "MSG" || msg.GeneratedDate == nil || !msg.GeneratedDate.Equal(now) {
+				t.Errorf("message type %q generated %v, want MSG at %v", msg.MessageType, msg.GeneratedDate, now)
+			}
+			want := tt.want
+			if msg.TransmissionType != want.TransmissionType || msg.Icao24 != want.Icao24 || msg.Callsign != want.Callsign ||
+				msg.Altitude != want.Altitude || msg.VerticalRate != want.VerticalRate || msg.Squawk != want.Squawk {
+				t.Errorf("type %d %s %q alt %d vr %d squawk %d; want type %d %s %q alt %d vr %d squawk %d",
+					msg.TransmissionType, msg.Icao24, msg.Callsign, msg.Altitude, msg.VerticalRate, msg.Squawk,
+					want.TransmissionType, want.Icao24, want.Callsign, want.Altitude, want.VerticalRate, want.Squawk)
+			}
+			if msg.Emergency != want.Emergency || msg.Alert != want.Alert || msg.Spi != want.Spi || msg.OnGround != want.OnGround {
+				t.Errorf("emergency %v alert %v spi %v ground %v; want %v %v %v %v",
+					msg.Emergency, msg.Alert, msg.Spi, msg.OnGround, want.Emergency, want.Alert, want.Spi, want.OnGround)
+			}
+			for _, f := range []struct {
+				name      string
+				got, want float32
+			}{
+				{"lat", msg.Lat, want.Lat}, {"lon", msg.Lon, want.Lon},
+				{"ground speed", msg.GroundSpeed, want.GroundSpeed}, {"track", msg.Track, want.Track},
+			} {
+				if math.Abs(float64(f.got-f.want)) > 0.01 {
+					t.Errorf("%s %v, want %v", f.name, f.got, f.want)
+				}
+			}
+		})
+	}
+}
+
+// gillhamField encodes an altitude in Gillham code as the 13-bit AC field
+// of a surveillance reply: C1 A1 C2 A2 C4 A4 M B1 Q B2 D2 B4 D4. It is the
+// textbook encoding rather than the inverse of the decoder: the 500 ft
+// steps are a Gray code over D2 D4 A1 A2 A4 B1 B2 B4 and the 100 ft steps
+// the C1 C2 C4 sequence 001 011 010 110 100, reflected in odd 500s.
+func gillhamField(alt int32) uint32 {
+	steps := alt/100 + 12
+	fiveHundreds, hundreds := steps/5, steps%5
+	if fiveHundreds%2 == 1 {
+		hundreds = 4 - hundreds
+	}
+	gray := uint32(fiveHundreds ^ fiveHundreds>>1)
+	c := []uint32{0b001, 0b011, 0b010, 0b110, 0b100}[hundreds]
+
+	var field uint32
+	for i, bit := range []uint32{0x0004, 0x0001, 0x0800, 0x0200, 0x0080, 0x0020, 0x0008, 0x0002} { // D2 D4 A1 A2 A4 B1 B2 B4
+		if gray&(0x80>>i) != 0 {
+			field |= bit
+		}
+	}
+	for i, bit := range []uint32{0x1000, 0x0400, 0x0100} { // C1 C2 C4
+		if c&(0b100>>i) != 0 {
+			field |= bit
+		}
+	}
+	return field
+}
+
+func TestModeSAltitude(t *testing.T) {
+	for alt := int32(-1000); alt <= 126700; alt += 100 {
+		field := gillhamField(alt)
+		if got := altitude13(field); got != alt {
+			t.Fatalf("altitude13(%#04x) = %d, want %d", field, got, alt)
+		}
+		// The 12-bit field of a position leaves out the M bit.
+		if got := altitude12(field>>1&0xfc0 | field&0x3f); got != alt {
+			t.Fatalf("altitude12 of %d = %d", alt, got)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		field uint32
+		fn    func(uint32) int32
+		want  int32
+	}{
+		{"25 ft steps", 0x1838, altitude13, 38000},
+		{"25 ft steps, lowest", 0x0010, altitude13, -1000},
+		{"metric", 0x1878, altitude13, 0},
+		{"12-bit 25 ft steps", 0xc38, altitude12, 38000},
+		{"invalid Gillham code", 0x0000, altitude13, 0},
+		{"100s out of range", 0x1d00, altitude13, 0},
+		{"squawk 7700", 0x0aaa, squawkOf, 7700},
+		{"squawk 7500", 0x0aa2, squawkOf, 7500},
+		{"squawk 1200", 0x0808, squawkOf, 1200},
+		{"squawk 0000", 0, squawkOf, 0},
+	}
+	for _, tt := range tests {
+		if got := tt.fn(tt.field); got != tt.want {
+			t.Errorf("%s: %#04x decodes as %d, want %d", tt.name, tt.field, got, tt.want)
+		}
+	}
+}
+
+func TestCPRNL(t *testing.T) {
+	// Zone counts at the transition latitudes of DO-260B.
+	tests := []struct {
+		lat  float64
+		want int
+	}{
+		{0, 59}, {10.47, 59}, {10.48, 58}, {52.2572, 36}, {-52.2572, 36},
+		{86.5, 3}, {86.9, 2}, {87, 2}, {87.1, 1}, {90, 1},
+	}
+	for _, tt := range tests {
+		if got := cprNL(tt.lat); got != tt.want {
+			t.Errorf("cprNL(%v) = %d, want %d", tt.lat, got, tt.want)
+		}
+	}
+}
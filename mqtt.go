@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// defaultMQTTPort is the standard port of unencrypted MQTT.
+const defaultMQTTPort = "1883"
+
+// mqttSensor is one derived value and the topic, under the prefix, it is
+// published on.
+type mqttSensor struct {
+	topic, value string
+}
+
+// mqttPublisher publishes values derived from the tracked aircraft, such as
+// the nearest aircraft and the number within a radius, as retained messages
+// on fixed topics under prefix every interval. It connects to the broker
+// lazily and reconnects on the next interval after a failure. prefix/status
+// is "online" while connected and "offline" once the collector stops or,
+// through the broker's will, loses the connection. When discovery is set,
+// Home Assistant discovery configs for the sensors are published under it
+// on every connect.
+type mqttPublisher struct {
+	addr, username, password, prefix string
+	interval                         time.Duration
+	radiusNM                         float64
+	tracker                          *Tracker
+	gps                              *gpsd
+	discovery                        string
+	clientID                         string
+	conn                             net.Conn
+}
+
+func newMQTTPublisher(addr, username, password, prefix string, interval time.Duration, radiusNM float64, tracker *Tracker, gps *gpsd) *mqttPublisher {
+	return &mqttPublisher{
+		addr: addr, username: username, password: password, prefix: prefix,
+		interval: interval, radiusNM: radiusNM, tracker: tracker, gps: gps,
+		clientID: "adsb-go-dataset-" + uuid.NewString()[:8],
+	}
+}
+
+// Run publishes every interval until done is closed, then marks the
+// sensors offline. Failures are logged once until a publish succeeds again.
+func (p *mqttPublisher) Run(done <-chan struct{}) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	failing := false
+	for {
+		err := p.publishSensors(clock.Now())
+		switch {
+		case err != nil && !failing:
+			log.Printf("Error publishing sensors to MQTT broker %s: %v", p.addr, err)
+		case err == nil && failing:
+			log.Printf("Publishing sensors to MQTT broker %s again", p.addr)
+		}
+		failing = err != nil
+		select {
+		case <-done:
+			p.close()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// publishSensors connects if needed and publishes the sensors at now.
+// While the sink is disabled it disconnects instead, so the sensors show
+// as offline rather than keeping stale values.
+func (p *mqttPublisher) publishSensors(now time.Time) error {
+	if !toggles.Enabled("mqtt") {
+		metricDisabledSink.Add("mqtt", float64(len(p.sensors(now))))
+		p.close()
+		return nil
+	}
+	if p.conn == nil {
+		if err := p.connect(); err != nil {
+			metricSinkErrors.Inc("mqtt")
+			return err
+		}
+		if p.discovery != "" {
+			if err := p.publishDiscovery(); err != nil {
+				return err
+			}
+		}
+		if err := p.publish(p.prefix+"/status", "online"); err != nil {
+			return err
+		}
+	}
+	sensors := p.sensors(now)
+	for _, s := range sensors {
+		if err := p.publish(p.prefix+"/"+s.topic, s.value); err != nil {
+			return err
+		}
+	}
+	metricSinkEvents.Add("mqtt", float64(len(sensors)))
+	return nil
+}
+
+// sensors derives the published values from the tracked aircraft. Surface
+// vehicles and obstacles are not counted. Of the aircraft in an emergency,
+// the one with the lowest address is described. The nearest aircraft and the
+// number within radiusNM need the receiver's position; when it is known,
+// the lowest aircraft is also only looked for within the radius. Values
+// that do not exist, like the nearest aircraft when none has a position,
+// are published empty.
+func (p *mqttPublisher) sensors(now time.Time) []mqttSensor {
+	lat, lon, located := RECEIVER_LAT, RECEIVER_LON, RECEIVER_LAT != 0 || RECEIVER_LON != 0
+	if pos := p.gps.Position(); pos != nil {
+		lat, lon, located = pos.Lat, pos.Lon, true
+	}
+
+	count, within, emergencies := 0, 0, 0
+	var nearest, lowest, emergency *Aircraft
+	nearestNM := math.Inf(1)
+	aircraft := p.tracker.Snapshot()
+	for i := range aircraft {
+		a := &aircraft[i]
+		if a.Kind != "" || p.tracker.expired(a, now) {
+			continue
+		}
+		count++
+		if a.Emergency {
+			emergencies++
+			if emergency == nil || a.Icao24 < emergency.Icao24 {
+				emergency = a
+			}
+		}
+		inside := !located
+		if located && a.HasPosition() {
+			d := distanceNM(lat, lon, float64(a.Lat), float64(a.Lon))
+			if d < nearestNM {
+				nearest, nearestNM = a, d
+			}
+			if d <= p.radiusNM {
+				within++
+				inside = true
+			}
+		}
+		if inside && !a.OnGround && a.Altitude > 0 && (lowest == nil || a.Altitude < lowest.Altitude) {
+			lowest = a
+		}
+	}
+
+	sensors := []mqttSensor{{"aircraft_count", strconv.Itoa(count)}}
+	var emergencyICAO24, emergencyCallsign, squawk string
+	if emergency != nil {
+		emergencyICAO24, emergencyCallsign = emergency.Icao24, emergency.Callsign
+		squawk = fmt.Sprintf("%04d", emergency.Squawk)
+	}
+	sensors = append(sensors,
+		mqttSensor{"emergency", strconv.Itoa(emergencies)},
+		mqttSensor{"emergency/icao24", emergencyICAO24},
+		mqttSensor{"emergency/callsign", emergencyCallsign},
+		mqttSensor{"emergency/squawk", squawk})
+	if located {
+		sensors = append(sensors, mqttSensor{"within_radius", strconv.Itoa(within)})
+		var distance, icao24, callsign, altitude string
+		if nearest != nil {
+			distance = strconv.FormatFloat(nearestNM, 'f', 1, 64)
+			icao24, callsign, altitude = nearest.Icao24, nearest.Callsign, mqttAltitude(nearest)
+		}
+		sensors = append(sensors,
+			mqttSensor{"nearest/distance_nm", distance},
+			mqttSensor{"nearest/icao24", icao24},
+			mqttSensor{"nearest/callsign", callsign},
+			mqttSensor{"nearest/altitude", altitude})
+	}
+	var icao24, callsign, altitude string
+	if lowest != nil {
+		icao24, callsign, altitude = lowest.Icao24, lowest.Callsign, mqttAltitude(lowest)
+	}
+	return append(sensors,
+		mqttSensor{"lowest/icao24", icao24},
+		mqttSensor{"lowest/callsign", callsign},
+		mqttSensor{"lowest/altitude", altitude})
+}
+
+// mqttAltitude is an aircraft's altitude in feet, or empty when it has not
+// reported one.
+func mqttAltitude(a *Aircraft) string {
+	if a.Altitude == 0 && !a.OnGround {
+		return ""
+	}
+	return strconv.Itoa(int(a.Altitude))
+}
+
+// mqttDiscoverySensor describes a sensor to Home Assistant. Sensors that
+// need the receiver's position are marked located.
+type mqttDiscoverySensor struct {
+	object, name, topic, unit, icon string
+	located                         bool
+}
+
+// mqttDiscoverySensors are the sensors announced to Home Assistant.
+var mqttDiscoverySensors = []mqttDiscoverySensor{
+	{object: "aircraft_count", name: "Aircraft", topic: "aircraft_count", unit: "aircraft", icon: "mdi:airplane"},
+	{object: "within_radius", name: "Aircraft nearby", topic: "within_radius", unit: "aircraft", icon: "mdi:airplane-marker", located: true},
+	{object: "nearest_distance", name: "Nearest aircraft distance", topic: "nearest/distance_nm", unit: "nmi", icon: "mdi:map-marker-distance", located: true},
+	{object: "nearest_callsign", name: "Nearest aircraft", topic: "nearest/callsign", icon: "mdi:airplane", located: true},
+	{object: "nearest_icao24", name: "Nearest aircraft address", topic: "nearest/icao24", icon: "mdi:identifier", located: true},
+	{object: "nearest_altitude", name: "Nearest aircraft altitude", topic: "nearest/altitude", unit: "ft", icon: "mdi:airplane-takeoff", located: true},
+	{object: "emergency", name: "Aircraft in emergency", topic: "emergency", unit: "aircraft", icon: "mdi:alert"},
+	{object: "emergency_callsign", name: "Emergency aircraft", topic: "emergency/callsign", icon: "mdi:alert"},
+	{object: "emergency_squawk", name: "Emergency squawk", topic: "emergency/squawk", icon: "mdi:alert"},
+}
+
+// mqttNodeInvalid matches the characters Home Assistant does not allow in
+// node and object IDs.
+var mqttNodeInvalid = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+// publishDiscovery publishes a retained Home Assistant discovery config
+// for every sensor to <discovery>/sensor/<node>/<object>/config, where the
+// node is the receiver name. Sensors that need the receiver's position are
+// only announced when it is configured or comes from gpsd. All of them are
+// unavailable while the status topic is offline, and empty values, which
+// Home Assistant cannot show as a number, are unknown.
+func (p *mqttPublisher) publishDiscovery() error {
+	node := mqttNodeInvalid.ReplaceAllString(RECEIVER_NAME, "_")
+	if node == "" {
+		node = "adsb"
+	}
+	located := RECEIVER_LAT != 0 || RECEIVER_LON != 0 || p.gps != nil
+	device := map[string]interface{}{
+		"identifiers":  []string{"adsb-go-dataset_" + node},
+		"name":         "ADS-B " + RECEIVER_NAME,
+		"manufacturer": "adsb-go-dataset",
+	}
+	for _, s := range mqttDiscoverySensors {
+		if s.located && !located {
+			continue
+		}
+		config := map[string]interface{}{
+			"name":               s.name,
+			"unique_id":          "adsb-go-dataset_" + node + "_" + s.object,
+			"state_topic":        p.prefix + "/" + s.topic,
+			"availability_topic": p.prefix + "/status",
+			"icon":               s.icon,
+			"value_template":     "{{ value if value else None }}",
+			"device":             device,
+		}
+		if s.unit != "" {
+			config["unit_of_measurement"] = s.unit
+			config["state_class"] = "measurement"
+		}
+		payload, err := json.Marshal(config)
+		if err != nil {
+			return err
+		}
+		if err := p.publish(p.discovery+"/sensor/"+node+"/"+s.object+"/config", string(payload)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// connect opens an MQTT 3.1.1 session with a clean start and a will that
+// marks the sensors offline.
+func (p *mqttPublisher) connect() error {
+	conn, err := net.DialTimeout("tcp", p.addr, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	// The broker drops the session when nothing arrives for one and a half
+	// keep-alives; a publish is sent every interval.
+	keepAlive := int(2*p.interval/time.Second) + 10
+	if keepAlive > math.MaxUint16 {
+		keepAlive = math.MaxUint16
+	}
+	var body mqttBuffer
+	body.str("MQTT")
+	flags := byte(0x02 | 0x04 | 0x20) // clean session, will, will retain
+	if p.username != "" {
+		flags |= 0x80
+	}
+	if p.password != "" {
+		flags |= 0x40
+	}
+	body.WriteByte(4) // protocol level 3.1.1
+	body.WriteByte(flags)
+	body.uint16(keepAlive)
+	body.str(p.clientID)
+	body.str(p.prefix + "/status")
+	body.str("offline")
+	if p.username != "" {
+		body.str(p.username)
+	}
+	if p.password != "" {
+		body.str(p.password)
+	}
+
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Write(mqttPacket(0x10, body.Bytes())); err != nil {
+		conn.Close()
+		return err
+	}
+	ack := make([]byte, 4)
+	if _, err := io.ReadFull(conn, ack); err != nil {
+		conn.Close()
+		return fmt.Errorf("reading CONNACK: %w", err)
+	}
+	if ack[0] != 0x20 || ack[1] != 2 {
+		conn.Close()
+		return errors.New("unexpected reply to CONNECT")
+	}
+	switch ack[3] {
+	case 0:
+	case 4, 5:
+		conn.Close()
+		return newError(errAuth, fmt.Errorf("broker refused the connection: not authorized (code %d)", ack[3]))
+	default:
+		conn.Close()
+		return fmt.Errorf("broker refused the connection with code %d", ack[3])
+	}
+	conn.SetDeadline(time.Time{})
+	p.conn = conn
+	return nil
+}
+
+// publish sends a retained message at QoS 0. The connection is dropped on
+// failure, to be reopened on the next interval.
+func (p *mqttPublisher) publish(topic, value string) error {
+	var body mqttBuffer
+	body.str(topic)
+	body.WriteString(value)
+	p.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if _, err := p.conn.Write(mqttPacket(0x31, body.Bytes())); err != nil {
+		metricSinkErrors.Inc("mqtt")
+		p.conn.Close()
+		p.conn = nil
+		return err
+	}
+	return nil
+}
+
+// close marks the sensors offline and disconnects, which discards the will.
+func (p *mqttPublisher) close() {
+	if p.conn == nil {
+		return
+	}
+	if p.publish(p.prefix+"/status", "offline") == nil {
+		p.conn.Write(mqttPacket(0xe0, nil))
+		p.conn.Close()
+		p.conn = nil
+	}
+}
+
+// mqttPacket frames body as a control packet of the given type and flags.
+func mqttPacket(header byte, body []byte) []byte {
+	packet := []byte{header}
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if n == 0 {
+			break
+		}
+	}
+	return append(packet, body...)
+}
+
+// mqttBuffer encodes the fields of MQTT packets.
+type mqttBuffer struct {
+	bytes.Buffer
+}
+
+func (b *mqttBuffer) uint16(v int) {
+	b.WriteByte(byte(v >> 8))
+	b.WriteByte(byte(v))
+}
+
+func (b *mqttBuffer) str(s string) {
+	b.uint16(len(s))
+	b.WriteString(s)
+}
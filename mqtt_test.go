@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMQTTPacket(t *testing.T) {
+	// The remaining length is a base-128 varint of up to four bytes.
+	tests := []struct {
+		n    int
+		want []byte
+	}{
+		{0, []byte{0x00}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x80, 0x01}},
+		{16383, []byte{0xff, 0x7f}},
+		{16384, []byte{0x80, 0x80, 0x01}},
+		{2097152, []byte{0x80, 0x80, 0x80, 0x01}},
+	}
+	for _, tt := range tests {
+		packet := mqttPacket(0x31, make([]byte, tt.n))
+		if packet[0] != 0x31 || !bytes.Equal(packet[1:1+len(tt.want)], tt.want) || len(packet) != 1+len(tt.want)+tt.n {
+			t.Errorf("length %d framed as %x, want %x", tt.n, packet[:1+len(tt.want)], tt.want)
+		}
+	}
+}
+
+// readMQTTPacket reads a control packet as its header and body.
+func readMQTTPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	body := make([]byte, n)
+	_, err = io.ReadFull(r, body)
+	return header, body, err
+}
+
+// mqttString splits an MQTT string off the front of b.
+func mqttString(b []byte) (string, []byte) {
+	n := int(binary.BigEndian.Uint16(b))
+	return string(b[2 : 2+n]), b[2+n:]
+}
+
+// fakeBroker accepts one connection, answers its CONNECT with code and
+// returns the packets it receives, publishes as "topic=value", until the
+// client disconnects.
+func fakeBroker(t *testing.T, code byte) (addr string, packets <-chan []string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	ch := make(chan []string, 1)
+	go func() {
+		var got []string
+		defer func() { ch <- got }()
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			header, body, err := readMQTTPacket(r)
+			if err != nil {
+				return
+			}
+			switch header {
+			case 0x10:
+				// CONNECT: protocol, level, flags, keep-alive, then the
+				// client ID, will and credentials.
+				protocol, rest := mqttString(body)
+				connect := fmt.Sprintf("CONNECT %s level %d flags %#x keep-alive %d", protocol, rest[0], rest[1], binary.BigEndian.Uint16(rest[2:4]))
+				for rest = rest[4:]; len(rest) > 0; {
+					var s string
+					s, rest = mqttString(rest)
+					connect += " " + s
+				}
+				got = append(got, connect)
+				conn.Write([]byte{0x20, 2, 0, code})
+			case 0x31:
+				topic, value := mqttString(body)
+				got = append(got, topic+"="+string(value))
+			case 0xe0:
+				got = append(got, "DISCONNECT")
+			default:
+				got = append(got, "unexpected packet")
+			}
+		}
+	}()
+	return ln.Addr().String(), ch
+}
+
+func TestMQTTPublisher(t *testing.T) {
+	saved := [2]float64{RECEIVER_LAT, RECEIVER_LON}
+	defer func() { RECEIVER_LAT, RECEIVER_LON = saved[0], saved[1] }()
+	RECEIVER_LAT, RECEIVER_LON = 0, 0
+
+	addr, packets := fakeBroker(t, 0)
+	p := newMQTTPublisher(addr, "user", "secret", "adsb", 30*time.Second, 10, newTracker(), nil)
+	if err := p.publishSensors(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	p.close()
+
+	want := []string{
+		// Clean session, will, retained will, password and username; a
+		// keep-alive of twice the interval plus ten seconds.
+		"CONNECT MQTT level 4 flags 0xe6 keep-alive 70 " + p.clientID + " adsb/status offline user secret",
+		"adsb/status=online",
+		"adsb/aircraft_count=0",
+		"adsb/emergency=0",
+		"adsb/emergency/icao24=",
+		"adsb/emergency/callsign=",
+		"adsb/emergency/squawk=",
+		"adsb/lowest/icao24=",
+		"adsb/lowest/callsign=",
+		"adsb/lowest/altitude=",
+		"adsb/status=offline",
+		"DISCONNECT",
+	}
+	if got := <-packets; !reflect.DeepEqual(got, want) {
+		t.Errorf("broker received\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestMQTTRefused(t *testing.T) {
+	tests := []struct {
+		code byte
+		kind errorKind
+	}{
+		{2, errInternal},
+		{4, errAuth},
+		{5, errAuth},
+	}
+	for _, tt := range tests {
+		addr, _ := fakeBroker(t, tt.code)
+		p := newMQTTPublisher(addr, "", "", "adsb", 30*time.Second, 10, newTracker(), nil)
+		err := p.publishSensors(time.Now())
+		if err == nil || errorKindOf(err) != tt.kind {
+			t.Errorf("code %d: error %v of kind %q, want kind %q", tt.code, err, errorKindOf(err), tt.kind)
+		}
+		if p.conn != nil {
+			t.Errorf("code %d: still connected", tt.code)
+		}
+	}
+}
+
+func TestMQTTSensors(t *testing.T) {
+	saved := [2]float64{RECEIVER_LAT, RECEIVER_LON}
+	defer func() { RECEIVER_LAT, RECEIVER_LON = saved[0], saved[1] }()
+
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	tracker := &Tracker{expiry: time.Minute, positionExpiry: time.Minute, ghostAfter: time.Hour, ghostExpiry: time.Minute, aircraft: map[string]*Aircraft{}}
+	// Positions are north of Dublin airport, a sixtieth of a degree being a
+	// nautical mile.
+	const lat, lon = 53.4213, -6.2701
+	for _, msg := range []SBS1Message{
+		{Icao24: "4CA2D6", Callsign: "EIN123", TransmissionType: 3, Altitude: 3000, Lat: lat + 5.0/60, Lon: lon, Emergency: true},
+		{Icao24: "400000", Callsign: "BAW1", TransmissionType: 3, Altitude: 1500, Lat: lat + 20.0/60, Lon: lon},
+		{Icao24: "400000", TransmissionType: 6, Altitude: 1500, Squawk: 7700, Emergency: true},
+		{Icao24: "3C0000", TransmissionType: 5, Altitude: 2000},
+		{Icao24: "4CA001", Callsign: "EIN1", TransmissionType: 2, OnGround: true, Lat: lat + 1.0/60, Lon: lon},
+		{Icao24: "4CA002", Kind: "vehicle", TransmissionType: 2, OnGround: true, Lat: lat, Lon: lon},
+		{Icao24: "4CA003", TransmissionType: 3, Altitude: 500, Lat: lat, Lon: lon, Timestamp: formatTimestamp(now.Add(-2 * time.Minute))},
+	} {
+		if msg.Timestamp == "" {
+			msg.Timestamp = formatTimestamp(now)
+		}
+		tracker.Update(msg)
+	}
+	p := newMQTTPublisher("", "", "", "adsb", 30*time.Second, 10, tracker, nil)
+
+	// Located, the nearest is on the ground and the lowest is within the
+	// radius.
+	RECEIVER_LAT, RECEIVER_LON = lat, lon
+	want := []mqttSensor{
+		{"aircraft_count", "4"},
+		{"emergency", "2"},
+		{"emergency/icao24", "400000"},
+		{"emergency/callsign", "BAW1"},
+		{"emergency/squawk", "7700"},
+		{"within_radius", "2"},
+		{"nearest/distance_nm", "1.0"},
+		{"nearest/icao24", "4CA001"},
+		{"nearest/callsign", "EIN1"},
+		{"nearest/altitude", "0"},
+		{"lowest/icao24", "4CA2D6"},
+		{"lowest/callsign", "EIN123"},
+		{"lowest/altitude", "3000"},
+	}
+	if got := p.sensors(now); !reflect.DeepEqual(got, want) {
+		t.Errorf("located sensors\n%v\nwant\n%v", got, want)
+	}
+
+	// Unlocated, the lowest is looked for everywhere. The expired aircraft
+	// would be lower still.
+	RECEIVER_LAT, RECEIVER_LON = 0, 0
+	want = []mqttSensor{
+		{"aircraft_count", "4"},
+		{"emergency", "2"},
+		{"emergency/icao24", "400000"},
+		{"emergency/callsign", "BAW1"},
+		{"emergency/squawk", "7700"},
+		{"lowest/icao24", "400000"},
+		{"lowest/callsign", "BAW1"},
+		{"lowest/altitude", "1500"},
+	}
+	if got := p.sensors(now); !reflect.DeepEqual(got, want) {
+		t.Errorf("unlocated sensors\n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestMQTTDiscovery(t *testing.T) {
+	saved := [2]float64{RECEIVER_LAT, RECEIVER_LON}
+	savedName := RECEIVER_NAME
+	defer func() { RECEIVER_LAT, RECEIVER_LON, RECEIVER_NAME = saved[0], saved[1], savedName }()
+	RECEIVER_LAT, RECEIVER_LON, RECEIVER_NAME = 0, 0, "Roof antenna"
+
+	addr, packets := fakeBroker(t, 0)
+	p := newMQTTPublisher(addr, "", "", "adsb", 30*time.Second, 10, newTracker(), nil)
+	p.discovery = "homeassistant"
+	if err := p.publishSensors(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	p.close()
+
+	// Without the receiver's position, only the sensors that do not need
+	// it are announced, before the status goes online.
+	configs := map[string]map[string]interface{}{}
+	var objects []string
+	for _, packet := range (<-packets)[1:] {
+		topic, payload, _ := strings.Cut(packet, "=")
+		if topic == "adsb/status" {
+			break
+		}
+		object := strings.TrimSuffix(strings.TrimPrefix(topic, "homeassistant/sensor/Roof_antenna/"), "/config")
+		var config map[string]interface{}
+		if err := json.Unmarshal([]byte(payload), &config); err != nil {
+			t.Fatalf("%s: %v", topic, err)
+		}
+		objects, configs[object] = append(objects, object), config
+	}
+	if want := []string{"aircraft_count", "emergency", "emergency_callsign", "emergency_squawk"}; !reflect.DeepEqual(objects, want) {
+		t.Errorf("announced %q, want %q", objects, want)
+	}
+	config := configs["emergency_squawk"]
+	for key, want := range map[string]interface{}{
+		"unique_id":          "adsb-go-dataset_Roof_antenna_emergency_squawk",
+		"state_topic":        "adsb/emergency/squawk",
+		"availability_topic": "adsb/status",
+	} {
+		if config[key] != want {
+			t.Errorf("%s %v, want %v", key, config[key], want)
+		}
+	}
+	if _, ok := config["unit_of_measurement"]; ok {
+		t.Error("a squawk has a unit")
+	}
+	if configs["aircraft_count"]["unit_of_measurement"] != "aircraft" {
+		t.Errorf("aircraft count config %v", configs["aircraft_count"])
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OpenSky reports metres, metres per second and seconds since the epoch.
+const (
+	feetPerMetre       = 3.28084
+	knotsPerMetreSec   = 1.94384
+	feetMinPerMetreSec = 196.850
+)
+
+// openskyResponse is a states/all response. Each state vector is an array
+// whose fields are documented at
+// https://openskynetwork.github.io/opensky-api/rest.html.
+type openskyResponse struct {
+	Time   int64           `json:"time"`
+	States [][]interface{} `json:"states"`
+}
+
+// openskyRecord is one state vector with the response's time added. It is
+// what an OpenSky feed's lines hold.
+type openskyRecord struct {
+	Time           int64    `json:"time"`
+	Icao24         string   `json:"icao24"`
+	Callsign       string   `json:"callsign,omitempty"`
+	Country        string   `json:"origin_country,omitempty"`
+	TimePosition   *int64   `json:"time_position,omitempty"`
+	LastContact    int64    `json:"last_contact"`
+	Lon            *float64 `json:"longitude,omitempty"`
+	Lat            *float64 `json:"latitude,omitempty"`
+	BaroAltitude   *float64 `json:"baro_altitude,omitempty"`
+	OnGround       bool     `json:"on_ground,omitempty"`
+	Velocity       *float64 `json:"velocity,omitempty"`
+	TrueTrack      *float64 `json:"true_track,omitempty"`
+	VerticalRate   *float64 `json:"vertical_rate,omitempty"`
+	GeoAltitude    *float64 `json:"geo_altitude,omitempty"`
+	Squawk         string   `json:"squawk,omitempty"`
+	SPI            bool     `json:"spi,omitempty"`
+	PositionSource int      `json:"position_source,omitempty"`
+}
+
+// newOpenSkyRecord reads a state vector. Fields of the wrong type are left
+// unset.
+func newOpenSkyRecord(now int64, state []interface{}) openskyRecord {
+	str := func(i int) string {
+		if i < len(state) {
+			s, _ := state[i].(string)
+			return s
+		}
+		return ""
+	}
+	num := func(i int) *float64 {
+		if i < len(state) {
+			if f, ok := state[i].(float64); ok {
+				return &f
+			}
+		}
+		return nil
+	}
+	flag := func(i int) bool {
+		if i < len(state) {
+			b, _ := state[i].(bool)
+			return b
+		}
+		return false
+	}
+
+	rec := openskyRecord{
+		Time:         now,
+		Icao24:       str(0),
+		Callsign:     strings.TrimSpace(str(1)),
+		Country:      str(2),
+		Lon:          num(5),
+		Lat:          num(6),
+		BaroAltitude: num(7),
+		OnGround:     flag(8),
+		Velocity:     num(9),
+		TrueTrack:    num(10),
+		VerticalRate: num(11),
+		GeoAltitude:  num(13),
+		Squawk:       str(14),
+		SPI:          flag(15),
+	}
+	if t := num(3); t != nil {
+		tp := int64(*t)
+		rec.TimePosition = &tp
+	}
+	if t := num(4); t != nil {
+		rec.LastContact = int64(*t)
+	}
+	if source := num(16); source != nil {
+		rec.PositionSource = int(*source)
+	}
+	return rec
+}
+
+// openskyQuery restricts the state vectors fetched to OPENSKY_BBOX.
+var openskyQuery url.Values
+
+// parseBoundingBox parses OPENSKY_BBOX, "lamin,lomin,lamax,lomax" in
+// degrees, into the query parameters of states/all.
+func parseBoundingBox(spec string) (url.Values, error) {
+	query := url.Values{}
+	if spec == "" {
+		return query, nil
+	}
+	parts := strings.Split(spec, ",")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("invalid opensky_bbox %q, expected 'lamin,lomin,lamax,lomax'", spec)
+	}
+	var v [4]float64
+	for i, part := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid opensky_bbox %q, expected 'lamin,lomin,lamax,lomax'", spec)
+		}
+		v[i] = f
+	}
+	if v[0] < -90 || v[2] > 90 || v[0] >= v[2] || v[1] < -180 || v[3] > 180 || v[1] >= v[3] {
+		return nil, fmt.Errorf("invalid opensky_bbox %q, latitudes must be within -90 to 90 and longitudes within -180 to 180, minimum first", spec)
+	}
+	for i, name := range []string{"lamin", "lomin", "lamax", "lomax"} {
+		query.Set(name, strconv.FormatFloat(v[i], 'f', -1, 64))
+	}
+	return query, nil
+}
+
+// openskyToken fetches and caches an OAuth2 access token with the client
+// credentials of an OpenSky API client.
+type openskyToken struct {
+	url, id, secret string
+	client          *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// Get returns a token that is valid for at least another minute.
+func (t *openskyToken) Get() (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.token != "" && time.Until(t.expires) > time.Minute {
+		return t.token, nil
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}, "client_id": {t.id}, "client_secret": {t.secret}}
+	req, err := http.NewRequest(http.MethodPost, t.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", userAgent())
+	res, err := t.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("fetching an OpenSky token: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", newError(errAuth, fmt.Errorf("fetching an OpenSky token: %s returned %s", t.url, res.Status))
+	}
+	var body struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil || body.AccessToken == "" {
+		return "", fmt.Errorf("fetching an OpenSky token: %s returned no access_token", t.url)
+	}
+	t.token = body.AccessToken
+	t.expires = time.Now().Add(time.Duration(body.ExpiresIn) * time.Second)
+	return t.token, nil
+}
+
+// openskyPoller turns successive states/all responses into lines, one per
+// aircraft that OpenSky heard from since the previous poll.
+type openskyPoller struct {
+	url    string
+	client *http.Client
+	token  *openskyToken // nil for anonymous access
+	// contacts and positions are each aircraft's last_contact and
+	// time_position at the previous poll.
+	contacts  map[string]int64
+	positions map[string]int64
+}
+
+// openOpenSky polls the states/all endpoint at rawURL every interval,
+// restricted to the area in query, and returns the aircraft with new data
+// as JSON lines, as openPolled does. Without a client id the API is used
+// anonymously.
+func openOpenSky(rawURL string, query url.Values, clientID, clientSecret, tokenURL string, interval, wait time.Duration, stop <-chan struct{}) (io.ReadCloser, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, newError(errConfig, fmt.Errorf("invalid opensky_url %q: %w", rawURL, err))
+	}
+	u.RawQuery = query.Encode()
+	client := &http.Client{Timeout: 30 * time.Second}
+	p := &openskyPoller{url: u.String(), client: client, contacts: map[string]int64{}, positions: map[string]int64{}}
+	if clientID != "" {
+		p.token = &openskyToken{url: tokenURL, id: clientID, secret: clientSecret, client: client}
+	}
+
+	return openPolled(rawURL, interval, wait, stop, p.poll)
+}
+
+// poll fetches the state vectors once and returns a line for each aircraft
+// whose last contact changed. Positions already reported are left out so
+// the tracker does not take a stale position for a new report.
+func (p *openskyPoller) poll() ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, p.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgent())
+	if p.token != nil {
+		token, err := p.token.Get()
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	switch {
+	case res.StatusCode == http.StatusTooManyRequests:
+		if retry := res.Header.Get("X-Rate-Limit-Retry-After-Seconds"); retry != "" {
+			return nil, fmt.Errorf("OpenSky's rate limit is exhausted for another %ss", retry)
+		}
+		return nil, fmt.Errorf("OpenSky's rate limit is exhausted")
+	case res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden:
+		return nil, newError(errAuth, fmt.Errorf("OpenSky returned %s", res.Status))
+	case res.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("OpenSky returned %s", res.Status)
+	}
+	var snapshot openskyResponse
+	if err := json.NewDecoder(res.Body).Decode(&snapshot); err != nil {
+		return nil, fmt.Errorf("decoding OpenSky's state vectors: %w", err)
+	}
+
+	var lines bytes.Buffer
+	contacts, positions := map[string]int64{}, map[string]int64{}
+	for _, state := range snapshot.States {
+		rec := newOpenSkyRecord(snapshot.Time, state)
+		if rec.Icao24 == "" {
+			continue
+		}
+		contacts[rec.Icao24] = rec.LastContact
+		if prev, ok := p.contacts[rec.Icao24]; ok && prev == rec.LastContact {
+			continue
+		}
+		if rec.TimePosition != nil {
+			positions[rec.Icao24] = *rec.TimePosition
+			if prev, ok := p.positions[rec.Icao24]; ok && prev == *rec.TimePosition {
+				rec.Lat, rec.Lon = nil, nil
+			}
+		}
+		data, err := json.Marshal(rec)
+		if err != nil {
+			return nil, err
+		}
+		lines.Write(data)
+		lines.WriteByte('\n')
+	}
+	p.contacts, p.positions = contacts, positions
+	return lines.Bytes(), nil
+}
+
+// parseOpenSkyLine converts a line of an OpenSky feed to a message. It is
+// generated at the aircraft's last contact and logged at the response's
+// time.
+func parseOpenSkyLine(line string) (SBS1Message, bool) {
+	var rec openskyRecord
+	if err := json.Unmarshal([]byte(line), &rec); err != nil || rec.Icao24 == "" || rec.Time == 0 {
+		metricParseErrors.Inc("opensky")
+		return SBS1Message{}, false
+	}
+	msg := NewSBS1Message()
+	msg.MessageType = "MSG"
+	msg.Icao24 = strings.ToUpper(rec.Icao24)
+	msg.Callsign = rec.Callsign
+
+	logged := time.Unix(rec.Time, 0).UTC()
+	generated := logged
+	if rec.LastContact != 0 {
+		generated = time.Unix(rec.LastContact, 0).UTC()
+	}
+	msg.GeneratedDate, msg.LoggedDate = &generated, &logged
+	if observeRecordedTime(msg.GeneratedDate, msg.LoggedDate) {
+		msg.Timestamp = formatTimestamp(clock.Now())
+	}
+
+	if rec.BaroAltitude != nil {
+		msg.Altitude = int32(*rec.BaroAltitude * feetPerMetre)
+	}
+	msg.OnGround = rec.OnGround
+	if rec.Velocity != nil {
+		msg.GroundSpeed = float32(*rec.Velocity * knotsPerMetreSec)
+	}
+	if rec.TrueTrack != nil {
+		msg.Track = float32(*rec.TrueTrack)
+	}
+	if rec.Lat != nil && rec.Lon != nil {
+		msg.Lat, msg.Lon = float32(*rec.Lat), float32(*rec.Lon)
+	}
+	if rec.VerticalRate != nil {
+		msg.VerticalRate = int32(*rec.VerticalRate * feetMinPerMetreSec)
+	}
+	msg.Squawk = parseInt(rec.Squawk)
+	msg.Emergency = msg.Squawk == 7500 || msg.Squawk == 7600 || msg.Squawk == 7700
+	msg.Spi = rec.SPI
+
+	switch {
+	case rec.Lat != nil && rec.Lon != nil:
+		msg.TransmissionType = 3
+	case msg.GroundSpeed != 0:
+		msg.TransmissionType = 4
+	case msg.Callsign != "":
+		msg.TransmissionType = 1
+	default:
+		msg.TransmissionType = 5
+	}
+	return msg, true
+}
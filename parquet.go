@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+// Parquet physical types, converted types and the other enums of
+// parquet.thrift that the writer uses.
+const (
+	parquetBoolean   = 0
+	parquetInt32     = 1
+	parquetInt64     = 2
+	parquetDouble    = 5
+	parquetByteArray = 6
+
+	parquetUTF8            = 0
+	parquetTimestampMillis = 9
+
+	parquetRequired = 0
+	parquetOptional = 1
+
+	parquetPlain = 0
+	parquetRLE   = 3
+	parquetGzip  = 2
+)
+
+// parquetColumn is a flat column and its values, one per row. Nil values
+// are nulls, which only optional columns may hold. Values are bool for
+// BOOLEAN, int32 for INT32, int64 for INT64, float64 for DOUBLE and string
+// for BYTE_ARRAY.
+type parquetColumn struct {
+	name      string
+	typ       int32
+	converted int32 // -1 for none
+	optional  bool
+	values    []interface{}
+}
+
+// writeParquet writes the columns, which must have the same number of
+// rows, as a Parquet file of one row group, with a GZIP-compressed data
+// page of PLAIN values per column. This is what Athena, Spark and DuckDB
+// read without further setup, though not as compact as dictionary pages.
+func writeParquet(w io.Writer, columns []parquetColumn, createdBy string) error {
+	rows := 0
+	if len(columns) > 0 {
+		rows = len(columns[0].values)
+	}
+	var file bytes.Buffer
+	file.WriteString("PAR1")
+
+	var chunks [][]byte
+	totalSize := 0
+	for _, col := range columns {
+		page := parquetPage(col)
+		var compressed bytes.Buffer
+		zw := gzip.NewWriter(&compressed)
+		zw.Write(page)
+		zw.Close()
+
+		var header thriftWriter
+		header.begin()
+		header.i32(1, 0) // DATA_PAGE
+		header.i32(2, int32(len(page)))
+		header.i32(3, int32(compressed.Len()))
+		header.structBegin(5)
+		header.i32(1, int32(rows))
+		header.i32(2, parquetPlain)
+		header.i32(3, parquetRLE)
+		header.i32(4, parquetRLE)
+		header.end()
+		header.end()
+
+		offset := file.Len()
+		file.Write(header.Bytes())
+		file.Write(compressed.Bytes())
+		uncompressedSize := header.Len() + len(page)
+		compressedSize := file.Len() - offset
+		totalSize += uncompressedSize
+
+		// The ColumnChunk, an element of the row group's columns.
+		var meta thriftWriter
+		meta.begin()
+		meta.i64(2, int64(offset))
+		meta.structBegin(3)
+		meta.i32(1, col.typ)
+		meta.listBegin(2, thriftI32, 2)
+		meta.rawI32(parquetPlain)
+		meta.rawI32(parquetRLE)
+		meta.listBegin(3, thriftBinary, 1)
+		meta.rawBinary(col.name)
+		meta.i32(4, parquetGzip)
+		meta.i64(5, int64(rows))
+		meta.i64(6, int64(uncompressedSize))
+		meta.i64(7, int64(compressedSize))
+		meta.i64(9, int64(offset))
+		meta.end()
+		meta.end()
+		chunks = append(chunks, meta.Bytes())
+	}
+
+	// The FileMetaData.
+	var footer thriftWriter
+	footer.begin()
+	footer.i32(1, 1)
+	footer.listBegin(2, thriftStruct, len(columns)+1)
+	footer.begin()
+	footer.binary(4, "schema")
+	footer.i32(5, int32(len(columns)))
+	footer.end()
+	for _, col := range columns {
+		footer.begin()
+		footer.i32(1, col.typ)
+		repetition := int32(parquetRequired)
+		if col.optional {
+			repetition = parquetOptional
+		}
+		footer.i32(3, repetition)
+		footer.binary(4, col.name)
+		if col.converted >= 0 {
+			footer.i32(6, col.converted)
+		}
+		footer.end()
+	}
+	footer.i64(3, int64(rows))
+	footer.listBegin(4, thriftStruct, 1)
+	footer.begin()
+	footer.listBegin(1, thriftStruct, len(chunks))
+	for _, chunk := range chunks {
+		footer.Write(chunk)
+	}
+	footer.i64(2, int64(totalSize))
+	footer.i64(3, int64(rows))
+	footer.end()
+	footer.binary(6, createdBy)
+	footer.end()
+
+	file.Write(footer.Bytes())
+	binary.Write(&file, binary.LittleEndian, uint32(footer.Len()))
+	file.WriteString("PAR1")
+	_, err := w.Write(file.Bytes())
+	return err
+}
+
+// parquetPage encodes the uncompressed data page of a column: definition
+// levels for optional columns, then the PLAIN non-null values.
+func parquetPage(col parquetColumn) []byte {
+	var page bytes.Buffer
+	if col.optional {
+		// One bit-packed run of the RLE/bit-packing hybrid, in groups of
+		// eight levels, prefixed by its length.
+		groups := (len(col.values) + 7) / 8
+		levels := make([]byte, groups)
+		for i, v := range col.values {
+			if v != nil {
+				levels[i/8] |= 1 << (i % 8)
+			}
+		}
+		run := binary.AppendUvarint(nil, uint64(groups)<<1|1)
+		run = append(run, levels...)
+		binary.Write(&page, binary.LittleEndian, uint32(len(run)))
+		page.Write(run)
+	}
+
+	nonNull := 0
+	var bits []byte
+	for _, v := range col.values {
+		if v == nil {
+			continue
+		}
+		switch v := v.(type) {
+		case bool:
+			if nonNull%8 == 0 {
+				bits = append(bits, 0)
+			}
+			if v {
+				bits[nonNull/8] |= 1 << (nonNull % 8)
+			}
+		case int32:
+			binary.Write(&page, binary.LittleEndian, v)
+		case int64:
+			binary.Write(&page, binary.LittleEndian, v)
+		case float64:
+			binary.Write(&page, binary.LittleEndian, math.Float64bits(v))
+		case string:
+			binary.Write(&page, binary.LittleEndian, uint32(len(v)))
+			page.WriteString(v)
+		}
+		nonNull++
+	}
+	page.Write(bits)
+	return page.Bytes()
+}
+
+// Thrift compact protocol types.
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftStruct = 12
+)
+
+// thriftWriter encodes structs in the Thrift compact protocol, as Parquet
+// metadata is. Field IDs are delta-encoded against the previous field of
+// the struct being written, so every struct, whether the top-level one, a
+// field or a list element, is written between begin and end.
+type thriftWriter struct {
+	bytes.Buffer
+	last  int16
+	stack []int16
+}
+
+// begin starts the fields of a struct.
+func (t *thriftWriter) begin() {
+	t.stack = append(t.stack, t.last)
+	t.last = 0
+}
+
+// end ends the fields of a struct.
+func (t *thriftWriter) end() {
+	t.WriteByte(0)
+	t.last = t.stack[len(t.stack)-1]
+	t.stack = t.stack[:len(t.stack)-1]
+}
+
+func (t *thriftWriter) field(id int16, typ byte) {
+	if delta := id - t.last; delta > 0 && delta <= 15 {
+		t.WriteByte(byte(delta)<<4 | typ)
+	} else {
+		t.WriteByte(typ)
+		t.varint(uint64(uint16(id)<<1 ^ uint16(id>>15)))
+	}
+	t.last = id
+}
+
+func (t *thriftWriter) varint(v uint64) {
+	t.Write(binary.AppendUvarint(nil, v))
+}
+
+func (t *thriftWriter) rawI32(v int32) {
+	t.varint(uint64(uint32(v<<1 ^ v>>31)))
+}
+
+func (t *thriftWriter) rawBinary(s string) {
+	t.varint(uint64(len(s)))
+	t.WriteString(s)
+}
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.rawI32(v)
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.field(id, thriftI64)
+	t.varint(uint64(v<<1 ^ v>>63))
+}
+
+func (t *thriftWriter) binary(id int16, s string) {
+	t.field(id, thriftBinary)
+	t.rawBinary(s)
+}
+
+// structBegin starts a struct field, to be ended with end.
+func (t *thriftWriter) structBegin(id int16) {
+	t.field(id, thriftStruct)
+	t.begin()
+}
+
+// listBegin starts a list field of n elements, which follow it; struct
+// elements are each written between begin and end.
+func (t *thriftWriter) listBegin(id int16, elem byte, n int) {
+	t.field(id, 9)
+	if n < 15 {
+		t.WriteByte(byte(n)<<4 | elem)
+	} else {
+		t.WriteByte(0xf0 | elem)
+		t.varint(uint64(n))
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apache/arrow/go/v14/arrow"
+	"github.com/apache/arrow/go/v14/arrow/array"
+	"github.com/apache/arrow/go/v14/arrow/memory"
+	"github.com/apache/arrow/go/v14/parquet/file"
+	"github.com/apache/arrow/go/v14/parquet/pqarrow"
+	"github.com/apache/arrow/go/v14/parquet/schema"
+)
+
+// readParquet opens a written file with the Apache Arrow reader, and
+// returns it and its columns by name.
+func readParquet(t *testing.T, data []byte) (*file.Reader, map[string]arrow.Array) {
+	t.Helper()
+	r, err := file.NewParquetReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("opening the file: %v", err)
+	}
+	fr, err := pqarrow.NewFileReader(r, pqarrow.ArrowReadProperties{}, memory.DefaultAllocator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, err := fr.ReadTable(context.Background())
+	if err != nil {
+		t.Fatalf("reading the file: %v", err)
+	}
+	t.Cleanup(table.Release)
+	columns := map[string]arrow.Array{}
+	for i := 0; i < int(table.NumCols()); i++ {
+		col := table.Column(i)
+		if chunks := col.Data().Chunks(); len(chunks) == 1 {
+			columns[col.Name()] = chunks[0]
+		}
+	}
+	return r, columns
+}
+
+func TestWriteParquet(t *testing.T) {
+	// Enough rows for several groups of definition levels and of packed
+	// booleans, with nulls in every optional column.
+	const n = 21
+	columns := []parquetColumn{
+		{name: "flag", typ: parquetBoolean, converted: -1},
+		{name: "count", typ: parquetInt32, converted: -1, optional: true},
+		{name: "time", typ: parquetInt64, converted: parquetTimestampMillis},
+		{name: "value", typ: parquetDouble, converted: -1, optional: true},
+		{name: "name", typ: parquetByteArray, converted: parquetUTF8, optional: true},
+	}
+	for i := 0; i < n; i++ {
+		columns[0].values = append(columns[0].values, i%3 == 0)
+		columns[2].values = append(columns[2].values, int64(1760608800000+i))
+		if i%4 == 1 {
+			for _, c := range []int{1, 3, 4} {
+				columns[c].values = append(columns[c].values, nil)
+			}
+			continue
+		}
+		columns[1].values = append(columns[1].values, int32(-i))
+		columns[3].values = append(columns[3].values, float64(i)/4)
+		columns[4].values = append(columns[4].values, fmt.Sprintf("row %d é", i))
+	}
+	var data bytes.Buffer
+	if err := writeParquet(&data, columns, "adsb-go-dataset test"); err != nil {
+		t.Fatal(err)
+	}
+
+	r, got := readParquet(t, data.Bytes())
+	meta := r.MetaData()
+	if r.NumRows() != n || meta.GetCreatedBy() != "adsb-go-dataset test" {
+		t.Errorf("%d rows created by %q", r.NumRows(), meta.GetCreatedBy())
+	}
+	if meta.Schema.NumColumns() != len(columns) {
+		t.Fatalf("%d columns, want %d", meta.Schema.NumColumns(), len(columns))
+	}
+	converted := map[int32]schema.ConvertedType{
+		-1: schema.ConvertedTypes.None, parquetUTF8: schema.ConvertedTypes.UTF8, parquetTimestampMillis: schema.ConvertedTypes.TimestampMillis,
+	}
+	for i, col := range columns {
+		c := meta.Schema.Column(i)
+		if c.Name() != col.name || int32(c.PhysicalType()) != col.typ || c.ConvertedType() != converted[col.converted] || (c.MaxDefinitionLevel() == 1) != col.optional {
+			t.Errorf("column %d is %s", i, c)
+		}
+	}
+
+	flag, count, at := got["flag"].(*array.Boolean), got["count"].(*array.Int32), got["time"].(*array.Timestamp)
+	value, name := got["value"].(*array.Float64), got["name"].(*array.String)
+	for i := 0; i < n; i++ {
+		if flag.Value(i) != (i%3 == 0) || int64(at.Value(i)) != int64(1760608800000+i) {
+			t.Errorf("row %d: flag %v time %v", i, flag.Value(i), at.Value(i))
+		}
+		if i%4 == 1 {
+			if !count.IsNull(i) || !value.IsNull(i) || !name.IsNull(i) {
+				t.Errorf("row %d: %v %v %q, want nulls", i, count.Value(i), value.Value(i), name.Value(i))
+			}
+			continue
+		}
+		if count.IsNull(i) || count.Value(i) != int32(-i) || value.Value(i) != float64(i)/4 || name.Value(i) != fmt.Sprintf("row %d é", i) {
+			t.Errorf("row %d: %v %v %q", i, count.Value(i), value.Value(i), name.Value(i))
+		}
+	}
+}
+
+func TestS3Parquet(t *testing.T) {
+	at := time.Date(2026, 10, 16, 10, 0, 0, 0, time.UTC)
+	msgs := []SBS1Message{
+		{Timestamp: formatTimestamp(at), MessageType: "MSG", TransmissionType: 3, Icao24: "4ca2d6", Altitude: 35000, Lat: 53.1, Lon: -6.2, OnGround: true},
+		{Timestamp: formatTimestamp(at.Add(time.Second)), MessageType: "MSG", TransmissionType: 1, Icao24: "a1b2c3", Callsign: "EIN123"},
+	}
+	var data bytes.Buffer
+	if err := writeParquet(&data, s3Columns(msgs), "adsb-go-dataset test"); err != nil {
+		t.Fatal(err)
+	}
+	_, got := readParquet(t, data.Bytes())
+
+	times := got["time"].(*array.Timestamp)
+	if times.Len() != 2 || times.Value(0).ToTime(arrow.Millisecond) != at {
+		t.Errorf("times %v, want %v first", times, at)
+	}
+	if icao := got["icao24"].(*array.String); icao.Value(0) != "4ca2d6" || icao.Value(1) != "a1b2c3" {
+		t.Errorf("icao24 %v", icao)
+	}
+	if alt := got["altitude"].(*array.Int32); alt.Value(0) != 35000 || !alt.IsNull(1) {
+		t.Errorf("altitude %v, want 35000 and null", alt)
+	}
+	if lat := got["lat"].(*array.Float64); lat.Value(0) < 53.09 || lat.Value(0) > 53.11 || !lat.IsNull(1) {
+		t.Errorf("lat %v", lat)
+	}
+	if ground := got["on_ground"].(*array.Boolean); !ground.Value(0) || ground.Value(1) {
+		t.Errorf("on_ground %v", ground)
+	}
+	if callsign := got["callsign"].(*array.String); !callsign.IsNull(0) || callsign.Value(1) != "EIN123" {
+		t.Errorf("callsign %v", callsign)
+	}
+	if message := got["message"].(*array.String); !strings.Contains(message.Value(0), `"icao24":"4ca2d6"`) {
+		t.Errorf("message %q", message.Value(0))
+	}
+}
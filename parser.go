@@ -0,0 +1,312 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// sbs1FieldNames names the 22 comma-separated fields of an SBS-1 MSG line.
+var sbs1FieldNames = [22]string{
+	"message_type", "transmission_type", "session_id", "aircraft_id", "icao24", "flight_id",
+	"generated_date", "generated_time", "logged_date", "logged_time", "callsign",
+	"altitude", "ground_speed", "track", "lat", "lon", "vertical_rate", "squawk",
+	"alert", "emergency", "spi", "on_ground",
+}
+
+var (
+	errTooFewFields    = errors.New("too few fields")
+	errTooManyFields   = errors.New("too many fields")
+	errMessageType     = errors.New("unsupported message type")
+	errInvalidInteger  = errors.New("invalid integer")
+	errInvalidFloat    = errors.New("invalid number")
+	errOutOfRange      = errors.New("out of range")
+	errInvalidFlag     = errors.New("invalid flag, expected 0, 1 or -1")
+	errInvalidICAO     = errors.New("invalid ICAO address")
+	errInvalidSquawk   = errors.New("invalid squawk, expected up to four octal digits")
+	errInvalidDateTime = errors.New("invalid date/time")
+)
+
+// ParseError describes a malformed SBS-1 line. Field is the SBS-1 field
+// name, or "line" when the line as a whole is unusable.
+type ParseError struct {
+	Field string
+	Value string
+	Err   error
+}
+
+func (e *ParseError) Error() string {
+	if errors.Is(e.Err, errTooFewFields) || errors.Is(e.Err, errTooManyFields) {
+		return fmt.Sprintf("%s of %s fields: %v", e.Field, e.Value, e.Err)
+	}
+	return fmt.Sprintf("%s %q: %v", e.Field, e.Value, e.Err)
+}
+
+func (e *ParseError) Unwrap() error { return e.Err }
+
+// ParseErrors collects every malformed field found in a single line.
+type ParseErrors []*ParseError
+
+func (e ParseErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// ParseStrict parses msg like Parse but reports malformed input instead of
+// silently zeroing it. Line-level problems are returned as a *ParseError;
+// malformed fields are returned as ParseErrors alongside the leniently
+// parsed message, so callers can still decide to keep it.
+func ParseStrict(msg string) (SBS1Message, error) {
+	parts := strings.Split(strings.TrimSpace(msg), ",")
+	switch {
+	case parts[0] != "MSG":
+		return SBS1Message{}, &ParseError{Field: "line", Value: parts[0], Err: errMessageType}
+	case len(parts) < len(sbs1FieldNames):
+		return SBS1Message{}, &ParseError{Field: "line", Value: strconv.Itoa(len(parts)), Err: errTooFewFields}
+	}
+
+	sbs1, _ := Parse(msg)
+
+	var errs ParseErrors
+	if len(parts) > len(sbs1FieldNames) {
+		errs = append(errs, &ParseError{Field: "line", Value: strconv.Itoa(len(parts)), Err: errTooManyFields})
+	}
+	errs = validateSBS1Fields(parts, errs)
+	if len(errs) > 0 {
+		return sbs1, errs
+	}
+	return sbs1, nil
+}
+
+// validateSBS1Fields appends an error for every non-empty field that does
+// not hold a well-formed value. Empty fields are normal in SBS-1 output.
+func validateSBS1Fields(parts []string, errs ParseErrors) ParseErrors {
+	check := func(i int, err error) {
+		if err != nil {
+			errs = append(errs, &ParseError{Field: sbs1FieldNames[i], Value: parts[i], Err: err})
+		}
+	}
+
+	check(1, checkInt(parts[1], 1, 8))
+	check(4, checkICAO(parts[4]))
+	check(6, checkDateTime(parts[6], parts[7]))
+	check(8, checkDateTime(parts[8], parts[9]))
+	check(11, checkInt(parts[11], -2000, 200000))
+	check(12, checkFloat(parts[12], 0, 5000))
+	check(13, checkFloat(parts[13], 0, 360))
+	check(14, checkFloat(parts[14], -90, 90))
+	check(15, checkFloat(parts[15], -180, 180))
+	check(16, checkInt(parts[16], -100000, 100000))
+	check(17, checkSquawk(parts[17]))
+	for i := 18; i <= 21; i++ {
+		check(i, checkFlag(parts[i]))
+	}
+	return errs
+}
+
+// checkInt validates an optional integer field within [lo, hi].
+func checkInt(s string, lo, hi int64) error {
+	if s == "" {
+		return nil
+	}
+	i, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return errInvalidInteger
+	}
+	if i < lo || i > hi {
+		return errOutOfRange
+	}
+	return nil
+}
+
+// checkFloat validates an optional decimal field within [lo, hi].
+func checkFloat(s string, lo, hi float64) error {
+	if s == "" {
+		return nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return errInvalidFloat
+	}
+	if !(f >= lo && f <= hi) {
+		return errOutOfRange
+	}
+	return nil
+}
+
+// checkFlag validates an optional SBS-1 boolean, which dump1090 writes as
+// 0 or -1 and other decoders as 0 or 1.
+func checkFlag(s string) error {
+	switch s {
+	case "", "0", "1", "-1":
+		return nil
+	}
+	return errInvalidFlag
+}
+
+// checkICAO validates a 24-bit hex address. A leading '~' marks non-ICAO
+// addresses such as TIS-B targets.
+func checkICAO(s string) error {
+	s = strings.TrimPrefix(s, "~")
+	if len(s) != 6 {
+		return errInvalidICAO
+	}
+	if _, err := strconv.ParseUint(s, 16, 32); err != nil {
+		return errInvalidICAO
+	}
+	return nil
+}
+
+// checkSquawk validates an optional Mode A code.
+func checkSquawk(s string) error {
+	if s == "" {
+		return nil
+	}
+	if len(s) > 4 {
+		return errInvalidSquawk
+	}
+	for _, r := range s {
+		if r < '0' || r > '7' {
+			return errInvalidSquawk
+		}
+	}
+	return nil
+}
+
+// checkDateTime validates an optional date/time pair, whose date may be
+// left out.
+func checkDateTime(date, timeStr string) error {
+	if date == "" && timeStr == "" {
+		return nil
+	}
+	_, err := sbsDateTime(date, timeStr, clock.Now())
+	return err
+}
+
+// parseLine parses one line from a feed according to PARSE_MODE and
+// records the outcome in the parser metrics. In lenient mode malformed
+// fields are counted but the message is kept with zero values, matching the
+// historical behaviour; in strict mode the message is dropped.
+func parseLine(line string) (SBS1Message, bool) {
+	return parseLineAs(INPUT_FORMAT, line)
+}
+
+// parseLineAs is parseLine for a line in the given input format. The
+// ICAO address and callsign of the message are normalized.
+func parseLineAs(format, line string) (SBS1Message, bool) {
+	msg, ok := parseFormat(format, line)
+	if ok {
+		normalizeIdentity(&msg)
+	}
+	return msg, ok
+}
+
+// parseFormat parses line in format and counts the outcome.
+func parseFormat(format, line string) (SBS1Message, bool) {
+	metricMessagesReceived.Inc("")
+
+	if format != "sbs" {
+		parse := parseBeastLine
+		switch format {
+		case "avr", "rtlsdr":
+			parse = parseAVRLine
+		case "aircraft_json", "aggregator":
+			parse = parseAircraftJSONLine
+		case "readsb_json":
+			parse = parseReadsbJSONLine
+		case "uat":
+			parse = parseUATLine
+		case "opensky":
+			parse = parseOpenSkyLine
+		case "vrs":
+			parse = parseVRSLine
+		case "adsc":
+			parse = parseADSCLine
+		}
+		msg, ok := parse(line)
+		if ok {
+			metricMessagesParsed.Inc("")
+		} else {
+			metricMessagesRejected.Inc("")
+		}
+		return msg, ok
+	}
+
+	msg, err := ParseStrict(line)
+	if err == nil {
+		metricMessagesParsed.Inc("")
+		return msg, true
+	}
+
+	var fieldErrs ParseErrors
+	if !errors.As(err, &fieldErrs) {
+		var lineErr *ParseError
+		if errors.As(err, &lineErr) && lineErr.Err != errMessageType {
+			metricParseErrors.Inc(lineErr.Field)
+		}
+		metricMessagesRejected.Inc("")
+		return msg, false
+	}
+
+	for _, fe := range fieldErrs {
+		metricParseErrors.Inc(fe.Field)
+	}
+	if PARSE_MODE == "strict" {
+		log.Printf("Rejecting malformed message: %v", err)
+		metricMessagesRejected.Inc("")
+		return msg, false
+	}
+	metricMessagesParsed.Inc("")
+	return msg, true
+}
+
+// normalizeIdentity writes the ICAO address and callsign of msg the same
+// way whatever its source, as set by icao24_case and callsign_format, so
+// that "A1B2C3" from one feed and "a1b2c3" from another are one aircraft.
+func normalizeIdentity(msg *SBS1Message) {
+	msg.Icao24 = normalizeICAO24(msg.Icao24, ICAO24_CASE)
+	msg.Callsign = normalizeCallsign(msg.Callsign, CALLSIGN_FORMAT)
+}
+
+// normalizeICAO24 trims an address and sets the case of its hex digits.
+// The ~ of non-ICAO addresses is kept.
+func normalizeICAO24(icao24, policy string) string {
+	icao24 = strings.TrimSpace(icao24)
+	switch policy {
+	case "lower":
+		return strings.ToLower(icao24)
+	case "upper":
+		return strings.ToUpper(icao24)
+	}
+	return icao24
+}
+
+// normalizeCallsign strips the padding of a callsign. With "clean" it is
+// also uppercased and anything but letters and digits, like the '@' and
+// '_' of undecodable characters, is removed.
+func normalizeCallsign(callsign, policy string) string {
+	callsign = strings.TrimSpace(callsign)
+	if policy != "clean" {
+		return callsign
+	}
+	var b strings.Builder
+	for _, r := range strings.ToUpper(callsign) {
+		if r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+var (
+	metricMessagesReceived = newCounter("adsb_messages_received_total", "Lines read from the feed.", "")
+	metricMessagesParsed   = newCounter("adsb_messages_parsed_total", "Lines accepted as SBS-1 messages.", "")
+	metricMessagesRejected = newCounter("adsb_messages_rejected_total", "Lines dropped by the parser.", "")
+	metricParseErrors      = newCounter("adsb_parse_errors_total", "Malformed SBS-1 fields, by field.", "field")
+	metricTimesCorrected   = newCounter("adsb_times_corrected_total", "SBS-1 date/time pairs moved a day as they straddled midnight, by field.", "field")
+)
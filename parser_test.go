@@ -0,0 +1,35 @@
+package main
+
+import (
+	"io/fs"
+	"testing"
+)
+
+// FuzzParse checks the contract between the lenient and strict parsers on
+// arbitrary lines, starting from every line of the conformance corpus. Run
+// it with go test -fuzz=FuzzParse; failing inputs are kept in
+// testdata/fuzz/FuzzParse and replayed by go test.
+func FuzzParse(f *testing.F) {
+	corpus, err := fs.Sub(conformanceCorpus, "conformance")
+	if err != nil {
+		f.Fatal(err)
+	}
+	seeds, err := fuzzSeeds(corpus)
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, line := range seeds {
+		f.Add(line)
+	}
+	for _, value := range fuzzValues {
+		f.Add("MSG,3,1,1,4CA2D6,1,2023/01/01,00:00:00.000,2023/01/01,00:00:00.000," + value + ",35000,,,53.1,-6.2,,,0,0,0,0")
+	}
+
+	saved := clock
+	f.Cleanup(func() { clock = saved })
+	f.Fuzz(func(t *testing.T, line string) {
+		if err := checkParserModes(line); err != nil {
+			t.Errorf("%q: %v", line, err)
+		}
+	})
+}
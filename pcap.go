@@ -0,0 +1,493 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// maxPcapRecord bounds a captured packet, so a corrupt length fails instead
+// of allocating gigabytes.
+const maxPcapRecord = 1 << 20
+
+// maxPendingSegments is how many out-of-order segments a connection holds
+// while waiting for a missing one. Beyond that the segment is taken as
+// lost, which costs the line it was part of.
+const maxPendingSegments = 64
+
+// Link types of captured frames, from the tcpdump.org list.
+const (
+	linkNull     = 0
+	linkEthernet = 1
+	linkRawBSD   = 12
+	linkRawAlt   = 14
+	linkRaw      = 101
+	linkLoop     = 108
+	linkLinuxSLL = 113
+	linkIPv4     = 228
+	linkIPv6     = 229
+	linkSLL2     = 276
+)
+
+// openCapture opens a capture for replay: a file of feed lines, or a pcap
+// or pcapng packet capture, whose traffic from the feed port is extracted.
+// Either may be compressed with gzip or zstd. Beast frames are returned hex
+// encoded, as they are archived. A directory is read as one capture, see
+// openCaptureDir.
+func openCapture(path string) (io.ReadCloser, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return openCaptureDir(path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := decompress(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(4)
+	if !isPcap(magic) {
+		return struct {
+			io.Reader
+			io.Closer
+		}{br, f}, nil
+	}
+	if INPUT_FORMAT != "sbs" && INPUT_FORMAT != "avr" && INPUT_FORMAT != "uat" && INPUT_FORMAT != "beast" {
+		f.Close()
+		return nil, configErrorf("%s is a packet capture, which can only be read with input_format sbs, avr, uat or beast", path)
+	}
+	port, err := capturePort()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	pr := extractCapture(br, port, INPUT_FORMAT == "beast", path)
+	return struct {
+		io.Reader
+		io.Closer
+	}{pr, closers{pr, f}}, nil
+}
+
+// capturePort is the port whose traffic is extracted from packet captures:
+// the feed port.
+func capturePort() (uint16, error) {
+	port, err := strconv.ParseUint(feedPort(), 10, 16)
+	if err != nil {
+		return 0, configErrorf("invalid dump1090_port %q", feedPort())
+	}
+	return uint16(port), nil
+}
+
+// extractCapture returns the lines sent from port in the pcap or pcapng
+// capture r, reassembled connection by connection. With beast, they are
+// the hex encoded Beast frames. path names the capture in the log.
+func extractCapture(r io.Reader, port uint16, beast bool, path string) *io.PipeReader {
+	pr, pw := io.Pipe()
+	go func() {
+		ex := &tcpExtractor{port: port, w: pw, beast: beast, streams: map[tcpStreamKey]*tcpStream{}}
+		err := readPcap(r, ex.packet)
+		ex.close()
+		if err == nil {
+			log.Printf("Read %d packets from port %d of %s in %d connections, with %d lost segments", ex.packets, port, path, ex.connections, ex.gaps)
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// closers closes several things, returning the first error.
+type closers []io.Closer
+
+func (cs closers) Close() error {
+	var first error
+	for _, c := range cs {
+		if err := c.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// isPcap reports whether a file starting with magic is a pcap or pcapng
+// capture.
+func isPcap(magic []byte) bool {
+	if len(magic) < 4 {
+		return false
+	}
+	switch binary.BigEndian.Uint32(magic) {
+	case 0xa1b2c3d4, 0xd4c3b2a1, 0xa1b23c4d, 0x4d3cb2a1, 0x0a0d0d0a:
+		return true
+	}
+	return false
+}
+
+// isPcapFile reports whether f is a packet capture, leaving it at its
+// start.
+func isPcapFile(f *os.File) (bool, error) {
+	magic := make([]byte, 4)
+	n, err := io.ReadFull(f, magic)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	return isPcap(magic[:n]), nil
+}
+
+// readPcap calls packet with every frame of a pcap or pcapng capture and
+// its link type.
+func readPcap(r io.Reader, packet func(link uint16, frame []byte)) error {
+	var magic [4]byte
+	if _, err := io.ReadFull(r, magic[:]); err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint32(magic[:]) == 0x0a0d0d0a {
+		return readPcapNG(io.MultiReader(bytes.NewReader(magic[:]), r), packet)
+	}
+
+	var order binary.ByteOrder = binary.LittleEndian
+	if magic[0] == 0xa1 {
+		order = binary.BigEndian
+	}
+	var header [20]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return fmt.Errorf("reading pcap header: %w", err)
+	}
+	link := uint16(order.Uint32(header[16:20]))
+	var record [16]byte
+	for {
+		if _, err := io.ReadFull(r, record[:]); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("reading pcap record: %w", err)
+		}
+		n := order.Uint32(record[8:12])
+		if n > maxPcapRecord {
+			return fmt.Errorf("corrupt pcap record of %d bytes", n)
+		}
+		frame := make([]byte, n)
+		if _, err := io.ReadFull(r, frame); err != nil {
+			return fmt.Errorf("reading pcap record: %w", err)
+		}
+		packet(link, frame)
+	}
+}
+
+// readPcapNG reads the packet blocks of a pcapng capture. Each section sets
+// its byte order and each interface its link type.
+func readPcapNG(r io.Reader, packet func(link uint16, frame []byte)) error {
+	var order binary.ByteOrder = binary.LittleEndian
+	var links []uint16
+	var header [12]byte
+	for {
+		if _, err := io.ReadFull(r, header[:8]); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("reading pcapng block: %w", err)
+		}
+		read := 8
+		if binary.BigEndian.Uint32(header[:4]) == 0x0a0d0d0a {
+			// A section header starts with the byte-order magic, which
+			// also decides how its own length is read.
+			if _, err := io.ReadFull(r, header[8:12]); err != nil {
+				return fmt.Errorf("reading pcapng section: %w", err)
+			}
+			order = binary.LittleEndian
+			if binary.BigEndian.Uint32(header[8:12]) == 0x1a2b3c4d {
+				order = binary.BigEndian
+			}
+			links = links[:0]
+			read = 12
+		}
+		blockType, length := order.Uint32(header[:4]), order.Uint32(header[4:8])
+		if length < uint32(read)+4 || length > maxPcapRecord || length%4 != 0 {
+			return fmt.Errorf("corrupt pcapng block of %d bytes", length)
+		}
+		block := make([]byte, length-uint32(read))
+		if _, err := io.ReadFull(r, block); err != nil {
+			return fmt.Errorf("reading pcapng block: %w", err)
+		}
+		body := block[:len(block)-4]
+
+		switch blockType {
+		case 1: // interface description
+			if len(body) >= 2 {
+				links = append(links, order.Uint16(body[:2]))
+			}
+		case 6, 2: // enhanced packet, and the obsolete packet block
+			if len(body) < 20 {
+				continue
+			}
+			id := int(order.Uint32(body[:4]))
+			if blockType == 2 {
+				id = int(order.Uint16(body[:2]))
+			}
+			n := int(order.Uint32(body[12:16]))
+			if id >= len(links) || n > len(body)-20 {
+				continue
+			}
+			packet(links[id], body[20:20+n])
+		case 3: // simple packet, always from the first interface
+			if len(body) < 4 || len(links) == 0 {
+				continue
+			}
+			n := int(order.Uint32(body[:4]))
+			if n > len(body)-4 {
+				n = len(body) - 4
+			}
+			packet(links[0], body[4:4+n])
+		}
+	}
+}
+
+// ipPacket strips the link layer off a captured frame.
+func ipPacket(link uint16, frame []byte) []byte {
+	switch link {
+	case linkEthernet:
+		off := 14
+		if len(frame) < off {
+			return nil
+		}
+		etherType := binary.BigEndian.Uint16(frame[12:14])
+		for (etherType == 0x8100 || etherType == 0x88a8) && len(frame) >= off+4 {
+			etherType = binary.BigEndian.Uint16(frame[off+2 : off+4])
+			off += 4
+		}
+		if etherType != 0x0800 && etherType != 0x86dd {
+			return nil
+		}
+		return frame[off:]
+	case linkNull, linkLoop:
+		if len(frame) < 4 {
+			return nil
+		}
+		return frame[4:]
+	case linkLinuxSLL:
+		if len(frame) < 16 {
+			return nil
+		}
+		return frame[16:]
+	case linkSLL2:
+		if len(frame) < 20 {
+			return nil
+		}
+		return frame[20:]
+	case linkRaw, linkRawBSD, linkRawAlt, linkIPv4, linkIPv6:
+		return frame
+	}
+	return nil
+}
+
+// tcpStreamKey identifies one direction of a TCP connection.
+type tcpStreamKey struct {
+	src, dst     string
+	sport, dport uint16
+}
+
+// tcpStream reassembles one direction of a connection.
+type tcpStream struct {
+	next    uint32
+	pending map[uint32][]byte
+	// partial is the start of a line whose end has not arrived yet.
+	partial []byte
+	// beast receives the connection's data when it carries Beast frames,
+	// which are written hex encoded as they complete.
+	beast *io.PipeWriter
+}
+
+// tcpExtractor writes the lines sent from port, connection by connection,
+// so that the lines of connections open at the same time never mix. With
+// beast, the connections carry Beast frames, which are written hex encoded
+// one per line, as feedReader does.
+type tcpExtractor struct {
+	port    uint16
+	w       io.Writer
+	beast   bool
+	streams map[tcpStreamKey]*tcpStream
+	// decoders are the running Beast decoders of the connections.
+	decoders sync.WaitGroup
+
+	packets, connections, gaps int
+}
+
+// packet handles one captured frame.
+func (ex *tcpExtractor) packet(link uint16, frame []byte) {
+	ip := ipPacket(link, frame)
+	if len(ip) < 1 {
+		return
+	}
+	var key tcpStreamKey
+	var segment []byte
+	switch ip[0] >> 4 {
+	case 4:
+		if len(ip) < 20 || ip[9] != 6 || binary.BigEndian.Uint16(ip[6:8])&0x3fff != 0 {
+			return // not TCP, or a fragment
+		}
+		headerLen, total := int(ip[0]&0x0f)*4, int(binary.BigEndian.Uint16(ip[2:4]))
+		if total > len(ip) {
+			total = len(ip)
+		}
+		if headerLen < 20 || headerLen > total {
+			return
+		}
+		key.src, key.dst, segment = string(ip[12:16]), string(ip[16:20]), ip[headerLen:total]
+	case 6:
+		if len(ip) < 40 || ip[6] != 6 {
+			return // not TCP, or behind extension headers
+		}
+		end := 40 + int(binary.BigEndian.Uint16(ip[4:6]))
+		if end > len(ip) {
+			end = len(ip)
+		}
+		key.src, key.dst, segment = string(ip[8:24]), string(ip[24:40]), ip[40:end]
+	default:
+		return
+	}
+	if len(segment) < 20 {
+		return
+	}
+	key.sport, key.dport = binary.BigEndian.Uint16(segment[0:2]), binary.BigEndian.Uint16(segment[2:4])
+	if key.sport != ex.port {
+		return
+	}
+	ex.packets++
+	seq, flags := binary.BigEndian.Uint32(segment[4:8]), segment[13]
+	dataOff := int(segment[12]>>4) * 4
+	if dataOff < 20 || dataOff > len(segment) {
+		return
+	}
+	data := segment[dataOff:]
+
+	s := ex.streams[key]
+	switch {
+	case flags&0x02 != 0: // SYN
+		ex.end(key)
+		s = ex.open(key, seq+1)
+	case s == nil && len(data) > 0:
+		// The capture started after the connection did.
+		s = ex.open(key, seq)
+	}
+	if s != nil && len(data) > 0 {
+		ex.segment(s, seq, data)
+	}
+	if flags&0x05 != 0 { // FIN or RST
+		ex.end(key)
+	}
+}
+
+// open starts reassembling a connection at seq.
+func (ex *tcpExtractor) open(key tcpStreamKey, seq uint32) *tcpStream {
+	s := &tcpStream{next: seq, pending: map[uint32][]byte{}}
+	if ex.beast {
+		pr, pw := io.Pipe()
+		s.beast = pw
+		ex.decoders.Add(1)
+		go func() {
+			defer ex.decoders.Done()
+			pr.CloseWithError(readBeast(pr, func(frame []byte) {
+				fmt.Fprintf(ex.w, "%x\n", frame)
+			}))
+		}()
+	}
+	ex.streams[key] = s
+	ex.connections++
+	return s
+}
+
+// segment adds data at seq to s, writing the lines it completes.
+func (ex *tcpExtractor) segment(s *tcpStream, seq uint32, data []byte) {
+	if int32(seq-s.next) > 0 {
+		s.pending[seq] = append([]byte(nil), data...)
+		if len(s.pending) > maxPendingSegments {
+			ex.skip(s)
+		}
+	} else {
+		ex.append(s, seq, data)
+	}
+	ex.flush(s)
+}
+
+// skip gives up on the missing segment and carries on from the earliest
+// one held. The line it was part of is lost.
+func (ex *tcpExtractor) skip(s *tcpStream) {
+	first, firstSet := uint32(0), false
+	for k := range s.pending {
+		if !firstSet || int32(k-first) < 0 {
+			first, firstSet = k, true
+		}
+	}
+	s.next, s.partial = first, s.partial[:0]
+	ex.gaps++
+}
+
+// flush appends the held segments that have become contiguous.
+func (ex *tcpExtractor) flush(s *tcpStream) {
+	for progress := true; progress; {
+		progress = false
+		for k, d := range s.pending {
+			if int32(k-s.next) <= 0 {
+				delete(s.pending, k)
+				ex.append(s, k, d)
+				progress = true
+			}
+		}
+	}
+}
+
+// append adds data at seq, which starts at or before s.next, and writes the
+// complete lines.
+func (ex *tcpExtractor) append(s *tcpStream, seq uint32, data []byte) {
+	if skip := int(s.next - seq); skip < len(data) {
+		data = data[skip:]
+	} else {
+		return // retransmitted
+	}
+	s.next += uint32(len(data))
+	if s.beast != nil {
+		s.beast.Write(data)
+		return
+	}
+	s.partial = append(s.partial, data...)
+	if i := bytes.LastIndexByte(s.partial, '\n'); i >= 0 {
+		ex.w.Write(s.partial[:i+1])
+		s.partial = append(s.partial[:0], s.partial[i+1:]...)
+	}
+}
+
+// end closes a connection. Segments still missing are given up on.
+func (ex *tcpExtractor) end(key tcpStreamKey) {
+	s := ex.streams[key]
+	if s == nil {
+		return
+	}
+	for len(s.pending) > 0 {
+		ex.skip(s)
+		ex.flush(s)
+	}
+	if s.beast != nil {
+		s.beast.Close()
+	}
+	delete(ex.streams, key)
+}
+
+// close ends every connection still open at the end of the capture.
+func (ex *tcpExtractor) close() {
+	for key := range ex.streams {
+		ex.end(key)
+	}
+	ex.decoders.Wait()
+}
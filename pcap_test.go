@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"strings"
+	"testing"
+)
+
+// Packets of captures built for tests, from the layer outwards.
+
+// tcpPacket is a TCP segment with the SYN (0x02), FIN (0x01) and other
+// flags given.
+func tcpPacket(sport, dport uint16, seq uint32, flags byte, data string) []byte {
+	b := make([]byte, 20, 20+len(data))
+	binary.BigEndian.PutUint16(b[0:2], sport)
+	binary.BigEndian.PutUint16(b[2:4], dport)
+	binary.BigEndian.PutUint32(b[4:8], seq)
+	b[12], b[13] = 5<<4, flags|0x10
+	return append(b, data...)
+}
+
+// ipv4Packet wraps a TCP segment from host src to host dst of 10.0.0.0/24.
+func ipv4Packet(src, dst byte, segment []byte) []byte {
+	b := make([]byte, 20, 20+len(segment))
+	b[0], b[8], b[9] = 0x45, 64, 6
+	binary.BigEndian.PutUint16(b[2:4], uint16(20+len(segment)))
+	copy(b[12:16], []byte{10, 0, 0, src})
+	copy(b[16:20], []byte{10, 0, 0, dst})
+	return append(b, segment...)
+}
+
+// ipv6Packet wraps a TCP segment from ::src to ::dst.
+func ipv6Packet(src, dst byte, segment []byte) []byte {
+	b := make([]byte, 40, 40+len(segment))
+	b[0], b[6], b[7] = 0x60, 6, 64
+	binary.BigEndian.PutUint16(b[4:6], uint16(len(segment)))
+	b[23], b[39] = src, dst
+	return append(b, segment...)
+}
+
+// etherFrame wraps an IPv4 packet in Ethernet, with an 802.1Q tag if vlan.
+func etherFrame(ip []byte, vlan bool) []byte {
+	b := make([]byte, 12)
+	if vlan {
+		b = append(b, 0x81, 0x00, 0x00, 0x07)
+	}
+	return append(append(b, 0x08, 0x00), ip...)
+}
+
+// pcapFile is a pcap capture of frames of link type link.
+func pcapFile(order binary.ByteOrder, link uint32, frames ...[]byte) []byte {
+	var b bytes.Buffer
+	for _, v := range []interface{}{uint32(0xa1b2c3d4), uint16(2), uint16(4), int32(0), uint32(0), uint32(65535), link} {
+		binary.Write(&b, order, v)
+	}
+	for i, f := range frames {
+		for _, v := range []uint32{uint32(1700000000 + i), 0, uint32(len(f)), uint32(len(f))} {
+			binary.Write(&b, order, v)
+		}
+		b.Write(f)
+	}
+	return b.Bytes()
+}
+
+// pcapngBlock is a pcapng block of body, padded to 32 bits.
+func pcapngBlock(order binary.ByteOrder, typ uint32, body []byte) []byte {
+	for len(body)%4 != 0 {
+		body = append(body, 0)
+	}
+	var b bytes.Buffer
+	n := uint32(12 + len(body))
+	binary.Write(&b, order, typ)
+	binary.Write(&b, order, n)
+	b.Write(body)
+	binary.Write(&b, order, n)
+	return b.Bytes()
+}
+
+// pcapngFile is a pcapng capture of one interface of link type link. Its
+// first frame is in an enhanced packet block, the others in simple packet
+// blocks.
+func pcapngFile(order binary.ByteOrder, link uint16, frames ...[]byte) []byte {
+	var b bytes.Buffer
+	shb := make([]byte, 16)
+	order.PutUint32(shb[0:4], 0x1a2b3c4d)
+	order.PutUint16(shb[4:6], 1)
+	order.PutUint64(shb[8:16], ^uint64(0))
+	b.Write(pcapngBlock(order, 0x0a0d0d0a, shb))
+	idb := make([]byte, 8)
+	order.PutUint16(idb[0:2], link)
+	order.PutUint32(idb[4:8], 65535)
+	b.Write(pcapngBlock(order, 1, idb))
+	for i, f := range frames {
+		if i == 0 {
+			epb := make([]byte, 20)
+			order.PutUint32(epb[12:16], uint32(len(f)))
+			order.PutUint32(epb[16:20], uint32(len(f)))
+			b.Write(pcapngBlock(order, 6, append(epb, f...)))
+			continue
+		}
+		spb := make([]byte, 4)
+		order.PutUint32(spb, uint32(len(f)))
+		b.Write(pcapngBlock(order, 3, append(spb, f...)))
+	}
+	return b.Bytes()
+}
+
+// extractTCP returns the lines sent from port 30003 in a capture.
+func extractTCP(t *testing.T, capture []byte) (string, *tcpExtractor) {
+	t.Helper()
+	var out bytes.Buffer
+	ex := &tcpExtractor{port: 30003, w: &out, streams: map[tcpStreamKey]*tcpStream{}}
+	if err := readPcap(bytes.NewReader(capture), ex.packet); err != nil {
+		t.Fatal(err)
+	}
+	ex.close()
+	return out.String(), ex
+}
+
+func TestPcapExtract(t *testing.T) {
+	const (
+		line1 = "MSG,3,1,1,4CA2D6,1,2026/10/16,10:00:00.000,2026/10/16,10:00:00.000,,35000,,,53.1,-6.2,,,0,0,0,0\n"
+		line2 = "MSG,1,1,1,4CA2D6,1,2026/10/16,10:00:01.000,2026/10/16,10:00:01.000,EIN123,,,,,,,,,,,0\n"
+		line3 = "MSG,4,1,1,A1B2C3,1,2026/10/16,10:00:02.000,2026/10/16,10:00:02.000,,,450,90,,,0,,,,,0\n"
+	)
+	// Connection a sends line1 and line2 split across segments, the
+	// second of which arrives after the third and again as a
+	// retransmission. Connection b, from another host, sends line3 at
+	// the same time. Traffic to the feed port and from other ports is
+	// not the feed.
+	a := func(seq uint32, flags byte, data string) []byte {
+		return tcpPacket(30003, 50000, seq, flags, data)
+	}
+	b := func(seq uint32, flags byte, data string) []byte {
+		return tcpPacket(30003, 50001, seq, flags, data)
+	}
+	segments := [][]byte{
+		a(999, 0x02, ""),
+		b(4999, 0x02, ""),
+		a(1000, 0, line1[:30]),
+		b(5000, 0, line3[:50]),
+		a(1000+uint32(len(line1)), 0, line2),
+		tcpPacket(50000, 30003, 1, 0, "client data\n"),
+		tcpPacket(30002, 50000, 1, 0, "other port\n"),
+		a(1030, 0, line1[30:]),
+		a(1030, 0, line1[30:]),
+		b(5050, 0x01, line3[50:]),
+		a(1000+uint32(len(line1)+len(line2)), 0x01, ""),
+	}
+	want := line1 + line2 + line3
+
+	ipv4 := func(seg []byte) []byte { return ipv4Packet(1, 2, seg) }
+	tests := []struct {
+		name  string
+		frame func(seg []byte) []byte
+		file  func(frames ...[]byte) []byte
+	}{
+		{"pcap ethernet", func(seg []byte) []byte { return etherFrame(ipv4(seg), false) },
+			func(f ...[]byte) []byte { return pcapFile(binary.LittleEndian, linkEthernet, f...) }},
+		{"pcap big-endian ethernet with VLAN tags", func(seg []byte) []byte { return etherFrame(ipv4(seg), true) },
+			func(f ...[]byte) []byte { return pcapFile(binary.BigEndian, linkEthernet, f...) }},
+		{"pcap raw IPv4", ipv4,
+			func(f ...[]byte) []byte { return pcapFile(binary.LittleEndian, linkRaw, f...) }},
+		{"pcap loopback", func(seg []byte) []byte { return append([]byte{2, 0, 0, 0}, ipv4(seg)...) },
+			func(f ...[]byte) []byte { return pcapFile(binary.LittleEndian, linkNull, f...) }},
+		{"pcapng Linux cooked IPv6", func(seg []byte) []byte { return append(make([]byte, 16), ipv6Packet(1, 2, seg)...) },
+			func(f ...[]byte) []byte { return pcapngFile(binary.LittleEndian, linkLinuxSLL, f...) }},
+		{"pcapng big-endian ethernet", func(seg []byte) []byte { return etherFrame(ipv4(seg), false) },
+			func(f ...[]byte) []byte { return pcapngFile(binary.BigEndian, linkEthernet, f...) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var frames [][]byte
+			for _, seg := range segments {
+				frames = append(frames, tt.frame(seg))
+			}
+			capture := tt.file(frames...)
+			if !isPcap(capture[:4]) {
+				t.Errorf("capture starting %x not recognized", capture[:4])
+			}
+			got, ex := extractTCP(t, capture)
+			if got != want {
+				t.Errorf("extracted\n%s\nwant\n%s", got, want)
+			}
+			if ex.connections != 2 || ex.gaps != 0 {
+				t.Errorf("%d connections with %d gaps, want 2 without", ex.connections, ex.gaps)
+			}
+		})
+	}
+}
+
+func TestPcapLostSegment(t *testing.T) {
+	lines := make([]string, maxPendingSegments+3)
+	for i := range lines {
+		lines[i] = strings.Repeat("x", 9) + string(rune('a'+i%26)) + "\n"
+	}
+	// The capture starts after the connection did, and the second
+	// segment never arrives.
+	var frames [][]byte
+	for i, line := range lines {
+		if i != 1 {
+			frames = append(frames, ipv4Packet(1, 2, tcpPacket(30003, 50000, uint32(1000+11*i), 0, line)))
+		}
+	}
+	got, ex := extractTCP(t, pcapFile(binary.LittleEndian, linkRaw, frames...))
+	want := lines[0] + strings.Join(lines[2:], "")
+	if got != want {
+		t.Errorf("extracted %q, want %q", got, want)
+	}
+	if ex.connections != 1 || ex.gaps != 1 {
+		t.Errorf("%d connections with %d gaps, want 1 with 1", ex.connections, ex.gaps)
+	}
+}
+
+func TestPcapCorrupt(t *testing.T) {
+	capture := pcapFile(binary.LittleEndian, linkRaw, []byte("packet"))
+	binary.LittleEndian.PutUint32(capture[24+8:], maxPcapRecord+1)
+	if err := readPcap(bytes.NewReader(capture), func(uint16, []byte) {}); err == nil || !strings.Contains(err.Error(), "corrupt pcap record") {
+		t.Errorf("error %v, want a corrupt record", err)
+	}
+
+	block := pcapngFile(binary.LittleEndian, linkRaw)
+	block = append(block, 6, 0, 0, 0, 13, 0, 0, 0)
+	if err := readPcap(bytes.NewReader(block), func(uint16, []byte) {}); err == nil || !strings.Contains(err.Error(), "corrupt pcapng block") {
+		t.Errorf("error %v, want a corrupt block", err)
+	}
+
+	if isPcap([]byte("MSG,")) {
+		t.Error("a feed capture taken for a packet capture")
+	}
+}
+
+func TestPcapBeast(t *testing.T) {
+	ident, _ := hex.DecodeString("8D4840D6202CC371C32CE0576098")
+	frame := append([]byte{0x1a, '3', 0, 0, 0, 0, 0, 0x1a, 0x1a, 0x80}, ident...)
+	// A frame split across segments, and one straddling two.
+	stream := string(frame) + string(frame)
+	capture := pcapFile(binary.LittleEndian, linkRaw,
+		ipv4Packet(1, 2, tcpPacket(30005, 50000, 999, 0x02, "")),
+		ipv4Packet(1, 2, tcpPacket(30005, 50000, 1000, 0, stream[:10])),
+		ipv4Packet(1, 2, tcpPacket(30005, 50000, 1010, 0, stream[10:30])),
+		ipv4Packet(1, 2, tcpPacket(30005, 50000, 1030, 0x01, stream[30:])),
+	)
+	out, err := io.ReadAll(extractCapture(bytes.NewReader(capture), 30005, true, "test.pcap"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := "33" + "00000000001a" + "80" + "8d4840d6202cc371c32ce0576098\n"
+	if string(out) != line+line {
+		t.Errorf("extracted %q, want two frames", out)
+	}
+}
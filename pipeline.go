@@ -0,0 +1,416 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// pipelineOptions are the options of the collector that a pipeline of the
+// config file sets for itself: its sinks and the transmission types it
+// keeps.
+var pipelineOptions = []string{
+	"dataset_api_write_token", "types",
+	"sqlite_dir", "sqlite_keep_days",
+	"postgres_url", "postgres_table", "postgres_interval",
+	"s3_bucket", "s3_prefix", "s3_region", "s3_endpoint", "s3_access_key_id", "s3_secret_access_key", "s3_session_token", "s3_interval",
+	"splunk_url", "splunk_token", "splunk_index", "splunk_sourcetype", "splunk_ack", "splunk_interval",
+	"redis_url", "redis_stream", "redis_maxlen", "redis_maxlen_exact", "redis_interval",
+	"kinesis_stream", "kinesis_region", "kinesis_endpoint", "kinesis_access_key_id", "kinesis_secret_access_key", "kinesis_session_token", "kinesis_interval",
+	"firehose_stream", "firehose_region", "firehose_endpoint", "firehose_access_key_id", "firehose_secret_access_key", "firehose_session_token", "firehose_interval",
+	"pubsub_topic", "pubsub_credentials", "pubsub_endpoint", "pubsub_batch_size", "pubsub_interval",
+	"eventhubs_connection_string", "eventhubs_name", "eventhubs_partition_key", "eventhubs_interval",
+	"bigquery_table", "bigquery_credentials", "bigquery_interval",
+	"webhook_url", "webhook_method", "webhook_header", "webhook_template", "webhook_mode", "webhook_batch_size", "webhook_interval",
+}
+
+// pipelineFilterFlags are the options only pipelines have. They are not
+// flags of the collector, but are checked and described like them.
+var pipelineFilterFlags = []cli.Flag{
+	&cli.StringSliceFlag{
+		Name:  "icao",
+		Usage: "Only send messages of these ICAO addresses or ranges, such as 'ADF7C8-ADF7CF'.",
+	},
+	&cli.StringSliceFlag{
+		Name:  "callsign",
+		Usage: "Only send messages of aircraft whose callsign starts with one of these prefixes.",
+	},
+	&cli.StringSliceFlag{
+		Name:  "message_types",
+		Usage: "Only send these message types, such as MSG for aircraft messages or SNAPSHOT, STATS and ENRICHMENT_UPDATE for the collector's own events.",
+	},
+}
+
+// pipelineName restricts pipeline names to what reads well in logs.
+var pipelineName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*$`)
+
+// pipelineSettings are the options a pipeline of the config file sets, in
+// the form their flags parse. Options left out take their defaults.
+type pipelineSettings struct {
+	flags  map[string]cli.Flag
+	values map[string][]string
+}
+
+// configPipelines are the pipelines of the config file, by name.
+var configPipelines = map[string]pipelineSettings{}
+
+// pipelineFlags returns the options a pipeline can set, by name.
+func pipelineFlags(appFlags []cli.Flag) map[string]cli.Flag {
+	all := configFlags(appFlags)
+	flags := map[string]cli.Flag{}
+	for _, name := range pipelineOptions {
+		flags[name] = all[name]
+	}
+	for _, f := range pipelineFilterFlags {
+		flags[f.Names()[0]] = f
+	}
+	return flags
+}
+
+// parsePipelines checks the "pipelines" object of the config file at path
+// against pipelineFlags, returning every problem found.
+func parsePipelines(path string, value interface{}, appFlags []cli.Flag) (map[string]pipelineSettings, []error) {
+	objects, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, []error{fmt.Errorf("%s: pipelines: expected an object of pipelines by name", path)}
+	}
+	flags := pipelineFlags(appFlags)
+	names := make([]string, 0, len(objects))
+	for name := range objects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []error
+	pipelines := map[string]pipelineSettings{}
+	for _, name := range names {
+		if !pipelineName.MatchString(name) {
+			errs = append(errs, fmt.Errorf("%s: pipelines: %q must be letters, digits, '-' and '_'", path, name))
+			continue
+		}
+		options, ok := objects[name].(map[string]interface{})
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: pipelines.%s: expected an object of options", path, name))
+			continue
+		}
+		settings := pipelineSettings{flags: flags, values: map[string][]string{}}
+		for key, v := range options {
+			f, ok := flags[key]
+			if !ok {
+				errs = append(errs, fmt.Errorf("%s: pipelines.%s: unknown key %q%s", path, name, key, suggestKey(key, flags)))
+				continue
+			}
+			values, err := configValues(f, v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: pipelines.%s.%s: %w", path, name, key, err))
+				continue
+			}
+			settings.values[key] = values
+		}
+		pipelines[name] = settings
+	}
+	return pipelines, errs
+}
+
+// value returns an option as its flag would print it, or its default.
+func (s pipelineSettings) value(name string) string {
+	if v, ok := s.values[name]; ok {
+		return v[0]
+	}
+	switch f := s.flags[name].(type) {
+	case *cli.StringFlag:
+		return f.Value
+	case *cli.IntFlag:
+		return strconv.Itoa(f.Value)
+	case *cli.BoolFlag:
+		return strconv.FormatBool(f.Value)
+	case *cli.DurationFlag:
+		return f.Value.String()
+	}
+	return ""
+}
+
+func (s pipelineSettings) int(name string) int {
+	n, _ := strconv.Atoi(s.value(name))
+	return n
+}
+
+func (s pipelineSettings) bool(name string) bool {
+	b, _ := strconv.ParseBool(s.value(name))
+	return b
+}
+
+func (s pipelineSettings) duration(name string) time.Duration {
+	d, _ := time.ParseDuration(s.value(name))
+	return d
+}
+
+// list returns a list option, whose items may also be separated by commas.
+func (s pipelineSettings) list(name string) []string {
+	var items []string
+	for _, v := range s.values[name] {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+	}
+	return items
+}
+
+// sinkConfig returns the sinks the pipeline sets.
+func (s pipelineSettings) sinkConfig() sinkConfig {
+	return sinkConfig{
+		sqliteDir:         s.value("sqlite_dir"),
+		sqliteKeepDays:    s.int("sqlite_keep_days"),
+		postgresURL:       s.value("postgres_url"),
+		postgresTable:     s.value("postgres_table"),
+		postgresInterval:  s.duration("postgres_interval"),
+		s3Bucket:          s.value("s3_bucket"),
+		s3Prefix:          s.value("s3_prefix"),
+		s3Region:          s.value("s3_region"),
+		s3Endpoint:        s.value("s3_endpoint"),
+		s3AccessKeyID:     s.value("s3_access_key_id"),
+		s3SecretAccessKey: s.value("s3_secret_access_key"),
+		s3SessionToken:    s.value("s3_session_token"),
+		s3Interval:        s.duration("s3_interval"),
+		splunkURL:         s.value("splunk_url"),
+		splunkToken:       s.value("splunk_token"),
+		splunkIndex:       s.value("splunk_index"),
+		splunkSourcetype:  s.value("splunk_sourcetype"),
+		splunkAck:         s.bool("splunk_ack"),
+		splunkInterval:    s.duration("splunk_interval"),
+		redisURL:          s.value("redis_url"),
+		redisStream:       s.value("redis_stream"),
+		redisMaxLen:       s.int("redis_maxlen"),
+		redisMaxLenExact:  s.bool("redis_maxlen_exact"),
+		redisInterval:     s.duration("redis_interval"),
+		kinesisStream:     s.value("kinesis_stream"),
+		kinesisRegion:     s.value("kinesis_region"),
+		kinesisEndpoint:   s.value("kinesis_endpoint"),
+		kinesisAccessKey:  s.value("kinesis_access_key_id"),
+		kinesisSecretKey:  s.value("kinesis_secret_access_key"),
+		kinesisSession:    s.value("kinesis_session_token"),
+		kinesisInterval:   s.duration("kinesis_interval"),
+		firehoseStream:    s.value("firehose_stream"),
+		firehoseRegion:    s.value("firehose_region"),
+		firehoseEndpoint:  s.value("firehose_endpoint"),
+		firehoseAccessKey: s.value("firehose_access_key_id"),
+		firehoseSecretKey: s.value("firehose_secret_access_key"),
+		firehoseSession:   s.value("firehose_session_token"),
+		firehoseInterval:  s.duration("firehose_interval"),
+		pubsubTopic:       s.value("pubsub_topic"),
+		pubsubCredentials: s.value("pubsub_credentials"),
+		pubsubEndpoint:    s.value("pubsub_endpoint"),
+		pubsubBatchSize:   s.int("pubsub_batch_size"),
+		pubsubInterval:    s.duration("pubsub_interval"),
+		eventhubsConn:     s.value("eventhubs_connection_string"),
+		eventhubsName:     s.value("eventhubs_name"),
+		eventhubsKey:      s.value("eventhubs_partition_key"),
+		eventhubsInterval: s.duration("eventhubs_interval"),
+		bigqueryTable:     s.value("bigquery_table"),
+		bigqueryCreds:     s.value("bigquery_credentials"),
+		bigqueryInterval:  s.duration("bigquery_interval"),
+		webhookURL:        s.value("webhook_url"),
+		webhookMethod:     s.value("webhook_method"),
+		webhookHeaders:    s.values["webhook_header"],
+		webhookTemplate:   s.value("webhook_template"),
+		webhookMode:       s.value("webhook_mode"),
+		webhookBatchSize:  s.int("webhook_batch_size"),
+		webhookInterval:   s.duration("webhook_interval"),
+	}
+}
+
+// validate checks the pipeline's filters and that it has a sink.
+func (s pipelineSettings) validate() error {
+	if s.value("dataset_api_write_token") == "" && len(s.sinkConfig().names()) == 0 {
+		return errors.New("has no sink: set dataset_api_write_token, sqlite_dir, postgres_url, s3_bucket, splunk_url, redis_url, kinesis_stream, firehose_stream, pubsub_topic, eventhubs_connection_string, bigquery_table or webhook_url")
+	}
+	if _, err := parseTransmissionTypes(s.list("types")); err != nil {
+		return fmt.Errorf("invalid types: %w", err)
+	}
+	if _, err := parseICAORanges(s.list("icao")); err != nil {
+		return fmt.Errorf("invalid icao: %w", err)
+	}
+	return s.sinkConfig().validate()
+}
+
+// pipeline is a named pipeline of the config file. It shares the feeds,
+// parsing, tracking and enrichment of the collector, and sends the
+// messages that pass its filters to its own sinks.
+type pipeline struct {
+	name         string
+	types        typeFilter
+	icao         []icaoRange
+	callsigns    []string
+	messageTypes []string
+
+	// uploads sends batch to DataSet, and is nil without a token.
+	uploads *uploader
+	batch   []SBS1Message
+	sizer   *batchSizer
+	sinks   *messageSinks
+}
+
+// startPipeline starts the sinks of a validated pipeline.
+func startPipeline(name string, s pipelineSettings) (*pipeline, error) {
+	p := &pipeline{name: name, callsigns: s.list("callsign"), messageTypes: s.list("message_types")}
+	p.types, _ = parseTransmissionTypes(s.list("types"))
+	p.icao, _ = parseICAORanges(s.list("icao"))
+	if token := s.value("dataset_api_write_token"); token != "" {
+		// Pipelines cannot be paused, so their uploader has no spool.
+		p.uploads = &uploader{dataset: newDatasetClient(token)}
+		p.sizer = newBatchSizer()
+	}
+	var err error
+	if p.sinks, err = s.sinkConfig().start(); err != nil {
+		return nil, fmt.Errorf("pipeline %s: %w", name, err)
+	}
+	return p, nil
+}
+
+// match reports whether msg from aircraft a passes the pipeline's filters.
+// Events of the collector have no aircraft, so they only pass filters on
+// aircraft when the event names one.
+func (p *pipeline) match(msg SBS1Message, a Aircraft) bool {
+	if len(p.messageTypes) > 0 && !containsFold(p.messageTypes, msg.MessageType) {
+		return false
+	}
+	if p.types != nil && msg.MessageType == "MSG" && !p.types[msg.TransmissionType] {
+		return false
+	}
+	if len(p.icao) > 0 && !containsICAO(p.icao, msg.Icao24) {
+		return false
+	}
+	if len(p.callsigns) > 0 && !hasAnyPrefix(a.Callsign, p.callsigns) {
+		return false
+	}
+	return true
+}
+
+// pipelines are the running pipelines of the config file.
+type pipelines []*pipeline
+
+// startPipelines starts every pipeline of the config file, in name order.
+func startPipelines() (pipelines, error) {
+	names := make([]string, 0, len(configPipelines))
+	for name := range configPipelines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var ps pipelines
+	for _, name := range names {
+		p, err := startPipeline(name, configPipelines[name])
+		if err != nil {
+			ps.Close()
+			return nil, err
+		}
+		log.Printf("Started pipeline %s", name)
+		ps = append(ps, p)
+	}
+	return ps, nil
+}
+
+// AddMessage hands a decoded aircraft message from aircraft a to every
+// pipeline it passes, for its sinks and its DataSet batch. It returns the
+// error of a DataSet batch that filled up and failed.
+func (ps pipelines) AddMessage(msg SBS1Message, a Aircraft) error {
+	var firstErr error
+	for _, p := range ps {
+		if !p.match(msg, a) {
+			continue
+		}
+		p.sinks.Add(msg)
+		if err := p.queue(msg); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// AddEvent hands an event of the collector, such as a snapshot or receiver
+// statistics, to the DataSet batch of every pipeline it passes.
+func (ps pipelines) AddEvent(msg SBS1Message) error {
+	var firstErr error
+	for _, p := range ps {
+		if !p.match(msg, Aircraft{Callsign: msg.Callsign}) {
+			continue
+		}
+		if err := p.queue(msg); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// queue adds msg to the pipeline's DataSet batch, sending it once full.
+func (p *pipeline) queue(msg SBS1Message) error {
+	if p.uploads == nil {
+		return nil
+	}
+	if !toggles.Enabled("dataset") {
+		metricDisabledSink.Inc("dataset")
+		return nil
+	}
+	p.batch = append(p.batch, msg)
+	p.sizer.Observe(1, time.Now())
+	if p.sizer.Full(len(p.batch)) {
+		return p.flush()
+	}
+	return nil
+}
+
+// flush sends the pipeline's DataSet batch.
+func (p *pipeline) flush() error {
+	if len(p.batch) == 0 {
+		return nil
+	}
+	err := p.uploads.Send(p.batch)
+	p.batch = p.batch[:0]
+	p.sizer.Sent()
+	if err != nil {
+		log.Printf("Error sending messages of pipeline %s: %v", p.name, err)
+		return fmt.Errorf("pipeline %s: %w", p.name, err)
+	}
+	return nil
+}
+
+// Flush sends the DataSet batch of every pipeline.
+func (ps pipelines) Flush() error {
+	var firstErr error
+	for _, p := range ps {
+		if err := p.flush(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// FlushDue sends the DataSet batches that have waited the batch latency.
+func (ps pipelines) FlushDue(now time.Time) error {
+	var firstErr error
+	for _, p := range ps {
+		if p.sizer == nil || !p.sizer.Due(now) {
+			continue
+		}
+		if err := p.flush(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Close flushes every pipeline and stops its sinks.
+func (ps pipelines) Close() {
+	for _, p := range ps {
+		p.flush()
+		p.sinks.Close()
+	}
+}
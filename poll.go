@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// aircraftJSON is the part of the aircraft.json served by dump1090-fa and
+// readsb that the poller reads. The ADS-B Exchange v2 API serves the same
+// records under ac, with now in milliseconds.
+type aircraftJSON struct {
+	Now      float64           `json:"now"`
+	Aircraft []*aircraftRecord `json:"aircraft"`
+	AC       []*aircraftRecord `json:"ac"`
+}
+
+// aircraftRecord is one aircraft of aircraft.json, with the file's now
+// added. It is what a polled feed's lines hold, and what readsb streams on
+// its JSON port. dump1090-fa before 4.0 wrote altitude, speed and vert_rate
+// instead of alt_baro, gs and baro_rate.
+type aircraftRecord struct {
+	Now       float64     `json:"now"`
+	Hex       string      `json:"hex"`
+	Flight    string      `json:"flight,omitempty"`
+	AltBaro   interface{} `json:"alt_baro,omitempty"` // feet, or "ground"
+	Altitude  interface{} `json:"altitude,omitempty"`
+	GS        *float64    `json:"gs,omitempty"`
+	Speed     *float64    `json:"speed,omitempty"`
+	Track     *float64    `json:"track,omitempty"`
+	Lat       *float64    `json:"lat,omitempty"`
+	Lon       *float64    `json:"lon,omitempty"`
+	BaroRate  *float64    `json:"baro_rate,omitempty"`
+	VertRate  *float64    `json:"vert_rate,omitempty"`
+	Squawk    string      `json:"squawk,omitempty"`
+	Emergency string      `json:"emergency,omitempty"`
+	Seen      float64     `json:"seen"`
+	SeenPos   *float64    `json:"seen_pos,omitempty"`
+	RSSI      *float64    `json:"rssi,omitempty"`
+	Messages  int         `json:"messages,omitempty"`
+
+	// What readsb and dump1090-fa decode beyond SBS-1.
+	Type       string   `json:"type,omitempty"`
+	Category   string   `json:"category,omitempty"`
+	AltGeom    *float64 `json:"alt_geom,omitempty"`
+	IAS        *float64 `json:"ias,omitempty"`
+	TAS        *float64 `json:"tas,omitempty"`
+	Mach       *float64 `json:"mach,omitempty"`
+	NavQNH     *float64 `json:"nav_qnh,omitempty"`
+	NavAltMCP  *float64 `json:"nav_altitude_mcp,omitempty"`
+	NavAltFMS  *float64 `json:"nav_altitude_fms,omitempty"`
+	NavHeading *float64 `json:"nav_heading,omitempty"`
+	NavModes   []string `json:"nav_modes,omitempty"`
+	NIC        *int32   `json:"nic,omitempty"`
+	NACp       *int32   `json:"nac_p,omitempty"`
+	NACv       *int32   `json:"nac_v,omitempty"`
+	SIL        *int32   `json:"sil,omitempty"`
+	Version    *int32   `json:"version,omitempty"`
+}
+
+// aircraftPoller turns successive aircraft.json snapshots into lines, one
+// per aircraft that sent something since the previous poll.
+type aircraftPoller struct {
+	url      string
+	headers  http.Header
+	interval time.Duration
+	client   *http.Client
+	// messages is each aircraft's message count at the previous poll.
+	messages map[string]int
+}
+
+// openAircraftJSON polls url every interval, with headers added to the
+// requests, and returns the aircraft with new data as JSON lines, as
+// openPolled does.
+func openAircraftJSON(url string, headers http.Header, interval, wait time.Duration, stop <-chan struct{}) (io.ReadCloser, error) {
+	p := &aircraftPoller{url: url, headers: headers, interval: interval, client: &http.Client{Timeout: 10 * time.Second}, messages: map[string]int{}}
+	return openPolled(url, interval, wait, stop, p.poll)
+}
+
+// openPolled calls poll every interval and returns the lines it produces
+// as a feed. The first poll is retried for up to wait, like dialFeed; later
+// failures are logged and polling carries on. The lines end when stop is
+// closed or the reader is closed. name identifies the source in logs.
+func openPolled(name string, interval, wait time.Duration, stop <-chan struct{}, poll func() ([]byte, error)) (io.ReadCloser, error) {
+	var lines []byte
+	err := waitForFeed(name, wait, stop, func() (err error) {
+		lines, err = poll()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		failing := false
+		for {
+			if _, err := pw.Write(lines); err != nil {
+				return
+			}
+			select {
+			case <-ticker.C:
+			case <-stop:
+				pw.Close()
+				return
+			}
+			var err error
+			lines, err = poll()
+			switch {
+			case err != nil && !failing:
+				log.Printf("Error polling %s, retrying every %s: %v", name, interval, err)
+			case err == nil && failing:
+				log.Printf("Polling %s again", name)
+			}
+			failing = err != nil
+		}
+	}()
+	return pr, nil
+}
+
+// poll fetches aircraft.json once and returns a line for each aircraft
+// whose message count changed. Positions older than the poll interval are
+// left out so the tracker does not take a stale position for a new report.
+func (p *aircraftPoller) poll() ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, p.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range p.headers {
+		req.Header[name] = values
+	}
+	req.Header.Set("User-Agent", userAgent())
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", p.url, res.Status)
+	}
+	var snapshot aircraftJSON
+	if err := json.NewDecoder(res.Body).Decode(&snapshot); err != nil {
+		return nil, fmt.Errorf("decoding %s: %w", p.url, err)
+	}
+
+	if snapshot.Now > 1e11 {
+		snapshot.Now /= 1000
+	}
+
+	var lines bytes.Buffer
+	seen := map[string]int{}
+	for _, rec := range append(snapshot.Aircraft, snapshot.AC...) {
+		if rec == nil || rec.Hex == "" {
+			continue
+		}
+		seen[rec.Hex] = rec.Messages
+		// Without a message count, fall back to whether the aircraft was
+		// heard since the last poll.
+		if prev, ok := p.messages[rec.Hex]; rec.Messages != 0 && ok && prev == rec.Messages {
+			continue
+		} else if rec.Messages == 0 && rec.Seen > p.interval.Seconds() {
+			continue
+		}
+		if rec.SeenPos == nil || *rec.SeenPos > p.interval.Seconds() {
+			rec.Lat, rec.Lon = nil, nil
+		}
+		rec.Now = snapshot.Now
+		data, err := json.Marshal(rec)
+		if err != nil {
+			return nil, err
+		}
+		lines.Write(data)
+		lines.WriteByte('\n')
+	}
+	p.messages = seen
+	return lines.Bytes(), nil
+}
+
+// parseAircraftJSONLine converts a line of a polled feed to a message. It
+// is generated when the aircraft was last heard and logged at the
+// snapshot's time.
+func parseAircraftJSONLine(line string) (SBS1Message, bool) {
+	var rec aircraftRecord
+	if err := json.Unmarshal([]byte(line), &rec); err != nil || rec.Hex == "" || rec.Now == 0 {
+		metricParseErrors.Inc("aircraft_json")
+		return SBS1Message{}, false
+	}
+	return aircraftRecordMessage(rec), true
+}
+
+// parseReadsbJSONLine converts a line of readsb's JSON output to a message.
+// Lines without now are timed when they are read.
+func parseReadsbJSONLine(line string) (SBS1Message, bool) {
+	var rec aircraftRecord
+	if err := json.Unmarshal([]byte(line), &rec); err != nil || rec.Hex == "" {
+		metricParseErrors.Inc("readsb_json")
+		return SBS1Message{}, false
+	}
+	if rec.Now == 0 {
+		rec.Now = float64(clock.Now().UnixNano()) / float64(time.Second)
+	}
+	return aircraftRecordMessage(rec), true
+}
+
+// aircraftRecordMessage converts an aircraft record to a message.
+func aircraftRecordMessage(rec aircraftRecord) SBS1Message {
+	msg := NewSBS1Message()
+	msg.MessageType = "MSG"
+	msg.Icao24 = strings.ToUpper(rec.Hex)
+	msg.Callsign = strings.TrimSpace(rec.Flight)
+
+	logged := time.Unix(0, int64(rec.Now*float64(time.Second))).UTC()
+	generated := logged.Add(-time.Duration(rec.Seen * float64(time.Second)))
+	msg.GeneratedDate, msg.LoggedDate = &generated, &logged
+	if observeRecordedTime(msg.GeneratedDate, msg.LoggedDate) {
+		msg.Timestamp = formatTimestamp(clock.Now())
+	}
+
+	altitude := rec.AltBaro
+	if altitude == nil {
+		altitude = rec.Altitude
+	}
+	switch alt := altitude.(type) {
+	case float64:
+		msg.Altitude = int32(alt)
+	case string:
+		msg.OnGround = alt == "ground"
+	}
+	if gs := firstOf(rec.GS, rec.Speed); gs != nil {
+		msg.GroundSpeed = float32(*gs)
+	}
+	if rec.Track != nil {
+		msg.Track = float32(*rec.Track)
+	}
+	if rec.Lat != nil && rec.Lon != nil {
+		msg.Lat, msg.Lon = float32(*rec.Lat), float32(*rec.Lon)
+	}
+	if rate := firstOf(rec.BaroRate, rec.VertRate); rate != nil {
+		msg.VerticalRate = int32(*rate)
+	}
+	msg.Squawk = parseInt(rec.Squawk)
+	msg.Emergency = rec.Emergency != "" && rec.Emergency != "none"
+	if rec.RSSI != nil {
+		msg.SignalLevel = float32(*rec.RSSI)
+	}
+	addRecordDetails(&msg, rec)
+
+	switch {
+	case rec.Lat != nil && rec.Lon != nil:
+		msg.TransmissionType = 3
+	case msg.GroundSpeed != 0:
+		msg.TransmissionType = 4
+	case msg.Callsign != "":
+		msg.TransmissionType = 1
+	default:
+		msg.TransmissionType = 5
+	}
+	return msg
+}
+
+// addRecordDetails copies what a record has beyond SBS-1 to msg: the
+// emitter category, geometric altitude, airspeeds, the autopilot's
+// selections, and the accuracy and integrity of the position. The position
+// source is taken from the record's type: adsb, mlat, tisb or adsr.
+func addRecordDetails(msg *SBS1Message, rec aircraftRecord) {
+	msg.Category = rec.Category
+	if rec.AltGeom != nil {
+		msg.GeomAltitude = int32(*rec.AltGeom)
+	}
+	if rec.IAS != nil {
+		msg.IAS = int32(*rec.IAS)
+	}
+	if rec.TAS != nil {
+		msg.TAS = int32(*rec.TAS)
+	}
+	if rec.Mach != nil {
+		msg.Mach = float32(*rec.Mach)
+	}
+	if rec.NavQNH != nil {
+		msg.NavQNH = float32(*rec.NavQNH)
+	}
+	if alt := firstOf(rec.NavAltMCP, rec.NavAltFMS); alt != nil {
+		msg.NavAltitude = int32(*alt)
+	}
+	if rec.NavHeading != nil {
+		msg.NavHeading = float32(*rec.NavHeading)
+	}
+	msg.NavModes = rec.NavModes
+	msg.NIC, msg.NACp, msg.NACv, msg.SIL, msg.ADSBVersion = rec.NIC, rec.NACp, rec.NACv, rec.SIL, rec.Version
+	if rec.Lat != nil && rec.Lon != nil {
+		switch source, _, _ := strings.Cut(rec.Type, "_"); source {
+		case "adsb", "mlat", "tisb", "adsr":
+			msg.PositionSource = source
+		}
+	}
+}
+
+// firstOf returns the first of values that is set.
+func firstOf(values ...*float64) *float64 {
+	for _, v := range values {
+		if v != nil {
+			return v
+		}
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"sort"
+	"time"
+	"unsafe"
+)
+
+// PositionSample is a position an aircraft reported, with the altitude and
+// velocity known at the time, as kept in its position history.
+type PositionSample struct {
+	Lat          float32   `json:"lat"`
+	Lon          float32   `json:"lon"`
+	Altitude     int32     `json:"altitude,omitempty"`
+	GroundSpeed  float32   `json:"ground_speed,omitempty"`
+	Track        float32   `json:"track,omitempty"`
+	VerticalRate int32     `json:"vertical_rate,omitempty"`
+	At           time.Time `json:"at"`
+}
+
+// positionSampleSize is what one slot of a position history takes.
+const positionSampleSize = int(unsafe.Sizeof(PositionSample{}))
+
+// positionRing is the position history of one aircraft: the latest
+// positions, up to the ring's depth, overwriting the oldest once full. Its
+// slots are allocated on the first position, so aircraft never heard with
+// one cost nothing.
+type positionRing struct {
+	samples []PositionSample
+	next    int
+	full    bool
+}
+
+// add records s, dropping the oldest sample when the ring is full.
+func (r *positionRing) add(s PositionSample, depth int) {
+	if r.samples == nil {
+		r.samples = make([]PositionSample, depth)
+	}
+	r.samples[r.next] = s
+	r.next = (r.next + 1) % len(r.samples)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// list returns a copy of the samples, oldest first.
+func (r *positionRing) list() []PositionSample {
+	if !r.full {
+		return append([]PositionSample(nil), r.samples[:r.next]...)
+	}
+	out := make([]PositionSample, 0, len(r.samples))
+	out = append(out, r.samples[r.next:]...)
+	return append(out, r.samples[:r.next]...)
+}
+
+// recordPosition adds a's current position to its history.
+func (t *Tracker) recordPosition(a *Aircraft, now time.Time) {
+	if t.historyDepth <= 0 {
+		return
+	}
+	if a.history == nil {
+		a.history = &positionRing{}
+	}
+	a.history.add(PositionSample{
+		Lat: a.Lat, Lon: a.Lon, Altitude: a.Altitude,
+		GroundSpeed: a.GroundSpeed, Track: a.Track, VerticalRate: a.VerticalRate,
+		At: now,
+	}, t.historyDepth)
+}
+
+// Positions returns the recent positions of icao24, oldest first, and
+// whether the aircraft is tracked. Positions from before the aircraft's
+// current flight are not included, as the tracker forgets it in between.
+func (t *Tracker) Positions(icao24 string) ([]PositionSample, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	a, ok := t.aircraft[icao24]
+	if !ok {
+		return nil, false
+	}
+	if a.history == nil {
+		return []PositionSample{}, true
+	}
+	return a.history.list(), true
+}
+
+// AllPositions returns the recent positions of every tracked aircraft that
+// has any, by ICAO address. It is meant for consumers that look at the
+// whole airspace at once, such as closest-point-of-approach checks, and
+// copies everything under one lock so the tracks are consistent.
+func (t *Tracker) AllPositions() map[string][]PositionSample {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make(map[string][]PositionSample, len(t.aircraft))
+	for icao24, a := range t.aircraft {
+		if a.history != nil {
+			out[icao24] = a.history.list()
+		}
+	}
+	return out
+}
+
+// PositionHistoryUsage reports the memory taken by position histories: the
+// aircraft that have one, the samples they hold and the bytes allocated for
+// their slots, which is what the depth costs whether or not they are full.
+type PositionHistoryUsage struct {
+	Depth    int `json:"depth"`
+	Aircraft int `json:"aircraft"`
+	Samples  int `json:"samples"`
+	Bytes    int `json:"bytes"`
+}
+
+// HistoryUsage returns the memory taken by position histories.
+func (t *Tracker) HistoryUsage() PositionHistoryUsage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	u := PositionHistoryUsage{Depth: t.historyDepth}
+	for _, a := range t.aircraft {
+		if a.history == nil {
+			continue
+		}
+		u.Aircraft++
+		if a.history.full {
+			u.Samples += len(a.history.samples)
+		} else {
+			u.Samples += a.history.next
+		}
+		u.Bytes += len(a.history.samples)*positionSampleSize + int(unsafe.Sizeof(positionRing{}))
+	}
+	return u
+}
+
+// aircraftPositions is returned by GET /aircraft/{icao24}/positions and, for
+// every aircraft, by GET /positions.
+type aircraftPositions struct {
+	Icao24    string           `json:"icao24"`
+	Positions []PositionSample `json:"positions"`
+}
+
+// sortedPositions turns AllPositions into a list ordered by ICAO address.
+func sortedPositions(all map[string][]PositionSample) []aircraftPositions {
+	out := make([]aircraftPositions, 0, len(all))
+	for icao24, positions := range all {
+		out = append(out, aircraftPositions{Icao24: icao24, Positions: positions})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Icao24 < out[j].Icao24 })
+	return out
+}
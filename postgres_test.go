@@ -0,0 +1,197 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+// pgSession is what a fake PostgreSQL server received.
+type pgSession struct {
+	user, password string
+	queries        []string
+	copied         string
+}
+
+// fakePostgres serves one session, asking for a clear text password and
+// accepting only secret. It answers the query for TimescaleDB with a row
+// when timescale, and a COPY with copyErr when set.
+func fakePostgres(t *testing.T, timescale bool, copyErr string) (url string, session <-chan pgSession) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	ch := make(chan pgSession, 1)
+	go func() {
+		var got pgSession
+		defer func() { ch <- got }()
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		b := pgproto3.NewBackend(conn, conn)
+
+		startup, err := b.ReceiveStartupMessage()
+		if err != nil {
+			return
+		}
+		if m, ok := startup.(*pgproto3.StartupMessage); ok {
+			got.user = m.Parameters["user"]
+		}
+		b.Send(&pgproto3.AuthenticationCleartextPassword{})
+		if b.Flush() != nil || b.SetAuthType(pgproto3.AuthTypeCleartextPassword) != nil {
+			return
+		}
+		msg, err := b.Receive()
+		if err != nil {
+			return
+		}
+		if m, ok := msg.(*pgproto3.PasswordMessage); ok {
+			got.password = m.Password
+		}
+		if got.password != "secret" {
+			b.Send(&pgproto3.ErrorResponse{Severity: "FATAL", Code: "28P01", Message: `password authentication failed for user "adsb"`})
+			b.Flush()
+			return
+		}
+		b.Send(&pgproto3.AuthenticationOk{})
+		b.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+		b.Flush()
+
+		for {
+			msg, err := b.Receive()
+			if err != nil {
+				return
+			}
+			switch m := msg.(type) {
+			case *pgproto3.Terminate:
+				return
+			case *pgproto3.Query:
+				got.queries = append(got.queries, m.String)
+				switch {
+				case strings.HasPrefix(m.String, "COPY"):
+					b.Send(&pgproto3.CopyInResponse{ColumnFormatCodes: make([]uint16, 17)})
+					b.Flush()
+					for done := false; !done; {
+						msg, err := b.Receive()
+						if err != nil {
+							return
+						}
+						switch m := msg.(type) {
+						case *pgproto3.CopyData:
+							got.copied += string(m.Data)
+						case *pgproto3.CopyDone, *pgproto3.CopyFail:
+							done = true
+						}
+					}
+					if copyErr != "" {
+						b.Send(&pgproto3.ErrorResponse{Severity: "ERROR", Code: "42703", Message: copyErr})
+					} else {
+						b.Send(&pgproto3.CommandComplete{CommandTag: []byte("COPY 1")})
+					}
+				case strings.Contains(m.String, "pg_extension"):
+					b.Send(&pgproto3.RowDescription{Fields: []pgproto3.FieldDescription{{Name: []byte("?column?"), DataTypeOID: 23, DataTypeSize: 4, TypeModifier: -1}}})
+					tag := "SELECT 0"
+					if timescale {
+						b.Send(&pgproto3.DataRow{Values: [][]byte{[]byte("1")}})
+						tag = "SELECT 1"
+					}
+					b.Send(&pgproto3.CommandComplete{CommandTag: []byte(tag)})
+				default:
+					b.Send(&pgproto3.CommandComplete{CommandTag: []byte("CREATE")})
+				}
+				b.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+				b.Flush()
+			}
+		}
+	}()
+	return "postgres://adsb:secret@" + ln.Addr().String() + "/adsb?sslmode=disable", ch
+}
+
+// testPostgresSink is a sink that only writes when told to.
+func testPostgresSink(t *testing.T, url string) *postgresSink {
+	t.Helper()
+	config, err := parsePostgresURL(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newPostgresSink(config, "adsb_messages", time.Hour)
+}
+
+func TestPostgresSink(t *testing.T) {
+	msg := SBS1Message{
+		Timestamp:   formatTimestamp(time.Date(2026, 10, 16, 10, 0, 0, 0, time.UTC)),
+		MessageType: "MSG", TransmissionType: 3, Icao24: "4ca2d6", Callsign: "EIN\t1",
+		Altitude: 35000, Lat: 53.1, Lon: -6.2,
+	}
+
+	for _, timescale := range []bool{false, true} {
+		url, session := fakePostgres(t, timescale, "")
+		s := testPostgresSink(t, url)
+		unsent, err := s.write([]SBS1Message{msg})
+		if err != nil || len(unsent) > 0 {
+			t.Fatalf("write left %d messages: %v", len(unsent), err)
+		}
+		s.Close()
+		got := <-session
+
+		if got.user != "adsb" || got.password != "secret" {
+			t.Errorf("logged in as %q with %q", got.user, got.password)
+		}
+		index := "CREATE INDEX IF NOT EXISTS adsb_messages_time ON adsb_messages (time DESC)"
+		if timescale {
+			index = "SELECT create_hypertable('adsb_messages', 'time', if_not_exists => TRUE)"
+		}
+		if len(got.queries) != 4 || !strings.HasPrefix(got.queries[0], "CREATE TABLE IF NOT EXISTS adsb_messages (") || got.queries[2] != index ||
+			got.queries[3] != "COPY adsb_messages ("+postgresColumns+") FROM STDIN" {
+			t.Errorf("timescale %v: queries %q", timescale, got.queries)
+		}
+		row := strings.Split(strings.TrimSuffix(got.copied, "\n"), "\t")
+		if len(row) != 17 || row[0] != "2026-10-16T10:00:00.000Z" || row[1] != "4ca2d6" || row[2] != `EIN\t1` ||
+			row[5] != "35000" || row[6] != `\N` || row[9] != "53.1" || row[12] != "f" || !strings.HasPrefix(row[16], `{"`) {
+			t.Errorf("copied %q", got.copied)
+		}
+	}
+}
+
+func TestPostgresErrors(t *testing.T) {
+	url, _ := fakePostgres(t, false, "")
+	s := testPostgresSink(t, strings.Replace(url, ":secret@", ":wrong@", 1))
+	defer s.Close()
+	msgs := []SBS1Message{{MessageType: "MSG", Icao24: "4ca2d6"}}
+	unsent, err := s.write(msgs)
+	if errorKindOf(err) != errAuth || len(unsent) != 1 {
+		t.Errorf("wrong password: %d unsent, error %v of kind %s", len(unsent), err, errorKindOf(err))
+	}
+
+	url, session := fakePostgres(t, false, `column "squawk" of relation "adsb_messages" does not exist`)
+	s = testPostgresSink(t, url)
+	unsent, err = s.write(msgs)
+	if err == nil || !strings.Contains(err.Error(), "does not exist") || len(unsent) != 1 {
+		t.Errorf("failed COPY: %d unsent, error %v", len(unsent), err)
+	}
+	if s.conn != nil {
+		t.Error("connection kept after a failed COPY")
+	}
+	s.Close()
+	<-session
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	s = testPostgresSink(t, "postgres://adsb:secret@"+addr+"/adsb?sslmode=disable")
+	defer s.Close()
+	if _, err := s.write(msgs); errorKindOf(err) != errConnect {
+		t.Errorf("closed port: error %v of kind %s", err, errorKindOf(err))
+	}
+}
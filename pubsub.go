@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	// pubsubPendingMax bounds the messages waiting to be published, which
+	// includes those kept for a retry while Pub/Sub is unreachable.
+	pubsubPendingMax = 100000
+	// pubsubBatchMax is the most messages Pub/Sub takes in one publish
+	// request.
+	pubsubBatchMax = 1000
+	// pubsubScope is the OAuth2 scope publishing needs.
+	pubsubScope = "https://www.googleapis.com/auth/pubsub"
+)
+
+// pubsubTopicName matches the full resource name of a topic.
+var pubsubTopicName = regexp.MustCompile(`^projects/[a-z][a-z0-9-]{4,28}[a-z0-9]/topics/[A-Za-z][A-Za-z0-9._~%+-]{2,254}$`)
+
+// pubsubSink publishes every decoded aircraft message to a Google Cloud
+// Pub/Sub topic every interval, in requests of up to batchSize messages,
+// as the message's JSON with the ICAO address as ordering key. Requests are
+// sent one at a time and a batch that fails is kept and published again
+// before anything queued since, so a subscription with message ordering
+// receives each aircraft's messages in order.
+type pubsubSink struct {
+	*batchSink
+	topic    string
+	endpoint string
+	// token is nil for the emulator, which takes no credentials.
+	token     *gcpToken
+	batchSize int
+	client    *http.Client
+}
+
+// newPubSubSink starts publishing in the background. Without credentials,
+// tokens come from the metadata server, unless endpoint is set, which is
+// then taken to be the emulator.
+func newPubSubSink(topic, credentials, endpoint string, batchSize int, interval time.Duration) (*pubsubSink, error) {
+	s := &pubsubSink{
+		topic: topic, endpoint: strings.TrimSuffix(endpoint, "/"),
+		batchSize: batchSize, client: withChaos("pubsub", newHTTPClient()),
+	}
+	if s.endpoint == "" {
+		s.endpoint = "https://pubsub.googleapis.com"
+	}
+	if credentials != "" || endpoint == "" {
+		var err error
+		if s.token, err = newGCPToken(credentials, pubsubScope, newHTTPClient()); err != nil {
+			return nil, fmt.Errorf("pubsub_credentials: %w", err)
+		}
+	}
+	s.batchSink = newBatchSink("pubsub", "Pub/Sub", topic, pubsubPendingMax, interval, s.write)
+	return s, nil
+}
+
+// write publishes msgs in requests of up to batchSize, stopping at the
+// first that fails, and returns the messages not published.
+func (s *pubsubSink) write(msgs []SBS1Message) ([]SBS1Message, error) {
+	for len(msgs) > 0 {
+		n := len(msgs)
+		if n > s.batchSize {
+			n = s.batchSize
+		}
+		if err := s.publish(msgs[:n]); err != nil {
+			return msgs, err
+		}
+		metricSinkEvents.Add("pubsub", float64(n))
+		msgs = msgs[n:]
+	}
+	return nil, nil
+}
+
+// pubsubMessage is a message of a publish request.
+type pubsubMessage struct {
+	Data        []byte            `json:"data"`
+	OrderingKey string            `json:"orderingKey,omitempty"`
+	Attributes  map[string]string `json:"attributes"`
+}
+
+// publish sends msgs in one publish request. Messages without an ICAO
+// address, such as those of the collector itself, have no ordering key.
+func (s *pubsubSink) publish(msgs []SBS1Message) error {
+	messages := make([]pubsubMessage, len(msgs))
+	for i, msg := range msgs {
+		data, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		messages[i] = pubsubMessage{
+			Data:        data,
+			OrderingKey: strings.ToLower(msg.Icao24),
+			Attributes:  map[string]string{"event_id": eventID(msg), "message_type": msg.MessageType},
+		}
+		if msg.Icao24 != "" {
+			messages[i].Attributes["icao24"] = msg.Icao24
+		}
+	}
+	body, err := json.Marshal(map[string][]pubsubMessage{"messages": messages})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.endpoint+"/v1/"+s.topic+":publish", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.token != nil {
+		if err := s.token.authorize(req); err != nil {
+			return err
+		}
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		// Errors carry {"error": {"code": ..., "message": ..., "status": ...}}.
+		var reply struct {
+			Error struct {
+				Message string `json:"message"`
+				Status  string `json:"status"`
+			} `json:"error"`
+		}
+		err := fmt.Errorf("Pub/Sub returned %s", resp.Status)
+		if json.Unmarshal(data, &reply) == nil && reply.Error.Status != "" {
+			err = fmt.Errorf("Pub/Sub returned %s: %s: %s", resp.Status, reply.Error.Status, reply.Error.Message)
+		}
+		if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+			return newError(errAuth, err)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// queryDB runs SQL for the query command.
+type queryDB interface {
+	// Query runs the statements in query and calls row for each row they
+	// return.
+	Query(query string, row func(columns []string, values []interface{}) error) error
+	Close() error
+}
+
+// queryViews are the views both engines offer over messages besides
+// flights, which each engine defines: every position.
+const queryViews = `
+CREATE TEMP VIEW positions AS
+SELECT time, icao24, callsign, flight_uuid, altitude, ground_speed, track, vertical_rate, lat, lon, on_ground, receiver
+FROM messages WHERE lat IS NOT NULL;
+`
+
+// queryFlightsOfDays merges the flights tables of several days, %s, as a
+// flight crossing midnight has a row in each.
+const queryFlightsOfDays = `CREATE TEMP VIEW flights AS
+SELECT flight_uuid, max(icao24) AS icao24, max(callsign) AS callsign, min(first_seen) AS first_seen, max(last_seen) AS last_seen,
+	max(max_altitude) AS max_altitude, sum(messages) AS messages, sum(positions) AS positions
+FROM (%s) GROUP BY flight_uuid`
+
+// queryCommand runs SQL over local archives: the daily SQLite archives of
+// sqlite_dir, or with DuckDB the NDJSON and Parquet files of a directory.
+func queryCommand() *cli.Command {
+	return &cli.Command{
+		Name:      "query",
+		Usage:     "Run SQL over local archives, in the views 'messages', 'positions' and 'flights'.",
+		ArgsUsage: "SQL",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "engine",
+				Value: "sqlite",
+				Usage: "'sqlite' to query the daily SQLite archives, or 'duckdb' to query NDJSON message files, such as spooled batches or dead letters, and Parquet files as the S3 sink writes them.",
+			},
+			&cli.StringFlag{
+				Name:  "dir",
+				Usage: "The directory of the archives. Defaults to sqlite_dir with the sqlite engine.",
+			},
+			&cli.StringFlag{
+				Name:  "from",
+				Usage: "The first UTC day to query, as YYYY-MM-DD. Defaults to --to with the sqlite engine, and to the first day archived with duckdb.",
+			},
+			&cli.StringFlag{
+				Name:  "to",
+				Usage: "The last UTC day to query, as YYYY-MM-DD. Defaults to the latest day archived.",
+			},
+			&cli.BoolFlag{
+				Name:  "csv",
+				Usage: "Print the rows as CSV with a header instead of a table.",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if c.NArg() != 1 {
+				return configErrorf("give the SQL to run as one argument, e.g. query \"SELECT count(*) FROM messages\"")
+			}
+			var db queryDB
+			var err error
+			switch c.String("engine") {
+			case "sqlite":
+				db, err = openSQLiteQuery(c.String("dir"), c.String("from"), c.String("to"))
+			case "duckdb":
+				db, err = openDuckDBQuery(c.String("dir"), c.String("from"), c.String("to"))
+			default:
+				return configErrorf("unknown --engine %q, expected 'sqlite' or 'duckdb'", c.String("engine"))
+			}
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+			if err := db.Query(queryViews, func([]string, []interface{}) error { return nil }); err != nil {
+				return err
+			}
+			if c.Bool("csv") {
+				return queryCSV(db, c.Args().First(), os.Stdout)
+			}
+			return queryTable(db, c.Args().First(), os.Stdout)
+		},
+	}
+}
+
+// openSQLiteQuery attaches the SQLite archives of the days from from to to.
+func openSQLiteQuery(dir, from, to string) (queryDB, error) {
+	if !sqliteSupported {
+		return nil, configErrorf("query needs a build with SQLite: go build -tags sqlite")
+	}
+	if dir == "" {
+		dir = SQLITE_DIR
+	}
+	if dir == "" {
+		return nil, configErrorf("no archive directory given. Use --dir or set sqlite_dir")
+	}
+	files, err := queryDays(dir, from, to)
+	if err != nil {
+		return nil, err
+	}
+	db, err := openSQLite(":memory:")
+	if err != nil {
+		return nil, err
+	}
+	if err := attachDays(db, files); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// duckdbColumns are the message fields DuckDB reads from NDJSON files;
+// the rest are left out.
+const duckdbColumns = `{timestamp: 'VARCHAR', message_type: 'VARCHAR', transmission_type: 'INTEGER',
+	icao24: 'VARCHAR', callsign: 'VARCHAR', altitude: 'INTEGER', ground_speed: 'DOUBLE', track: 'DOUBLE',
+	vertical_rate: 'INTEGER', lat: 'DOUBLE', lon: 'DOUBLE', squawk: 'INTEGER', emergency: 'BOOLEAN',
+	on_ground: 'BOOLEAN', receiver: 'VARCHAR', flight_uuid: 'VARCHAR'}`
+
+// duckdbMessageColumns are the columns of messages with the DuckDB engine:
+// those of the SQLite archives without message.
+const duckdbMessageColumns = "time, icao24, callsign, message_type, transmission_type, altitude, ground_speed, track, vertical_rate, lat, lon, squawk, on_ground, emergency, receiver, flight_uuid"
+
+// openDuckDBQuery reads the NDJSON message files in dir and the Parquet
+// files in and below it, such as a copy of what the S3 sink wrote, into
+// the messages view, limited to the days from from to to if given.
+func openDuckDBQuery(dir, from, to string) (queryDB, error) {
+	if !duckdbSupported {
+		return nil, configErrorf("query --engine duckdb needs a build with DuckDB: go build -tags duckdb")
+	}
+	if dir == "" {
+		return nil, configErrorf("no directory given. Use --dir with the directory of the NDJSON or Parquet files")
+	}
+	var sources []string
+	if names, _ := filepath.Glob(filepath.Join(dir, "*.ndjson")); len(names) > 0 {
+		sources = append(sources, `SELECT make_timestamp(CAST(timestamp AS BIGINT) // 1000) AS time, icao24, callsign, message_type,
+	transmission_type, altitude, ground_speed, track, vertical_rate, lat, lon, lpad(CAST(squawk AS VARCHAR), 4, '0') AS squawk,
+	coalesce(on_ground, false) AS on_ground, coalesce(emergency, false) AS emergency, receiver, flight_uuid
+FROM read_json(`+sqlQuote(filepath.Join(dir, "*.ndjson"))+`, format = 'newline_delimited', columns = `+duckdbColumns+`)`)
+	}
+	parquet := false
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() && strings.HasSuffix(path, ".parquet") {
+			parquet = true
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	if parquet {
+		sources = append(sources, "SELECT "+strings.Replace(duckdbMessageColumns, "time", "CAST(time AS TIMESTAMP) AS time", 1)+
+			" FROM read_parquet("+sqlQuote(filepath.Join(dir, "**", "*.parquet"))+", union_by_name = true)")
+	}
+	if len(sources) == 0 {
+		return nil, configErrorf("%s holds no .ndjson or .parquet files", dir)
+	}
+
+	var where []string
+	for _, bound := range []struct{ flag, value, op string }{{"from", from, ">="}, {"to", to, "<"}} {
+		if bound.value == "" {
+			continue
+		}
+		day, err := time.Parse("2006-01-02", bound.value)
+		if err != nil {
+			return nil, configErrorf("invalid --%s %q, expected YYYY-MM-DD", bound.flag, bound.value)
+		}
+		if bound.flag == "to" {
+			day = day.AddDate(0, 0, 1)
+		}
+		where = append(where, fmt.Sprintf("time %s TIMESTAMP '%s'", bound.op, day.Format("2006-01-02")))
+	}
+	view := "CREATE TEMP VIEW messages AS SELECT * FROM (" + strings.Join(sources, " UNION ALL BY NAME ") + ")"
+	if len(where) > 0 {
+		view += " WHERE " + strings.Join(where, " AND ")
+	}
+	view += ";\nCREATE TEMP VIEW flights AS " + sqliteFlightsOfMessages + " GROUP BY flight_uuid"
+
+	db, err := openDuckDB()
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Query(view, func([]string, []interface{}) error { return nil }); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// queryDays returns the archive files of the days from from to to that
+// exist in dir.
+func queryDays(dir, from, to string) ([]string, error) {
+	var last time.Time
+	if to != "" {
+		t, err := time.Parse("2006-01-02", to)
+		if err != nil {
+			return nil, configErrorf("invalid --to %q, expected YYYY-MM-DD", to)
+		}
+		last = t
+	} else {
+		names, err := filepath.Glob(filepath.Join(dir, "adsb-????????.db"))
+		if err != nil {
+			return nil, err
+		}
+		if len(names) == 0 {
+			return nil, configErrorf("%s holds no SQLite archives", dir)
+		}
+		sort.Strings(names)
+		last, err = time.Parse("20060102", strings.TrimSuffix(strings.TrimPrefix(filepath.Base(names[len(names)-1]), "adsb-"), ".db"))
+		if err != nil {
+			return nil, err
+		}
+	}
+	first := last
+	if from != "" {
+		t, err := time.Parse("2006-01-02", from)
+		if err != nil {
+			return nil, configErrorf("invalid --from %q, expected YYYY-MM-DD", from)
+		}
+		first = t
+	}
+	if first.After(last) {
+		return nil, configErrorf("--from %s is after --to %s", first.Format("2006-01-02"), last.Format("2006-01-02"))
+	}
+
+	var files []string
+	for day := first; !day.After(last); day = day.AddDate(0, 0, 1) {
+		path := filepath.Join(dir, sqliteDayFile(day))
+		if _, err := os.Stat(path); err == nil {
+			files = append(files, path)
+		}
+	}
+	if len(files) == 0 {
+		return nil, configErrorf("%s holds no SQLite archives from %s to %s", dir, first.Format("2006-01-02"), last.Format("2006-01-02"))
+	}
+	return files, nil
+}
+
+// attachDays makes the messages of files available as the temporary view
+// messages, and their flights as the view flights. Each file is attached read-only as d<YYYYMMDD>, so a single
+// day can also be queried as d20261016.messages. When there are more days
+// than SQLite can attach, they are instead copied one by one into a
+// temporary table, which is slower and needs temporary disk space.
+func attachDays(db sqliteDB, files []string) error {
+	schema := func(path string) string {
+		return "d" + strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), "adsb-"), ".db")
+	}
+	attach := func(path string) error {
+		uri := "file:" + filepath.ToSlash(path) + "?mode=ro"
+		return db.Exec(fmt.Sprintf("ATTACH DATABASE %s AS %s", sqlQuote(uri), schema(path)))
+	}
+
+	if len(files) <= db.MaxAttached() {
+		var selects, flights []string
+		for _, path := range files {
+			if err := attach(path); err != nil {
+				return fmt.Errorf("attaching %s: %w", path, err)
+			}
+			selects = append(selects, "SELECT * FROM "+schema(path)+".messages")
+			flights = append(flights, dayFlights(db, schema(path)))
+		}
+		if err := db.Exec("CREATE TEMP VIEW messages AS " + strings.Join(selects, " UNION ALL ")); err != nil {
+			return err
+		}
+		return db.Exec(fmt.Sprintf(queryFlightsOfDays, strings.Join(flights, " UNION ALL ")))
+	}
+
+	fmt.Fprintf(os.Stderr, "Copying %d days into a temporary table, as this SQLite attaches at most %d databases\n", len(files), db.MaxAttached())
+	for i, path := range files {
+		if err := attach(path); err != nil {
+			return fmt.Errorf("attaching %s: %w", path, err)
+		}
+		stmts := []string{
+			"INSERT INTO temp.messages SELECT * FROM " + schema(path) + ".messages",
+			"INSERT INTO temp.flights_by_day " + dayFlights(db, schema(path)),
+		}
+		if i == 0 {
+			stmts = []string{
+				"CREATE TEMP TABLE messages AS SELECT * FROM " + schema(path) + ".messages",
+				"CREATE TEMP TABLE flights_by_day AS " + dayFlights(db, schema(path)),
+			}
+		}
+		for _, stmt := range stmts {
+			if err := db.Exec(stmt); err != nil {
+				return fmt.Errorf("copying %s: %w", path, err)
+			}
+		}
+		if err := db.Exec("DETACH DATABASE " + schema(path)); err != nil {
+			return err
+		}
+	}
+	return db.Exec(fmt.Sprintf(queryFlightsOfDays, "SELECT * FROM temp.flights_by_day"))
+}
+
+// dayFlights selects the flights of the attached day schema, from its
+// messages if its file was last written before it had a flights table.
+func dayFlights(db sqliteDB, schema string) string {
+	found := false
+	db.Query("SELECT 1 FROM "+schema+".sqlite_master WHERE type = 'table' AND name = 'flights'", func([]string, []interface{}) error {
+		found = true
+		return nil
+	})
+	if found {
+		return "SELECT * FROM " + schema + ".flights"
+	}
+	return strings.Replace(sqliteFlightsOfMessages, "FROM messages", "FROM "+schema+".messages", 1) + " GROUP BY flight_uuid"
+}
+
+// sqlQuote quotes s as an SQL string literal.
+func sqlQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// queryValue renders a column value; NULL is empty.
+func queryValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case []byte:
+		return fmt.Sprintf("%x", v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// queryTable prints the rows as a table, with a header for each
+// statement that returns rows.
+func queryTable(db queryDB, query string, w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	var header []string
+	rows := 0
+	err := db.Query(query, func(columns []string, values []interface{}) error {
+		if rows == 0 || !sameColumns(header, columns) {
+			if rows > 0 {
+				fmt.Fprintln(tw)
+			}
+			header = columns
+			fmt.Fprintln(tw, strings.Join(columns, "\t"))
+		}
+		rows++
+		cells := make([]string, len(values))
+		for i, v := range values {
+			cells[i] = queryValue(v)
+		}
+		fmt.Fprintln(tw, strings.Join(cells, "\t"))
+		return nil
+	})
+	if ferr := tw.Flush(); err == nil {
+		err = ferr
+	}
+	return err
+}
+
+// queryCSV prints the rows as CSV, with a header for each statement that
+// returns rows.
+func queryCSV(db queryDB, query string, w io.Writer) error {
+	cw := csv.NewWriter(w)
+	var header []string
+	err := db.Query(query, func(columns []string, values []interface{}) error {
+		if header == nil || !sameColumns(header, columns) {
+			header = columns
+			if err := cw.Write(columns); err != nil {
+				return err
+			}
+		}
+		cells := make([]string, len(values))
+		for i, v := range values {
+			cells[i] = queryValue(v)
+		}
+		return cw.Write(cells)
+	})
+	cw.Flush()
+	if err == nil {
+		err = cw.Error()
+	}
+	return err
+}
+
+func sameColumns(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// ReceiverStats is a periodic receiver-performance event built from the
+// decoder's stats.json, so RF health is stored next to the traffic.
+type ReceiverStats struct {
+	Period              float64  `json:"period"`
+	Messages            int      `json:"messages"`
+	ModeS               int      `json:"modes"`
+	ModeAC              int      `json:"modeac,omitempty"`
+	Bad                 int      `json:"bad"`
+	UnknownICAO         int      `json:"unknown_icao"`
+	Accepted            int      `json:"accepted"`
+	SamplesDropped      int64    `json:"samples_dropped,omitempty"`
+	Signal              *float64 `json:"signal,omitempty"`
+	Noise               *float64 `json:"noise,omitempty"`
+	PeakSignal          *float64 `json:"peak_signal,omitempty"`
+	StrongSignals       int      `json:"strong_signals"`
+	StrongSignalPercent float64  `json:"strong_signal_percent"`
+	Tracks              int      `json:"tracks"`
+	SingleMessageTracks int      `json:"single_message_tracks"`
+	Gain                *float64 `json:"gain_db,omitempty"`
+	ConfiguredGain      string   `json:"configured_gain,omitempty"`
+	Antenna             string   `json:"antenna,omitempty"`
+}
+
+// decoderStats is the part of a dump1090-fa or readsb stats.json we use.
+type decoderStats struct {
+	GainDB   *float64 `json:"gain_db"`
+	Last1Min struct {
+		Start    float64 `json:"start"`
+		End      float64 `json:"end"`
+		Messages int     `json:"messages"`
+		Local    struct {
+			SamplesDropped int64    `json:"samples_dropped"`
+			ModeAC         int      `json:"modeac"`
+			ModeS          int      `json:"modes"`
+			Bad            int      `json:"bad"`
+			UnknownICAO    int      `json:"unknown_icao"`
+			Accepted       []int    `json:"accepted"`
+			Signal         *float64 `json:"signal"`
+			Noise          *float64 `json:"noise"`
+			PeakSignal     *float64 `json:"peak_signal"`
+			StrongSignals  int      `json:"strong_signals"`
+			GainDB         *float64 `json:"gain_db"`
+		} `json:"local"`
+		Tracks struct {
+			All           int `json:"all"`
+			SingleMessage int `json:"single_message"`
+		} `json:"tracks"`
+	} `json:"last1min"`
+}
+
+// statsScraper reads the decoder's stats.json once per interval and turns
+// each new one-minute period into a STATS event.
+type statsScraper struct {
+	source  string
+	client  *http.Client
+	lastEnd float64
+}
+
+// newStatsScraper creates a scraper for an http(s) URL or a local file.
+func newStatsScraper(source string) *statsScraper {
+	return &statsScraper{source: source, client: newHTTPClient()}
+}
+
+// Run scrapes every interval and sends events to out until done is closed.
+func (s *statsScraper) Run(interval time.Duration, out chan<- SBS1Message, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			msg, ok, err := s.Scrape()
+			if err != nil {
+				log.Println("Error reading receiver stats:", err)
+				continue
+			}
+			if ok {
+				select {
+				case out <- msg:
+				case <-done:
+					return
+				}
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// Scrape reads the stats once. It reports false when the decoder has not
+// completed a new period since the last scrape.
+func (s *statsScraper) Scrape() (SBS1Message, bool, error) {
+	data, err := s.read()
+	if err != nil {
+		return SBS1Message{}, false, err
+	}
+	var stats decoderStats
+	if err := json.Unmarshal(data, &stats); err != nil {
+		return SBS1Message{}, false, fmt.Errorf("decoding %s: %w", s.source, err)
+	}
+	period := stats.Last1Min
+	if period.End == 0 || period.End == s.lastEnd {
+		return SBS1Message{}, false, nil
+	}
+	s.lastEnd = period.End
+
+	rs := &ReceiverStats{
+		Period:              period.End - period.Start,
+		Messages:            period.Messages,
+		ModeS:               period.Local.ModeS,
+		ModeAC:              period.Local.ModeAC,
+		Bad:                 period.Local.Bad,
+		UnknownICAO:         period.Local.UnknownICAO,
+		SamplesDropped:      period.Local.SamplesDropped,
+		Signal:              period.Local.Signal,
+		Noise:               period.Local.Noise,
+		PeakSignal:          period.Local.PeakSignal,
+		StrongSignals:       period.Local.StrongSignals,
+		Tracks:              period.Tracks.All,
+		SingleMessageTracks: period.Tracks.SingleMessage,
+		Gain:                period.Local.GainDB,
+		ConfiguredGain:      SDR_GAIN,
+		Antenna:             ANTENNA,
+	}
+	if rs.Gain == nil {
+		rs.Gain = stats.GainDB
+	}
+	for _, n := range period.Local.Accepted {
+		rs.Accepted += n
+	}
+	if rs.Accepted > 0 {
+		rs.StrongSignalPercent = float64(rs.StrongSignals) * 100 / float64(rs.Accepted)
+	}
+
+	end := time.Unix(0, int64(period.End*float64(time.Second)))
+	return SBS1Message{Timestamp: formatTimestamp(end), MessageType: "STATS", ReceiverStats: rs}, true, nil
+}
+
+func (s *statsScraper) read() ([]byte, error) {
+	if !strings.HasPrefix(s.source, "http://") && !strings.HasPrefix(s.source, "https://") {
+		return os.ReadFile(s.source)
+	}
+	res, err := s.client.Get(s.source)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", s.source, res.Status)
+	}
+	return io.ReadAll(res.Body)
+}
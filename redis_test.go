@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is a Redis server speaking RESP2 that answers what the sink
+// sends, accepting only password, and keeps the entries of the
+// transactions it ran.
+type fakeRedis struct {
+	ln       net.Listener
+	password string
+	// execErr is the error each XADD gives when its transaction runs.
+	execErr string
+
+	mu       sync.Mutex
+	commands []string
+	entries  [][]string
+	conns    []net.Conn
+}
+
+// startFakeRedis listens on addr, such as 127.0.0.1:0.
+func startFakeRedis(t *testing.T, addr, password, execErr string) *fakeRedis {
+	t.Helper()
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{ln: ln, password: password, execErr: execErr}
+	t.Cleanup(f.stop)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.conns = append(f.conns, conn)
+			f.mu.Unlock()
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+// stop closes the listener and every connection.
+func (f *fakeRedis) stop() {
+	f.ln.Close()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, conn := range f.conns {
+		conn.Close()
+	}
+}
+
+// url is where the sink finds the server, with user and password.
+func (f *fakeRedis) url(user, password string, db int) string {
+	return fmt.Sprintf("redis://%s:%s@%s/%d", user, password, f.ln.Addr(), db)
+}
+
+// sent returns the commands received, with their names upper-cased.
+func (f *fakeRedis) sent() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.commands...)
+}
+
+// stored returns the arguments of the XADDs that ran.
+func (f *fakeRedis) stored() [][]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([][]string(nil), f.entries...)
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	var queued [][]string
+	for {
+		args, err := readRedisCommand(r)
+		if err != nil {
+			return
+		}
+		name := strings.ToUpper(args[0])
+		f.mu.Lock()
+		f.commands = append(f.commands, strings.Join(append([]string{name}, args[1:]...), " "))
+		f.mu.Unlock()
+
+		reply := "+OK\r\n"
+		switch name {
+		case "HELLO":
+			// Servers before Redis 6 do not know HELLO.
+			reply = "-ERR unknown command 'HELLO'\r\n"
+		case "AUTH":
+			if args[len(args)-1] != f.password {
+				reply = "-WRONGPASS invalid username-password pair or user is disabled.\r\n"
+			}
+		case "SELECT", "MULTI":
+		case "XADD":
+			queued = append(queued, args)
+			reply = "+QUEUED\r\n"
+		case "EXEC":
+			reply = fmt.Sprintf("*%d\r\n", len(queued))
+			f.mu.Lock()
+			for _, args := range queued {
+				if f.execErr != "" {
+					reply += "-" + f.execErr + "\r\n"
+					continue
+				}
+				f.entries = append(f.entries, args)
+				id := fmt.Sprintf("1760608800000-%d", len(f.entries))
+				reply += fmt.Sprintf("$%d\r\n%s\r\n", len(id), id)
+			}
+			f.mu.Unlock()
+			queued = nil
+		default:
+			reply = fmt.Sprintf("-ERR unknown command '%s'\r\n", args[0])
+		}
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+// readRedisCommand reads a command sent as an array of bulk strings.
+func readRedisCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("not a command: %q", line)
+	}
+	args := make([]string, n)
+	for i := range args {
+		if line, err = r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, fmt.Errorf("not a bulk string: %q", line)
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		args[i] = string(data[:size])
+	}
+	return args, nil
+}
+
+// testRedisSink is a sink that only writes when flushed.
+func testRedisSink(t *testing.T, url string, maxLen int, exact bool) *redisSink {
+	t.Helper()
+	config, err := parseRedisURL(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newRedisSink(config, "adsb", maxLen, exact, time.Hour)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestRedisSink(t *testing.T) {
+	msgs := []SBS1Message{
+		{MessageType: "MSG", TransmissionType: 3, Icao24: "4ca2d6", Altitude: 35000},
+		{MessageType: "MSG", TransmissionType: 1, Icao24: "a1b2c3", Callsign: "EIN123"},
+	}
+	tests := []struct {
+		name   string
+		maxLen int
+		exact  bool
+		trim   string
+	}{
+		{"approximate", 1000, false, "maxlen ~ 1000 "},
+		{"exact", 1000, true, "maxlen 1000 "},
+		{"untrimmed", 0, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := startFakeRedis(t, "127.0.0.1:0", "secret", "")
+			s := testRedisSink(t, f.url("adsb", "secret", 2), tt.maxLen, tt.exact)
+			for _, msg := range msgs {
+				s.Add(msg)
+			}
+			if err := s.Flush(); err != nil {
+				t.Fatal(err)
+			}
+
+			sent := f.sent()
+			want := []string{"AUTH adsb secret", "SELECT 2", "MULTI", "XADD", "XADD", "EXEC"}
+			if len(sent) != len(want)+1 || !strings.HasPrefix(sent[0], "HELLO") {
+				t.Fatalf("sent %q", sent)
+			}
+			for i, w := range want {
+				if !strings.HasPrefix(sent[i+1], w) {
+					t.Errorf("command %d is %q, want %s", i+1, sent[i+1], w)
+				}
+			}
+			entries := f.stored()
+			if len(entries) != len(msgs) {
+				t.Fatalf("stored %d entries, want %d", len(entries), len(msgs))
+			}
+			for i, args := range entries {
+				prefix := "xadd adsb " + tt.trim + "* event "
+				if got := strings.Join(args, " "); !strings.HasPrefix(got, prefix) {
+					t.Errorf("entry %d added with %q, want it to start %q", i, got, prefix)
+				}
+				fields := args[len(args)-8:]
+				var event SBS1Message
+				if err := json.Unmarshal([]byte(fields[1]), &event); err != nil || event.Icao24 != msgs[i].Icao24 {
+					t.Errorf("entry %d holds %q: %v", i, fields[1], err)
+				}
+				if fields[2] != "event_id" || fields[3] != eventID(msgs[i]) || fields[5] != "MSG" || fields[7] != msgs[i].Icao24 {
+					t.Errorf("entry %d fields %q", i, fields)
+				}
+			}
+		})
+	}
+}
+
+func TestRedisErrors(t *testing.T) {
+	msg := SBS1Message{MessageType: "MSG", TransmissionType: 3, Icao24: "4ca2d6"}
+
+	f := startFakeRedis(t, "127.0.0.1:0", "secret", "")
+	s := testRedisSink(t, f.url("adsb", "wrong", 0), 0, false)
+	s.Add(msg)
+	if err := s.Flush(); errorKindOf(err) != errAuth || len(s.pending) != 1 {
+		t.Errorf("wrong password: %d pending, error %v of kind %s", len(s.pending), err, errorKindOf(err))
+	}
+
+	// An error running a command fails the batch, which is kept.
+	f = startFakeRedis(t, "127.0.0.1:0", "secret", "WRONGTYPE Operation against a key holding the wrong kind of value")
+	s = testRedisSink(t, f.url("adsb", "secret", 0), 0, false)
+	s.Add(msg)
+	if err := s.Flush(); err == nil || !strings.Contains(err.Error(), "WRONGTYPE") || len(s.pending) != 1 {
+		t.Errorf("failed XADD: %d pending, error %v", len(s.pending), err)
+	}
+
+	// Messages written while the server is down are sent once it is back.
+	f = startFakeRedis(t, "127.0.0.1:0", "secret", "")
+	addr := f.ln.Addr().String()
+	s = testRedisSink(t, f.url("adsb", "secret", 0), 0, false)
+	s.Add(msg)
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	f.stop()
+	s.Add(msg)
+	if err := s.Flush(); errorKindOf(err) != errConnect || len(s.pending) != 1 {
+		t.Errorf("server down: %d pending, error %v of kind %s", len(s.pending), err, errorKindOf(err))
+	}
+	// The client tries to dial again in the background, every second.
+	f = startFakeRedis(t, addr, "secret", "")
+	s.Add(msg)
+	deadline := time.Now().Add(5 * time.Second)
+	for err := s.Flush(); err != nil || len(s.pending) != 0; err = s.Flush() {
+		if time.Now().After(deadline) {
+			t.Fatalf("server back: %d pending, error %v", len(s.pending), err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if n := len(f.stored()); n != 2 {
+		t.Errorf("%d entries stored after reconnecting, want 2", n)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+)
+
+var metricRemoteWriteDropped = newCounter("adsb_remote_write_aircraft_dropped_total", "Aircraft left out of a remote write because of remote_write_max_aircraft.", "")
+
+// remoteWriter pushes each recently heard aircraft's altitude, ground speed
+// and vertical rate to a Prometheus remote write endpoint every interval,
+// as one series per aircraft and value. Aircraft not heard since the last
+// push are left out, so their series go stale in Prometheus; at most
+// maxAircraft, the most recently heard, are sent each time.
+type remoteWriter struct {
+	url         string
+	token       string
+	interval    time.Duration
+	maxAircraft int
+	callsign    bool
+	tracker     *Tracker
+	client      *http.Client
+}
+
+func newRemoteWriter(url, token string, interval time.Duration, maxAircraft int, callsign bool, tracker *Tracker) *remoteWriter {
+	return &remoteWriter{url: url, token: token, interval: interval, maxAircraft: maxAircraft, callsign: callsign, tracker: tracker, client: withChaos("remote_write", newHTTPClient())}
+}
+
+// Run pushes every interval until done is closed. Failures are logged once
+// until a push succeeds again; the samples of a failed push are not
+// retried, as the next one carries newer values.
+func (w *remoteWriter) Run(done <-chan struct{}) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	failing := false
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		err := w.push(clock.Now())
+		switch {
+		case err != nil && !failing:
+			log.Printf("Error writing aircraft metrics to %s: %v", w.url, err)
+		case err == nil && failing:
+			log.Printf("Writing aircraft metrics to %s again", w.url)
+		}
+		failing = err != nil
+	}
+}
+
+// push sends the aircraft heard within the last interval before now.
+func (w *remoteWriter) push(now time.Time) error {
+	var recent []Aircraft
+	for _, a := range w.tracker.Snapshot() {
+		if now.Sub(a.LastSeen) <= w.interval && !w.tracker.expired(&a, now) {
+			recent = append(recent, a)
+		}
+	}
+	if len(recent) == 0 {
+		return nil
+	}
+	if !toggles.Enabled("remote_write") {
+		metricDisabledSink.Add("remote_write", float64(len(recent)))
+		return nil
+	}
+	if len(recent) > w.maxAircraft {
+		sort.SliceStable(recent, func(i, j int) bool { return recent[i].LastSeen.After(recent[j].LastSeen) })
+		metricRemoteWriteDropped.Add("", float64(len(recent)-w.maxAircraft))
+		recent = recent[:w.maxAircraft]
+	}
+
+	body, samples := w.writeRequest(recent, now)
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(snappy.Encode(nil, body)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if w.token != "" {
+		req.Header.Set("Authorization", "Bearer "+w.token)
+	}
+	res, err := w.client.Do(req)
+	if err != nil {
+		metricSinkErrors.Inc("remote_write")
+		return err
+	}
+	defer res.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+	if res.StatusCode >= 300 {
+		metricSinkErrors.Inc("remote_write")
+		return fmt.Errorf("%s: %s", res.Status, bytes.TrimSpace(msg))
+	}
+	metricSinkEvents.Add("remote_write", float64(samples))
+	return nil
+}
+
+// writeRequest encodes a remote write WriteRequest holding the aircraft's
+// values at now, and returns it with the number of samples. Values the
+// aircraft has not reported are left out.
+func (w *remoteWriter) writeRequest(aircraft []Aircraft, now time.Time) ([]byte, int) {
+	var req protoBuffer
+	samples := 0
+	for _, a := range aircraft {
+		labels := [][2]string{{"icao24", a.Icao24}}
+		if w.callsign && a.Callsign != "" {
+			labels = append(labels, [2]string{"callsign", a.Callsign})
+		}
+		if RECEIVER_NAME != "" {
+			labels = append(labels, [2]string{"receiver", RECEIVER_NAME})
+		}
+		series := func(name string, value float64) {
+			var ts protoBuffer
+			// Labels are sorted by name, __name__ first.
+			all := append([][2]string{{"__name__", name}}, labels...)
+			sort.Slice(all, func(i, j int) bool { return all[i][0] < all[j][0] })
+			for _, l := range all {
+				var label protoBuffer
+				label.str(1, l[0])
+				label.str(2, l[1])
+				ts.message(1, label.Bytes())
+			}
+			var sample protoBuffer
+			sample.double(1, value)
+			sample.varint(2, uint64(now.UnixMilli()))
+			ts.message(2, sample.Bytes())
+			req.message(1, ts.Bytes())
+			samples++
+		}
+		if a.Altitude != 0 || a.OnGround {
+			series("adsb_aircraft_altitude_feet", float64(a.Altitude))
+		}
+		if a.GroundSpeed != 0 {
+			series("adsb_aircraft_ground_speed_knots", float64(a.GroundSpeed))
+			// The vertical rate comes with the speed in velocity messages.
+			series("adsb_aircraft_vertical_rate_feet_per_minute", float64(a.VerticalRate))
+		}
+	}
+	return req.Bytes(), samples
+}
+
+// protoBuffer encodes protobuf fields.
+type protoBuffer struct {
+	bytes.Buffer
+}
+
+func (b *protoBuffer) uvarint(v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	b.Write(buf[:binary.PutUvarint(buf[:], v)])
+}
+
+func (b *protoBuffer) varint(field int, v uint64) {
+	b.uvarint(uint64(field)<<3 | 0)
+	b.uvarint(v)
+}
+
+func (b *protoBuffer) double(field int, v float64) {
+	b.uvarint(uint64(field)<<3 | 1)
+	binary.Write(b, binary.LittleEndian, math.Float64bits(v))
+}
+
+func (b *protoBuffer) message(field int, data []byte) {
+	b.uvarint(uint64(field)<<3 | 2)
+	b.uvarint(uint64(len(data)))
+	b.Write(data)
+}
+
+func (b *protoBuffer) str(field int, s string) {
+	b.message(field, []byte(s))
+}
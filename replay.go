@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// zstdMagic starts every Zstandard frame, little endian.
+const zstdMagic = 0xfd2fb528
+
+// zstdMaxWindow is the largest window a frame may need, which bounds the
+// memory a decoder holds. zstd only exceeds it with --long=28 or more.
+const zstdMaxWindow = 1 << 27
+
+// decompress returns r decompressed when it starts like a gzip or zstd
+// stream, and unchanged otherwise.
+func decompress(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return zr, nil
+	case len(magic) == 4 && binary.LittleEndian.Uint32(magic) == zstdMagic:
+		// One goroutine decodes as the stream is read, so nothing is
+		// left running when the caller stops reading.
+		zr, err := zstd.NewReader(br, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(zstdMaxWindow))
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	}
+	return br, nil
+}
+
+// openCaptureDir opens the files in dir as one capture, one after the
+// other in the order of their names, which is the order of time for
+// archive_dir files and other dated names. Extensions do not count, so
+// sbs-20240101T000000Z.sbs comes before sbs-20240101T000000Z-1.sbs.gz.
+// Hidden files and subdirectories are skipped.
+func openCaptureDir(dir string) (io.ReadCloser, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && !strings.HasPrefix(e.Name(), ".") {
+			names = append(names, e.Name())
+		}
+	}
+	if len(names) == 0 {
+		return nil, configErrorf("%s holds no captures to replay", dir)
+	}
+	sort.SliceStable(names, func(i, j int) bool {
+		ki, _, _ := strings.Cut(names[i], ".")
+		kj, _, _ := strings.Cut(names[j], ".")
+		if ki != kj {
+			return ki < kj
+		}
+		return names[i] < names[j]
+	})
+	log.Printf("Replaying %d captures from %s", len(names), dir)
+	return &captureDir{dir: dir, names: names}, nil
+}
+
+// captureDir reads the captures of a directory in turn, opening each only
+// when the previous one is done. A capture that does not end with a
+// newline is given one, so its last line is not joined to the next.
+type captureDir struct {
+	dir   string
+	names []string
+	cur   io.ReadCloser
+	last  byte
+}
+
+func (c *captureDir) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for {
+		if c.cur == nil {
+			if len(c.names) == 0 {
+				return 0, io.EOF
+			}
+			path := filepath.Join(c.dir, c.names[0])
+			c.names = c.names[1:]
+			f, err := openCapture(path)
+			if err != nil {
+				return 0, err
+			}
+			log.Printf("Replaying %s", path)
+			c.cur, c.last = f, '\n'
+		}
+		n, err := c.cur.Read(p)
+		if n > 0 {
+			c.last = p[n-1]
+			return n, nil
+		}
+		if err != io.EOF {
+			return 0, err
+		}
+		c.cur.Close()
+		c.cur = nil
+		if c.last != '\n' {
+			p[0], c.last = '\n', '\n'
+			return 1, nil
+		}
+	}
+}
+
+func (c *captureDir) Close() error {
+	if c.cur == nil {
+		return nil
+	}
+	return c.cur.Close()
+}
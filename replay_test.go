@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestDecompress(t *testing.T) {
+	const capture = "MSG,3,1,1,4CA2D6,1,2026/10/16,10:00:00.000,2026/10/16,10:00:00.000,,35000,,,53.1,-6.2,,,0,0,0,0\n"
+	input := strings.Repeat(capture, 1000)
+
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write([]byte(input))
+	gw.Close()
+
+	// Two frames, as when compressed captures are concatenated.
+	var zs bytes.Buffer
+	for _, part := range []string{input[:len(input)/2], input[len(input)/2:]} {
+		zw, err := zstd.NewWriter(&zs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		zw.Write([]byte(part))
+		zw.Close()
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"plain", []byte(input)},
+		{"gzip", gz.Bytes()},
+		{"zstd", zs.Bytes()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := decompress(bytes.NewReader(tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != input {
+				t.Errorf("read %d bytes, want the %d of the capture", len(got), len(input))
+			}
+		})
+	}
+
+	t.Run("corrupt zstd", func(t *testing.T) {
+		data := append([]byte(nil), zs.Bytes()...)
+		data[len(data)/2] ^= 0xff
+		r, err := decompress(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		if _, err := io.ReadAll(r); err == nil {
+			t.Error("read a corrupt stream without an error")
+		}
+	})
+}
+
+// replayCollectorEnv, when set, makes TestReplayDeterministic run the
+// collector with the arguments it holds, one per line, in place of the test.
+const replayCollectorEnv = "ADSB_TEST_COLLECTOR_ARGS"
+
+func TestReplayDeterministic(t *testing.T) {
+	if args := os.Getenv(replayCollectorEnv); args != "" {
+		os.Args = append([]string{"adsb-go-dataset"}, strings.Split(args, "\n")...)
+		main()
+		return
+	}
+	if testing.Short() {
+		t.Skip("runs the collector")
+	}
+
+	capture := filepath.Join(t.TempDir(), "capture.sbs")
+	lines := []string{
+		"MSG,1,1,1,4CA2D6,1,2026/10/16,10:00:00.000,2026/10/16,10:00:00.000,EIN123  ,,,,,,,,,,,0",
+		"MSG,3,1,1,4CA2D6,1,2026/10/16,10:00:01.000,2026/10/16,10:00:01.000,,35000,,,53.1,-6.2,,,0,0,0,0",
+		"MSG,4,1,1,4CA2D6,1,2026/10/16,10:00:02.000,2026/10/16,10:00:02.000,,,450,90,,,64,,,,,0",
+		"MSG,3,1,1,A1B2C3,1,2026/10/16,10:00:02.500,2026/10/16,10:00:02.500,,12000,,,53.4,-6.3,,,0,0,0,0",
+		"MSG,6,1,1,A1B2C3,1,2026/10/16,10:00:03.000,2026/10/16,10:00:03.000,,,,,,,,7700,0,1,0,0",
+		"MSG,3,1,1,4CA2D6,1,2026/10/16,10:00:31.000,2026/10/16,10:00:31.000,,35025,,,53.1,-6.1,,,0,0,0,0",
+	}
+	if err := os.WriteFile(capture, []byte(strings.Join(lines, "\n")+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	replay := func() []string {
+		var (
+			mu     sync.Mutex
+			bodies []string
+		)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			mu.Lock()
+			bodies = append(bodies, r.URL.Path+" "+string(body))
+			mu.Unlock()
+			w.Write([]byte(`{"status":"success"}`))
+		}))
+		defer srv.Close()
+
+		args := []string{
+			"--replay=" + capture, "--clock=recorded", "--dataset_api_write_token=token",
+			"--dataset_url=" + srv.URL, "--spool_dir=" + t.TempDir(), "--receiver_name=test",
+		}
+		cmd := exec.Command(os.Args[0], "-test.run=^TestReplayDeterministic$")
+		cmd.Env = append(os.Environ(), replayCollectorEnv+"="+strings.Join(args, "\n"))
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("collector failed: %v\n%s", err, out)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		return bodies
+	}
+	first, second := replay(), replay()
+	if len(first) == 0 {
+		t.Fatal("nothing uploaded")
+	}
+	if len(first) != len(second) {
+		t.Fatalf("%d uploads, then %d", len(first), len(second))
+	}
+	for i := range first {
+		if first[i] != second[i] {
+			t.Errorf("upload %d differs:\n%s\n%s", i, first[i], second[i])
+		}
+	}
+}
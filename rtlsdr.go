@@ -0,0 +1,112 @@
+//go:build rtlsdr
+
+package main
+
+/*
+#cgo pkg-config: librtlsdr
+#include <rtl-sdr.h>
+*/
+import "C"
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"sync"
+	"unsafe"
+)
+
+// rtlsdrSupported is set in builds with the rtlsdr tag, which link
+// librtlsdr.
+const rtlsdrSupported = true
+
+// rtlsdrDevice reads I/Q samples from an RTL-SDR dongle.
+type rtlsdrDevice struct {
+	dev   *C.rtlsdr_dev_t
+	close sync.Once
+}
+
+// openRTLSDRDevice opens the dongle with the given index, tunes it to
+// rtlsdrFrequency at demodSampleRate, corrects its frequency by ppm and
+// sets its gain: "auto" for the tuner's AGC, a gain in dB, rounded to the
+// nearest the tuner supports, or "" for its highest, as dump1090 does.
+func openRTLSDRDevice(index int, gain string, ppm int) (io.ReadCloser, error) {
+	if count := int(C.rtlsdr_get_device_count()); index >= count {
+		return nil, fmt.Errorf("no RTL-SDR device %d, found %d", index, count)
+	}
+	d := &rtlsdrDevice{}
+	if C.rtlsdr_open(&d.dev, C.uint32_t(index)) < 0 {
+		return nil, fmt.Errorf("opening RTL-SDR device %d failed", index)
+	}
+	if err := d.tune(gain, ppm); err != nil {
+		d.Close()
+		return nil, fmt.Errorf("setting up RTL-SDR device %d: %w", index, err)
+	}
+	return d, nil
+}
+
+func (d *rtlsdrDevice) tune(gain string, ppm int) error {
+	if ppm != 0 && C.rtlsdr_set_freq_correction(d.dev, C.int(ppm)) < 0 {
+		return fmt.Errorf("setting frequency correction %d ppm failed", ppm)
+	}
+	if C.rtlsdr_set_sample_rate(d.dev, demodSampleRate) < 0 {
+		return fmt.Errorf("setting sample rate failed")
+	}
+	if C.rtlsdr_set_center_freq(d.dev, rtlsdrFrequency) < 0 {
+		return fmt.Errorf("tuning to 1090 MHz failed")
+	}
+	if gain == "auto" {
+		if C.rtlsdr_set_tuner_gain_mode(d.dev, 0) < 0 {
+			return fmt.Errorf("enabling automatic gain failed")
+		}
+	} else {
+		if C.rtlsdr_set_tuner_gain_mode(d.dev, 1) < 0 {
+			return fmt.Errorf("enabling manual gain failed")
+		}
+		// Gains are in tenths of a dB, in increasing order.
+		n := C.rtlsdr_get_tuner_gains(d.dev, nil)
+		if n <= 0 {
+			return fmt.Errorf("listing tuner gains failed")
+		}
+		gains := make([]C.int, n)
+		C.rtlsdr_get_tuner_gains(d.dev, &gains[0])
+		target := gains[n-1]
+		if gain != "" {
+			db, err := strconv.ParseFloat(gain, 64)
+			if err != nil {
+				return fmt.Errorf("invalid gain %q", gain)
+			}
+			for _, g := range gains {
+				if math.Abs(float64(g)-db*10) < math.Abs(float64(target)-db*10) {
+					target = g
+				}
+			}
+		}
+		if C.rtlsdr_set_tuner_gain(d.dev, target) < 0 {
+			return fmt.Errorf("setting gain %.1f dB failed", float64(target)/10)
+		}
+	}
+	if C.rtlsdr_reset_buffer(d.dev) < 0 {
+		return fmt.Errorf("resetting the sample buffer failed")
+	}
+	return nil
+}
+
+// Read fills p with samples. librtlsdr reads in multiples of 512 bytes.
+func (d *rtlsdrDevice) Read(p []byte) (int, error) {
+	n := len(p) &^ 511
+	if n == 0 {
+		return 0, io.ErrShortBuffer
+	}
+	var read C.int
+	if C.rtlsdr_read_sync(d.dev, unsafe.Pointer(&p[0]), C.int(n), &read) < 0 {
+		return 0, fmt.Errorf("reading samples failed")
+	}
+	return int(read), nil
+}
+
+func (d *rtlsdrDevice) Close() error {
+	d.close.Do(func() { C.rtlsdr_close(d.dev) })
+	return nil
+}
@@ -0,0 +1,16 @@
+//go:build !rtlsdr
+
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+// rtlsdrSupported is unset in builds without the rtlsdr tag, which do not
+// need librtlsdr and cannot receive from a dongle themselves.
+const rtlsdrSupported = false
+
+func openRTLSDRDevice(index int, gain string, ppm int) (io.ReadCloser, error) {
+	return nil, errors.New("this build has no RTL-SDR support, rebuild it with -tags rtlsdr")
+}
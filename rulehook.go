@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxRuleBody is the largest rule definition the rules webhook accepts.
+const maxRuleBody = 1 << 20
+
+// RuleAudit is an AUDIT event recording a change to the alert rules made
+// through the rules webhook, or the expiry of a rule added there.
+type RuleAudit struct {
+	Action    string     `json:"action"`
+	Rule      string     `json:"rule"`
+	Remote    string     `json:"remote,omitempty"`
+	UserAgent string     `json:"user_agent,omitempty"`
+	Expires   *time.Time `json:"expires,omitempty"`
+	// Definition is the rule as added; removals leave it out.
+	Definition *AlertRule `json:"definition,omitempty"`
+}
+
+// ruleWebhook lets other tools, such as a flight-planning system, add and
+// remove alert rules (watchlists and geofences) while the collector runs.
+// It is separate from the control API so that those tools get no other
+// powers. Every change is logged and sent to DataSet as an AUDIT event.
+type ruleWebhook struct {
+	token   string
+	alerter *Alerter
+	audits  chan<- SBS1Message
+}
+
+// routes returns the endpoints of the rules webhook:
+//
+//	GET    /rules         lists the rules
+//	PUT    /rules/{name}  adds or replaces a runtime rule
+//	DELETE /rules/{name}  removes a runtime rule
+func (h *ruleWebhook) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rules", h.list)
+	mux.HandleFunc("/rules/", h.rule)
+	return mux
+}
+
+// serve runs the rules webhook on addr in the background, and expires
+// runtime rules.
+func (h *ruleWebhook) serve(addr string) {
+	go func() {
+		log.Printf("Serving rules webhook on %s", addr)
+		if err := http.ListenAndServe(addr, requireToken(h.token, h.routes())); err != nil {
+			log.Println("Rules webhook stopped:", err)
+		}
+	}()
+	safeGo("rule_expiry", true, func() {
+		for range time.Tick(time.Second) {
+			for _, r := range h.alerter.ExpireRules(clock.Now()) {
+				log.Printf("Alert rule %q expired", r.Name)
+				h.audit(RuleAudit{Action: "expire", Rule: r.Name, Expires: r.Expires})
+			}
+		}
+	})
+}
+
+func (h *ruleWebhook) list(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, h.alerter.Rules())
+}
+
+func (h *ruleWebhook) rule(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/rules/")
+	if name == "" || strings.Contains(name, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		h.put(w, r, name)
+	case http.MethodDelete:
+		h.delete(w, r, name)
+	default:
+		w.Header().Set("Allow", "PUT, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *ruleWebhook) put(w http.ResponseWriter, r *http.Request, name string) {
+	var rule AlertRule
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRuleBody))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&rule); err != nil && err != io.EOF {
+		http.Error(w, fmt.Sprintf("invalid rule: %v", err), http.StatusBadRequest)
+		return
+	}
+	if rule.Name != "" && rule.Name != name {
+		http.Error(w, fmt.Sprintf("rule name %q does not match the path", rule.Name), http.StatusBadRequest)
+		return
+	}
+	rule.Name, rule.Runtime = name, true
+	if rule.Expires != nil && !rule.Expires.After(clock.Now()) {
+		http.Error(w, "expires is in the past", http.StatusBadRequest)
+		return
+	}
+	if err := rule.prepare(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	replaced, err := h.alerter.SetRule(&rule)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	action, done, status := "add", "added", http.StatusCreated
+	if replaced {
+		action, done, status = "replace", "replaced", http.StatusOK
+	}
+	log.Printf("Alert rule %q %s by %s", name, done, remoteHost(r))
+	h.audit(RuleAudit{Action: action, Rule: name, Remote: remoteHost(r), UserAgent: r.UserAgent(), Expires: rule.Expires, Definition: &rule})
+	writeJSON(w, status, &rule)
+}
+
+func (h *ruleWebhook) delete(w http.ResponseWriter, r *http.Request, name string) {
+	removed, err := h.alerter.RemoveRule(name)
+	switch {
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case !removed:
+		http.Error(w, fmt.Sprintf("no rule %q", name), http.StatusNotFound)
+		return
+	}
+	log.Printf("Alert rule %q removed by %s", name, remoteHost(r))
+	h.audit(RuleAudit{Action: "remove", Rule: name, Remote: remoteHost(r), UserAgent: r.UserAgent()})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// audit hands an AUDIT event to the main loop.
+func (h *ruleWebhook) audit(a RuleAudit) {
+	msg := SBS1Message{Timestamp: formatTimestamp(clock.Now()), MessageType: "AUDIT", RuleAudit: &a}
+	select {
+	case h.audits <- msg:
+	case <-time.After(5 * time.Second):
+		log.Printf("Dropped the audit event for rule %q: pipeline did not accept it", a.Rule)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// remoteHost is the address a request came from, without the port.
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// rulesCommand groups the tools for working on alert rules.
+func rulesCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "rules",
+		Usage: "Work on alert rules.",
+		Subcommands: []*cli.Command{
+			{
+				Name:  "test",
+				Usage: "Replay a capture against alert rules and report which rules would have fired and how often. Nothing is uploaded or notified.",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "file",
+						Usage: "The JSON file of alert rules to test. Defaults to alert_rules.",
+					},
+					&cli.StringFlag{
+						Name:     "capture",
+						Required: true,
+						Usage:    "The raw capture to replay, a file or a directory of files in input_format.",
+					},
+					&cli.BoolFlag{
+						Name:  "alerts",
+						Usage: "Also list every alert as it would have been raised.",
+					},
+				},
+				Action: rulesTest,
+			},
+		},
+	}
+}
+
+func rulesTest(c *cli.Context) error {
+	path := c.String("file")
+	if path == "" {
+		path = ALERT_RULES
+	}
+	if path == "" {
+		return configErrorf("no alert rules given. Use --file or set alert_rules")
+	}
+	rules, err := loadAlertRules(path)
+	if err != nil {
+		return newError(errConfig, err)
+	}
+	if surface, err = newSurfaceFilter(VEHICLE_ICAO_RANGES.Value(), OBSTACLE_ICAO_RANGES.Value(), VEHICLES, OBSTACLES); err != nil {
+		return err
+	}
+	if transmissionTypes, err = parseTransmissionTypes(TRANSMISSION_TYPES.Value()); err != nil {
+		return configErrorf("%v", err)
+	}
+	if ids, err = newIDScheme(ID_FORMAT); err != nil {
+		return configErrorf("%v", err)
+	}
+
+	f, err := openCapture(c.String("capture"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	clock = &recordedClock{}
+
+	var list io.Writer
+	if c.Bool("alerts") {
+		list = os.Stdout
+	}
+	result, err := runRulesTest(f, rules, list)
+	if err != nil {
+		return err
+	}
+	if list != nil {
+		fmt.Println()
+	}
+	return result.Print(os.Stdout)
+}
+
+// ruleTally is what a rule did during a rules test.
+type ruleTally struct {
+	alerts, notified int
+	aircraft         map[string]bool
+	first, last      time.Time
+}
+
+// rulesTestResult is the outcome of a rules test.
+type rulesTestResult struct {
+	lines, messages int
+	aircraft        map[string]bool
+	span            time.Duration
+	rules           []*AlertRule
+	tally           map[string]*ruleTally
+	suppressed      int
+}
+
+// runRulesTest sends the lines in r through parsing, filtering and tracking
+// like the collector, and evaluates the rules on recorded time with the
+// configured throttling and digests. Alerts are written to list, if set,
+// as they are raised.
+func runRulesTest(r io.Reader, rules []*AlertRule, list io.Writer) (*rulesTestResult, error) {
+	res := &rulesTestResult{aircraft: map[string]bool{}, rules: rules, tally: map[string]*ruleTally{}}
+	for _, rule := range rules {
+		res.tally[rule.Name] = &ruleTally{aircraft: map[string]bool{}}
+	}
+	// The notifications of one evaluation always fit, as every rule raises
+	// at most one alert and a digest flushes at most once.
+	sim := &Alerter{
+		rules:          rules,
+		global:         newTokenBucket(ALERT_RATE, ALERT_BURST),
+		digestSize:     ALERT_DIGEST_SIZE,
+		digestInterval: ALERT_DIGEST_INTERVAL,
+		active:         map[string]time.Time{},
+		out:            make(chan Notification, len(rules)+2),
+		raised: func(alert Alert) {
+			t := res.tally[alert.Rule]
+			t.alerts++
+			t.aircraft[alert.Aircraft.Icao24] = true
+			if t.first.IsZero() {
+				t.first = alert.Time
+			}
+			t.last = alert.Time
+			if list != nil {
+				fmt.Fprintf(list, "%s  %s\n", alert.Time.Format("2006-01-02 15:04:05"), alert)
+			}
+		},
+	}
+	drain := func() {
+		for {
+			select {
+			case n := <-sim.out:
+				for _, alert := range n.Alerts {
+					res.tally[alert.Rule].notified++
+				}
+			default:
+				return
+			}
+		}
+	}
+
+	tracker := newTracker()
+	var first, last time.Time
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		res.lines++
+		parsed, ok := parseLine(scanner.Text())
+		if !ok || !transmissionTypes.Keep(parsed) || !surface.Apply(&parsed) {
+			continue
+		}
+		res.messages++
+		if ts, err := parseTimestamp(parsed.Timestamp); err == nil {
+			if first.IsZero() {
+				first = ts
+			}
+			last = ts
+		}
+		aircraft := tracker.annotate(&parsed)
+		res.aircraft[aircraft.Icao24] = true
+		sim.Evaluate(aircraft, nil)
+		drain()
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sim.mu.Lock()
+	if len(sim.pending) > 0 {
+		sim.flushLocked(clock.Now())
+	}
+	res.suppressed = sim.suppressed
+	sim.mu.Unlock()
+	drain()
+	res.span = last.Sub(first)
+	return res, nil
+}
+
+// Print writes the outcome as a table with a row per rule, in the order of
+// the rules file.
+func (res *rulesTestResult) Print(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "replayed\t%s, %d lines, %d messages, %d aircraft\n", res.span.Round(time.Second), res.lines, res.messages, len(res.aircraft))
+	fmt.Fprintln(tw)
+	fmt.Fprintln(tw, "RULE\tALERTS\tAIRCRAFT\tALERTS/DAY\tNOTIFIED\tFIRST\tLAST")
+	for _, rule := range res.rules {
+		t := res.tally[rule.Name]
+		perDay, firstSeen, lastSeen := "-", "-", "-"
+		if res.span > 0 {
+			perDay = fmt.Sprintf("%.1f", float64(t.alerts)*float64(24*time.Hour)/float64(res.span))
+		}
+		if t.alerts > 0 {
+			firstSeen, lastSeen = t.first.Format("2006-01-02 15:04:05"), t.last.Format("2006-01-02 15:04:05")
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%d\t%s\t%s\n", rule.Name, t.alerts, len(t.aircraft), perDay, t.notified, firstSeen, lastSeen)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if res.suppressed > 0 {
+		fmt.Fprintf(w, "\n%d alert(s) would have been suppressed by throttling (alert_rate, alert_burst and the rules' throttle).\n", res.suppressed)
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// s3PendingMax bounds the messages waiting to be written, which includes
+// those kept for a retry while the bucket is unreachable.
+const s3PendingMax = 1000000
+
+// s3Writer buffers every decoded aircraft message and every interval
+// uploads them to an S3 bucket as Parquet files, one per UTC hour of the
+// messages' time, under Hive-style partitions:
+// prefix/year=2026/month=10/day=16/hour=12/20261016T121500Z-1a2b3c4d.parquet.
+// Athena, Spark and DuckDB read the partitions as columns. The columns are
+// those of the SQLite archives. Files that fail to upload are kept and
+// written again with the next interval's messages of their hour.
+type s3Writer struct {
+	bucket, prefix string
+	// endpoint is set for S3-compatible stores, which are addressed with
+	// the bucket in the path rather than the host.
+	endpoint string
+	creds    awsCredentials
+	interval time.Duration
+	client   *http.Client
+
+	mu      sync.Mutex
+	pending []SBS1Message
+	dropped int
+
+	// flushMu serializes uploads.
+	flushMu sync.Mutex
+	failing bool
+}
+
+func newS3Writer(bucket, prefix, region, endpoint, accessKey, secretKey, sessionToken string, interval time.Duration) *s3Writer {
+	return &s3Writer{
+		bucket: bucket, prefix: strings.Trim(prefix, "/"), endpoint: strings.TrimSuffix(endpoint, "/"),
+		creds:    awsCredentials{region: region, accessKey: accessKey, secretKey: secretKey, sessionToken: sessionToken},
+		interval: interval, client: withChaos("s3", newHTTPClient()),
+	}
+}
+
+// Run uploads every interval until done is closed. What is left is
+// uploaded by a last Flush.
+func (w *s3Writer) Run(done <-chan struct{}) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			w.Flush()
+		}
+	}
+}
+
+// Add queues a message to be written.
+func (w *s3Writer) Add(msg SBS1Message) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.pending) >= s3PendingMax {
+		w.dropped++
+		return
+	}
+	w.pending = append(w.pending, msg)
+}
+
+// Flush uploads the queued messages, a file per hour. Failures are logged
+// once until an upload succeeds again.
+func (w *s3Writer) Flush() {
+	w.flushMu.Lock()
+	defer w.flushMu.Unlock()
+	w.mu.Lock()
+	pending, dropped := w.pending, w.dropped
+	w.pending, w.dropped = nil, 0
+	w.mu.Unlock()
+	if dropped > 0 {
+		metricSinkErrors.Add("s3", float64(dropped))
+		log.Printf("Dropped %d message(s) for S3, which fell behind", dropped)
+	}
+	if len(pending) == 0 {
+		return
+	}
+
+	hours := map[time.Time][]SBS1Message{}
+	var order []time.Time
+	for _, msg := range pending {
+		hour := messageTime(msg).UTC().Truncate(time.Hour)
+		if _, ok := hours[hour]; !ok {
+			order = append(order, hour)
+		}
+		hours[hour] = append(hours[hour], msg)
+	}
+	sort.Slice(order, func(i, j int) bool { return order[i].Before(order[j]) })
+
+	now := time.Now().UTC()
+	var failed []SBS1Message
+	var firstErr error
+	for _, hour := range order {
+		msgs := hours[hour]
+		key := w.key(hour, now)
+		if err := w.upload(key, msgs); err != nil {
+			metricSinkErrors.Inc("s3")
+			failed = append(failed, msgs...)
+			if firstErr == nil {
+				firstErr = fmt.Errorf("uploading %s: %w", key, err)
+			}
+			continue
+		}
+		metricSinkEvents.Add("s3", float64(len(msgs)))
+	}
+	switch {
+	case firstErr != nil && !w.failing:
+		log.Printf("Error writing messages to S3 bucket %s: %v", w.bucket, firstErr)
+	case firstErr == nil && w.failing:
+		log.Printf("Writing messages to S3 bucket %s again", w.bucket)
+	}
+	w.failing = firstErr != nil
+	if len(failed) > 0 {
+		w.requeue(failed)
+	}
+}
+
+// requeue puts failed messages back in front of those queued since,
+// dropping the oldest beyond s3PendingMax.
+func (w *s3Writer) requeue(failed []SBS1Message) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	pending := append(failed, w.pending...)
+	if over := len(pending) - s3PendingMax; over > 0 {
+		pending = pending[over:]
+		w.dropped += over
+	}
+	w.pending = pending
+}
+
+// key is the object key of a file of the messages of hour, written at now.
+func (w *s3Writer) key(hour, now time.Time) string {
+	name := fmt.Sprintf("year=%04d/month=%02d/day=%02d/hour=%02d/%s-%s.parquet",
+		hour.Year(), hour.Month(), hour.Day(), hour.Hour(), now.Format("20060102T150405Z"), uuid.NewString()[:8])
+	if w.prefix == "" {
+		return name
+	}
+	return w.prefix + "/" + name
+}
+
+// upload writes msgs as a Parquet file and puts it at key.
+func (w *s3Writer) upload(key string, msgs []SBS1Message) error {
+	var body bytes.Buffer
+	if err := writeParquet(&body, s3Columns(msgs), "adsb-go-dataset "+version); err != nil {
+		return err
+	}
+	return w.put(key, body.Bytes(), "application/vnd.apache.parquet")
+}
+
+// s3Columns lays out messages as the columns of the SQLite archives, with
+// time as a UTC timestamp in milliseconds.
+func s3Columns(msgs []SBS1Message) []parquetColumn {
+	columns := []parquetColumn{
+		{name: "time", typ: parquetInt64, converted: parquetTimestampMillis},
+		{name: "icao24", typ: parquetByteArray, converted: parquetUTF8, optional: true},
+		{name: "callsign", typ: parquetByteArray, converted: parquetUTF8, optional: true},
+		{name: "message_type", typ: parquetByteArray, converted: parquetUTF8, optional: true},
+		{name: "transmission_type", typ: parquetInt32, converted: -1, optional: true},
+		{name: "altitude", typ: parquetInt32, converted: -1, optional: true},
+		{name: "ground_speed", typ: parquetDouble, converted: -1, optional: true},
+		{name: "track", typ: parquetDouble, converted: -1, optional: true},
+		{name: "vertical_rate", typ: parquetInt32, converted: -1, optional: true},
+		{name: "lat", typ: parquetDouble, converted: -1, optional: true},
+		{name: "lon", typ: parquetDouble, converted: -1, optional: true},
+		{name: "squawk", typ: parquetByteArray, converted: parquetUTF8, optional: true},
+		{name: "on_ground", typ: parquetBoolean, converted: -1},
+		{name: "emergency", typ: parquetBoolean, converted: -1},
+		{name: "receiver", typ: parquetByteArray, converted: parquetUTF8, optional: true},
+		{name: "flight_uuid", typ: parquetByteArray, converted: parquetUTF8, optional: true},
+		{name: "message", typ: parquetByteArray, converted: parquetUTF8, optional: true},
+	}
+	for _, msg := range msgs {
+		row := sqliteRow(msg)
+		row[0] = messageTime(msg).UnixMilli()
+		for i, v := range row {
+			columns[i].values = append(columns[i].values, v)
+		}
+	}
+	return columns
+}
+
+// put uploads data to key with a request signed with AWS Signature
+// Version 4.
+func (w *s3Writer) put(key string, data []byte, contentType string) error {
+	var objectURL string
+	if w.endpoint != "" {
+		objectURL = w.endpoint + "/" + w.bucket + "/" + s3EscapePath(key)
+	} else {
+		objectURL = "https://" + w.bucket + ".s3." + w.creds.region + ".amazonaws.com/" + s3EscapePath(key)
+	}
+	req, err := http.NewRequest(http.MethodPut, objectURL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	w.creds.sign(req, "s3", data, time.Now().UTC())
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		err := fmt.Errorf("S3 returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+		if resp.StatusCode == http.StatusForbidden {
+			return newError(errAuth, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// s3EscapePath escapes key as Signature Version 4 expects: every byte but
+// the unreserved characters and the slashes between segments, including
+// the = of partitions.
+func s3EscapePath(key string) string {
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9', strings.IndexByte("-._~/", c) >= 0:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestS3EscapePath(t *testing.T) {
+	tests := []struct{ key, want string }{
+		{"adsb/year=2026/hour=12/x.parquet", "adsb/year%3D2026/hour%3D12/x.parquet"},
+		{"a b+c~d_e-f.g", "a%20b%2Bc~d_e-f.g"},
+		{"ü", "%C3%BC"},
+	}
+	for _, tt := range tests {
+		if got := s3EscapePath(tt.key); got != tt.want {
+			t.Errorf("s3EscapePath(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestS3Key(t *testing.T) {
+	hour := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	now := hour.Add(75 * time.Minute)
+	for prefix, want := range map[string]string{
+		"":       `^year=2026/month=03/day=01/hour=12/20260301T131500Z-[0-9a-f]{8}\.parquet$`,
+		"/adsb/": `^adsb/year=2026/month=03/day=01/hour=12/20260301T131500Z-[0-9a-f]{8}\.parquet$`,
+		"a/b":    `^a/b/year=2026/month=03/day=01/hour=12/20260301T131500Z-[0-9a-f]{8}\.parquet$`,
+	} {
+		w := newS3Writer("bucket", prefix, "us-east-1", "", "", "", "", time.Minute)
+		if got := w.key(hour, now); !regexp.MustCompile(want).MatchString(got) {
+			t.Errorf("prefix %q: key %s, want %s", prefix, got, want)
+		}
+	}
+}
+
+func TestS3Put(t *testing.T) {
+	status := http.StatusOK
+	var path, auth, body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		path, auth, body = r.URL.EscapedPath(), r.Header.Get("Authorization"), string(data)
+		w.WriteHeader(status)
+		io.WriteString(w, "<Error><Code>AccessDenied</Code></Error>")
+	}))
+	defer srv.Close()
+
+	// An S3-compatible endpoint is addressed with the bucket in the path.
+	w := newS3Writer("bucket", "adsb", "us-east-1", srv.URL+"/", testAccessKey, testSecretKey, "", time.Minute)
+	if err := w.put("adsb/hour=12/x.parquet", []byte("data"), "application/vnd.apache.parquet"); err != nil {
+		t.Fatal(err)
+	}
+	if path != "/bucket/adsb/hour%3D12/x.parquet" || body != "data" || !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential="+testAccessKey+"/") {
+		t.Errorf("put %q to %s, signed %q", body, path, auth)
+	}
+
+	status = http.StatusForbidden
+	if err := w.put("adsb/x.parquet", nil, "application/vnd.apache.parquet"); errorKindOf(err) != errAuth || !strings.Contains(err.Error(), "AccessDenied") {
+		t.Errorf("forbidden: error %v, want an auth error", err)
+	}
+	status = http.StatusInternalServerError
+	if err := w.put("adsb/x.parquet", nil, "application/vnd.apache.parquet"); err == nil || errorKindOf(err) == errAuth {
+		t.Errorf("server error: error %v", err)
+	}
+}
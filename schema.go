@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/urfave/cli/v2"
+)
+
+// eventType is a kind of event the collector emits, told apart by its
+// message_type, and the fields it always carries.
+type eventType struct {
+	messageType string
+	doc         string
+	required    []string
+}
+
+// eventTypes are the events the collector emits. Every one is an Event;
+// the fields not listed as required are set when known.
+var eventTypes = []eventType{
+	{"MSG", "A decoded aircraft message, with the tracker's flight_uuid and, when configured, its enrichment and the receiver's position.", []string{"icao24"}},
+	{"SNAPSHOT", "An aircraft of a periodic airspace snapshot, which holds one such event per tracked aircraft.", []string{"snapshot"}},
+	{"STATS", "Receiver performance over the last stats interval.", []string{"receiver_stats"}},
+	{"ADVISORY", "A recommendation to change the SDR gain.", []string{"gain_advisory"}},
+	{"AUDIT", "A change made through the control API or the rules webhook, carrying toggle_audit or rule_audit.", nil},
+	{"ENRICHMENT_UPDATE", "Enrichment of an aircraft that arrived after its first messages were sent.", []string{"icao24", "enrichment"}},
+}
+
+// schemaBaseURL is where published schemas live, by version.
+const schemaBaseURL = "https://github.com/imichaelmoore/adsb-go-dataset/schema"
+
+var (
+	timeType = reflect.TypeOf(time.Time{})
+	rawType  = reflect.TypeOf(json.RawMessage{})
+)
+
+// schemaStructs returns the struct types reachable from SBS1Message, the
+// event itself first and the others in the order their fields appear.
+func schemaStructs() []reflect.Type {
+	var order []reflect.Type
+	seen := map[reflect.Type]bool{}
+	var visit func(t reflect.Type)
+	visit = func(t reflect.Type) {
+		for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice || t.Kind() == reflect.Map {
+			if t == rawType {
+				return
+			}
+			t = t.Elem()
+		}
+		if t.Kind() != reflect.Struct || t == timeType || seen[t] {
+			return
+		}
+		seen[t] = true
+		order = append(order, t)
+		for _, f := range schemaFields(t) {
+			visit(f.Type)
+		}
+	}
+	visit(reflect.TypeOf(SBS1Message{}))
+	return order
+}
+
+// schemaField is a field of a struct as it appears in JSON. Index is its
+// index in the struct.
+type schemaField struct {
+	Name      string
+	Type      reflect.Type
+	OmitEmpty bool
+	Index     int
+}
+
+// schemaFields returns the fields of t that encoding/json writes.
+func schemaFields(t reflect.Type) []schemaField {
+	var fields []schemaField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields = append(fields, schemaField{Name: name, Type: f.Type, OmitEmpty: strings.Contains(opts, "omitempty"), Index: i})
+	}
+	return fields
+}
+
+// schemaName is the name of struct type t in published schemas. The event
+// itself is called Event.
+func schemaName(t reflect.Type) string {
+	if t == reflect.TypeOf(SBS1Message{}) {
+		return "Event"
+	}
+	r := []rune(t.Name())
+	r[0] = unicode.ToUpper(r[0])
+	return string(r)
+}
+
+// jsonSchema returns a JSON Schema (draft 2020-12) of the events, with
+// every nested object under $defs.
+func jsonSchema() map[string]interface{} {
+	defs := map[string]interface{}{}
+	for _, t := range schemaStructs() {
+		properties := map[string]interface{}{}
+		var required []string
+		for _, f := range schemaFields(t) {
+			properties[f.Name] = jsonSchemaType(f.Type)
+			if !f.OmitEmpty && f.Type.Kind() != reflect.Ptr {
+				required = append(required, f.Name)
+			}
+		}
+		def := map[string]interface{}{"type": "object", "properties": properties}
+		if len(required) > 0 {
+			def["required"] = required
+		}
+		defs[schemaName(t)] = def
+	}
+
+	var types []interface{}
+	var names []string
+	for _, et := range eventTypes {
+		variant := map[string]interface{}{
+			"title":       et.messageType,
+			"description": et.doc,
+			"properties":  map[string]interface{}{"message_type": map[string]interface{}{"const": et.messageType}},
+			"required":    append([]string{"message_type"}, et.required...),
+		}
+		types = append(types, variant)
+		names = append(names, et.messageType)
+	}
+	event := defs["Event"].(map[string]interface{})
+	event["properties"].(map[string]interface{})["message_type"] = map[string]interface{}{"type": "string", "enum": names}
+
+	return map[string]interface{}{
+		"$schema":     "https://json-schema.org/draft/2020-12/schema",
+		"$id":         schemaBaseURL + "/" + version + "/event.schema.json",
+		"title":       "Event",
+		"description": fmt.Sprintf("An event of adsb-go-dataset %s, as written to DataSet's message attribute and to every other sink.", version),
+		"version":     version,
+		"$ref":        "#/$defs/Event",
+		"oneOf":       types,
+		"$defs":       defs,
+	}
+}
+
+// jsonSchemaType returns the schema of a value of type t.
+func jsonSchemaType(t reflect.Type) map[string]interface{} {
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t == rawType || t.Kind() == reflect.Interface:
+		return map[string]interface{}{}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return jsonSchemaType(t.Elem())
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "contentEncoding": "base64"}
+		}
+		return map[string]interface{}{"type": "array", "items": jsonSchemaType(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": jsonSchemaType(t.Elem())}
+	case reflect.Struct:
+		return map[string]interface{}{"$ref": "#/$defs/" + schemaName(t)}
+	}
+	return map[string]interface{}{}
+}
+
+// protoSchema returns a proto3 description of the events whose JSON
+// mapping matches what the collector writes. Field numbers follow the
+// order of the fields, so they only hold for this version.
+func protoSchema() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "// Events of adsb-go-dataset %s. Generated; do not edit.\n", version)
+	b.WriteString("//\n// Events are told apart by message_type:\n")
+	for _, et := range eventTypes {
+		fmt.Fprintf(&b, "//   %s: %s\n", et.messageType, et.doc)
+	}
+	b.WriteString("\nsyntax = \"proto3\";\n\npackage adsb.v1;\n\n")
+	b.WriteString("import \"google/protobuf/struct.proto\";\nimport \"google/protobuf/timestamp.proto\";\n")
+	for _, t := range schemaStructs() {
+		fmt.Fprintf(&b, "\nmessage %s {\n", schemaName(t))
+		for i, f := range schemaFields(t) {
+			fmt.Fprintf(&b, "  %s %s = %d [json_name = %q];\n", protoType(f.Type), f.Name, i+1, f.Name)
+		}
+		b.WriteString("}\n")
+	}
+	return b.String()
+}
+
+// protoType returns the proto3 type of a field of type t, with its
+// repeated or optional label.
+func protoType(t reflect.Type) string {
+	switch {
+	case t == timeType:
+		return "google.protobuf.Timestamp"
+	case t == rawType || t.Kind() == reflect.Interface:
+		return "google.protobuf.Value"
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		elem := protoType(t.Elem())
+		if t.Elem().Kind() == reflect.Struct {
+			return elem
+		}
+		return "optional " + elem
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "bytes"
+		}
+		return "repeated " + protoType(t.Elem())
+	case reflect.Map:
+		return fmt.Sprintf("map<%s, %s>", protoType(t.Key()), protoType(t.Elem()))
+	case reflect.Struct:
+		return schemaName(t)
+	}
+	return protoScalars[t.Kind()]
+}
+
+// protoScalars are the proto3 types of Go's scalar kinds.
+var protoScalars = map[reflect.Kind]string{
+	reflect.String: "string", reflect.Bool: "bool",
+	reflect.Int: "int64", reflect.Int8: "int32", reflect.Int16: "int32", reflect.Int32: "int32", reflect.Int64: "int64",
+	reflect.Uint: "uint64", reflect.Uint8: "uint32", reflect.Uint16: "uint32", reflect.Uint32: "uint32", reflect.Uint64: "uint64",
+	reflect.Float32: "float", reflect.Float64: "double",
+}
+
+// schemaHandler serves the JSON Schema at /schema and the protobuf
+// description at /schema.proto.
+func schemaHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Schema-Version", version)
+	if strings.HasSuffix(r.URL.Path, ".proto") {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprint(w, protoSchema())
+		return
+	}
+	w.Header().Set("Content-Type", "application/schema+json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(jsonSchema())
+}
+
+// schemaCommand prints the schema of the events.
+func schemaCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "schema",
+		Usage: "Print the JSON Schema or protobuf description of the events this version emits",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "format",
+				Value: "json",
+				Usage: "Print 'json' for a JSON Schema or 'proto' for a proto3 file.",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			switch c.String("format") {
+			case "json":
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				return enc.Encode(jsonSchema())
+			case "proto":
+				_, err := fmt.Print(protoSchema())
+				return err
+			}
+			return configErrorf("unknown format %q, expected 'json' or 'proto'", c.String("format"))
+		},
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"io"
+	"os"
+	"time"
+)
+
+// defaultSerialBauds is the baud rate of a serial device by input format:
+// the Mode-S Beast's for Beast, and a common rate for the SBS-1's and other
+// receivers' text output.
+var defaultSerialBauds = map[string]int{"sbs": 115200, "avr": 115200, "beast": 3000000}
+
+// openSerialFeed opens the serial device at path, waiting for up to wait
+// for it to appear, e.g. while the USB receiver is plugged in.
+func openSerialFeed(path string, baud int, wait time.Duration, stop <-chan struct{}) (io.ReadCloser, error) {
+	var f *os.File
+	err := waitForFeed(path, wait, stop, func() (err error) {
+		f, err = openSerial(path, baud)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// termiosIoctl runs fn on the descriptor of f. Unlike Fd, it leaves f in
+// non-blocking mode, so that closing f still interrupts a read.
+func termiosIoctl(f *os.File, fn func(fd uintptr) error) error {
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var ferr error
+	if err := conn.Control(func(fd uintptr) { ferr = fn(fd) }); err != nil {
+		return err
+	}
+	return ferr
+}
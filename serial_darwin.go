@@ -0,0 +1,67 @@
+//go:build darwin
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// darwinIOSSIOSPEED sets a baud rate that termios cannot express,
+// _IOW('T', 2, speed_t) from IOKit/serial/ioss.h.
+const darwinIOSSIOSPEED = 0x80085402
+
+// serialBaudRates are the baud rates a serial device can be set to. Rates
+// above 230400 are set with darwinIOSSIOSPEED.
+var serialBaudRates = map[int]uint64{
+	9600: 9600, 19200: 19200, 38400: 38400, 57600: 57600, 115200: 115200, 230400: 230400,
+	460800: 460800, 921600: 921600, 1000000: 1000000, 2000000: 2000000, 3000000: 3000000, 4000000: 4000000,
+}
+
+// openSerial opens the serial device at path in raw mode at baud, 8N1
+// without flow control.
+func openSerial(path string, baud int) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, err
+	}
+	speed := serialBaudRates[baud]
+	err = termiosIoctl(f, func(fd uintptr) error {
+		var t syscall.Termios
+		if err := ioctl(fd, syscall.TIOCGETA, unsafe.Pointer(&t)); err != nil {
+			return fmt.Errorf("%s is not a serial device: %w", path, err)
+		}
+		t.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON | syscall.IXOFF
+		t.Oflag &^= syscall.OPOST
+		t.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+		t.Cflag &^= syscall.CSIZE | syscall.PARENB | syscall.CSTOPB
+		t.Cflag |= syscall.CS8 | syscall.CREAD | syscall.CLOCAL
+		if speed <= 230400 {
+			t.Ispeed, t.Ospeed = speed, speed
+		}
+		t.Cc[syscall.VMIN], t.Cc[syscall.VTIME] = 1, 0
+		if err := ioctl(fd, syscall.TIOCSETA, unsafe.Pointer(&t)); err != nil {
+			return fmt.Errorf("configuring %s: %w", path, err)
+		}
+		if speed > 230400 {
+			if err := ioctl(fd, darwinIOSSIOSPEED, unsafe.Pointer(&speed)); err != nil {
+				return fmt.Errorf("setting %s to %d baud: %w", path, baud, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func ioctl(fd, req uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
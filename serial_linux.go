@@ -0,0 +1,60 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// linuxCBAUD masks the baud rate bits of c_cflag. It comes from
+// asm-generic/termbits.h, as syscall does not export it.
+const linuxCBAUD = 0x100f
+
+// serialBaudRates are the baud rates a serial device can be set to.
+var serialBaudRates = map[int]uint32{
+	9600: syscall.B9600, 19200: syscall.B19200, 38400: syscall.B38400, 57600: syscall.B57600,
+	115200: syscall.B115200, 230400: syscall.B230400, 460800: syscall.B460800, 921600: syscall.B921600,
+	1000000: syscall.B1000000, 2000000: syscall.B2000000, 3000000: syscall.B3000000, 4000000: syscall.B4000000,
+}
+
+// openSerial opens the serial device at path in raw mode at baud, 8N1
+// without flow control.
+func openSerial(path string, baud int) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, err
+	}
+	speed := serialBaudRates[baud]
+	err = termiosIoctl(f, func(fd uintptr) error {
+		var t syscall.Termios
+		if err := ioctl(fd, syscall.TCGETS, unsafe.Pointer(&t)); err != nil {
+			return fmt.Errorf("%s is not a serial device: %w", path, err)
+		}
+		t.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON | syscall.IXOFF
+		t.Oflag &^= syscall.OPOST
+		t.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+		t.Cflag &^= syscall.CSIZE | syscall.PARENB | syscall.CSTOPB | linuxCBAUD
+		t.Cflag |= syscall.CS8 | syscall.CREAD | syscall.CLOCAL | speed
+		t.Ispeed, t.Ospeed = speed, speed
+		t.Cc[syscall.VMIN], t.Cc[syscall.VTIME] = 1, 0
+		if err := ioctl(fd, syscall.TCSETS, unsafe.Pointer(&t)); err != nil {
+			return fmt.Errorf("configuring %s: %w", path, err)
+		}
+		return nil
+	})
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func ioctl(fd, req uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
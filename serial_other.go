@@ -0,0 +1,15 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// serialBaudRates is empty where serial devices are not supported.
+var serialBaudRates = map[int]uint32{}
+
+func openSerial(path string, baud int) (*os.File, error) {
+	return nil, errors.New("serial devices are not supported on this platform")
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// sinkConfig holds the settings of the sinks that store every decoded
+// aircraft message, from the top-level options or from a pipeline of the
+// config file. Empty settings leave a sink out.
+type sinkConfig struct {
+	sqliteDir      string
+	sqliteKeepDays int
+
+	postgresURL      string
+	postgresTable    string
+	postgresInterval time.Duration
+
+	s3Bucket, s3Prefix, s3Region, s3Endpoint string
+	s3AccessKeyID, s3SecretAccessKey         string
+	s3SessionToken                           string
+	s3Interval                               time.Duration
+
+	splunkURL, splunkToken        string
+	splunkIndex, splunkSourcetype string
+	splunkAck                     bool
+	splunkInterval                time.Duration
+
+	redisURL, redisStream string
+	redisMaxLen           int
+	redisMaxLenExact      bool
+	redisInterval         time.Duration
+
+	kinesisStream, kinesisRegion, kinesisEndpoint string
+	kinesisAccessKey, kinesisSecretKey            string
+	kinesisSession                                string
+	kinesisInterval                               time.Duration
+
+	firehoseStream, firehoseRegion, firehoseEndpoint string
+	firehoseAccessKey, firehoseSecretKey             string
+	firehoseSession                                  string
+	firehoseInterval                                 time.Duration
+
+	pubsubTopic, pubsubCredentials, pubsubEndpoint string
+	pubsubBatchSize                                int
+	pubsubInterval                                 time.Duration
+
+	eventhubsConn, eventhubsName, eventhubsKey string
+	eventhubsInterval                          time.Duration
+
+	bigqueryTable, bigqueryCreds string
+	bigqueryInterval             time.Duration
+
+	webhookURL, webhookMethod    string
+	webhookHeaders               []string
+	webhookTemplate, webhookMode string
+	webhookBatchSize             int
+	webhookInterval              time.Duration
+
+	// stdout is only a top-level option, as the messages of several
+	// pipelines would be mixed on it.
+	stdout bool
+}
+
+// topSinkConfig returns the sinks of the top-level options.
+func topSinkConfig() sinkConfig {
+	return sinkConfig{
+		sqliteDir:         SQLITE_DIR,
+		sqliteKeepDays:    SQLITE_KEEP_DAYS,
+		postgresURL:       POSTGRES_URL,
+		postgresTable:     POSTGRES_TABLE,
+		postgresInterval:  POSTGRES_INTERVAL,
+		s3Bucket:          S3_BUCKET,
+		s3Prefix:          S3_PREFIX,
+		s3Region:          S3_REGION,
+		s3Endpoint:        S3_ENDPOINT,
+		s3AccessKeyID:     S3_ACCESS_KEY_ID,
+		s3SecretAccessKey: S3_SECRET_ACCESS_KEY,
+		s3SessionToken:    S3_SESSION_TOKEN,
+		s3Interval:        S3_INTERVAL,
+		splunkURL:         SPLUNK_URL,
+		splunkToken:       SPLUNK_TOKEN,
+		splunkIndex:       SPLUNK_INDEX,
+		splunkSourcetype:  SPLUNK_SOURCETYPE,
+		splunkAck:         SPLUNK_ACK,
+		splunkInterval:    SPLUNK_INTERVAL,
+		redisURL:          REDIS_URL,
+		redisStream:       REDIS_STREAM,
+		redisMaxLen:       REDIS_MAXLEN,
+		redisMaxLenExact:  REDIS_MAXLEN_EXACT,
+		redisInterval:     REDIS_INTERVAL,
+		kinesisStream:     KINESIS_STREAM,
+		kinesisRegion:     KINESIS_REGION,
+		kinesisEndpoint:   KINESIS_ENDPOINT,
+		kinesisAccessKey:  KINESIS_ACCESS_KEY_ID,
+		kinesisSecretKey:  KINESIS_SECRET_ACCESS_KEY,
+		kinesisSession:    KINESIS_SESSION_TOKEN,
+		kinesisInterval:   KINESIS_INTERVAL,
+		firehoseStream:    FIREHOSE_STREAM,
+		firehoseRegion:    FIREHOSE_REGION,
+		firehoseEndpoint:  FIREHOSE_ENDPOINT,
+		firehoseAccessKey: FIREHOSE_ACCESS_KEY_ID,
+		firehoseSecretKey: FIREHOSE_SECRET_ACCESS_KEY,
+		firehoseSession:   FIREHOSE_SESSION_TOKEN,
+		firehoseInterval:  FIREHOSE_INTERVAL,
+		pubsubTopic:       PUBSUB_TOPIC,
+		pubsubCredentials: PUBSUB_CREDENTIALS,
+		pubsubEndpoint:    PUBSUB_ENDPOINT,
+		pubsubBatchSize:   PUBSUB_BATCH_SIZE,
+		pubsubInterval:    PUBSUB_INTERVAL,
+		eventhubsConn:     EVENTHUBS_CONNECTION,
+		eventhubsName:     EVENTHUBS_NAME,
+		eventhubsKey:      EVENTHUBS_PARTITION_KEY,
+		eventhubsInterval: EVENTHUBS_INTERVAL,
+		bigqueryTable:     BIGQUERY_TABLE,
+		bigqueryCreds:     BIGQUERY_CREDENTIALS,
+		bigqueryInterval:  BIGQUERY_INTERVAL,
+		webhookURL:        WEBHOOK_URL,
+		webhookMethod:     WEBHOOK_METHOD,
+		webhookHeaders:    WEBHOOK_HEADERS.Value(),
+		webhookTemplate:   WEBHOOK_TEMPLATE,
+		webhookMode:       WEBHOOK_MODE,
+		webhookBatchSize:  WEBHOOK_BATCH_SIZE,
+		webhookInterval:   WEBHOOK_INTERVAL,
+		stdout:            STDOUT,
+	}
+}
+
+// names returns the options of the configured sinks.
+func (c sinkConfig) names() []string {
+	var names []string
+	for _, sink := range []struct {
+		name string
+		on   bool
+	}{
+		{"sqlite_dir", c.sqliteDir != ""},
+		{"postgres_url", c.postgresURL != ""},
+		{"s3_bucket", c.s3Bucket != ""},
+		{"splunk_url", c.splunkURL != ""},
+		{"redis_url", c.redisURL != ""},
+		{"kinesis_stream", c.kinesisStream != ""},
+		{"firehose_stream", c.firehoseStream != ""},
+		{"pubsub_topic", c.pubsubTopic != ""},
+		{"eventhubs_connection_string", c.eventhubsConn != ""},
+		{"bigquery_table", c.bigqueryTable != ""},
+		{"webhook_url", c.webhookURL != ""},
+		{"stdout", c.stdout},
+	} {
+		if sink.on {
+			names = append(names, sink.name)
+		}
+	}
+	return names
+}
+
+// validate checks the settings of the configured sinks.
+func (c sinkConfig) validate() error {
+	if c.sqliteDir != "" && !sqliteSupported {
+		return fmt.Errorf("sqlite_dir needs a build with SQLite: go build -tags sqlite")
+	}
+	if c.sqliteKeepDays < 0 {
+		return fmt.Errorf("sqlite_keep_days must not be negative")
+	}
+	if c.postgresURL != "" {
+		if _, err := parsePostgresURL(c.postgresURL); err != nil {
+			return fmt.Errorf("invalid postgres_url: %w", err)
+		}
+		switch {
+		case !postgresTableName.MatchString(c.postgresTable):
+			return fmt.Errorf("postgres_table %q must be a table name, optionally schema-qualified, of letters, digits and underscores", c.postgresTable)
+		case c.postgresInterval < 100*time.Millisecond:
+			return fmt.Errorf("postgres_interval must be at least 100ms")
+		}
+	}
+	if c.s3Bucket != "" {
+		switch {
+		case c.s3AccessKeyID == "" || c.s3SecretAccessKey == "":
+			return fmt.Errorf("s3_bucket needs s3_access_key_id and s3_secret_access_key")
+		case c.s3Region == "":
+			return fmt.Errorf("s3_region cannot be empty")
+		case c.s3Endpoint != "" && !strings.HasPrefix(c.s3Endpoint, "http://") && !strings.HasPrefix(c.s3Endpoint, "https://"):
+			return fmt.Errorf("s3_endpoint %q must be an http:// or https:// URL", c.s3Endpoint)
+		case c.s3Interval < time.Second:
+			return fmt.Errorf("s3_interval must be at least 1s")
+		}
+	}
+	if c.splunkURL != "" {
+		switch {
+		case !strings.HasPrefix(c.splunkURL, "http://") && !strings.HasPrefix(c.splunkURL, "https://"):
+			return fmt.Errorf("splunk_url %q must be an http:// or https:// URL", c.splunkURL)
+		case c.splunkToken == "":
+			return fmt.Errorf("splunk_url needs splunk_token")
+		case c.splunkInterval < 100*time.Millisecond:
+			return fmt.Errorf("splunk_interval must be at least 100ms")
+		}
+	}
+	if c.redisURL != "" {
+		if _, err := parseRedisURL(c.redisURL); err != nil {
+			return fmt.Errorf("invalid redis_url: %w", err)
+		}
+		switch {
+		case c.redisStream == "":
+			return fmt.Errorf("redis_stream cannot be empty")
+		case c.redisMaxLen < 0:
+			return fmt.Errorf("redis_maxlen must not be negative")
+		case c.redisInterval < 100*time.Millisecond:
+			return fmt.Errorf("redis_interval must be at least 100ms")
+		}
+	}
+	if c.kinesisStream != "" {
+		switch {
+		case c.kinesisAccessKey == "" || c.kinesisSecretKey == "":
+			return fmt.Errorf("kinesis_stream needs kinesis_access_key_id and kinesis_secret_access_key")
+		case c.kinesisRegion == "":
+			return fmt.Errorf("kinesis_region cannot be empty")
+		case c.kinesisEndpoint != "" && !strings.HasPrefix(c.kinesisEndpoint, "http://") && !strings.HasPrefix(c.kinesisEndpoint, "https://"):
+			return fmt.Errorf("kinesis_endpoint %q must be an http:// or https:// URL", c.kinesisEndpoint)
+		case c.kinesisInterval < 100*time.Millisecond:
+			return fmt.Errorf("kinesis_interval must be at least 100ms")
+		}
+	}
+	if c.firehoseStream != "" {
+		switch {
+		case c.firehoseAccessKey == "" || c.firehoseSecretKey == "":
+			return fmt.Errorf("firehose_stream needs firehose_access_key_id and firehose_secret_access_key")
+		case c.firehoseRegion == "":
+			return fmt.Errorf("firehose_region cannot be empty")
+		case c.firehoseEndpoint != "" && !strings.HasPrefix(c.firehoseEndpoint, "http://") && !strings.HasPrefix(c.firehoseEndpoint, "https://"):
+			return fmt.Errorf("firehose_endpoint %q must be an http:// or https:// URL", c.firehoseEndpoint)
+		case c.firehoseInterval < 100*time.Millisecond:
+			return fmt.Errorf("firehose_interval must be at least 100ms")
+		}
+	}
+	if c.pubsubTopic != "" {
+		switch {
+		case !pubsubTopicName.MatchString(c.pubsubTopic):
+			return fmt.Errorf("pubsub_topic %q must be a full topic name such as 'projects/my-project/topics/adsb'", c.pubsubTopic)
+		case c.pubsubEndpoint != "" && !strings.HasPrefix(c.pubsubEndpoint, "http://") && !strings.HasPrefix(c.pubsubEndpoint, "https://"):
+			return fmt.Errorf("pubsub_endpoint %q must be an http:// or https:// URL", c.pubsubEndpoint)
+		case c.pubsubBatchSize < 1 || c.pubsubBatchSize > pubsubBatchMax:
+			return fmt.Errorf("pubsub_batch_size must be between 1 and %d", pubsubBatchMax)
+		case c.pubsubInterval < 100*time.Millisecond:
+			return fmt.Errorf("pubsub_interval must be at least 100ms")
+		}
+	}
+	if c.eventhubsConn != "" {
+		conn, err := parseEventHubsConnection(c.eventhubsConn)
+		switch {
+		case err != nil:
+			return fmt.Errorf("invalid eventhubs_connection_string: %w", err)
+		case conn.entity == "" && c.eventhubsName == "":
+			return fmt.Errorf("eventhubs_name is needed when eventhubs_connection_string has no EntityPath")
+		case conn.entity != "" && c.eventhubsName != "" && conn.entity != c.eventhubsName:
+			return fmt.Errorf("eventhubs_name %q differs from the EntityPath %q of eventhubs_connection_string", c.eventhubsName, conn.entity)
+		case c.eventhubsKey != "icao24" && c.eventhubsKey != "receiver" && c.eventhubsKey != "none":
+			return fmt.Errorf("unknown eventhubs_partition_key %q, expected 'icao24', 'receiver' or 'none'", c.eventhubsKey)
+		case c.eventhubsInterval < 100*time.Millisecond:
+			return fmt.Errorf("eventhubs_interval must be at least 100ms")
+		}
+	}
+	if c.bigqueryTable != "" {
+		switch {
+		case !bigqueryTableName.MatchString(c.bigqueryTable):
+			return fmt.Errorf("bigquery_table %q must be a table name such as 'my-project.adsb.events'", c.bigqueryTable)
+		case c.bigqueryInterval < 100*time.Millisecond:
+			return fmt.Errorf("bigquery_interval must be at least 100ms")
+		}
+	}
+	if c.webhookURL != "" {
+		if _, err := parseHeaders(c.webhookHeaders); err != nil {
+			return fmt.Errorf("invalid webhook_header: %w", err)
+		}
+		switch {
+		case !strings.HasPrefix(c.webhookURL, "http://") && !strings.HasPrefix(c.webhookURL, "https://"):
+			return fmt.Errorf("webhook_url %q must be an http:// or https:// URL", c.webhookURL)
+		case c.webhookMethod != "POST" && c.webhookMethod != "PUT" && c.webhookMethod != "PATCH":
+			return fmt.Errorf("unknown webhook_method %q, expected 'POST', 'PUT' or 'PATCH'", c.webhookMethod)
+		case c.webhookMode != "batch" && c.webhookMode != "event":
+			return fmt.Errorf("unknown webhook_mode %q, expected 'batch' or 'event'", c.webhookMode)
+		case c.webhookBatchSize < 1:
+			return fmt.Errorf("webhook_batch_size must be at least 1")
+		case c.webhookInterval < 100*time.Millisecond:
+			return fmt.Errorf("webhook_interval must be at least 100ms")
+		}
+	}
+	return nil
+}
+
+// messageSinks are the running sinks of a sinkConfig.
+type messageSinks struct {
+	sqlite    *sqliteArchive
+	postgres  *postgresSink
+	s3        *s3Writer
+	s3Done    chan struct{}
+	splunk    *splunkSink
+	redis     *redisSink
+	kinesis   *kinesisSink
+	firehose  *firehoseSink
+	pubsub    *pubsubSink
+	eventhubs *eventhubsSink
+	bigquery  *bigquerySink
+	webhook   *webhookSink
+	stdout    *stdoutSink
+}
+
+// start starts the configured sinks, which write in the background.
+func (c sinkConfig) start() (*messageSinks, error) {
+	s := &messageSinks{}
+	if c.sqliteDir != "" {
+		var err error
+		if s.sqlite, err = newSQLiteArchive(c.sqliteDir, c.sqliteKeepDays); err != nil {
+			return nil, err
+		}
+	}
+	if c.postgresURL != "" {
+		config, _ := parsePostgresURL(c.postgresURL)
+		s.postgres = newPostgresSink(config, c.postgresTable, c.postgresInterval)
+	}
+	if c.s3Bucket != "" {
+		s.s3 = newS3Writer(c.s3Bucket, c.s3Prefix, c.s3Region, c.s3Endpoint, c.s3AccessKeyID, c.s3SecretAccessKey, c.s3SessionToken, c.s3Interval)
+		s.s3Done = make(chan struct{})
+		safeGo("s3", true, func() { s.s3.Run(s.s3Done) })
+	}
+	if c.splunkURL != "" {
+		s.splunk = newSplunkSink(c.splunkURL, c.splunkToken, c.splunkIndex, c.splunkSourcetype, c.splunkAck, c.splunkInterval)
+	}
+	if c.redisURL != "" {
+		config, _ := parseRedisURL(c.redisURL)
+		s.redis = newRedisSink(config, c.redisStream, c.redisMaxLen, c.redisMaxLenExact, c.redisInterval)
+	}
+	if c.kinesisStream != "" {
+		s.kinesis = newKinesisSink(c.kinesisStream, c.kinesisRegion, c.kinesisEndpoint, c.kinesisAccessKey, c.kinesisSecretKey, c.kinesisSession, c.kinesisInterval)
+	}
+	if c.firehoseStream != "" {
+		s.firehose = newFirehoseSink(c.firehoseStream, c.firehoseRegion, c.firehoseEndpoint, c.firehoseAccessKey, c.firehoseSecretKey, c.firehoseSession, c.firehoseInterval)
+	}
+	if c.pubsubTopic != "" {
+		var err error
+		if s.pubsub, err = newPubSubSink(c.pubsubTopic, c.pubsubCredentials, c.pubsubEndpoint, c.pubsubBatchSize, c.pubsubInterval); err != nil {
+			return nil, err
+		}
+	}
+	if c.eventhubsConn != "" {
+		s.eventhubs = newEventHubsSink(c.eventhubsConn, c.eventhubsName, c.eventhubsKey, c.eventhubsInterval)
+	}
+	if c.bigqueryTable != "" {
+		var err error
+		if s.bigquery, err = newBigQuerySink(c.bigqueryTable, c.bigqueryCreds, c.bigqueryInterval); err != nil {
+			return nil, err
+		}
+	}
+	if c.webhookURL != "" {
+		var err error
+		if s.webhook, err = newWebhookSink(c.webhookURL, c.webhookMethod, c.webhookHeaders, c.webhookTemplate, c.webhookMode, c.webhookBatchSize, c.webhookInterval); err != nil {
+			return nil, err
+		}
+	}
+	if c.stdout {
+		s.stdout = newStdoutSink(os.Stdout)
+	}
+	return s, nil
+}
+
+// Add queues a message in every sink that is not disabled.
+func (s *messageSinks) Add(msg SBS1Message) {
+	if s.sqlite != nil && s.enabled("sqlite") {
+		s.sqlite.Add(msg)
+	}
+	if s.postgres != nil && s.enabled("postgres") {
+		s.postgres.Add(msg)
+	}
+	if s.s3 != nil && s.enabled("s3") {
+		s.s3.Add(msg)
+	}
+	if s.splunk != nil && s.enabled("splunk") {
+		s.splunk.Add(msg)
+	}
+	if s.redis != nil && s.enabled("redis") {
+		s.redis.Add(msg)
+	}
+	if s.kinesis != nil && s.enabled("kinesis") {
+		s.kinesis.Add(msg)
+	}
+	if s.firehose != nil && s.enabled("firehose") {
+		s.firehose.Add(msg)
+	}
+	if s.pubsub != nil && s.enabled("pubsub") {
+		s.pubsub.Add(msg)
+	}
+	if s.eventhubs != nil && s.enabled("eventhubs") {
+		s.eventhubs.Add(msg)
+	}
+	if s.bigquery != nil && s.enabled("bigquery") {
+		s.bigquery.Add(msg)
+	}
+	if s.webhook != nil && s.enabled("webhook") {
+		s.webhook.Add(msg)
+	}
+	if s.stdout != nil && s.enabled("stdout") {
+		s.stdout.Add(msg)
+	}
+}
+
+// enabled reports whether sink is enabled, counting the message it drops
+// if not.
+func (s *messageSinks) enabled(sink string) bool {
+	if toggles.Enabled(sink) {
+		return true
+	}
+	metricDisabledSink.Inc(sink)
+	return false
+}
+
+// Close writes what the sinks have queued and stops them.
+func (s *messageSinks) Close() {
+	if s.sqlite != nil {
+		if err := s.sqlite.Close(); err != nil {
+			log.Println("Error writing SQLite archive:", err)
+		}
+	}
+	if s.postgres != nil {
+		s.postgres.Close()
+	}
+	if s.s3 != nil {
+		close(s.s3Done)
+		s.s3.Flush()
+	}
+	if s.splunk != nil {
+		s.splunk.Close()
+	}
+	if s.redis != nil {
+		s.redis.Close()
+	}
+	if s.kinesis != nil {
+		s.kinesis.Close()
+	}
+	if s.firehose != nil {
+		s.firehose.Close()
+	}
+	if s.pubsub != nil {
+		s.pubsub.Close()
+	}
+	if s.eventhubs != nil {
+		s.eventhubs.Close()
+	}
+	if s.bigquery != nil {
+		s.bigquery.Close()
+	}
+	if s.webhook != nil {
+		s.webhook.Close()
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import "time"
+
+// AirspaceSnapshot describes an aircraft's place in a periodic airspace
+// snapshot.
+type AirspaceSnapshot struct {
+	// Aircraft is how many aircraft the snapshot holds, so a consumer can
+	// tell when it has all of them.
+	Aircraft int `json:"aircraft"`
+	// Seen and SeenPos are the seconds since the aircraft's last message
+	// and last position, like aircraft.json's seen and seen_pos.
+	Seen     float64  `json:"seen"`
+	SeenPos  *float64 `json:"seen_pos,omitempty"`
+	Messages int      `json:"messages"`
+}
+
+// airspaceSnapshot returns a SNAPSHOT message for every aircraft the
+// tracker holds at now, all with now as their timestamp.
+func airspaceSnapshot(t *Tracker, now time.Time) []SBS1Message {
+	var current []Aircraft
+	for _, a := range t.Snapshot() {
+		if !t.expired(&a, now) {
+			current = append(current, a)
+		}
+	}
+
+	messages := make([]SBS1Message, 0, len(current))
+	for _, a := range current {
+		a := a
+		snapshot := &AirspaceSnapshot{Aircraft: len(current), Seen: now.Sub(a.LastSeen).Seconds(), Messages: a.Messages}
+		if a.LastPosition != nil {
+			seenPos := now.Sub(*a.LastPosition).Seconds()
+			snapshot.SeenPos = &seenPos
+		}
+		logged := now
+		messages = append(messages, SBS1Message{
+			Timestamp:     formatTimestamp(now),
+			MessageType:   "SNAPSHOT",
+			Icao24:        a.Icao24,
+			GeneratedDate: &a.LastSeen,
+			LoggedDate:    &logged,
+			Callsign:      a.Callsign,
+			Altitude:      a.Altitude,
+			GroundSpeed:   a.GroundSpeed,
+			Track:         a.Track,
+			Lat:           a.Lat,
+			Lon:           a.Lon,
+			VerticalRate:  a.VerticalRate,
+			Squawk:        a.Squawk,
+			Emergency:     a.Emergency,
+			OnGround:      a.OnGround,
+			LinkType:      LINK_TYPE,
+			FlightUUID:    a.FlightUUID,
+			Ghost:         a.Ghost,
+			Kind:          a.Kind,
+			Snapshot:      snapshot,
+		})
+	}
+	return messages
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"runtime"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// soakSample is one heap and goroutine snapshot taken during a soak run.
+type soakSample struct {
+	Elapsed    float64 `json:"elapsed_seconds"`
+	Lines      int     `json:"lines"`
+	HeapBytes  uint64  `json:"heap_bytes"`
+	Goroutines int     `json:"goroutines"`
+	Aircraft   int     `json:"aircraft"`
+	Cached     int     `json:"cached"`
+}
+
+// soakResult is the outcome of a soak run and its --json output.
+type soakResult struct {
+	Version         string       `json:"version"`
+	Lines           int          `json:"lines"`
+	Seconds         float64      `json:"seconds"`
+	HeapGrowth      float64      `json:"heap_growth"`
+	GoroutineGrowth float64      `json:"goroutine_growth"`
+	Leaking         []string     `json:"leaking,omitempty"`
+	Samples         []soakSample `json:"samples"`
+}
+
+// soakCommand runs the pipeline on generated traffic for a long time and
+// fails if memory or goroutines keep growing.
+func soakCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "soak",
+		Usage: "Feed generated traffic through parsing, tracking, caching and payload encoding for a long time, snapshot heap and goroutine counts, and fail if they trend upward.",
+		Flags: []cli.Flag{
+			&cli.DurationFlag{
+				Name:  "duration",
+				Value: time.Hour,
+				Usage: "How long to run.",
+			},
+			&cli.DurationFlag{
+				Name:  "interval",
+				Value: time.Minute,
+				Usage: "Time between heap and goroutine snapshots.",
+			},
+			&cli.DurationFlag{
+				Name:  "warmup",
+				Value: 5 * time.Minute,
+				Usage: "Snapshots taken before this are logged but not used for the trend, so the tracker and caches can fill first.",
+			},
+			&cli.IntFlag{
+				Name:  "aircraft",
+				Value: 2000,
+				Usage: "Number of aircraft in the air at once.",
+			},
+			&cli.Float64Flag{
+				Name:  "churn",
+				Value: 0.001,
+				Usage: "Chance, per message, that an aircraft lands and a new one takes its place.",
+			},
+			&cli.Float64Flag{
+				Name:  "max_heap_growth",
+				Value: 0.1,
+				Usage: "Fail if the heap trend grows by more than this share of its size after warmup.",
+			},
+			&cli.Float64Flag{
+				Name:  "max_goroutine_growth",
+				Value: 2,
+				Usage: "Fail if the goroutine trend grows by more than this many goroutines after warmup.",
+			},
+			&cli.Int64Flag{
+				Name:  "seed",
+				Usage: "Seed for the generated traffic. Defaults to the current time.",
+			},
+			&cli.BoolFlag{
+				Name:  "json",
+				Usage: "Print the result as JSON.",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if c.Duration("interval") <= 0 || c.Duration("duration") < 3*c.Duration("interval")+c.Duration("warmup") {
+				return configErrorf("--duration must leave room for at least three --interval snapshots after --warmup")
+			}
+			if c.Int("aircraft") < 1 {
+				return configErrorf("--aircraft must be at least 1")
+			}
+			if churn := c.Float64("churn"); churn < 0 || churn > 1 {
+				return configErrorf("--churn must be between 0 and 1")
+			}
+			var err error
+			if surface, err = newSurfaceFilter(VEHICLE_ICAO_RANGES.Value(), OBSTACLE_ICAO_RANGES.Value(), VEHICLES, OBSTACLES); err != nil {
+				return err
+			}
+			if transmissionTypes, err = parseTransmissionTypes(TRANSMISSION_TYPES.Value()); err != nil {
+				return configErrorf("%v", err)
+			}
+			seed := c.Int64("seed")
+			if !c.IsSet("seed") {
+				seed = time.Now().UnixNano()
+			}
+			log.Printf("Soaking for %s with %d aircraft, seed %d", c.Duration("duration"), c.Int("aircraft"), seed)
+
+			s := &soak{
+				gen:      newTrafficGenerator(rand.New(rand.NewSource(seed)), c.Int("aircraft"), c.Float64("churn")),
+				duration: c.Duration("duration"),
+				interval: c.Duration("interval"),
+				warmup:   c.Duration("warmup"),
+			}
+			res, err := s.run()
+			if err != nil {
+				return err
+			}
+			res.judge(c.Float64("max_heap_growth"), c.Float64("max_goroutine_growth"))
+			if c.Bool("json") {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				if err := enc.Encode(res); err != nil {
+					return err
+				}
+			} else if err := res.Print(); err != nil {
+				return err
+			}
+			if len(res.Leaking) > 0 {
+				return fmt.Errorf("soak found a leak: %v keeps growing", res.Leaking)
+			}
+			return nil
+		},
+	}
+}
+
+// soak drives one long-lived tracker and lookup cache with generated
+// traffic, the way a collector running for weeks would.
+type soak struct {
+	gen                        *trafficGenerator
+	duration, interval, warmup time.Duration
+}
+
+// run feeds traffic until the duration passes, sampling every interval.
+func (s *soak) run() (*soakResult, error) {
+	saved := clock
+	defer func() { clock = saved }()
+	clock = &recordedClock{}
+
+	tracker := newTracker()
+	cache := newLookupCache(ENRICHMENT_CACHE_SIZE, ENRICHMENT_CACHE_TTL, ENRICHMENT_NEGATIVE_TTL)
+	sizer := newBatchSizer()
+	batch := make([]SBS1Message, 0, sizer.min)
+	res := &soakResult{Version: version}
+
+	start := time.Now()
+	next := start.Add(s.interval)
+	for {
+		// Check the time every few thousand lines rather than on each one.
+		for i := 0; i < 4096; i++ {
+			res.Lines++
+			parsed, ok := parseLine(s.gen.Next())
+			if !ok || !transmissionTypes.Keep(parsed) || !surface.Apply(&parsed) {
+				continue
+			}
+			a := tracker.annotate(&parsed)
+			if a.Callsign != "" {
+				now := clock.Now()
+				if _, ok := cache.Get(a.Callsign, now); !ok {
+					var row []string
+					// Every other callsign is a cached miss.
+					if len(a.Callsign)%2 == 0 {
+						row = []string{a.Callsign}
+					}
+					cache.Put(a.Callsign, row, now)
+				}
+			}
+			batch = append(batch, parsed)
+			sizer.Observe(1, clock.Now())
+			if sizer.Full(len(batch)) {
+				if _, err := buildPayload(batch); err != nil {
+					return nil, err
+				}
+				batch = batch[:0]
+			}
+		}
+
+		if now := time.Now(); !now.Before(next) {
+			sample := takeSoakSample(now.Sub(start), res.Lines, tracker, cache)
+			res.Samples = append(res.Samples, sample)
+			log.Printf("soak %s: %d lines, heap %s, %d goroutines, %d aircraft, %d cached",
+				now.Sub(start).Round(time.Second), sample.Lines, formatBytes(float64(sample.HeapBytes)),
+				sample.Goroutines, sample.Aircraft, sample.Cached)
+			if now.Sub(start) >= s.duration {
+				res.Seconds = now.Sub(start).Seconds()
+				break
+			}
+			next = next.Add(s.interval)
+		}
+	}
+	// Keep only the samples after warmup for the trend.
+	steady := res.Samples[:0:0]
+	for _, sample := range res.Samples {
+		if sample.Elapsed >= s.warmup.Seconds() {
+			steady = append(steady, sample)
+		}
+	}
+	res.HeapGrowth = trendGrowth(steady, func(s soakSample) float64 { return float64(s.HeapBytes) })
+	res.GoroutineGrowth = trendGrowth(steady, func(s soakSample) float64 { return float64(s.Goroutines) })
+	if len(steady) > 0 && steady[0].HeapBytes > 0 {
+		res.HeapGrowth /= float64(steady[0].HeapBytes)
+	}
+	return res, nil
+}
+
+// takeSoakSample collects garbage and snapshots the live heap.
+func takeSoakSample(elapsed time.Duration, lines int, tracker *Tracker, cache *lookupCache) soakSample {
+	var mem runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&mem)
+	cache.mu.Lock()
+	cached := cache.lru.Len()
+	cache.mu.Unlock()
+	return soakSample{
+		Elapsed:    elapsed.Seconds(),
+		Lines:      lines,
+		HeapBytes:  mem.HeapAlloc,
+		Goroutines: runtime.NumGoroutine(),
+		Aircraft:   tracker.Len(),
+		Cached:     cached,
+	}
+}
+
+// trendGrowth fits a least-squares line through the samples and returns how
+// much it rises from the first sample to the last. A single outlier, such
+// as a map growing its buckets once, barely moves the fit.
+func trendGrowth(samples []soakSample, value func(soakSample) float64) float64 {
+	n := float64(len(samples))
+	if n < 2 {
+		return 0
+	}
+	var sx, sy, sxx, sxy float64
+	for _, s := range samples {
+		x, y := s.Elapsed, value(s)
+		sx += x
+		sy += y
+		sxx += x * x
+		sxy += x * y
+	}
+	d := n*sxx - sx*sx
+	if d == 0 {
+		return 0
+	}
+	slope := (n*sxy - sx*sy) / d
+	return slope * (samples[len(samples)-1].Elapsed - samples[0].Elapsed)
+}
+
+// judge records which resources grew by more than allowed.
+func (r *soakResult) judge(maxHeapGrowth, maxGoroutineGrowth float64) {
+	if r.HeapGrowth > maxHeapGrowth {
+		r.Leaking = append(r.Leaking, "heap")
+	}
+	if r.GoroutineGrowth > maxGoroutineGrowth {
+		r.Leaking = append(r.Leaking, "goroutines")
+	}
+}
+
+// Print writes the result as a table.
+func (r *soakResult) Print() error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "version\t%s\n", r.Version)
+	fmt.Fprintf(w, "lines\t%d in %.0fs\n", r.Lines, r.Seconds)
+	fmt.Fprintf(w, "heap trend\t%+.1f%%\n", 100*r.HeapGrowth)
+	fmt.Fprintf(w, "goroutine trend\t%+.1f\n", r.GoroutineGrowth)
+	if len(r.Leaking) > 0 {
+		fmt.Fprintf(w, "result\tFAIL (%v growing)\n", r.Leaking)
+	} else {
+		fmt.Fprintf(w, "result\tPASS\n")
+	}
+	return w.Flush()
+}
+
+// trafficGenerator produces an endless SBS-1 feed from a fleet of aircraft
+// that take off and land, so new addresses keep arriving and old ones must
+// expire. Time moves 10ms per message.
+type trafficGenerator struct {
+	rng    *rand.Rand
+	churn  float64
+	now    time.Time
+	fleet  []generatedAircraft
+	nextID int
+}
+
+type generatedAircraft struct {
+	icao24   string
+	callsign string
+	lat, lon float64
+	msgType  int
+}
+
+func newTrafficGenerator(rng *rand.Rand, aircraft int, churn float64) *trafficGenerator {
+	g := &trafficGenerator{
+		rng:   rng,
+		churn: churn,
+		now:   time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		fleet: make([]generatedAircraft, aircraft),
+	}
+	for i := range g.fleet {
+		g.fleet[i] = g.takeOff()
+	}
+	return g
+}
+
+// takeOff returns an aircraft with a new address and callsign.
+func (g *trafficGenerator) takeOff() generatedAircraft {
+	g.nextID = (g.nextID + 1) % 0xFFFFFF
+	return generatedAircraft{
+		icao24:   fmt.Sprintf("%06X", g.nextID),
+		callsign: fmt.Sprintf("SOK%d", g.nextID%10000),
+		lat:      g.rng.Float64()*120 - 60,
+		lon:      g.rng.Float64()*360 - 180,
+	}
+}
+
+// Next returns the next SBS-1 line.
+func (g *trafficGenerator) Next() string {
+	g.now = g.now.Add(10 * time.Millisecond)
+	i := g.rng.Intn(len(g.fleet))
+	if g.rng.Float64() < g.churn {
+		g.fleet[i] = g.takeOff()
+	}
+	a := &g.fleet[i]
+	a.msgType = a.msgType%3 + 1
+	date, tod := g.now.Format("2006/01/02"), g.now.Format("15:04:05.000")
+	prefix := fmt.Sprintf("MSG,%d,1,1,%s,1,%s,%s,%s,%s", []int{1, 3, 4}[a.msgType-1], a.icao24, date, tod, date, tod)
+	switch a.msgType {
+	case 1:
+		return prefix + "," + a.callsign + ",,,,,,,,,,,0"
+	case 2:
+		a.lat += (g.rng.Float64() - 0.5) * 0.01
+		a.lon += (g.rng.Float64() - 0.5) * 0.01
+		return prefix + fmt.Sprintf(",,35000,,,%.5f,%.5f,,,0,,0,0", a.lat, a.lon)
+	default:
+		return prefix + fmt.Sprintf(",,,450.0,%.1f,,,0,,0,,0,0", g.rng.Float64()*360)
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// splunkPendingMax bounds the messages waiting to be sent, which
+	// includes those kept for a retry while Splunk is unreachable.
+	splunkPendingMax = 100000
+	// splunkBatchMax is the most events sent in one request.
+	splunkBatchMax = 5000
+	// splunkAckTimeout is how long a request waits for its acknowledgement
+	// before its events are sent again.
+	splunkAckTimeout = 2 * time.Minute
+)
+
+// splunkSink sends every decoded aircraft message to a Splunk HTTP Event
+// Collector every interval, as one event per message in the message's JSON.
+// A batch that fails is kept and sent again with the next one. With
+// indexer acknowledgement a batch only counts as delivered once Splunk
+// reports it indexed, and is sent again when that takes longer than
+// splunkAckTimeout.
+type splunkSink struct {
+	url, token        string
+	index, sourcetype string
+	ack               bool
+	// channel identifies this collector's requests, which Splunk needs to
+	// track their acknowledgements.
+	channel  string
+	interval time.Duration
+	client   *http.Client
+
+	mu      sync.Mutex
+	pending []SBS1Message
+	dropped int
+
+	// flushMu serializes requests and guards unacked.
+	flushMu sync.Mutex
+	unacked map[int64]splunkBatch
+	failing bool
+	closed  bool
+}
+
+// splunkBatch is a request's events awaiting acknowledgement.
+type splunkBatch struct {
+	msgs []SBS1Message
+	sent time.Time
+}
+
+// newSplunkSink starts sending in the background.
+func newSplunkSink(url, token, index, sourcetype string, ack bool, interval time.Duration) *splunkSink {
+	s := &splunkSink{
+		url: strings.TrimSuffix(url, "/"), token: token, index: index, sourcetype: sourcetype,
+		ack: ack, channel: uuid.NewString(), interval: interval, client: withChaos("splunk", newHTTPClient()),
+		unacked: map[int64]splunkBatch{},
+	}
+	safeGo("splunk", true, func() {
+		for range time.Tick(interval) {
+			s.Flush()
+		}
+	})
+	return s
+}
+
+// Add queues a message to be sent.
+func (s *splunkSink) Add(msg SBS1Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.pending) >= splunkPendingMax {
+		s.dropped++
+		return
+	}
+	s.pending = append(s.pending, msg)
+}
+
+// Flush collects the acknowledgements of earlier requests and sends the
+// queued messages. Failures are logged once until a request succeeds
+// again.
+func (s *splunkSink) Flush() error {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+	return s.flushLocked()
+}
+
+func (s *splunkSink) flushLocked() error {
+	s.mu.Lock()
+	pending, dropped := s.pending, s.dropped
+	s.pending, s.dropped = nil, 0
+	s.mu.Unlock()
+	if dropped > 0 {
+		metricSinkErrors.Add("splunk", float64(dropped))
+		log.Printf("Dropped %d message(s) for Splunk, which fell behind", dropped)
+	}
+	if s.closed {
+		return nil
+	}
+
+	var err error
+	if len(s.unacked) > 0 {
+		var expired []SBS1Message
+		expired, err = s.pollAcksLocked()
+		pending = append(expired, pending...)
+	}
+	for len(pending) > 0 && err == nil {
+		n := len(pending)
+		if n > splunkBatchMax {
+			n = splunkBatchMax
+		}
+		if err = s.sendLocked(pending[:n]); err == nil {
+			pending = pending[n:]
+		}
+	}
+	switch {
+	case err != nil && !s.failing:
+		log.Printf("Error sending messages to Splunk at %s: %v", s.url, err)
+	case err == nil && s.failing:
+		log.Printf("Sending messages to Splunk at %s again", s.url)
+	}
+	s.failing = err != nil
+	if err != nil {
+		metricSinkErrors.Inc("splunk")
+	}
+	if len(pending) > 0 {
+		s.requeue(pending)
+	}
+	return err
+}
+
+// requeue puts unsent messages back in front of those queued since,
+// dropping the oldest beyond splunkPendingMax.
+func (s *splunkSink) requeue(msgs []SBS1Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pending := append(msgs, s.pending...)
+	if over := len(pending) - splunkPendingMax; over > 0 {
+		pending = pending[over:]
+		s.dropped += over
+	}
+	s.pending = pending
+}
+
+// splunkEvent is an event of the HEC event endpoint.
+type splunkEvent struct {
+	Time       json.Number       `json:"time"`
+	Host       string            `json:"host,omitempty"`
+	Source     string            `json:"source,omitempty"`
+	Sourcetype string            `json:"sourcetype,omitempty"`
+	Index      string            `json:"index,omitempty"`
+	Event      SBS1Message       `json:"event"`
+	Fields     map[string]string `json:"fields,omitempty"`
+}
+
+// sendLocked sends msgs in one request. With acknowledgement they are kept
+// in unacked until Splunk reports them indexed.
+func (s *splunkSink) sendLocked(msgs []SBS1Message) error {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, msg := range msgs {
+		host := msg.Receiver
+		if host == "" {
+			host = RECEIVER_NAME
+		}
+		event := splunkEvent{
+			Time:   json.Number(strconv.FormatFloat(float64(messageTime(msg).UnixMilli())/1000, 'f', 3, 64)),
+			Host:   host,
+			Source: SOURCE, Sourcetype: s.sourcetype, Index: s.index,
+			Event:  msg,
+			Fields: map[string]string{"event_id": eventID(msg)},
+		}
+		if COLLECTOR != "" {
+			event.Fields["collector"] = COLLECTOR
+		}
+		if err := enc.Encode(event); err != nil {
+			return err
+		}
+	}
+
+	var reply struct {
+		AckID *int64 `json:"ackId"`
+	}
+	if err := s.post("/services/collector/event", body.Bytes(), &reply); err != nil {
+		return err
+	}
+	if s.ack && reply.AckID != nil {
+		s.unacked[*reply.AckID] = splunkBatch{msgs: msgs, sent: time.Now()}
+		return nil
+	}
+	metricSinkEvents.Add("splunk", float64(len(msgs)))
+	return nil
+}
+
+// pollAcksLocked asks Splunk which requests in unacked are indexed, counts
+// their events as delivered and returns the events of those that waited
+// longer than splunkAckTimeout, to be sent again.
+func (s *splunkSink) pollAcksLocked() ([]SBS1Message, error) {
+	ids := make([]int64, 0, len(s.unacked))
+	for id := range s.unacked {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	query, _ := json.Marshal(map[string][]int64{"acks": ids})
+	var reply struct {
+		Acks map[string]bool `json:"acks"`
+	}
+	if err := s.post("/services/collector/ack", query, &reply); err != nil {
+		return nil, fmt.Errorf("polling acknowledgements: %w", err)
+	}
+
+	var expired []SBS1Message
+	timedOut := 0
+	for _, id := range ids {
+		batch := s.unacked[id]
+		switch {
+		case reply.Acks[strconv.FormatInt(id, 10)]:
+			metricSinkEvents.Add("splunk", float64(len(batch.msgs)))
+		case time.Since(batch.sent) > splunkAckTimeout:
+			expired = append(expired, batch.msgs...)
+			timedOut++
+		default:
+			continue
+		}
+		delete(s.unacked, id)
+	}
+	if timedOut > 0 {
+		metricSinkErrors.Add("splunk", float64(timedOut))
+		log.Printf("Splunk did not acknowledge %d request(s) within %s, sending their %d message(s) again", timedOut, splunkAckTimeout, len(expired))
+	}
+	return expired, nil
+}
+
+// post sends body to path and decodes the reply into v.
+func (s *splunkSink) post(path string, body []byte, v interface{}) error {
+	req, err := http.NewRequest(http.MethodPost, s.url+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Splunk "+s.token)
+	req.Header.Set("Content-Type", "application/json")
+	if s.ack {
+		req.Header.Set("X-Splunk-Request-Channel", s.channel)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		// Errors carry {"text": "...", "code": N}.
+		var reply struct {
+			Text string `json:"text"`
+			Code int    `json:"code"`
+		}
+		err := fmt.Errorf("Splunk returned %s", resp.Status)
+		if json.Unmarshal(data, &reply) == nil && reply.Text != "" {
+			err = fmt.Errorf("Splunk returned %s: %s (code %d)", resp.Status, reply.Text, reply.Code)
+		}
+		if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+			return newError(errAuth, err)
+		}
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("reading Splunk's reply: %w", err)
+	}
+	return nil
+}
+
+// Close sends what is queued and, with acknowledgement, waits up to ten
+// seconds for the outstanding requests to be acknowledged.
+func (s *splunkSink) Close() error {
+	err := s.Flush()
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+	for deadline := time.Now().Add(10 * time.Second); len(s.unacked) > 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Second)
+		if err := s.flushLocked(); err != nil {
+			break
+		}
+	}
+	if n := len(s.unacked); n > 0 {
+		log.Printf("Exiting with %d request(s) to Splunk not acknowledged", n)
+	}
+	s.closed = true
+	return err
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// spool stores batches on disk while uploading is paused. Each batch is one
+// newline-delimited JSON file, named so that lexical order is write order.
+type spool struct {
+	dir string
+
+	mu  sync.Mutex
+	seq int
+}
+
+// newSpool creates the spool directory if needed.
+func newSpool(dir string) (*spool, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating spool directory: %w", err)
+	}
+	return &spool{dir: dir}, nil
+}
+
+// Write stores a batch. The file is written under a temporary name and
+// renamed into place so a crash never leaves a partial batch behind.
+func (s *spool) Write(messages []SBS1Message) error {
+	s.mu.Lock()
+	s.seq++
+	name := fmt.Sprintf("batch-%s-%06d.ndjson", clock.Now().UTC().Format("20060102T150405.000000000Z"), s.seq)
+	s.mu.Unlock()
+
+	path := filepath.Join(s.dir, name)
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, msg := range messages {
+		if err := enc.Encode(msg); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Files lists spooled batches, oldest first.
+func (s *spool) Files() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".ndjson") {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Read loads a spooled batch.
+func (s *spool) Read(name string) ([]SBS1Message, error) {
+	return readNDJSON(filepath.Join(s.dir, name))
+}
+
+// Remove deletes a spooled batch once it has been delivered.
+func (s *spool) Remove(name string) error {
+	return os.Remove(filepath.Join(s.dir, name))
+}
+
+// readNDJSON loads newline-delimited SBS1Messages from path.
+func readNDJSON(path string) ([]SBS1Message, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var messages []SBS1Message
+	dec := json.NewDecoder(f)
+	for dec.More() {
+		var msg SBS1Message
+		if err := dec.Decode(&msg); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		messages = append(messages, msg)
+	}
+	return messages, nil
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sqliteDB is a connection to an SQLite database, provided by builds with
+// the sqlite tag.
+type sqliteDB interface {
+	// Exec runs a single statement with args bound to its parameters.
+	Exec(query string, args ...interface{}) error
+	// Query runs every statement in query and calls row for each row they
+	// return.
+	Query(query string, row func(columns []string, values []interface{}) error) error
+	// MaxAttached is how many databases can be attached at once.
+	MaxAttached() int
+	Close() error
+}
+
+// sqliteArchiveMax bounds the messages waiting to be written, should the
+// disk fall behind.
+const sqliteArchiveMax = 100000
+
+// sqliteSchema is the tables of every day's file. Values a message does
+// not carry are NULL; message holds the whole message as JSON. flights has
+// a row per flight heard that day, kept up to date as messages are
+// written; files from before it existed get theirs from their messages
+// when next opened.
+const sqliteSchema = `
+PRAGMA journal_mode = WAL;
+PRAGMA synchronous = NORMAL;
+CREATE TABLE IF NOT EXISTS messages (
+	time              TEXT NOT NULL,
+	icao24            TEXT,
+	callsign          TEXT,
+	message_type      TEXT,
+	transmission_type INTEGER,
+	altitude          INTEGER,
+	ground_speed      REAL,
+	track             REAL,
+	vertical_rate     INTEGER,
+	lat               REAL,
+	lon               REAL,
+	squawk            TEXT,
+	on_ground         INTEGER,
+	emergency         INTEGER,
+	receiver          TEXT,
+	flight_uuid       TEXT,
+	message           TEXT
+);
+CREATE INDEX IF NOT EXISTS messages_time ON messages (time);
+CREATE INDEX IF NOT EXISTS messages_icao24 ON messages (icao24, time);
+CREATE TABLE IF NOT EXISTS flights (
+	flight_uuid  TEXT PRIMARY KEY,
+	icao24       TEXT,
+	callsign     TEXT,
+	first_seen   TEXT NOT NULL,
+	last_seen    TEXT NOT NULL,
+	max_altitude INTEGER,
+	messages     INTEGER NOT NULL,
+	positions    INTEGER NOT NULL
+);
+INSERT INTO flights ` + sqliteFlightsOfMessages + ` AND NOT EXISTS (SELECT 1 FROM flights) GROUP BY flight_uuid;
+`
+
+// sqliteFlightsOfMessages aggregates the flights table from messages. It
+// ends in a WHERE clause, to be completed with GROUP BY flight_uuid.
+const sqliteFlightsOfMessages = `SELECT flight_uuid, max(icao24) AS icao24, max(callsign) AS callsign,
+	min(time) AS first_seen, max(time) AS last_seen, max(altitude) AS max_altitude, count(*) AS messages, count(lat) AS positions
+FROM messages WHERE flight_uuid IS NOT NULL`
+
+// sqliteFlightUpsert adds the aggregates of a batch of a flight's messages
+// to its row.
+const sqliteFlightUpsert = `INSERT INTO flights VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT (flight_uuid) DO UPDATE SET
+	icao24 = coalesce(excluded.icao24, icao24),
+	callsign = coalesce(excluded.callsign, callsign),
+	first_seen = min(first_seen, excluded.first_seen),
+	last_seen = max(last_seen, excluded.last_seen),
+	max_altitude = max(coalesce(max_altitude, excluded.max_altitude), coalesce(excluded.max_altitude, max_altitude)),
+	messages = messages + excluded.messages,
+	positions = positions + excluded.positions`
+
+const sqliteInsert = `INSERT INTO messages VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+// sqliteDayFile is the name of the archive file of a UTC day.
+func sqliteDayFile(day time.Time) string {
+	return "adsb-" + day.Format("20060102") + ".db"
+}
+
+// sqliteArchive keeps every decoded aircraft message in SQLite, one file
+// per UTC day of the messages' time, so that a day can be queried or
+// deleted on its own. Messages are written every second in a transaction.
+type sqliteArchive struct {
+	dir string
+	// keepDays is how many days of files are kept, including today, or 0
+	// to keep them all.
+	keepDays int
+
+	mu      sync.Mutex
+	pending []SBS1Message
+	dropped int
+
+	// writeMu guards the open file.
+	writeMu sync.Mutex
+	db      sqliteDB
+	day     string
+	closed  bool
+}
+
+// newSQLiteArchive creates the directory and starts writing in the
+// background.
+func newSQLiteArchive(dir string, keepDays int) (*sqliteArchive, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating sqlite directory: %w", err)
+	}
+	a := &sqliteArchive{dir: dir, keepDays: keepDays}
+	safeGo("sqlite", true, func() {
+		for range time.Tick(time.Second) {
+			if err := a.Flush(); err != nil {
+				log.Println("Error writing SQLite archive:", err)
+			}
+		}
+	})
+	return a, nil
+}
+
+// Add queues a message to be written.
+func (a *sqliteArchive) Add(msg SBS1Message) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.pending) >= sqliteArchiveMax {
+		a.dropped++
+		return
+	}
+	a.pending = append(a.pending, msg)
+}
+
+// Flush writes the queued messages.
+func (a *sqliteArchive) Flush() error {
+	a.mu.Lock()
+	pending, dropped := a.pending, a.dropped
+	a.pending, a.dropped = nil, 0
+	a.mu.Unlock()
+	if dropped > 0 {
+		metricSinkErrors.Add("sqlite", float64(dropped))
+		log.Printf("Dropped %d message(s) from the SQLite archive, which fell behind", dropped)
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	a.writeMu.Lock()
+	defer a.writeMu.Unlock()
+	if a.closed {
+		return nil
+	}
+	// Messages are grouped into a transaction per run of the same day.
+	for start := 0; start < len(pending); {
+		day := messageTime(pending[start]).UTC()
+		end := start + 1
+		for end < len(pending) && messageTime(pending[end]).UTC().Format("20060102") == day.Format("20060102") {
+			end++
+		}
+		if err := a.writeLocked(day, pending[start:end]); err != nil {
+			metricSinkErrors.Add("sqlite", float64(len(pending)-start))
+			return err
+		}
+		metricSinkEvents.Add("sqlite", float64(end-start))
+		start = end
+	}
+	return nil
+}
+
+func (a *sqliteArchive) writeLocked(day time.Time, msgs []SBS1Message) error {
+	if err := a.openLocked(day); err != nil {
+		return err
+	}
+	if err := a.db.Exec("BEGIN"); err != nil {
+		return err
+	}
+	var flights []*sqliteFlight
+	byUUID := map[string]*sqliteFlight{}
+	for _, msg := range msgs {
+		row := sqliteRow(msg)
+		if err := a.db.Exec(sqliteInsert, row...); err != nil {
+			a.db.Exec("ROLLBACK")
+			return err
+		}
+		if msg.FlightUUID == "" {
+			continue
+		}
+		f := byUUID[msg.FlightUUID]
+		if f == nil {
+			f = &sqliteFlight{uuid: msg.FlightUUID}
+			byUUID[msg.FlightUUID] = f
+			flights = append(flights, f)
+		}
+		f.add(row)
+	}
+	for _, f := range flights {
+		if err := a.db.Exec(sqliteFlightUpsert, f.values()...); err != nil {
+			a.db.Exec("ROLLBACK")
+			return err
+		}
+	}
+	return a.db.Exec("COMMIT")
+}
+
+// sqliteFlight aggregates the rows of a flight's messages in a batch, for
+// sqliteFlightUpsert.
+type sqliteFlight struct {
+	uuid, icao24, callsign string
+	first, last            string
+	maxAltitude            interface{}
+	messages, positions    int
+}
+
+// add counts a row of sqliteRow.
+func (f *sqliteFlight) add(row []interface{}) {
+	t := row[0].(string)
+	if f.messages == 0 || t < f.first {
+		f.first = t
+	}
+	if t > f.last {
+		f.last = t
+	}
+	if icao24, ok := row[1].(string); ok {
+		f.icao24 = icao24
+	}
+	if callsign, ok := row[2].(string); ok {
+		f.callsign = callsign
+	}
+	if altitude, ok := row[5].(int32); ok {
+		if max, ok := f.maxAltitude.(int32); !ok || altitude > max {
+			f.maxAltitude = altitude
+		}
+	}
+	if row[9] != nil {
+		f.positions++
+	}
+	f.messages++
+}
+
+func (f *sqliteFlight) values() []interface{} {
+	orNull := func(s string) interface{} {
+		if s == "" {
+			return nil
+		}
+		return s
+	}
+	return []interface{}{f.uuid, orNull(f.icao24), orNull(f.callsign), f.first, f.last, f.maxAltitude, f.messages, f.positions}
+}
+
+// openLocked makes the file of day the open one.
+func (a *sqliteArchive) openLocked(day time.Time) error {
+	name := sqliteDayFile(day)
+	if a.db != nil && a.day == name {
+		return nil
+	}
+	if a.db != nil {
+		a.db.Close()
+		a.db = nil
+	}
+	db, err := openSQLite(filepath.Join(a.dir, name))
+	if err != nil {
+		return err
+	}
+	if err := db.Query(sqliteSchema, func([]string, []interface{}) error { return nil }); err != nil {
+		db.Close()
+		return fmt.Errorf("creating %s: %w", name, err)
+	}
+	a.db, a.day = db, name
+	a.pruneLocked()
+	return nil
+}
+
+// pruneLocked deletes the files of the days before the last keepDays,
+// along with their journals. It runs whenever a file is opened, which is
+// at least once a day while messages are heard.
+func (a *sqliteArchive) pruneLocked() {
+	if a.keepDays <= 0 {
+		return
+	}
+	entries, err := os.ReadDir(a.dir)
+	if err != nil {
+		log.Println("Error listing SQLite archive:", err)
+		return
+	}
+	cutoff := sqliteDayFile(clock.Now().UTC().AddDate(0, 0, 1-a.keepDays))
+	for _, entry := range entries {
+		name := entry.Name()
+		base := strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(name, "-wal"), "-shm"), "-journal")
+		if _, err := time.Parse("adsb-20060102.db", base); err != nil || base >= cutoff || base == a.day {
+			continue
+		}
+		if err := os.Remove(filepath.Join(a.dir, name)); err != nil {
+			log.Println("Error deleting old SQLite archive:", err)
+			continue
+		}
+		if base == name {
+			log.Printf("Deleted %s, older than %d day(s)", name, a.keepDays)
+		}
+	}
+}
+
+// Close writes what is queued and closes the open file.
+func (a *sqliteArchive) Close() error {
+	err := a.Flush()
+	a.writeMu.Lock()
+	defer a.writeMu.Unlock()
+	a.closed = true
+	if a.db != nil {
+		if cerr := a.db.Close(); err == nil {
+			err = cerr
+		}
+		a.db = nil
+	}
+	return err
+}
+
+// messageTime is when a message was received, or now if its timestamp
+// cannot be read.
+func messageTime(msg SBS1Message) time.Time {
+	t, err := parseTimestamp(msg.Timestamp)
+	if err != nil {
+		return clock.Now()
+	}
+	return t
+}
+
+// sqliteReal widens v without the float32 noise, so 37.61 is stored as
+// 37.61 rather than 37.610000610351562.
+func sqliteReal(v float32) float64 {
+	f, _ := strconv.ParseFloat(strconv.FormatFloat(float64(v), 'f', -1, 32), 64)
+	return f
+}
+
+// sqliteRow is the values of a message for sqliteInsert.
+func sqliteRow(msg SBS1Message) []interface{} {
+	orNull := func(ok bool, v interface{}) interface{} {
+		if !ok {
+			return nil
+		}
+		return v
+	}
+	data, _ := json.Marshal(msg)
+	hasPosition := msg.Lat != 0 || msg.Lon != 0
+	return []interface{}{
+		messageTime(msg).UTC().Format("2006-01-02T15:04:05.000Z"),
+		orNull(msg.Icao24 != "", msg.Icao24),
+		orNull(msg.Callsign != "", msg.Callsign),
+		orNull(msg.MessageType != "", msg.MessageType),
+		orNull(msg.TransmissionType != 0, msg.TransmissionType),
+		orNull(msg.Altitude != 0 || msg.OnGround, msg.Altitude),
+		orNull(msg.GroundSpeed != 0, sqliteReal(msg.GroundSpeed)),
+		orNull(msg.GroundSpeed != 0, sqliteReal(msg.Track)),
+		orNull(msg.GroundSpeed != 0, msg.VerticalRate),
+		orNull(hasPosition, sqliteReal(msg.Lat)),
+		orNull(hasPosition, sqliteReal(msg.Lon)),
+		orNull(msg.Squawk != 0, fmt.Sprintf("%04d", msg.Squawk)),
+		msg.OnGround,
+		msg.Emergency,
+		orNull(msg.Receiver != "", msg.Receiver),
+		orNull(msg.FlightUUID != "", msg.FlightUUID),
+		string(data),
+	}
+}
@@ -0,0 +1,194 @@
+//go:build sqlite
+
+package main
+
+/*
+#cgo pkg-config: sqlite3
+#include <stdlib.h>
+#include <sqlite3.h>
+
+// SQLITE_TRANSIENT is a cast macro, which cgo cannot use.
+static int bind_text(sqlite3_stmt *stmt, int i, const char *s, int n) {
+	return sqlite3_bind_text(stmt, i, s, n, SQLITE_TRANSIENT);
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+)
+
+// sqliteSupported is set in builds with the sqlite tag, which link
+// libsqlite3.
+const sqliteSupported = true
+
+// cgoSQLite is a connection through libsqlite3. Statements run by Exec are
+// prepared once and kept.
+type cgoSQLite struct {
+	db    *C.sqlite3
+	stmts map[string]*C.sqlite3_stmt
+}
+
+// openSQLite opens or creates the database at path, which may be a file:
+// URI or ":memory:".
+func openSQLite(path string) (sqliteDB, error) {
+	cpath := C.CString(path)
+	defer C.free(unsafe.Pointer(cpath))
+	var db *C.sqlite3
+	flags := C.SQLITE_OPEN_READWRITE | C.SQLITE_OPEN_CREATE | C.SQLITE_OPEN_URI
+	if rc := C.sqlite3_open_v2(cpath, &db, C.int(flags), nil); rc != C.SQLITE_OK {
+		err := fmt.Errorf("opening %s: %s", path, C.GoString(C.sqlite3_errstr(rc)))
+		C.sqlite3_close_v2(db)
+		return nil, err
+	}
+	C.sqlite3_busy_timeout(db, 5000)
+	return &cgoSQLite{db: db, stmts: map[string]*C.sqlite3_stmt{}}, nil
+}
+
+func (s *cgoSQLite) err() error {
+	return errors.New(C.GoString(C.sqlite3_errmsg(s.db)))
+}
+
+// Exec runs a single statement with args bound to its parameters.
+func (s *cgoSQLite) Exec(query string, args ...interface{}) error {
+	stmt, ok := s.stmts[query]
+	if !ok {
+		cquery := C.CString(query)
+		defer C.free(unsafe.Pointer(cquery))
+		if C.sqlite3_prepare_v2(s.db, cquery, -1, &stmt, nil) != C.SQLITE_OK {
+			return s.err()
+		}
+		s.stmts[query] = stmt
+	}
+	defer C.sqlite3_clear_bindings(stmt)
+	defer C.sqlite3_reset(stmt)
+	for i, arg := range args {
+		if err := s.bind(stmt, C.int(i+1), arg); err != nil {
+			return err
+		}
+	}
+	for {
+		switch C.sqlite3_step(stmt) {
+		case C.SQLITE_ROW:
+		case C.SQLITE_DONE:
+			return nil
+		default:
+			return s.err()
+		}
+	}
+}
+
+func (s *cgoSQLite) bind(stmt *C.sqlite3_stmt, i C.int, arg interface{}) error {
+	var rc C.int
+	switch v := arg.(type) {
+	case nil:
+		rc = C.sqlite3_bind_null(stmt, i)
+	case bool:
+		n := 0
+		if v {
+			n = 1
+		}
+		rc = C.sqlite3_bind_int64(stmt, i, C.sqlite3_int64(n))
+	case int:
+		rc = C.sqlite3_bind_int64(stmt, i, C.sqlite3_int64(v))
+	case int32:
+		rc = C.sqlite3_bind_int64(stmt, i, C.sqlite3_int64(v))
+	case int64:
+		rc = C.sqlite3_bind_int64(stmt, i, C.sqlite3_int64(v))
+	case float32:
+		rc = C.sqlite3_bind_double(stmt, i, C.double(v))
+	case float64:
+		rc = C.sqlite3_bind_double(stmt, i, C.double(v))
+	case string:
+		cs := C.CString(v)
+		defer C.free(unsafe.Pointer(cs))
+		rc = C.bind_text(stmt, i, cs, C.int(len(v)))
+	default:
+		return fmt.Errorf("cannot bind a %T", arg)
+	}
+	if rc != C.SQLITE_OK {
+		return s.err()
+	}
+	return nil
+}
+
+// Query runs every statement in query and calls row for each row they
+// return, with the names of the statement's columns.
+func (s *cgoSQLite) Query(query string, row func(columns []string, values []interface{}) error) error {
+	cquery := C.CString(query)
+	defer C.free(unsafe.Pointer(cquery))
+	next := cquery
+	for *next != 0 {
+		var stmt *C.sqlite3_stmt
+		var tail *C.char
+		if C.sqlite3_prepare_v2(s.db, next, -1, &stmt, &tail) != C.SQLITE_OK {
+			return s.err()
+		}
+		next = tail
+		if stmt == nil {
+			// Whitespace or a comment.
+			continue
+		}
+		if err := s.rows(stmt, row); err != nil {
+			C.sqlite3_finalize(stmt)
+			return err
+		}
+		C.sqlite3_finalize(stmt)
+	}
+	return nil
+}
+
+func (s *cgoSQLite) rows(stmt *C.sqlite3_stmt, row func([]string, []interface{}) error) error {
+	var columns []string
+	for {
+		switch C.sqlite3_step(stmt) {
+		case C.SQLITE_ROW:
+		case C.SQLITE_DONE:
+			return nil
+		default:
+			return s.err()
+		}
+		n := int(C.sqlite3_column_count(stmt))
+		if columns == nil {
+			columns = make([]string, n)
+			for i := range columns {
+				columns[i] = C.GoString(C.sqlite3_column_name(stmt, C.int(i)))
+			}
+		}
+		values := make([]interface{}, n)
+		for i := range values {
+			ci := C.int(i)
+			switch C.sqlite3_column_type(stmt, ci) {
+			case C.SQLITE_INTEGER:
+				values[i] = int64(C.sqlite3_column_int64(stmt, ci))
+			case C.SQLITE_FLOAT:
+				values[i] = float64(C.sqlite3_column_double(stmt, ci))
+			case C.SQLITE_TEXT:
+				values[i] = C.GoStringN((*C.char)(unsafe.Pointer(C.sqlite3_column_text(stmt, ci))), C.sqlite3_column_bytes(stmt, ci))
+			case C.SQLITE_BLOB:
+				values[i] = C.GoBytes(C.sqlite3_column_blob(stmt, ci), C.sqlite3_column_bytes(stmt, ci))
+			}
+		}
+		if err := row(columns, values); err != nil {
+			return err
+		}
+	}
+}
+
+// MaxAttached is how many databases this SQLite can attach at once.
+func (s *cgoSQLite) MaxAttached() int {
+	return int(C.sqlite3_limit(s.db, C.SQLITE_LIMIT_ATTACHED, -1))
+}
+
+func (s *cgoSQLite) Close() error {
+	for _, stmt := range s.stmts {
+		C.sqlite3_finalize(stmt)
+	}
+	s.stmts = nil
+	if C.sqlite3_close(s.db) != C.SQLITE_OK {
+		return s.err()
+	}
+	return nil
+}
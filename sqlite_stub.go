@@ -0,0 +1,13 @@
+//go:build !sqlite
+
+package main
+
+import "errors"
+
+// sqliteSupported is unset in builds without the sqlite tag, which do not
+// need libsqlite3 and cannot keep SQLite archives.
+const sqliteSupported = false
+
+func openSQLite(path string) (sqliteDB, error) {
+	return nil, errors.New("this build has no SQLite support, rebuild it with -tags sqlite")
+}
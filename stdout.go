@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+// stdoutSink writes every decoded aircraft message to standard output as a
+// line of JSON, in the form of the spool, for piping into jq or another
+// tool. Each message is written as it arrives. After a failed write, such
+// as when the reader has gone away, messages are counted as errors and
+// dropped, with only the first failure logged.
+type stdoutSink struct {
+	mu     sync.Mutex
+	enc    *json.Encoder
+	failed bool
+}
+
+func newStdoutSink(w io.Writer) *stdoutSink {
+	return &stdoutSink{enc: json.NewEncoder(w)}
+}
+
+// Add writes msg.
+func (s *stdoutSink) Add(msg SBS1Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.enc.Encode(msg); err != nil {
+		metricSinkErrors.Inc("stdout")
+		if !s.failed {
+			log.Println("Error writing messages to stdout:", err)
+			s.failed = true
+		}
+	}
+}
+
+// logOutput is where JSON logs are written: stdout, unless the stdout sink
+// has it.
+func logOutput() io.Writer {
+	if STDOUT {
+		return os.Stderr
+	}
+	return os.Stdout
+}
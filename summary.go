@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// smtpSummaryAt is when the daily summary is mailed, after local midnight.
+var smtpSummaryAt time.Duration
+
+// parseTimeOfDay parses HH:MM into the time after midnight.
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// summaryView is a day of traffic, as mail summary templates see it.
+type summaryView struct {
+	Start, End          time.Time
+	Aircraft, Messages  int
+	MaxRangeNM          float64
+	Farthest            string
+	BusiestHour         int
+	BusiestHourMessages int
+	Alerts              []summaryCount
+	Emergencies         []string
+}
+
+type summaryCount struct {
+	Name  string
+	Count int
+}
+
+// dailySummary collects the traffic of a day and mails it at a fixed local
+// time of day: the aircraft and messages heard, the farthest aircraft, the
+// busiest hour, the alerts raised by rule and the emergencies squawked.
+// Ghosts, surface vehicles and obstacles do not count.
+type dailySummary struct {
+	at        time.Duration
+	mail      *mailer
+	rules     []string
+	lat, lon  float64
+	hasOrigin bool
+
+	mu          sync.Mutex
+	start, next time.Time
+	aircraft    map[string]bool
+	messages    int
+	maxRange    float64
+	farthest    string
+	hours       [24]int
+	alerts      map[string]float64
+	emergencies map[string]string
+}
+
+// newDailySummary starts mailing a summary at the local time of day at
+// after midnight. rules are the names whose alerts are counted.
+func newDailySummary(at time.Duration, mail *mailer, rules []string, lat, lon float64, hasOrigin bool) *dailySummary {
+	s := &dailySummary{at: at, mail: mail, rules: rules, lat: lat, lon: lon, hasOrigin: hasOrigin}
+	s.reset(clock.Now())
+	safeGo("summary", true, func() {
+		for range time.Tick(30 * time.Second) {
+			s.Tick(clock.Now())
+		}
+	})
+	return s
+}
+
+// reset starts a new day at now, running to the next summary time.
+func (s *dailySummary) reset(now time.Time) {
+	y, mo, d := now.Local().Date()
+	next := time.Date(y, mo, d, 0, 0, 0, 0, time.Local).Add(s.at)
+	if !next.After(now) {
+		next = time.Date(y, mo, d+1, 0, 0, 0, 0, time.Local).Add(s.at)
+	}
+	s.start, s.next = now, next
+	s.aircraft, s.emergencies = map[string]bool{}, map[string]string{}
+	s.messages, s.maxRange, s.farthest, s.hours = 0, 0, "", [24]int{}
+	s.alerts = map[string]float64{}
+	for _, rule := range s.rules {
+		s.alerts[rule] = metricAlerts.Value(rule)
+	}
+}
+
+// Observe records an aircraft update, with its range from the receiver's
+// GPS position or its fixed location.
+func (s *dailySummary) Observe(a Aircraft, receiver *ReceiverPosition) {
+	if a.Ghost || a.Kind != "" {
+		return
+	}
+	now := clock.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.aircraft[a.Icao24] = true
+	s.messages++
+	s.hours[now.Local().Hour()]++
+	if _, seen := s.emergencies[a.Icao24]; a.Emergency && a.Squawk != 0 && !seen {
+		s.emergencies[a.Icao24] = fmt.Sprintf("%s %s squawking %04d at %s", a.Icao24, a.Callsign, a.Squawk, now.Local().Format("15:04"))
+	}
+	rangeNM := -1.0
+	switch {
+	case !a.HasPosition():
+	case receiver != nil:
+		rangeNM = distanceNM(receiver.Lat, receiver.Lon, float64(a.Lat), float64(a.Lon))
+	case s.hasOrigin:
+		rangeNM = distanceNM(s.lat, s.lon, float64(a.Lat), float64(a.Lon))
+	}
+	if rangeNM > s.maxRange {
+		s.maxRange = rangeNM
+		s.farthest = a.Icao24
+		if a.Callsign != "" {
+			s.farthest += " " + a.Callsign
+		}
+	}
+}
+
+// Tick mails the summary once its time has come and starts the next day.
+func (s *dailySummary) Tick(now time.Time) {
+	s.mu.Lock()
+	if now.Before(s.next) {
+		s.mu.Unlock()
+		return
+	}
+	view := summaryView{
+		Start: s.start.Local(), End: now.Local(),
+		Aircraft: len(s.aircraft), Messages: s.messages,
+		MaxRangeNM: s.maxRange, Farthest: s.farthest,
+	}
+	for hour, n := range s.hours {
+		if n > view.BusiestHourMessages {
+			view.BusiestHour, view.BusiestHourMessages = hour, n
+		}
+	}
+	for _, rule := range s.rules {
+		if n := int(metricAlerts.Value(rule) - s.alerts[rule]); n > 0 {
+			view.Alerts = append(view.Alerts, summaryCount{rule, n})
+		}
+	}
+	for _, e := range s.emergencies {
+		view.Emergencies = append(view.Emergencies, e)
+	}
+	sort.Strings(view.Emergencies)
+	s.reset(now)
+	s.mu.Unlock()
+
+	if err := s.mail.SendSummary(view); err != nil {
+		log.Println("Error mailing daily summary:", err)
+		return
+	}
+	log.Printf("Mailed the daily summary for %s", view.Start.Format("2006-01-02"))
+}
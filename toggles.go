@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// toggleSinks are the sinks the control API can disable. A disabled sink
+// drops what it would have written, so nothing piles up while it is off.
+// The periodic writers, influx, remote_write and mqtt, skip their writes,
+// and smtp drops the mails it would have sent.
+var toggleSinks = []string{"dataset", "archive", "sqlite", "postgres", "s3", "splunk", "redis", "kinesis", "firehose", "pubsub", "eventhubs", "bigquery", "webhook", "stdout", "influx", "remote_write", "mqtt", "smtp"}
+
+var errInvalidToggle = errors.New("invalid toggle")
+
+var (
+	metricDisabledSink = newCounter("adsb_disabled_sink_messages_total", "Messages dropped because their sink was disabled through the control API, by sink.", "sink")
+	metricSampledOut   = newCounter("adsb_sampled_out_messages_total", "Aircraft messages not sent to DataSet because of the sample rate.", "")
+)
+
+// ToggleAudit is an AUDIT event recording a change to a runtime toggle made
+// through the control API.
+type ToggleAudit struct {
+	Action    string `json:"action"`
+	Toggle    string `json:"toggle"`
+	Value     string `json:"value,omitempty"`
+	Previous  string `json:"previous,omitempty"`
+	Remote    string `json:"remote,omitempty"`
+	UserAgent string `json:"user_agent,omitempty"`
+}
+
+// featureToggles are the switches operators flip through the control API
+// during incidents. They take effect with the next message.
+type featureToggles struct {
+	mu       sync.Mutex
+	disabled map[string]bool
+	rate     float64
+	// credit accumulates rate for each aircraft message; one is sent each
+	// time it reaches 1, which spreads the sent messages evenly.
+	credit float64
+}
+
+// toggles are the runtime toggles of the collector. The sample rate starts
+// at SAMPLE_RATE.
+var toggles = &featureToggles{disabled: map[string]bool{}, rate: 1}
+
+// Enabled reports whether sink has not been disabled.
+func (t *featureToggles) Enabled(sink string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return !t.disabled[sink]
+}
+
+// SetEnabled enables or disables sink and reports whether that changed
+// anything.
+func (t *featureToggles) SetEnabled(sink string, enabled bool) (bool, error) {
+	if !containsFold(toggleSinks, sink) {
+		return false, fmt.Errorf("%w: unknown sink %q, expected one of %s", errInvalidToggle, sink, strings.Join(toggleSinks, ", "))
+	}
+	sink = strings.ToLower(sink)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.disabled[sink] == !enabled {
+		return false, nil
+	}
+	if enabled {
+		delete(t.disabled, sink)
+	} else {
+		t.disabled[sink] = true
+	}
+	return true, nil
+}
+
+// Disabled returns the disabled sinks, sorted.
+func (t *featureToggles) Disabled() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var sinks []string
+	for sink := range t.disabled {
+		sinks = append(sinks, sink)
+	}
+	sort.Strings(sinks)
+	return sinks
+}
+
+// SampleRate returns the share of aircraft messages sent to DataSet.
+func (t *featureToggles) SampleRate() float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.rate
+}
+
+// SetSampleRate changes the share of aircraft messages sent to DataSet and
+// returns the previous one.
+func (t *featureToggles) SetSampleRate(rate float64) (float64, error) {
+	if !(rate >= 0 && rate <= 1) {
+		return 0, fmt.Errorf("%w: sample rate must be between 0 and 1", errInvalidToggle)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	previous := t.rate
+	t.rate, t.credit = rate, 0
+	return previous, nil
+}
+
+// Sample reports whether the next aircraft message is sent to DataSet.
+func (t *featureToggles) Sample() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.rate >= 1 {
+		return true
+	}
+	t.credit += t.rate
+	if t.credit < 1 {
+		metricSampledOut.Inc("")
+		return false
+	}
+	t.credit--
+	return true
+}
+
+// toggleAuditText summarises a toggle change for logs and the DataSet
+// message text.
+func toggleAuditText(a *ToggleAudit) string {
+	text := fmt.Sprintf("%s: %s", a.Toggle, a.Action)
+	if a.Value != "" {
+		text += " " + a.Value
+	}
+	if a.Previous != "" {
+		text += " (was " + a.Previous + ")"
+	}
+	if a.Remote != "" {
+		text += " by " + a.Remote
+	}
+	return text
+}
+
+// formatMuteUntil describes the end of an alert mute.
+func formatMuteUntil(until time.Time) string {
+	if until.IsZero() {
+		return "until unmuted"
+	}
+	return "until " + until.Format(time.RFC3339)
+}
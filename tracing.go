@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tracer exports one trace per batch over OTLP/HTTP with JSON encoding, so
+// an OpenTelemetry collector or tracing backend can show where a batch
+// spent its time between the first line read and the last sink response.
+type tracer struct {
+	url    string
+	client *http.Client
+	spans  chan otlpSpan
+	done   chan struct{}
+}
+
+// newTracer starts exporting to an OTLP endpoint such as
+// http://localhost:4318. A nil tracer traces nothing.
+func newTracer(endpoint string) *tracer {
+	t := &tracer{
+		url:    strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		client: newHTTPClient(),
+		spans:  make(chan otlpSpan, 1024),
+		done:   make(chan struct{}),
+	}
+	safeGo("tracing", false, t.export)
+	return t
+}
+
+// Close exports the remaining spans.
+func (t *tracer) Close() {
+	if t == nil {
+		return
+	}
+	close(t.spans)
+	<-t.done
+}
+
+// StartBatch begins the trace of a new batch. It returns nil when t is nil.
+func (t *tracer) StartBatch() *batchTrace {
+	if t == nil {
+		return nil
+	}
+	return &batchTrace{tracer: t, traceID: randomHex(16), rootID: randomHex(8), start: time.Now()}
+}
+
+// batchTrace collects timings for one batch. Parsing and enrichment happen
+// line by line while the batch fills, so their spans carry the cumulative
+// time across all lines rather than one contiguous interval.
+type batchTrace struct {
+	tracer  *tracer
+	traceID string
+	rootID  string
+	start   time.Time
+
+	lines, messages int
+	parse, enrich   time.Duration
+}
+
+// Observe records the handling of one line.
+func (b *batchTrace) Observe(parse, enrich time.Duration, kept bool) {
+	if b == nil {
+		return
+	}
+	b.lines++
+	b.parse += parse
+	b.enrich += enrich
+	if kept {
+		b.messages++
+	}
+}
+
+// Finish records the send to sink, which started at sendStart, and queues
+// the batch's spans for export.
+func (b *batchTrace) Finish(sendStart time.Time, sink string, sendErr error) {
+	if b == nil {
+		return
+	}
+	end := time.Now()
+	counts := []otlpAttribute{intAttribute("adsb.lines", b.lines), intAttribute("adsb.messages", b.messages)}
+	spans := []otlpSpan{
+		b.span("batch", "", b.start, end, counts),
+		b.span("read", b.rootID, b.start, sendStart, counts),
+		b.span("parse", b.rootID, b.start, b.start.Add(b.parse), []otlpAttribute{boolAttribute("adsb.cumulative", true)}),
+		b.span("enrich", b.rootID, b.start, b.start.Add(b.enrich), []otlpAttribute{boolAttribute("adsb.cumulative", true)}),
+		b.span("send", b.rootID, sendStart, end, []otlpAttribute{stringAttribute("adsb.sink", sink)}),
+	}
+	if sendErr != nil {
+		spans[0].Status = otlpStatus{Code: 2, Message: sendErr.Error()}
+		spans[4].Status = spans[0].Status
+	}
+	for _, span := range spans {
+		select {
+		case b.tracer.spans <- span:
+		default:
+			metricSpansDropped.Inc("")
+		}
+	}
+}
+
+func (b *batchTrace) span(name, parent string, start, end time.Time, attrs []otlpAttribute) otlpSpan {
+	id := b.rootID
+	if parent != "" {
+		id = randomHex(8)
+	}
+	return otlpSpan{
+		TraceID:           b.traceID,
+		SpanID:            id,
+		ParentSpanID:      parent,
+		Name:              name,
+		Kind:              1,
+		StartTimeUnixNano: strconv.FormatInt(start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(end.UnixNano(), 10),
+		Attributes:        attrs,
+	}
+}
+
+// export sends queued spans every five seconds, or sooner when many are
+// waiting.
+func (t *tracer) export() {
+	defer close(t.done)
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	var pending []otlpSpan
+	send := func() {
+		if len(pending) == 0 {
+			return
+		}
+		if err := t.post(pending); err != nil {
+			metricSinkErrors.Inc("otlp")
+			log.Println("Error exporting traces:", err)
+		}
+		pending = nil
+	}
+	for {
+		select {
+		case span, ok := <-t.spans:
+			if !ok {
+				send()
+				return
+			}
+			pending = append(pending, span)
+			if len(pending) >= 500 {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		}
+	}
+}
+
+func (t *tracer) post(spans []otlpSpan) error {
+	body := map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{"attributes": []otlpAttribute{
+				stringAttribute("service.name", "adsb-go-dataset"),
+				stringAttribute("service.version", version),
+				stringAttribute("service.instance.id", RECEIVER_NAME),
+			}},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "github.com/imichaelmoore/adsb-go-dataset"},
+				"spans": spans,
+			}},
+		}},
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	res, err := t.client.Post(t.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("OTLP endpoint returned %s", res.Status)
+	}
+	return nil
+}
+
+// otlpSpan is a span in the OTLP JSON encoding.
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+func stringAttribute(key, v string) otlpAttribute {
+	return otlpAttribute{key, map[string]interface{}{"stringValue": v}}
+}
+
+func intAttribute(key string, v int) otlpAttribute {
+	return otlpAttribute{key, map[string]interface{}{"intValue": strconv.Itoa(v)}}
+}
+
+func boolAttribute(key string, v bool) otlpAttribute {
+	return otlpAttribute{key, map[string]interface{}{"boolValue": v}}
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+var metricSpansDropped = newCounter("adsb_trace_spans_dropped_total", "Spans dropped because the export queue was full.", "")
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ghostMinReports is how many identical position reports in a row it takes
+// before an aircraft can be considered a ghost.
+const ghostMinReports = 10
+
+// Aircraft is the merged state of one aircraft built from the individual
+// SBS-1 messages that each carry only a subset of fields.
+type Aircraft struct {
+	Icao24        string     `json:"icao24"`
+	FlightUUID    string     `json:"flight_uuid"`
+	Callsign      string     `json:"callsign,omitempty"`
+	Altitude      int32      `json:"altitude,omitempty"`
+	GroundSpeed   float32    `json:"ground_speed,omitempty"`
+	Track         float32    `json:"track,omitempty"`
+	Lat           float32    `json:"lat,omitempty"`
+	Lon           float32    `json:"lon,omitempty"`
+	VerticalRate  int32      `json:"vertical_rate,omitempty"`
+	Squawk        int32      `json:"squawk,omitempty"`
+	Emergency     bool       `json:"emergency,omitempty"`
+	OnGround      bool       `json:"on_ground,omitempty"`
+	Ghost         bool       `json:"ghost,omitempty"`
+	Kind          string     `json:"kind,omitempty"`
+	FirstSeen     time.Time  `json:"first_seen"`
+	LastSeen      time.Time  `json:"last_seen"`
+	LastPosition  *time.Time `json:"last_position,omitempty"`
+	PositionSince *time.Time `json:"position_since,omitempty"`
+	Messages      int        `json:"messages"`
+
+	samePositionReports int
+	// reports are the latest positions by receiver, for position fusion,
+	// and owner the receiver the track follows with fusion "best".
+	reports map[string]positionReport
+	owner   string
+	// history holds the latest positions, read through the tracker.
+	history *positionRing
+}
+
+// positionReport is a position one receiver reported.
+type positionReport struct {
+	lat, lon float32
+	at       time.Time
+}
+
+// HasPosition reports whether a position has been received.
+func (a *Aircraft) HasPosition() bool {
+	return a.LastPosition != nil
+}
+
+// Tracker maintains the current state of every aircraft heard recently.
+//
+// Aircraft are forgotten after expiry without messages, and their position
+// after positionExpiry without a new one, since metadata such as callsigns
+// stays valid far longer than a position. An airborne aircraft reporting
+// the exact same position for ghostAfter is a decoder artifact: it is
+// flagged as a ghost, loses its position and is forgotten after only
+// ghostExpiry of silence.
+//
+// When several feeds hear an aircraft, their positions are fused as set by
+// fusion, so they do not show as interleaved tracks. The last historyDepth
+// positions of each aircraft are kept for consumers that need its track.
+type Tracker struct {
+	expiry         time.Duration
+	positionExpiry time.Duration
+	ghostAfter     time.Duration
+	ghostExpiry    time.Duration
+	fusion         string
+	fusionWindow   time.Duration
+	trust          map[string]float64
+	historyDepth   int
+
+	mu        sync.Mutex
+	aircraft  map[string]*Aircraft
+	lastSweep time.Time
+}
+
+// newTracker creates an empty tracker using the configured timeouts.
+func newTracker() *Tracker {
+	return &Tracker{
+		expiry:         TRACKER_EXPIRY,
+		positionExpiry: POSITION_EXPIRY,
+		ghostAfter:     GHOST_AFTER,
+		ghostExpiry:    GHOST_EXPIRY,
+		fusion:         POSITION_FUSION,
+		fusionWindow:   FUSION_WINDOW,
+		trust:          receiverTrust,
+		historyDepth:   POSITION_HISTORY_DEPTH,
+		aircraft:       map[string]*Aircraft{},
+	}
+}
+
+// Update merges msg into the state of its aircraft and returns a copy of
+// the updated state. Which fields are merged depends on the transmission
+// type, since SBS-1 leaves fields a message type does not carry empty.
+// Time is taken from the message, so several captures can be tracked at
+// once on recorded time.
+func (t *Tracker) Update(msg SBS1Message) Aircraft {
+	return t.update(&msg)
+}
+
+// update is Update, rewriting msg's position when it is fused.
+func (t *Tracker) update(msg *SBS1Message) Aircraft {
+	if msg.Icao24 == "" {
+		return Aircraft{}
+	}
+	now, err := parseTimestamp(msg.Timestamp)
+	if err != nil {
+		now = clock.Now()
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if now.Sub(t.lastSweep) >= 10*time.Second {
+		t.expireLocked(now)
+		t.lastSweep = now
+	}
+
+	a, ok := t.aircraft[msg.Icao24]
+	if !ok || t.expired(a, now) {
+		a = &Aircraft{Icao24: msg.Icao24, FlightUUID: newFlightUUID(msg.Icao24, now), FirstSeen: now}
+		t.aircraft[msg.Icao24] = a
+	}
+	if a.HasPosition() && now.Sub(*a.LastPosition) > t.positionExpiry {
+		a.clearPosition()
+	}
+	a.LastSeen = now
+	a.Messages++
+	a.Kind = msg.Kind
+	if msg.Callsign != "" {
+		a.Callsign = msg.Callsign
+	}
+
+	switch msg.TransmissionType {
+	case 2:
+		a.Altitude = msg.Altitude
+		a.GroundSpeed, a.Track = msg.GroundSpeed, msg.Track
+		t.fuse(a, msg, now)
+		t.setPosition(a, *msg, now)
+	case 3:
+		a.Altitude = msg.Altitude
+		a.Emergency = msg.Emergency
+		t.fuse(a, msg, now)
+		t.setPosition(a, *msg, now)
+	case 4:
+		a.GroundSpeed, a.Track = msg.GroundSpeed, msg.Track
+		a.VerticalRate = msg.VerticalRate
+	case 5, 7:
+		a.Altitude = msg.Altitude
+	case 6:
+		a.Altitude = msg.Altitude
+		a.Squawk = msg.Squawk
+		a.Emergency = msg.Emergency
+	}
+	if msg.TransmissionType >= 2 && msg.TransmissionType != 4 {
+		a.OnGround = msg.OnGround
+	}
+	return *a
+}
+
+// fuse combines msg's position with the other receivers' recent reports
+// for a, rewriting it and recording the receivers that contributed. With
+// fusion "best" the track stays with the most trusted receiver reporting
+// within the fusion window, and other receivers' positions are dropped;
+// with "average" the receivers' latest positions are averaged, weighted by
+// trust. Receivers with no trust never contribute.
+func (t *Tracker) fuse(a *Aircraft, msg *SBS1Message, now time.Time) {
+	if t.fusion == "" || t.fusion == "off" || msg.Receiver == "" || (msg.Lat == 0 && msg.Lon == 0) {
+		return
+	}
+	if t.trustOf(msg.Receiver) == 0 {
+		msg.Lat, msg.Lon = 0, 0
+		return
+	}
+	if a.reports == nil {
+		a.reports = map[string]positionReport{}
+	}
+	a.reports[msg.Receiver] = positionReport{lat: msg.Lat, lon: msg.Lon, at: now}
+	msg.Receivers = msg.Receivers[:0]
+	var lat, lon, weight float64
+	for name, r := range a.reports {
+		if now.Sub(r.at) > t.fusionWindow {
+			delete(a.reports, name)
+			continue
+		}
+		w := t.trustOf(name)
+		msg.Receivers = append(msg.Receivers, name)
+		lat, lon, weight = lat+w*float64(r.lat), lon+w*float64(r.lon), weight+w
+	}
+	sort.Strings(msg.Receivers)
+
+	switch t.fusion {
+	case "best":
+		if _, ok := a.reports[a.owner]; !ok || t.trustOf(msg.Receiver) > t.trustOf(a.owner) {
+			a.owner = msg.Receiver
+		}
+		if msg.Receiver != a.owner {
+			msg.Lat, msg.Lon = 0, 0
+		}
+	case "average":
+		msg.Lat, msg.Lon = float32(lat/weight), float32(lon/weight)
+	}
+}
+
+// trustOf returns the fusion weight of a receiver, 1 unless configured.
+func (t *Tracker) trustOf(receiver string) float64 {
+	if w, ok := t.trust[receiver]; ok {
+		return w
+	}
+	return 1
+}
+
+// annotate merges msg into the tracker and copies what the tracker knows
+// about the flight back onto msg.
+func (t *Tracker) annotate(msg *SBS1Message) Aircraft {
+	aircraft := t.update(msg)
+	msg.FlightUUID = aircraft.FlightUUID
+	msg.Ghost = aircraft.Ghost
+	return aircraft
+}
+
+// setPosition records a reported position and runs ghost detection.
+func (t *Tracker) setPosition(a *Aircraft, msg SBS1Message, now time.Time) {
+	if msg.Lat == 0 && msg.Lon == 0 {
+		return
+	}
+
+	if a.PositionSince != nil && msg.Lat == a.Lat && msg.Lon == a.Lon {
+		a.samePositionReports++
+	} else {
+		a.Lat, a.Lon = msg.Lat, msg.Lon
+		a.PositionSince = &now
+		a.samePositionReports = 0
+		a.Ghost = false
+	}
+
+	if !a.Ghost && !a.OnGround && a.samePositionReports >= ghostMinReports && now.Sub(*a.PositionSince) >= t.ghostAfter {
+		a.Ghost = true
+		metricGhosts.Inc("")
+		log.Printf("Flagging %s as a ghost stuck at %.5f,%.5f since %s", a.Icao24, a.Lat, a.Lon, a.PositionSince.Format(time.RFC3339))
+	}
+	if a.Ghost {
+		a.LastPosition = nil
+		return
+	}
+	a.LastPosition = &now
+	t.recordPosition(a, now)
+}
+
+// clearPosition forgets a stale position.
+func (a *Aircraft) clearPosition() {
+	a.Lat, a.Lon = 0, 0
+	a.LastPosition, a.PositionSince = nil, nil
+	a.samePositionReports = 0
+}
+
+// flightNamespace scopes flight UUIDs.
+var flightNamespace = uuid.MustParse("0b8f3f52-8d0e-4c51-b7b5-9e3c2a6d41f0")
+
+// newFlightUUID identifies one continuous sighting of an aircraft. It is
+// derived from the address and first-seen time, so replays of a capture
+// assign the same flight UUIDs. Despite the name, it is in the configured
+// ID scheme.
+func newFlightUUID(icao24 string, firstSeen time.Time) string {
+	// The address is hashed in upper case, as most feeds sent it before
+	// icao24_case, so IDs do not change with the setting.
+	icao24 = strings.ToUpper(icao24)
+	return ids.Derived(flightNamespace, firstSeen, []byte(icao24+"/"+strconv.FormatInt(firstSeen.UnixNano(), 10)))
+}
+
+// expired reports whether a has been silent for longer than its expiry.
+func (t *Tracker) expired(a *Aircraft, now time.Time) bool {
+	if a.Ghost {
+		return now.Sub(a.LastSeen) > t.ghostExpiry
+	}
+	return now.Sub(a.LastSeen) > t.expiry
+}
+
+// expireLocked drops silent aircraft and stale positions.
+func (t *Tracker) expireLocked(now time.Time) {
+	for icao, a := range t.aircraft {
+		switch {
+		case t.expired(a, now):
+			delete(t.aircraft, icao)
+		case a.HasPosition() && now.Sub(*a.LastPosition) > t.positionExpiry:
+			a.clearPosition()
+		}
+	}
+}
+
+// Snapshot returns a copy of every tracked aircraft, ordered by ICAO address.
+func (t *Tracker) Snapshot() []Aircraft {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	out := make([]Aircraft, 0, len(t.aircraft))
+	for _, a := range t.aircraft {
+		out = append(out, *a)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Icao24 < out[j].Icao24 })
+	return out
+}
+
+// Len returns the number of tracked aircraft.
+func (t *Tracker) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.aircraft)
+}
+
+// Counts returns the number of tracked entries by kind, so tagged surface
+// vehicles and obstacles do not inflate the aircraft count.
+func (t *Tracker) Counts() (aircraft, vehicles, obstacles int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, a := range t.aircraft {
+		switch a.Kind {
+		case kindVehicle:
+			vehicles++
+		case kindObstacle:
+			obstacles++
+		default:
+			aircraft++
+		}
+	}
+	return aircraft, vehicles, obstacles
+}
+
+// trackerState is the on-disk form of the tracker.
+type trackerState struct {
+	SavedAt  time.Time  `json:"saved_at"`
+	Aircraft []Aircraft `json:"aircraft"`
+}
+
+// Save writes the tracked aircraft to path, replacing it atomically.
+func (t *Tracker) Save(path string) error {
+	data, err := json.Marshal(trackerState{SavedAt: clock.Now(), Aircraft: t.Snapshot()})
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+".tmp", data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Load restores aircraft saved by Save, skipping any that would already
+// have expired, and returns how many were restored. A missing file is not
+// an error so the first start after enabling persistence works.
+func (t *Tracker) Load(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var state trackerState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return 0, fmt.Errorf("parsing tracker state %s: %w", path, err)
+	}
+
+	now := clock.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	restored := 0
+	for i := range state.Aircraft {
+		a := state.Aircraft[i]
+		if a.Icao24 == "" || t.expired(&a, now) {
+			continue
+		}
+		// The state may have been saved with another icao24_case.
+		a.Icao24 = normalizeICAO24(a.Icao24, ICAO24_CASE)
+		t.aircraft[a.Icao24] = &a
+		restored++
+	}
+	return restored, nil
+}
+
+var metricGhosts = newCounter("adsb_ghosts_total", "Aircraft flagged as stuck at a fixed position.", "")
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// testTracker is a tracker with the default timeouts.
+func testTracker() *Tracker {
+	tr := newTracker()
+	tr.expiry, tr.positionExpiry, tr.ghostAfter, tr.ghostExpiry = 5*time.Minute, time.Minute, 10*time.Minute, 30*time.Second
+	return tr
+}
+
+func TestTrackerUpdate(t *testing.T) {
+	start := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	rc := useRecordedClock(t, start)
+	tr := testTracker()
+
+	// update sends a message from 4CA2D6 a second after the last.
+	update := func(msg SBS1Message) Aircraft {
+		rc.Observe(clock.Now().Add(time.Second))
+		msg.Icao24 = "4CA2D6"
+		msg.Timestamp = formatTimestamp(clock.Now())
+		return tr.Update(msg)
+	}
+
+	update(SBS1Message{TransmissionType: 1, Callsign: "EIN123"})
+	update(SBS1Message{TransmissionType: 3, Altitude: 35000, Lat: 53.1, Lon: -6.2})
+	update(SBS1Message{TransmissionType: 4, GroundSpeed: 450, Track: 90, VerticalRate: -640})
+	update(SBS1Message{TransmissionType: 6, Altitude: 34900, Squawk: 7700, Emergency: true})
+	// Fields a message type does not carry are left alone: an
+	// identification without a callsign, a position without coordinates.
+	update(SBS1Message{TransmissionType: 1})
+	a := update(SBS1Message{TransmissionType: 3, Altitude: 34800, Emergency: true})
+
+	if a.Icao24 != "4CA2D6" || a.Callsign != "EIN123" || a.Altitude != 34800 || a.Squawk != 7700 || !a.Emergency {
+		t.Errorf("identity %s %q alt %d squawk %d emergency %v", a.Icao24, a.Callsign, a.Altitude, a.Squawk, a.Emergency)
+	}
+	if a.GroundSpeed != 450 || a.Track != 90 || a.VerticalRate != -640 {
+		t.Errorf("velocity %v %v %d", a.GroundSpeed, a.Track, a.VerticalRate)
+	}
+	if a.Lat != 53.1 || a.Lon != -6.2 || !a.HasPosition() {
+		t.Errorf("position %v %v, has position %v", a.Lat, a.Lon, a.HasPosition())
+	}
+	if a.Messages != 6 || !a.FirstSeen.Equal(start.Add(time.Second)) || !a.LastSeen.Equal(start.Add(6*time.Second)) {
+		t.Errorf("%d messages seen from %v to %v", a.Messages, a.FirstSeen, a.LastSeen)
+	}
+
+	// Velocity messages do not say whether the aircraft is on the ground.
+	if a := update(SBS1Message{TransmissionType: 2, OnGround: true}); !a.OnGround {
+		t.Error("not on the ground after a surface position")
+	}
+	if a := update(SBS1Message{TransmissionType: 4, GroundSpeed: 10}); !a.OnGround {
+		t.Error("a velocity message took the aircraft off the ground")
+	}
+	if a := update(SBS1Message{TransmissionType: 5, Altitude: 1000}); a.OnGround {
+		t.Error("still on the ground after an airborne altitude")
+	}
+}
+
+func TestTrackerExpiry(t *testing.T) {
+	rc := useRecordedClock(t, time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC))
+	tr := testTracker()
+	update := func(icao string, after time.Duration) Aircraft {
+		rc.Observe(clock.Now().Add(after))
+		return tr.Update(SBS1Message{Icao24: icao, TransmissionType: 1, Callsign: "EIN123", Timestamp: formatTimestamp(clock.Now())})
+	}
+
+	update("4CA2D6", 0)
+	if a := update("4CA2D6", 4*time.Minute); a.Messages != 2 {
+		t.Errorf("%d messages after 4 minutes of silence, want 2", a.Messages)
+	}
+	// An aircraft silent for longer than the expiry starts afresh.
+	update("A1B2C3", 6*time.Minute)
+	if a := update("4CA2D6", time.Second); a.Messages != 1 || a.Callsign != "EIN123" {
+		t.Errorf("%d messages after expiring, want 1", a.Messages)
+	}
+}
+
+func TestTrackerGhost(t *testing.T) {
+	rc := useRecordedClock(t, time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC))
+	tr := testTracker()
+	update := func(after time.Duration, msg SBS1Message) Aircraft {
+		rc.Observe(clock.Now().Add(after))
+		msg.Icao24, msg.Timestamp = "4CA2D6", formatTimestamp(clock.Now())
+		return tr.Update(msg)
+	}
+
+	// An airborne aircraft reporting the same position every minute is a
+	// ghost after ten reports and ten minutes.
+	for i := 0; i <= 10; i++ {
+		a := update(time.Minute, SBS1Message{TransmissionType: 3, Altitude: 35000, Lat: 53.1, Lon: -6.2})
+		if a.Ghost != (i == 10) || a.HasPosition() == (i == 10) {
+			t.Fatalf("report %d: ghost %v, has position %v", i, a.Ghost, a.HasPosition())
+		}
+	}
+	// A ghost is forgotten after the shorter ghost expiry.
+	if a := update(31*time.Second, SBS1Message{TransmissionType: 1}); a.Ghost || a.Messages != 1 {
+		t.Errorf("ghost %v with %d messages after the ghost expiry", a.Ghost, a.Messages)
+	}
+
+	// A position older than the position expiry is dropped.
+	update(time.Second, SBS1Message{TransmissionType: 3, Altitude: 35000, Lat: 53.1, Lon: -6.2})
+	if a := update(61*time.Second, SBS1Message{TransmissionType: 1}); a.HasPosition() || a.Lat != 0 {
+		t.Errorf("position %v,%v kept after the position expiry", a.Lat, a.Lon)
+	}
+}
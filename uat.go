@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// uatBase40 is the alphabet of UAT flight IDs.
+const uatBase40 = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ  .."
+
+// parseUATLine decodes a line of dump978's raw output, as served on port
+// 30978: "-" and a downlink frame in hex, then ";"-separated key=value
+// fields such as rssi. Uplink ("+") frames carry weather and traffic
+// information services rather than aircraft and are skipped.
+func parseUATLine(line string) (SBS1Message, bool) {
+	line = strings.TrimSpace(line)
+	if strings.HasPrefix(line, "+") {
+		return SBS1Message{}, false
+	}
+	fields := strings.Split(strings.TrimPrefix(line, "-"), ";")
+	frame, err := hex.DecodeString(fields[0])
+	if !strings.HasPrefix(line, "-") || err != nil || (len(frame) != 18 && len(frame) != 34) {
+		metricParseErrors.Inc("uat_frame")
+		return SBS1Message{}, false
+	}
+	msg, ok := decodeUAT(frame)
+	if !ok {
+		return msg, false
+	}
+	for _, field := range fields[1:] {
+		if value, ok := strings.CutPrefix(field, "rssi="); ok {
+			if rssi, err := strconv.ParseFloat(value, 32); err == nil {
+				msg.SignalLevel = float32(rssi)
+			}
+		}
+	}
+	return msg, true
+}
+
+// decodeUAT decodes a UAT ADS-B downlink frame: the header, the state
+// vector every payload type carries, and the mode status of types 1 and 3,
+// which holds the flight ID or squawk.
+func decodeUAT(frame []byte) (SBS1Message, bool) {
+	payloadType := frame[0] >> 3
+	if payloadType > 10 {
+		metricParseErrors.Inc("uat_payload")
+		return SBS1Message{}, false
+	}
+	msg := NewSBS1Message()
+	msg.MessageType = "MSG"
+	address := uint32(frame[1])<<16 | uint32(frame[2])<<8 | uint32(frame[3])
+	// Only ADS-B and TIS-B targets with an ICAO address are identified by
+	// it; the others are marked as non-ICAO like dump1090 does.
+	switch frame[0] & 7 {
+	case 0, 2:
+		msg.Icao24 = formatICAO(address)
+	default:
+		msg.Icao24 = "~" + formatICAO(address)
+	}
+
+	nic := frame[11] & 0x0f
+	rawLat := uint32(frame[4])<<15 | uint32(frame[5])<<7 | uint32(frame[6])>>1
+	rawLon := uint32(frame[6]&1)<<23 | uint32(frame[7])<<15 | uint32(frame[8])<<7 | uint32(frame[9])>>1
+	hasPosition := nic != 0 || rawLat != 0 || rawLon != 0
+	if hasPosition {
+		lat := float64(rawLat) * 360 / (1 << 24)
+		if lat > 90 {
+			lat -= 180
+		}
+		lon := float64(rawLon) * 360 / (1 << 24)
+		if lon > 180 {
+			lon -= 360
+		}
+		msg.Lat, msg.Lon = float32(lat), float32(lon)
+	}
+	if rawAlt := int32(frame[10])<<4 | int32(frame[11])>>4; rawAlt != 0 {
+		msg.Altitude = (rawAlt-1)*25 - 1000
+	}
+
+	switch airGround := frame[12] >> 6; airGround {
+	case 0, 1:
+		rawNS := int(frame[12]&0x1f)<<6 | int(frame[13])>>2
+		rawEW := int(frame[13]&0x03)<<9 | int(frame[14])<<1 | int(frame[15])>>7
+		if rawNS&0x3ff != 0 && rawEW&0x3ff != 0 {
+			ns, ew := float64(rawNS&0x3ff-1), float64(rawEW&0x3ff-1)
+			if rawNS&0x400 != 0 {
+				ns = -ns
+			}
+			if rawEW&0x400 != 0 {
+				ew = -ew
+			}
+			if airGround == 1 {
+				ns, ew = ns*4, ew*4
+			}
+			msg.GroundSpeed = float32(math.Hypot(ns, ew))
+			if ns != 0 || ew != 0 {
+				msg.Track = float32(math.Mod(math.Atan2(ew, ns)*180/math.Pi+360, 360))
+			}
+		}
+		if rawVR := int32(frame[15]&0x7f)<<4 | int32(frame[16])>>4; rawVR&0x1ff != 0 {
+			msg.VerticalRate = (rawVR&0x1ff - 1) * 64
+			if rawVR&0x200 != 0 {
+				msg.VerticalRate = -msg.VerticalRate
+			}
+		}
+	case 2:
+		msg.OnGround = true
+		if rawGS := int(frame[12]&0x1f)<<6 | int(frame[13])>>2; rawGS&0x3ff != 0 {
+			msg.GroundSpeed = float32(rawGS&0x3ff - 1)
+		}
+		rawTrack := int(frame[13]&0x03)<<9 | int(frame[14])<<1 | int(frame[15])>>7
+		if rawTrack>>9&3 != 0 {
+			msg.Track = float32(rawTrack&0x1ff) * 360 / 512
+		}
+	}
+
+	if (payloadType == 1 || payloadType == 3) && len(frame) == 34 {
+		id := uatFlightID(frame[17:23])
+		msg.Emergency = frame[23]>>5 != 0
+		if frame[26]&0x02 != 0 {
+			msg.Callsign = id
+		} else if squawk, err := strconv.Atoi(id); err == nil && len(id) == 4 {
+			msg.Squawk = int32(squawk)
+		}
+	}
+
+	switch {
+	case hasPosition:
+		msg.TransmissionType = 3
+	case msg.Callsign != "":
+		msg.TransmissionType = 1
+	default:
+		msg.TransmissionType = 4
+	}
+	return msg, true
+}
+
+// uatFlightID decodes the 8 base-40 characters of a mode status flight ID,
+// which follow the emitter category in b.
+func uatFlightID(b []byte) string {
+	var id strings.Builder
+	for i := 0; i < 3; i++ {
+		v := int(b[2*i])<<8 | int(b[2*i+1])
+		if i == 0 {
+			fmt.Fprintf(&id, "%c%c", uatBase40[v/40%40], uatBase40[v%40])
+			continue
+		}
+		fmt.Fprintf(&id, "%c%c%c", uatBase40[v/1600%40], uatBase40[v/40%40], uatBase40[v%40])
+	}
+	return strings.TrimRight(id.String(), " .")
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+// uploader delivers batches to DataSet. While paused, batches are written to
+// the spool instead and delivered once uploading resumes. Without a DataSet
+// client, when the collector only writes to other sinks, batches are
+// dropped.
+type uploader struct {
+	dataset     *datasetClient
+	spool       *spool
+	deadLetters *deadLetters
+
+	paused   atomic.Bool
+	draining sync.Mutex
+}
+
+// Send uploads a batch, or spools it while paused.
+func (u *uploader) Send(messages []SBS1Message) error {
+	if u.dataset == nil {
+		return nil
+	}
+	if u.paused.Load() {
+		log.Printf("Uploading paused, spooling %d messages", len(messages))
+		return u.spool.Write(messages)
+	}
+	if err := u.dataset.Send(messages); err != nil {
+		return u.deadLetters.Record("dataset", messages, err)
+	}
+	return nil
+}
+
+// Pause diverts new batches to the spool.
+func (u *uploader) Pause() {
+	if !u.paused.Swap(true) {
+		log.Println("Uploading paused")
+	}
+}
+
+// Resume restarts uploading and delivers spooled batches in the background.
+func (u *uploader) Resume() {
+	if u.paused.Swap(false) {
+		log.Println("Uploading resumed")
+	}
+	safeGo("drain", false, u.Drain)
+}
+
+// Paused reports whether uploading is paused.
+func (u *uploader) Paused() bool {
+	return u.paused.Load()
+}
+
+// Drain uploads spooled batches oldest first, stopping at the first failure
+// or when uploading is paused again.
+func (u *uploader) Drain() {
+	if u.dataset == nil {
+		return
+	}
+	u.draining.Lock()
+	defer u.draining.Unlock()
+
+	names, err := u.spool.Files()
+	if err != nil {
+		log.Println("Error listing spool:", err)
+		return
+	}
+	for _, name := range names {
+		if u.paused.Load() {
+			return
+		}
+		messages, err := u.spool.Read(name)
+		if err != nil {
+			log.Println("Error reading spooled batch:", err)
+			return
+		}
+		if err := u.dataset.Send(messages); err != nil {
+			log.Println("Error sending spooled batch:", err)
+			return
+		}
+		if err := u.spool.Remove(name); err != nil {
+			log.Println("Error removing spooled batch:", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,18 @@
+package main
+
+import "fmt"
+
+// version is stamped at build time with
+// go build -ldflags "-X main.version=v1.2.3".
+var version = "dev"
+
+// userAgent identifies this collector and its receiver to HTTP services.
+func userAgent() string {
+	if USER_AGENT != "" {
+		return USER_AGENT
+	}
+	if RECEIVER_NAME == "" {
+		return fmt.Sprintf("adsb-go-dataset/%s", version)
+	}
+	return fmt.Sprintf("adsb-go-dataset/%s (receiver=%s)", version, RECEIVER_NAME)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// vrsIDExpiry is how long the ICAO address of a Virtual Radar Server
+// aircraft id is remembered after it was last listed.
+const vrsIDExpiry = 10 * time.Minute
+
+// vrsAircraftList is the part of Virtual Radar Server's AircraftList.json
+// the poller reads. Given the lastDv of the previous response as ldv, the
+// server only lists aircraft that changed since, each with its Id and the
+// fields that changed.
+type vrsAircraftList struct {
+	AcList []vrsAircraft `json:"acList"`
+	LastDv string        `json:"lastDv"`
+	Stm    int64         `json:"stm"` // server time, Unix milliseconds
+}
+
+// vrsAircraft is one aircraft of an AircraftList.json, with the response's
+// server time added and the ICAO address filled in from earlier responses.
+// It is what a VRS feed's lines hold. Altitudes are in feet, speeds in
+// knots and vertical rates in feet per minute.
+type vrsAircraft struct {
+	Stm     int64    `json:"stm"`
+	ID      int      `json:"Id"`
+	Icao    string   `json:"Icao,omitempty"`
+	Call    string   `json:"Call,omitempty"`
+	Alt     *int32   `json:"Alt,omitempty"`
+	Spd     *float64 `json:"Spd,omitempty"`
+	Trak    *float64 `json:"Trak,omitempty"`
+	Lat     *float64 `json:"Lat,omitempty"`
+	Long    *float64 `json:"Long,omitempty"`
+	PosTime int64    `json:"PosTime,omitempty"` // Unix milliseconds
+	Vsi     *int32   `json:"Vsi,omitempty"`
+	Sqk     string   `json:"Sqk,omitempty"`
+	Gnd     *bool    `json:"Gnd,omitempty"`
+	Help    *bool    `json:"Help,omitempty"`
+}
+
+// vrsPoller fetches AircraftList.json incrementally and turns each
+// response into a line per changed aircraft.
+type vrsPoller struct {
+	url    string
+	client *http.Client
+	lastDv string
+	// ids maps VRS aircraft ids to ICAO addresses, which incremental
+	// responses only send when they change.
+	ids map[int]vrsID
+}
+
+// vrsID is the ICAO address of a VRS aircraft id and when it was last
+// listed.
+type vrsID struct {
+	icao string
+	seen time.Time
+}
+
+// openVRS polls the AircraftList.json at rawURL every interval and returns
+// the aircraft that changed as JSON lines, as openPolled does.
+func openVRS(rawURL string, interval, wait time.Duration, stop <-chan struct{}) (io.ReadCloser, error) {
+	p := &vrsPoller{url: rawURL, client: &http.Client{Timeout: 10 * time.Second}, ids: map[int]vrsID{}}
+	return openPolled(rawURL, interval, wait, stop, p.poll)
+}
+
+// poll fetches the aircraft that changed since the previous poll. The
+// first poll, and any after the server lost track of lastDv, lists every
+// aircraft in full.
+func (p *vrsPoller) poll() ([]byte, error) {
+	u, err := url.Parse(p.url)
+	if err != nil {
+		return nil, err
+	}
+	if p.lastDv != "" {
+		q := u.Query()
+		q.Set("ldv", p.lastDv)
+		u.RawQuery = q.Encode()
+	}
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgent())
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", p.url, res.Status)
+	}
+	var list vrsAircraftList
+	if err := json.NewDecoder(res.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("decoding %s: %w", p.url, err)
+	}
+	p.lastDv = list.LastDv
+
+	now := time.Now()
+	var lines bytes.Buffer
+	for _, ac := range list.AcList {
+		if ac.Icao != "" {
+			p.ids[ac.ID] = vrsID{icao: ac.Icao, seen: now}
+		} else if id, ok := p.ids[ac.ID]; ok {
+			ac.Icao = id.icao
+			p.ids[ac.ID] = vrsID{icao: id.icao, seen: now}
+		} else {
+			// An aircraft first listed before a lost response. The next
+			// full list names it.
+			continue
+		}
+		if !ac.changed() {
+			continue
+		}
+		ac.Stm = list.Stm
+		data, err := json.Marshal(ac)
+		if err != nil {
+			return nil, err
+		}
+		lines.Write(data)
+		lines.WriteByte('\n')
+	}
+	for id, v := range p.ids {
+		if now.Sub(v.seen) > vrsIDExpiry {
+			delete(p.ids, id)
+		}
+	}
+	return lines.Bytes(), nil
+}
+
+// changed reports whether ac carries a field a message is made of, rather
+// than only the signal level or message count that change all the time.
+func (ac *vrsAircraft) changed() bool {
+	return ac.Call != "" || ac.Alt != nil || ac.Spd != nil || ac.Trak != nil || ac.Lat != nil || ac.Long != nil ||
+		ac.Vsi != nil || ac.Sqk != "" || ac.Gnd != nil || ac.Help != nil
+}
+
+// parseVRSLine converts a line of a VRS feed to a message. It is generated
+// when the position was received if it carries one, and logged at the
+// server's time.
+func parseVRSLine(line string) (SBS1Message, bool) {
+	var ac vrsAircraft
+	if err := json.Unmarshal([]byte(line), &ac); err != nil || ac.Icao == "" || ac.Stm == 0 {
+		metricParseErrors.Inc("vrs")
+		return SBS1Message{}, false
+	}
+	msg := NewSBS1Message()
+	msg.MessageType = "MSG"
+	msg.Icao24 = strings.ToUpper(ac.Icao)
+	msg.Callsign = strings.TrimSpace(ac.Call)
+
+	logged := time.UnixMilli(ac.Stm).UTC()
+	generated := logged
+	if ac.PosTime != 0 && ac.Lat != nil && ac.Long != nil {
+		generated = time.UnixMilli(ac.PosTime).UTC()
+	}
+	msg.GeneratedDate, msg.LoggedDate = &generated, &logged
+	if observeRecordedTime(msg.GeneratedDate, msg.LoggedDate) {
+		msg.Timestamp = formatTimestamp(clock.Now())
+	}
+
+	if ac.Alt != nil {
+		msg.Altitude = *ac.Alt
+	}
+	if ac.Spd != nil {
+		msg.GroundSpeed = float32(*ac.Spd)
+	}
+	if ac.Trak != nil {
+		msg.Track = float32(*ac.Trak)
+	}
+	if ac.Lat != nil && ac.Long != nil {
+		msg.Lat, msg.Lon = float32(*ac.Lat), float32(*ac.Long)
+	}
+	if ac.Vsi != nil {
+		msg.VerticalRate = *ac.Vsi
+	}
+	msg.Squawk = parseInt(ac.Sqk)
+	msg.Emergency = ac.Help != nil && *ac.Help
+	msg.OnGround = ac.Gnd != nil && *ac.Gnd
+
+	switch {
+	case ac.Lat != nil && ac.Long != nil:
+		msg.TransmissionType = 3
+	case msg.GroundSpeed != 0:
+		msg.TransmissionType = 4
+	case msg.Callsign != "":
+		msg.TransmissionType = 1
+	case ac.Sqk != "":
+		msg.TransmissionType = 6
+	default:
+		msg.TransmissionType = 5
+	}
+	return msg, true
+}
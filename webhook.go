@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// webhookPendingMax bounds the messages waiting to be sent, which includes
+// those kept for a retry while the webhook is unreachable.
+const webhookPendingMax = 100000
+
+// webhookSink sends every decoded aircraft message to an HTTP endpoint every
+// interval, for services the collector has no sink of its own for. In
+// batch mode a request carries up to batchSize messages, by default as a
+// JSON array of the messages; in event mode it carries one, by default as
+// the message's JSON. A body template replaces the default body. Requests
+// are sent one at a time, and one that fails is sent again before anything
+// queued since; those the endpoint rejects with a client error are dropped.
+type webhookSink struct {
+	*batchSink
+	url, method string
+	headers     http.Header
+	// body is nil for the default body.
+	body      *template.Template
+	batch     bool
+	batchSize int
+	client    *http.Client
+}
+
+// newWebhookSink parses the body template, a file, and starts sending in
+// the background. headers have been checked by sinkConfig.validate.
+func newWebhookSink(url, method string, headers []string, templatePath, mode string, batchSize int, interval time.Duration) (*webhookSink, error) {
+	s := &webhookSink{
+		url: url, method: method, batch: mode == "batch", batchSize: batchSize,
+		client: withChaos("webhook", newGatewayClient()),
+	}
+	s.headers, _ = parseHeaders(headers)
+	if templatePath != "" {
+		data, err := os.ReadFile(templatePath)
+		if err != nil {
+			return nil, fmt.Errorf("webhook_template: %w", err)
+		}
+		if s.body, err = template.New("webhook_template").Funcs(webhookFuncs).Parse(string(data)); err != nil {
+			return nil, fmt.Errorf("webhook_template: %w", err)
+		}
+	}
+	s.batchSink = newBatchSink("webhook", "the webhook", "webhook "+url, webhookPendingMax, interval, s.write)
+	return s, nil
+}
+
+// webhookFuncs are the functions of body templates besides text/template's
+// own.
+var webhookFuncs = template.FuncMap{
+	// json encodes a value, such as an event or one of its objects.
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+// write sends msgs, one per request or batchSize per request in batch
+// mode, stopping at the first request that fails. It returns the messages
+// not sent.
+func (s *webhookSink) write(msgs []SBS1Message) ([]SBS1Message, error) {
+	size := 1
+	if s.batch {
+		size = s.batchSize
+	}
+	for len(msgs) > 0 {
+		n := len(msgs)
+		if n > size {
+			n = size
+		}
+		if err := s.send(msgs[:n]); err != nil {
+			return msgs, err
+		}
+		msgs = msgs[n:]
+	}
+	return nil, nil
+}
+
+// webhookEvent is what body templates see of a message: its JSON fields,
+// by name, and its event_id.
+func webhookEvent(msg SBS1Message) (map[string]interface{}, error) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var event map[string]interface{}
+	if err := dec.Decode(&event); err != nil {
+		return nil, err
+	}
+	event["event_id"] = eventID(msg)
+	return event, nil
+}
+
+// render returns the body of a request carrying msgs. Body templates are
+// executed on the event in event mode and on the list of events in batch
+// mode.
+func (s *webhookSink) render(msgs []SBS1Message) ([]byte, error) {
+	if s.body == nil {
+		if s.batch {
+			return json.Marshal(msgs)
+		}
+		return json.Marshal(msgs[0])
+	}
+	events := make([]map[string]interface{}, len(msgs))
+	for i, msg := range msgs {
+		var err error
+		if events[i], err = webhookEvent(msg); err != nil {
+			return nil, err
+		}
+	}
+	var data interface{} = events
+	if !s.batch {
+		data = events[0]
+	}
+	var buf bytes.Buffer
+	if err := s.body.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// send makes one request carrying msgs. Messages the template cannot
+// render or the endpoint rejects are dropped, since sending them again
+// would fail the same way; an error means they should be.
+func (s *webhookSink) send(msgs []SBS1Message) error {
+	body, err := s.render(msgs)
+	if err != nil {
+		metricParseErrors.Inc("webhook_template")
+		metricSinkErrors.Add("webhook", float64(len(msgs)))
+		log.Printf("Dropped %d message(s) for the webhook: %v", len(msgs), err)
+		return nil
+	}
+	req, err := http.NewRequest(s.method, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, values := range s.headers {
+		req.Header[name] = values
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	reply, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode/100 == 2 {
+		metricSinkEvents.Add("webhook", float64(len(msgs)))
+		return nil
+	}
+	err = fmt.Errorf("webhook returned %s", resp.Status)
+	if detail := strings.TrimSpace(string(reply)); detail != "" {
+		err = fmt.Errorf("webhook returned %s: %s", resp.Status, detail)
+	}
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return newError(errAuth, err)
+	case resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests:
+		metricSinkErrors.Add("webhook", float64(len(msgs)))
+		log.Printf("Dropped %d message(s) the webhook rejected: %v", len(msgs), err)
+		return nil
+	}
+	return err
+}